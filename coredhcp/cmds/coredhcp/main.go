@@ -17,6 +17,7 @@ import (
 
 	"github.com/coredhcp/coredhcp/plugins"
 	pl_autoconfigure "github.com/coredhcp/coredhcp/plugins/autoconfigure"
+	pl_ddns "github.com/coredhcp/coredhcp/plugins/ddns"
 	pl_dns "github.com/coredhcp/coredhcp/plugins/dns"
 	pl_file "github.com/coredhcp/coredhcp/plugins/file"
 	pl_ipv6only "github.com/coredhcp/coredhcp/plugins/ipv6only"
@@ -26,6 +27,7 @@ import (
 	pl_netmask "github.com/coredhcp/coredhcp/plugins/netmask"
 	pl_prefix "github.com/coredhcp/coredhcp/plugins/prefix"
 	pl_range "github.com/coredhcp/coredhcp/plugins/range"
+	pl_range6 "github.com/coredhcp/coredhcp/plugins/range6"
 	pl_router "github.com/coredhcp/coredhcp/plugins/router"
 	pl_searchdomains "github.com/coredhcp/coredhcp/plugins/searchdomains"
 	pl_serverid "github.com/coredhcp/coredhcp/plugins/serverid"
@@ -66,6 +68,7 @@ func getLogLevels() []string {
 
 var desiredPlugins = []*plugins.Plugin{
 	&pl_autoconfigure.Plugin,
+	&pl_ddns.Plugin,
 	&pl_dns.Plugin,
 	&pl_file.Plugin,
 	&pl_ipv6only.Plugin,
@@ -75,6 +78,7 @@ var desiredPlugins = []*plugins.Plugin{
 	&pl_netmask.Plugin,
 	&pl_prefix.Plugin,
 	&pl_range.Plugin,
+	&pl_range6.Plugin,
 	&pl_router.Plugin,
 	&pl_searchdomains.Plugin,
 	&pl_serverid.Plugin,
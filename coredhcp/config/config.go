@@ -32,6 +32,12 @@ type Config struct {
 	v       *viper.Viper
 	Server6 *ServerConfig
 	Server4 *ServerConfig
+	// Metrics is the host:port the Prometheus metrics are served on, empty
+	// if they are not served
+	Metrics string
+	// Admin is the host:port the admin endpoints, such as the reload of the
+	// configuration, are served on, empty if they are not served
+	Admin string
 }
 
 // New returns a new initialized instance of a Config object
@@ -80,9 +86,25 @@ func Load(pathOverride string) (*Config, error) {
 	if c.Server6 == nil && c.Server4 == nil {
 		return nil, ConfigErrorFromString("need at least one valid config for DHCPv6 or DHCPv4")
 	}
+	var err error
+	if c.Metrics, err = c.parseHTTPAddr("metrics"); err != nil {
+		return nil, err
+	}
+	if c.Admin, err = c.parseHTTPAddr("admin"); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
+// Path returns the file the configuration was read from, empty if it was not
+// read from a file
+func (c *Config) Path() string {
+	if c.v == nil {
+		return ""
+	}
+	return c.v.ConfigFileUsed()
+}
+
 func protoVersionCheck(v protocolVersion) error {
 	if v != protocolV6 && v != protocolV4 {
 		return fmt.Errorf("invalid protocol version: %d", v)
@@ -240,6 +262,18 @@ func (c *Config) parseConfig(ver protocolVersion) error {
 	return nil
 }
 
+// parseHTTPAddr reads the host:port of an HTTP endpoint, such as metrics
+func (c *Config) parseHTTPAddr(key string) (string, error) {
+	addr := c.v.GetString(key)
+	if addr == "" {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", ConfigErrorFromString("invalid `%s` address %q: %v", key, addr, err)
+	}
+	return addr, nil
+}
+
 // BUG(Natolumin): When listening on link-local multicast addresses without
 // binding to a specific interface, new interfaces coming up after the server
 // starts will not be taken into account.
@@ -0,0 +1,121 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package metrics holds what the server and the plugins share to export
+// Prometheus metrics: the namespace of the metrics, the counter of backend
+// errors, the gauges of the address pools, and the HTTP endpoint serving them.
+// Each package defines its own metrics with promauto, prefixed by Namespace.
+package metrics
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var log = logger.GetLogger("metrics")
+
+// Namespace is the prefix of all the metrics of coredhcp
+const Namespace = "coredhcp"
+
+// BackendErrors counts the failed operations on the databases the plugins
+// read and store leases in, by backend (postgres, redis) and operation
+var BackendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "backend_errors_total",
+	Help:      "Counter of failed operations on the lease backends.",
+}, []string{"backend", "op"})
+
+// Server serves the metrics over HTTP, at /metrics
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen binds the metrics endpoint to addr, given as host:port
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &Server{listener: ln, server: &http.Server{Handler: mux}}, nil
+}
+
+// Serve serves the metrics until the server is closed
+func (s *Server) Serve() error {
+	log.Printf("Serving metrics on http://%s/metrics", s.listener.Addr())
+	if err := s.server.Serve(s.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close stops serving the metrics
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Usage returns the number of addresses or prefixes a pool holds, and how many
+// of them are taken
+type Usage func() (size, used float64)
+
+var (
+	poolSize = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pool", "size"),
+		"Number of addresses or prefixes of the pool.", []string{"plugin", "pool"}, nil)
+	poolUsed = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "pool", "used"),
+		"Number of addresses or prefixes of the pool which are leased or unavailable.", []string{"plugin", "pool"}, nil)
+)
+
+// pools collects the usage of the registered pools when metrics are scraped
+type pools struct {
+	sync.Mutex
+	usage map[[2]string]*Usage
+}
+
+var registeredPools = &pools{usage: make(map[[2]string]*Usage)}
+
+func init() {
+	prometheus.MustRegister(registeredPools)
+}
+
+// RegisterPool exports the usage of a pool of a plugin. A pool registered
+// again replaces the previous one. The returned function unregisters it,
+// unless it was replaced since.
+func RegisterPool(plugin, pool string, usage Usage) func() {
+	key := [2]string{plugin, pool}
+	registered := &usage
+	registeredPools.Lock()
+	defer registeredPools.Unlock()
+	registeredPools.usage[key] = registered
+	return func() {
+		registeredPools.Lock()
+		defer registeredPools.Unlock()
+		if registeredPools.usage[key] == registered {
+			delete(registeredPools.usage, key)
+		}
+	}
+}
+
+func (p *pools) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolSize
+	ch <- poolUsed
+}
+
+func (p *pools) Collect(ch chan<- prometheus.Metric) {
+	p.Lock()
+	defer p.Unlock()
+	for key, usage := range p.usage {
+		size, used := (*usage)()
+		ch <- prometheus.MustNewConstMetric(poolSize, prometheus.GaugeValue, size, key[0], key[1])
+		ch <- prometheus.MustNewConstMetric(poolUsed, prometheus.GaugeValue, used, key[0], key[1])
+	}
+}
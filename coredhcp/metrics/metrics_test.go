@@ -0,0 +1,33 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterPool(t *testing.T) {
+	unregister := RegisterPool("range", "10.0.0.10-10.0.0.19", func() (float64, float64) { return 10, 3 })
+	err := testutil.CollectAndCompare(registeredPools, strings.NewReader(`
+# HELP coredhcp_pool_size Number of addresses or prefixes of the pool.
+# TYPE coredhcp_pool_size gauge
+coredhcp_pool_size{plugin="range",pool="10.0.0.10-10.0.0.19"} 10
+# HELP coredhcp_pool_used Number of addresses or prefixes of the pool which are leased or unavailable.
+# TYPE coredhcp_pool_used gauge
+coredhcp_pool_used{plugin="range",pool="10.0.0.10-10.0.0.19"} 3
+`))
+	assert.NoError(t, err)
+
+	// a pool set up again replaces the previous one, which can't remove it
+	unregisterAgain := RegisterPool("range", "10.0.0.10-10.0.0.19", func() (float64, float64) { return 10, 4 })
+	unregister()
+	assert.Equal(t, 2, testutil.CollectAndCount(registeredPools))
+	unregisterAgain()
+	assert.Equal(t, 0, testutil.CollectAndCount(registeredPools))
+}
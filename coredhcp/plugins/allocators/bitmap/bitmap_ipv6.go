@@ -0,0 +1,142 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+// This allocator handles IPv6 single address assignments within an arbitrary range, with the same
+// logic as the IPv4 allocator. Offsets within the range are computed with the ipcalc helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// MaxIPv6RangeSize is the largest number of addresses of a range, which bounds
+// the memory taken by the bitmap to 2MiB
+const MaxIPv6RangeSize = 1 << 24
+
+var (
+	errNotInRange6 = errors.New("IPv6 address outside of allowed range")
+	errInvalidIP6  = errors.New("invalid IPv6 address passed as input")
+)
+
+// IPv6Allocator allocates IPv6 addresses, tracking utilization with a bitmap
+type IPv6Allocator struct {
+	start net.IP
+	// size is the number of addresses in the range
+	size uint64
+
+	// This bitset implementation isn't goroutine-safe, we protect it with a mutex for now
+	// until we can swap for another concurrent implementation
+	bitmap *bitset.BitSet
+	l      sync.Mutex
+}
+
+func isIPv6(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() == nil
+}
+
+func (a *IPv6Allocator) toIP(offset uint64) net.IP {
+	if offset >= a.size {
+		panic("BUG: offset out of bounds")
+	}
+
+	r, err := allocators.AddPrefixes(a.start, offset, 128)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: offset %d overflows the range: %v", offset, err))
+	}
+	return r
+}
+
+func (a *IPv6Allocator) toOffset(ip net.IP) (uint, error) {
+	if !isIPv6(ip) {
+		return 0, errInvalidIP6
+	}
+	if bytes.Compare(ip, a.start) < 0 {
+		return 0, errNotInRange6
+	}
+
+	offset, err := allocators.Offset(ip, a.start, 128)
+	if err != nil || offset >= a.size {
+		return 0, errNotInRange6
+	}
+
+	return uint(offset), nil
+}
+
+// Allocate reserves an IP for a client
+func (a *IPv6Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
+	n.Mask = net.CIDRMask(128, 128)
+
+	// This is just a hint, ignore any error with it
+	hintOffset, _ := a.toOffset(hint.IP)
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	var next uint
+	// First try the exact match
+	if !a.bitmap.Test(hintOffset) {
+		next = hintOffset
+	} else {
+		// Then any available address
+		avail, ok := a.bitmap.NextClear(0)
+		if !ok || uint64(avail) >= a.size {
+			return n, allocators.ErrNoAddrAvail
+		}
+		next = avail
+	}
+
+	a.bitmap.Set(next)
+	n.IP = a.toIP(uint64(next))
+	return
+}
+
+// Free releases the given IP
+func (a *IPv6Allocator) Free(n net.IPNet) error {
+	offset, err := a.toOffset(n.IP)
+	if err != nil {
+		return errNotInRange6
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if !a.bitmap.Test(offset) {
+		return &allocators.ErrDoubleFree{Loc: n}
+	}
+	a.bitmap.Clear(offset)
+	return nil
+}
+
+// NewIPv6Allocator creates a new allocator suitable for giving out IPv6 addresses from the
+// [start, end] range
+func NewIPv6Allocator(start, end net.IP) (*IPv6Allocator, error) {
+	start, end = start.To16(), end.To16()
+	if !isIPv6(start) || !isIPv6(end) {
+		return nil, fmt.Errorf("invalid IPv6 addresses given to create the allocator: [%s,%s]", start, end)
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, errors.New("no IPs in the given range to allocate")
+	}
+
+	distance, err := allocators.Offset(end, start, 128)
+	if err != nil || distance >= MaxIPv6RangeSize {
+		return nil, fmt.Errorf("the range [%s,%s] is larger than the %d addresses the bitmap allocator supports", start, end, MaxIPv6RangeSize)
+	}
+
+	alloc := IPv6Allocator{
+		start: start,
+		size:  distance + 1,
+	}
+	alloc.bitmap = bitset.New(uint(alloc.size))
+
+	return &alloc, nil
+}
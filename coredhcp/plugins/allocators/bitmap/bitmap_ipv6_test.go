@@ -0,0 +1,106 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+func getv6Allocator() *IPv6Allocator {
+	alloc, err := NewIPv6Allocator(net.ParseIP("2001:db8::ff00"), net.ParseIP("2001:db8::1:ff"))
+	if err != nil {
+		panic(err)
+	}
+
+	return alloc
+}
+
+func Test6Alloc(t *testing.T) {
+	alloc := getv6Allocator()
+
+	net1, err := alloc.Allocate(net.IPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net1.IP.Equal(net.ParseIP("2001:db8::ff00")) {
+		t.Fatalf("Expected the start of the range, got %s", net1.IP)
+	}
+
+	net2, err := alloc.Allocate(net.IPNet{IP: net.ParseIP("2001:db8::1:ff")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net2.IP.Equal(net.ParseIP("2001:db8::1:ff")) {
+		t.Fatalf("Expected the hinted address, got %s", net2.IP)
+	}
+	if prefLen, totalLen := net2.Mask.Size(); prefLen != 128 || totalLen != 128 {
+		t.Fatalf("Prefixes have wrong size %d/%d", prefLen, totalLen)
+	}
+
+	err = alloc.Free(net1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alloc.Free(net1)
+	if err == nil {
+		t.Fatal("Expected DoubleFree error")
+	}
+}
+
+func Test6OutOfPool(t *testing.T) {
+	alloc := getv6Allocator()
+
+	for _, hint := range []string{"2001:db8::1", "2001:db8::1:100", "192.0.2.1"} {
+		res, err := alloc.Allocate(net.IPNet{IP: net.ParseIP(hint)})
+		if err != nil {
+			t.Fatalf("Failed to allocate with invalid hint %s: %v", hint, err)
+		}
+		if _, err := alloc.toOffset(res.IP); err != nil {
+			t.Fatalf("Obtained address %s outside of range for hint %s", res.IP, hint)
+		}
+	}
+
+	if err := alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::2:0")}); err == nil {
+		t.Fatal("Expected an error freeing an address outside of the range")
+	}
+}
+
+func Test6Exhaust(t *testing.T) {
+	alloc, err := NewIPv6Allocator(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := alloc.Allocate(net.IPNet{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alloc.Allocate(net.IPNet{}); !errors.Is(err, allocators.ErrNoAddrAvail) {
+		t.Fatalf("Expected ErrNoAddrAvail, got %v", err)
+	}
+}
+
+func Test6InvalidRange(t *testing.T) {
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1")); err == nil {
+		t.Fatal("Expected an error for a reversed range")
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")); err == nil {
+		t.Fatal("Expected an error for an IPv4 range")
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db9::")); err == nil {
+		t.Fatal("Expected an error for a range too large")
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ff:ffff")); err != nil {
+		t.Fatalf("Expected a range of %d addresses to be supported, got %v", MaxIPv6RangeSize, err)
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::100:0")); err == nil {
+		t.Fatalf("Expected an error for a range of more than %d addresses", MaxIPv6RangeSize)
+	}
+}
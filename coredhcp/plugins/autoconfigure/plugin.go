@@ -47,9 +47,10 @@ var argMap = map[string]dhcpv4.AutoConfiguration{
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
+	var value dhcpv4.AutoConfiguration
 	if len(args) > 0 {
 		var ok bool
-		autoconfigure, ok = argMap[args[0]]
+		value, ok = argMap[args[0]]
 		if !ok {
 			return nil, fmt.Errorf("unexpected value '%v' for autoconfigure argument", args[0])
 		}
@@ -57,6 +58,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) > 1 {
 		return nil, errors.New("too many arguments")
 	}
+	plugins.OnCommit(func() { autoconfigure = value })
 	return Handler4, nil
 }
 
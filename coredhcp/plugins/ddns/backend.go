@@ -0,0 +1,104 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package ddns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// record is a DNS record published for a lease
+type record struct {
+	Zone string `json:"zone"`
+	// Name is relative to the zone, an empty name standing for the apex
+	Name string `json:"name"`
+	// Type is one of A, AAAA or PTR
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	// IP is the address of A and AAAA records
+	IP net.IP `json:"ip,omitempty"`
+	// Host is the fully qualified target of PTR records
+	Host string `json:"host,omitempty"`
+}
+
+func (r record) String() string {
+	target := r.Host
+	if target == "" {
+		target = r.IP.String()
+	}
+	fqdn := r.Zone
+	if r.Name != "" {
+		fqdn = r.Name + "." + r.Zone
+	}
+	return fmt.Sprintf("%s %d IN %s %s", fqdn, r.TTL, r.Type, target)
+}
+
+// equal compares the content of records, regardless of their TTL
+func (r record) equal(o record) bool {
+	return r.Zone == o.Zone && r.Name == o.Name && r.Type == o.Type && r.IP.Equal(o.IP) && r.Host == o.Host
+}
+
+// content returns the JSON content of a record, in the format used by both
+// the CoreDNS postgresql and redis plugins
+func (r record) content() string {
+	var v interface{}
+	if r.Type == "PTR" {
+		v = struct {
+			Host string `json:"host"`
+		}{r.Host}
+	} else {
+		v = struct {
+			IP string `json:"ip"`
+		}{r.IP.String()}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// registration is the set of records published for a client, which are
+// removed when its lease expires
+type registration struct {
+	Records []record  `json:"records"`
+	Expires time.Time `json:"expires"`
+}
+
+// backend is where records are published for CoreDNS to serve them.
+// Registrations are stored along with the records, so that they can still be
+// removed after a restart.
+type backend interface {
+	// publish adds a record, if not already there
+	publish(r record) error
+	// remove deletes a record, if there
+	remove(r record) error
+	// loadRegistrations returns the stored registrations of the clients whose
+	// key starts with family, by client
+	loadRegistrations(family string) (map[string]*registration, error)
+	// loadRegistration returns the stored registration of a client, nil if
+	// it has none
+	loadRegistration(client string) (*registration, error)
+	// saveRegistration inserts or updates the registration of a client
+	saveRegistration(client string, reg *registration) error
+	// deleteRegistration removes the registration of a client
+	deleteRegistration(client string) error
+	// close releases the connections to the backend
+	close()
+}
+
+// openBackend connects to the backend described by a URL: postgres:// for
+// the CoreDNS postgresql plugin, and redis://, rediss://, redis-sentinel:// or
+// redis-cluster:// for the redis one
+func openBackend(url string) (backend, error) {
+	switch {
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return openPgBackend(url)
+	case strings.HasPrefix(url, "redis://"), strings.HasPrefix(url, "rediss://"),
+		strings.HasPrefix(url, "redis-sentinel://"), strings.HasPrefix(url, "redis-cluster://"):
+		return openRedisBackend(url)
+	}
+	return nil, fmt.Errorf("unsupported backend URL %q, want postgres:// or redis://", url)
+}
@@ -0,0 +1,124 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package ddns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// fqdnFlagE is the flag of the client FQDN option telling the domain name is
+// in the canonical wire format (RFC 4702 2.1)
+const fqdnFlagE = 0x04
+
+// normalizeZone returns a zone name lowercased and fully qualified
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+}
+
+// sanitizeLabel keeps the characters of a DNS label which are valid in a host
+// name. It returns an empty string if nothing valid is left.
+func sanitizeLabel(label string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(label) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		}
+	}
+	s := strings.Trim(b.String(), "-")
+	if len(s) > 63 {
+		s = strings.TrimRight(s[:63], "-")
+	}
+	return s
+}
+
+// hostLabel turns a name supplied by a client into a name relative to the
+// zone. Names within the zone are kept as they are, any other name is cut to
+// its first label. It returns an empty string if the name is not usable.
+func hostLabel(name, zone string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return ""
+	}
+	if rel, ok := relativeName(name+".", zone); ok && rel != "" {
+		labels := strings.Split(rel, ".")
+		for i, l := range labels {
+			labels[i] = sanitizeLabel(l)
+			if labels[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(labels, ".")
+	}
+	first, _, _ := strings.Cut(name, ".")
+	return sanitizeLabel(first)
+}
+
+// relativeName returns a fully qualified name relative to a zone, an empty
+// string standing for the apex. It returns false if the name is not within
+// the zone.
+func relativeName(fqdn, zone string) (string, bool) {
+	if fqdn == zone {
+		return "", true
+	}
+	if strings.HasSuffix(fqdn, "."+zone) {
+		return strings.TrimSuffix(fqdn, "."+zone), true
+	}
+	if zone == "." {
+		return strings.TrimSuffix(fqdn, "."), true
+	}
+	return "", false
+}
+
+// reverseName returns the name of the PTR record of an address
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// hostname4 returns the name a DHCPv4 client asks to be registered with: the
+// client FQDN option (81) if present, or else the host name option (12)
+func hostname4(req *dhcpv4.DHCPv4) string {
+	if data := req.Options.Get(dhcpv4.OptionFQDN); len(data) > 3 {
+		flags, name := data[0], data[3:]
+		if flags&fqdnFlagE != 0 {
+			var labels rfc1035label.Labels
+			if err := labels.FromBytes(name); err == nil && len(labels.Labels) > 0 {
+				return strings.Join(labels.Labels, ".")
+			}
+		} else if len(name) > 0 {
+			// Deprecated ASCII encoding
+			return string(name)
+		}
+	}
+	return req.HostName()
+}
+
+// hostname6 returns the name a DHCPv6 client asks to be registered with, from
+// the client FQDN option
+func hostname6(msg *dhcpv6.Message) string {
+	fqdn := msg.Options.FQDN()
+	if fqdn == nil || fqdn.DomainName == nil {
+		return ""
+	}
+	return strings.Join(fqdn.DomainName.Labels, ".")
+}
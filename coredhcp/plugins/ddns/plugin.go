@@ -0,0 +1,396 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package ddns implements a plugin registering the leases of named clients in
+// DNS, by publishing records to the backends of the CoreDNS postgresql and
+// redis plugins.
+//
+// The plugin looks at the replies built by the plugins before it, so it must
+// come after the plugins leasing addresses. A DHCPv4 client is registered
+// when it is acknowledged a lease, under the name from its client FQDN (81)
+// or host name (12) option. A DHCPv6 client is registered when it is replied
+// IA_NA addresses, under the name from its client FQDN option. The records are
+// removed when the client releases or declines its addresses, and when its
+// lease expires.
+//
+// Arguments for the plugin configuration are as follows, in this order:
+// - backend: a postgres:// URL of the database of the CoreDNS postgresql
+// plugin, or a redis:// URL of the server of the CoreDNS redis plugin, which
+// can also be a redis-sentinel:// or redis-cluster:// URL as described by the
+// redis plugin. The key prefix and suffix of the redis plugin can be given as
+// the prefix and suffix query parameters of the URL
+// - zone: the zone where A and AAAA records are published
+// - reverse zone: optional, the zone where PTR records are published. Use - to
+// publish none
+// - ttl: optional, the TTL of the published records. Defaults to 300s
+package ddns
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+)
+
+var log = logger.GetLogger("plugins/ddns")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:   "ddns",
+	Setup4: setup4,
+	Setup6: setup6,
+}
+
+const (
+	defaultTTL = 300 * time.Second
+	// defaultLeaseTime is assumed when a reply carries no lease time
+	defaultLeaseTime = time.Hour
+	// sweepInterval is how often expired registrations are looked for
+	sweepInterval = time.Minute
+)
+
+// PluginState is the data held by an instance of the ddns plugin
+type PluginState struct {
+	sync.Mutex
+	zone        string
+	reverseZone string
+	ttl         uint32
+	backend     backend
+	// registrations holds the records published per client
+	registrations map[string]*registration
+}
+
+// Handler4 handles DHCPv4 packets for the ddns plugin
+func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	client := "mac:" + req.ClientHWAddr.String()
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		p.unregister(client)
+		return resp, false
+	case dhcpv4.MessageTypeRequest:
+	default:
+		return resp, false
+	}
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck ||
+		resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() {
+		return resp, false
+	}
+
+	addrs := []net.IP{resp.YourIPAddr}
+	expires := time.Now().Add(resp.IPAddressLeaseTime(defaultLeaseTime))
+	host := hostLabel(hostname4(req), p.zone)
+	if host == "" {
+		// Renewing clients often leave their name out
+		if !p.renew(client, addrs, expires) {
+			log.Debugf("MAC %s has no usable host name, not registering it", req.ClientHWAddr.String())
+		}
+		return resp, false
+	}
+	p.register(client, host, addrs, expires)
+	return resp, false
+}
+
+// Handler6 handles DHCPv6 packets for the ddns plugin
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Errorf("BUG: could not decapsulate: %v", err)
+		return resp, false
+	}
+	duid := msg.Options.ClientID()
+	if duid == nil {
+		return resp, false
+	}
+	client := "duid:" + hex.EncodeToString(duid.ToBytes())
+
+	switch msg.Type() {
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		var addrs []net.IP
+		for _, iana := range msg.Options.IANA() {
+			for _, addr := range iana.Options.Addresses() {
+				addrs = append(addrs, addr.IPv6Addr)
+			}
+		}
+		p.unregister(client, addrs...)
+		return resp, false
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+	default:
+		return resp, false
+	}
+	// Advertisements don't lease anything
+	reply, ok := resp.(*dhcpv6.Message)
+	if !ok || reply.Type() != dhcpv6.MessageTypeReply {
+		return resp, false
+	}
+
+	var (
+		addrs []net.IP
+		valid time.Duration
+	)
+	for _, iana := range reply.Options.IANA() {
+		for _, addr := range iana.Options.Addresses() {
+			if addr.ValidLifetime == 0 {
+				continue
+			}
+			addrs = append(addrs, addr.IPv6Addr)
+			if addr.ValidLifetime > valid {
+				valid = addr.ValidLifetime
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return resp, false
+	}
+	expires := time.Now().Add(valid)
+	host := hostLabel(hostname6(msg), p.zone)
+	if host == "" {
+		if !p.renew(client, addrs, expires) {
+			log.Debugf("%s has no usable host name, not registering it", client)
+		}
+		return resp, false
+	}
+	p.register(client, host, addrs, expires)
+	return resp, false
+}
+
+// records returns the records to publish for a host name and its addresses
+func (p *PluginState) records(host string, addrs []net.IP) []record {
+	var records []record
+	for _, ip := range addrs {
+		r := record{Zone: p.zone, Name: host, Type: "AAAA", TTL: p.ttl, IP: ip}
+		if ip.To4() != nil {
+			r.Type, r.IP = "A", ip.To4()
+		}
+		records = append(records, r)
+		if p.reverseZone == "" {
+			continue
+		}
+		if name, ok := relativeName(reverseName(ip), p.reverseZone); ok {
+			records = append(records, record{Zone: p.reverseZone, Name: name, Type: "PTR", TTL: p.ttl, Host: host + "." + p.zone})
+		}
+	}
+	return records
+}
+
+// contains returns true if a record with the same content is in the list
+func contains(records []record, r record) bool {
+	for _, o := range records {
+		if o.equal(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// register publishes the records of a client, replacing the ones it had
+func (p *PluginState) register(client, host string, addrs []net.IP, expires time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.registerLocked(client, host, addrs, expires)
+}
+
+// renew registers a client under the host name of its current registration,
+// for a lease renewed without a name. It returns false if the client has no
+// registration to take the name from.
+func (p *PluginState) renew(client string, addrs []net.IP, expires time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+	reg, ok := p.registrations[client]
+	if !ok {
+		return false
+	}
+	for _, r := range reg.Records {
+		if r.Zone == p.zone && r.Type != "PTR" {
+			p.registerLocked(client, r.Name, addrs, expires)
+			return true
+		}
+	}
+	return false
+}
+
+// registerLocked publishes the records of a client, replacing the ones it
+// had. The caller must hold the plugin lock.
+func (p *PluginState) registerLocked(client, host string, addrs []net.IP, expires time.Time) {
+	reg := &registration{Records: p.records(host, addrs), Expires: expires}
+	old := p.registrations[client]
+	if old != nil {
+		for _, r := range old.Records {
+			if contains(reg.Records, r) {
+				continue
+			}
+			if err := p.backend.remove(r); err != nil {
+				log.Errorf("Could not remove %s: %v", r, err)
+			}
+		}
+	}
+	for _, r := range reg.Records {
+		if old != nil && contains(old.Records, r) {
+			continue
+		}
+		if err := p.backend.publish(r); err != nil {
+			log.Errorf("Could not publish %s: %v", r, err)
+			continue
+		}
+		log.Printf("Published %s for %s", r, client)
+	}
+	p.registrations[client] = reg
+	if err := p.backend.saveRegistration(client, reg); err != nil {
+		log.Errorf("Could not persist registration of %s: %v", client, err)
+	}
+}
+
+// unregisterLocked removes the records of a client for the given addresses,
+// or all of them if none is given. The caller must hold the plugin lock.
+func (p *PluginState) unregisterLocked(client string, addrs ...net.IP) {
+	reg, ok := p.registrations[client]
+	if !ok {
+		return
+	}
+	var kept []record
+	for _, r := range reg.Records {
+		if len(addrs) > 0 && !registers(r, addrs) {
+			kept = append(kept, r)
+			continue
+		}
+		if err := p.backend.remove(r); err != nil {
+			log.Errorf("Could not remove %s: %v", r, err)
+			continue
+		}
+		log.Printf("Removed %s for %s", r, client)
+	}
+
+	var err error
+	if len(kept) == 0 {
+		delete(p.registrations, client)
+		err = p.backend.deleteRegistration(client)
+	} else {
+		reg.Records = kept
+		err = p.backend.saveRegistration(client, reg)
+	}
+	if err != nil {
+		log.Errorf("Could not persist registration of %s: %v", client, err)
+	}
+}
+
+// unregister removes the records of a client for the given addresses, or all
+// of them if none is given
+func (p *PluginState) unregister(client string, addrs ...net.IP) {
+	p.Lock()
+	defer p.Unlock()
+	p.unregisterLocked(client, addrs...)
+}
+
+// registers returns true if a record was published for one of the addresses
+func registers(r record, addrs []net.IP) bool {
+	for _, ip := range addrs {
+		if r.IP != nil && r.IP.Equal(ip) {
+			return true
+		}
+		if r.Type == "PTR" {
+			if name, ok := relativeName(reverseName(ip), r.Zone); ok && name == r.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sweep removes the records of clients whose lease expired. The stored
+// registration is read again first, since another server may have renewed
+// the lease since we last saw it.
+func (p *PluginState) sweep(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	for client, reg := range p.registrations {
+		if reg.Expires.After(now) {
+			continue
+		}
+		stored, err := p.backend.loadRegistration(client)
+		if err != nil {
+			log.Errorf("Could not read registration of %s, keeping it: %v", client, err)
+			continue
+		}
+		if stored == nil {
+			// Removed by another server
+			delete(p.registrations, client)
+			continue
+		}
+		if stored.Expires.After(now) {
+			p.registrations[client] = stored
+			continue
+		}
+		log.Printf("Lease of %s expired, removing its records", client)
+		p.unregisterLocked(client)
+	}
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	p, err := setupDDNS("duid:", args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handler6, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	p, err := setupDDNS("mac:", args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handler4, nil
+}
+
+// setupDDNS sets up an instance of the plugin, which only takes over the
+// registrations of its own clients: the ones whose key starts with family,
+// mac: for DHCPv4 and duid: for DHCPv6
+func setupDDNS(family string, args ...string) (*PluginState, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid number of arguments, want: 2 (backend URL, zone) and optionally a reverse zone and a TTL, got: %d", len(args))
+	}
+	if args[1] == "" {
+		return nil, errors.New("zone cannot be empty")
+	}
+	p := &PluginState{
+		zone: normalizeZone(args[1]),
+		ttl:  uint32(defaultTTL.Seconds()),
+	}
+	if len(args) > 2 && args[2] != "-" && args[2] != "" {
+		p.reverseZone = normalizeZone(args[2])
+	}
+	if len(args) > 3 {
+		ttl, err := time.ParseDuration(args[3])
+		if err != nil || ttl < time.Second {
+			return nil, fmt.Errorf("invalid TTL: %v", args[3])
+		}
+		p.ttl = uint32(ttl.Seconds())
+	}
+
+	var err error
+	p.backend, err = openBackend(args[0])
+	if err != nil {
+		return nil, err
+	}
+	plugins.OnClose(p.backend.close)
+	p.registrations, err = p.backend.loadRegistrations(family)
+	if err != nil {
+		return nil, fmt.Errorf("could not load registrations: %w", err)
+	}
+	log.Printf("Registering leases in zone %s, reverse zone %q, %d registrations loaded", p.zone, p.reverseZone, len(p.registrations))
+
+	// Drop what expired while we were not running
+	p.sweep(time.Now())
+	plugins.OnClose(leasestore.Sweep(sweepInterval, p.sweep))
+
+	return p, nil
+}
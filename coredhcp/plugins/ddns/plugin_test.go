@@ -0,0 +1,302 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package ddns
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memBackend is an in-memory backend recording the published records
+type memBackend struct {
+	records       []record
+	registrations map[string]*registration
+}
+
+func (b *memBackend) publish(r record) error {
+	if !contains(b.records, r) {
+		b.records = append(b.records, r)
+	}
+	return nil
+}
+
+func (b *memBackend) remove(r record) error {
+	var kept []record
+	for _, o := range b.records {
+		if !o.equal(r) {
+			kept = append(kept, o)
+		}
+	}
+	b.records = kept
+	return nil
+}
+
+func (b *memBackend) loadRegistrations(family string) (map[string]*registration, error) {
+	regs := make(map[string]*registration)
+	for client, reg := range b.registrations {
+		if strings.HasPrefix(client, family) {
+			regs[client] = reg
+		}
+	}
+	return regs, nil
+}
+
+func (b *memBackend) loadRegistration(client string) (*registration, error) {
+	return b.registrations[client], nil
+}
+
+func (b *memBackend) saveRegistration(client string, reg *registration) error {
+	b.registrations[client] = reg
+	return nil
+}
+
+func (b *memBackend) deleteRegistration(client string) error {
+	delete(b.registrations, client)
+	return nil
+}
+
+func (b *memBackend) close() {}
+
+func testPluginState() (*PluginState, *memBackend) {
+	b := &memBackend{registrations: make(map[string]*registration)}
+	return &PluginState{
+		zone:          "example.org.",
+		reverseZone:   "10.in-addr.arpa.",
+		ttl:           300,
+		backend:       b,
+		registrations: make(map[string]*registration),
+	}, b
+}
+
+func testAck(t *testing.T, mt dhcpv4.MessageType, mac string, ip net.IP, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	hwaddr, err := net.ParseMAC(mac)
+	require.NoError(t, err)
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithHwAddr(hwaddr),
+	}, modifiers...)...)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(ip),
+		dhcpv4.WithLeaseTime(3600),
+	)
+	require.NoError(t, err)
+	return req, resp
+}
+
+func TestHostLabel(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"laptop", "laptop"},
+		{"Laptop.example.org", "laptop"},
+		{"laptop.lab.example.org.", "laptop.lab"},
+		{"laptop.elsewhere.net", "laptop"},
+		{"my_laptop!", "mylaptop"},
+		{"-", ""},
+		{"", ""},
+		{"example.org", "example"},
+	} {
+		assert.Equal(t, tt.want, hostLabel(tt.name, "example.org."), tt.name)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	assert.Equal(t, "4.3.2.10.in-addr.arpa.", reverseName(net.IPv4(10, 2, 3, 4)))
+	assert.Equal(t,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		reverseName(net.ParseIP("2001:db8::1")))
+}
+
+func TestHostname4(t *testing.T) {
+	req, err := dhcpv4.New(dhcpv4.WithOption(dhcpv4.OptHostName("plain")))
+	require.NoError(t, err)
+	assert.Equal(t, "plain", hostname4(req))
+
+	// the client FQDN option takes precedence, in wire format
+	labels := rfc1035label.NewLabels()
+	labels.Labels = []string{"wire", "example", "org"}
+	req.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionFQDN, append([]byte{fqdnFlagE, 0, 0}, labels.ToBytes()...)))
+	assert.Equal(t, "wire.example.org", hostname4(req))
+
+	// and in the deprecated ASCII encoding
+	req.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionFQDN, append([]byte{0, 0, 0}, "ascii"...)))
+	assert.Equal(t, "ascii", hostname4(req))
+}
+
+func TestRedisValue(t *testing.T) {
+	a := record{Zone: "example.org.", Name: "host", Type: "A", TTL: 300, IP: net.IPv4(10, 0, 0, 1).To4()}
+	existing := `{"txt":[{"text":"keep me"}],"a":[{"ttl":60,"ip":"10.0.0.2"}]}`
+
+	entry, changed, err := addRedisValue(existing, a)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	var fields map[string][]map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(entry), &fields))
+	assert.Len(t, fields["a"], 2)
+	assert.Equal(t, "keep me", fields["txt"][0]["text"])
+
+	_, changed, err = addRedisValue(entry, a)
+	require.NoError(t, err)
+	assert.False(t, changed, "adding twice")
+
+	entry, changed, err = removeRedisValue(entry, a)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	require.NoError(t, json.Unmarshal([]byte(entry), &fields))
+	assert.Len(t, fields["a"], 1)
+	assert.Equal(t, "10.0.0.2", fields["a"][0]["ip"])
+
+	entry, changed, err = addRedisValue("", a)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	entry, changed, err = removeRedisValue(entry, a)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, entry, "no record left")
+}
+
+func TestRegister4(t *testing.T) {
+	p, b := testPluginState()
+	const mac = "02:00:00:00:00:01"
+	ip := net.IPv4(10, 0, 0, 5)
+
+	req, resp := testAck(t, dhcpv4.MessageTypeRequest, mac, ip, dhcpv4.WithOption(dhcpv4.OptHostName("Laptop")))
+	p.Handler4(req, resp)
+	require.Len(t, b.records, 2)
+	assert.Equal(t, record{Zone: "example.org.", Name: "laptop", Type: "A", TTL: 300, IP: ip.To4()}, b.records[0])
+	assert.Equal(t, record{Zone: "10.in-addr.arpa.", Name: "5.0.0", Type: "PTR", TTL: 300, Host: "laptop.example.org."}, b.records[1])
+	require.Contains(t, b.registrations, "mac:"+mac)
+
+	// a new name replaces the previous records
+	req, resp = testAck(t, dhcpv4.MessageTypeRequest, mac, ip, dhcpv4.WithOption(dhcpv4.OptHostName("desktop")))
+	p.Handler4(req, resp)
+	require.Len(t, b.records, 2)
+	assert.Equal(t, "desktop", b.records[0].Name)
+	assert.Equal(t, "desktop.example.org.", b.records[1].Host)
+
+	req, resp = testAck(t, dhcpv4.MessageTypeRelease, mac, ip)
+	p.Handler4(req, resp)
+	assert.Empty(t, b.records)
+	assert.Empty(t, b.registrations)
+}
+
+func TestRenew4WithoutName(t *testing.T) {
+	p, b := testPluginState()
+	const mac = "02:00:00:00:00:01"
+	ip := net.IPv4(10, 0, 0, 5)
+
+	req, resp := testAck(t, dhcpv4.MessageTypeRequest, mac, ip, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	p.Handler4(req, resp)
+	first := b.registrations["mac:"+mac].Expires
+
+	// the renewal carries no name, the registration is kept and extended
+	time.Sleep(10 * time.Millisecond)
+	req, resp = testAck(t, dhcpv4.MessageTypeRequest, mac, ip)
+	p.Handler4(req, resp)
+	require.Len(t, b.records, 2)
+	assert.Equal(t, "laptop", b.records[0].Name)
+	require.Contains(t, b.registrations, "mac:"+mac)
+	assert.True(t, b.registrations["mac:"+mac].Expires.After(first))
+}
+
+func TestRegister4Ignored(t *testing.T) {
+	p, b := testPluginState()
+	const mac = "02:00:00:00:00:01"
+	ip := net.IPv4(10, 0, 0, 5)
+
+	// no name
+	req, resp := testAck(t, dhcpv4.MessageTypeRequest, mac, ip)
+	p.Handler4(req, resp)
+	// offers don't lease anything
+	req, resp = testAck(t, dhcpv4.MessageTypeDiscover, mac, ip, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	p.Handler4(req, resp)
+	// neither do NAKs
+	req, resp = testAck(t, dhcpv4.MessageTypeRequest, mac, ip, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	p.Handler4(req, resp)
+	assert.Empty(t, b.records)
+}
+
+func TestSweep(t *testing.T) {
+	p, b := testPluginState()
+	p.reverseZone = ""
+	p.register("mac:02:00:00:00:00:01", "old", []net.IP{net.IPv4(10, 0, 0, 1)}, time.Now().Add(-time.Minute))
+	p.register("mac:02:00:00:00:00:02", "new", []net.IP{net.IPv4(10, 0, 0, 2)}, time.Now().Add(time.Hour))
+	require.Len(t, b.records, 2)
+
+	p.sweep(time.Now())
+	require.Len(t, b.records, 1)
+	assert.Equal(t, "new", b.records[0].Name)
+	assert.NotContains(t, b.registrations, "mac:02:00:00:00:00:01")
+}
+
+func TestSweepRenewedElsewhere(t *testing.T) {
+	p, b := testPluginState()
+	p.reverseZone = ""
+	const client = "mac:02:00:00:00:00:01"
+	p.register(client, "host", []net.IP{net.IPv4(10, 0, 0, 1)}, time.Now().Add(-time.Minute))
+
+	// another server renewed the lease since
+	renewed := *b.registrations[client]
+	renewed.Expires = time.Now().Add(time.Hour)
+	b.registrations[client] = &renewed
+	p.sweep(time.Now())
+	assert.Len(t, b.records, 1)
+	assert.Equal(t, renewed.Expires, p.registrations[client].Expires)
+
+	// another server removed it
+	delete(b.registrations, client)
+	p.registrations[client].Expires = time.Now().Add(-time.Minute)
+	p.sweep(time.Now())
+	assert.Len(t, b.records, 1)
+	assert.Empty(t, p.registrations)
+}
+
+func TestRegister6(t *testing.T) {
+	p, b := testPluginState()
+	p.reverseZone = "8.b.d.0.1.0.0.2.ip6.arpa."
+	addr1, addr2 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = dhcpv6.MessageTypeRequest
+	req.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}))
+	req.AddOption(&dhcpv6.OptFQDN{DomainName: &rfc1035label.Labels{Labels: []string{"phone"}}})
+	resp := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: req.TransactionID}
+	resp.AddOption(&dhcpv6.OptIANA{Options: dhcpv6.IdentityOptions{Options: dhcpv6.Options{
+		&dhcpv6.OptIAAddress{IPv6Addr: addr1, PreferredLifetime: time.Hour, ValidLifetime: 2 * time.Hour},
+		&dhcpv6.OptIAAddress{IPv6Addr: addr2, PreferredLifetime: time.Hour, ValidLifetime: 2 * time.Hour},
+		// no longer valid, not registered
+		&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::3")},
+	}}})
+
+	p.Handler6(req, resp)
+	require.Len(t, b.records, 4)
+	assert.Equal(t, "AAAA", b.records[0].Type)
+	assert.Equal(t, "phone", b.records[0].Name)
+	assert.Equal(t, "PTR", b.records[1].Type)
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", b.records[1].Name)
+
+	// releasing one address keeps the records of the other
+	req.MessageType = dhcpv6.MessageTypeRelease
+	req.AddOption(&dhcpv6.OptIANA{Options: dhcpv6.IdentityOptions{Options: dhcpv6.Options{
+		&dhcpv6.OptIAAddress{IPv6Addr: addr1},
+	}}})
+	p.Handler6(req, nil)
+	require.Len(t, b.records, 2)
+	assert.True(t, b.records[0].IP.Equal(addr2))
+	assert.Len(t, b.registrations, 1)
+}
@@ -0,0 +1,133 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgBackend publishes records to the coredns_records table read by the
+// CoreDNS postgresql plugin
+type pgBackend struct {
+	pool *pgxpool.Pool
+}
+
+func openPgBackend(url string) (*pgBackend, error) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	if _, err := pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS coredhcp_dns_registrations (
+			client VARCHAR(300) PRIMARY KEY,
+			records TEXT NOT NULL,
+			expires TIMESTAMPTZ NOT NULL
+		);`); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("table creation failed: %w", err)
+	}
+	return &pgBackend{pool: pool}, nil
+}
+
+func (b *pgBackend) close() {
+	b.pool.Close()
+}
+
+func (b *pgBackend) publish(r record) error {
+	_, err := b.pool.Exec(context.Background(), `INSERT INTO coredns_records (zone, name, ttl, record_type, content)
+		SELECT $1, $2, $3, $4, $5 WHERE NOT EXISTS (
+			SELECT 1 FROM coredns_records WHERE zone = $1 AND name = $2 AND record_type = $4 AND content = $5)`,
+		r.Zone, r.Name, r.TTL, r.Type, r.content())
+	if err != nil {
+		return fmt.Errorf("record insert failed: %w", err)
+	}
+	return nil
+}
+
+func (b *pgBackend) remove(r record) error {
+	_, err := b.pool.Exec(context.Background(), `DELETE FROM coredns_records
+		WHERE zone = $1 AND name = $2 AND record_type = $3 AND content = $4`,
+		r.Zone, r.Name, r.Type, r.content())
+	if err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
+func (b *pgBackend) loadRegistrations(family string) (map[string]*registration, error) {
+	rows, err := b.pool.Query(context.Background(), `SELECT client, records, expires FROM coredhcp_dns_registrations
+		WHERE client LIKE $1 || '%'`, family)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+	var (
+		client, records string
+		expires         time.Time
+		regs            = make(map[string]*registration)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&client, &records, &expires); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		reg := &registration{Expires: expires}
+		if err := json.Unmarshal([]byte(records), &reg.Records); err != nil {
+			return nil, fmt.Errorf("malformed registration for %s: %w", client, err)
+		}
+		regs[client] = reg
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed registration row scanning: %w", err)
+	}
+	return regs, nil
+}
+
+func (b *pgBackend) loadRegistration(client string) (*registration, error) {
+	var (
+		records string
+		reg     registration
+	)
+	err := b.pool.QueryRow(context.Background(), `SELECT records, expires FROM coredhcp_dns_registrations WHERE client = $1`,
+		client).Scan(&records, &reg.Expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	if err := json.Unmarshal([]byte(records), &reg.Records); err != nil {
+		return nil, fmt.Errorf("malformed registration for %s: %w", client, err)
+	}
+	return &reg, nil
+}
+
+func (b *pgBackend) saveRegistration(client string, reg *registration) error {
+	records, err := json.Marshal(reg.Records)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.Exec(context.Background(), `INSERT INTO coredhcp_dns_registrations (client, records, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (client) DO UPDATE SET records = EXCLUDED.records, expires = EXCLUDED.expires`,
+		client, string(records), reg.Expires)
+	if err != nil {
+		return fmt.Errorf("registration insert/update failed: %w", err)
+	}
+	return nil
+}
+
+func (b *pgBackend) deleteRegistration(client string) error {
+	if _, err := b.pool.Exec(context.Background(), `DELETE FROM coredhcp_dns_registrations WHERE client = $1`, client); err != nil {
+		return fmt.Errorf("registration delete failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package ddns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+
+	predis "github.com/coredhcp/coredhcp/plugins/redis"
+)
+
+// registrationsKey is the hash holding the registrations. It is outside of
+// the key prefix and suffix of the zones, so that the CoreDNS redis plugin
+// doesn't take it for a zone when it is configured with any.
+const registrationsKey = "coredhcp:ddns"
+
+// serialField is the field of the hash of a zone holding its serial, which
+// the writers of the zone increment after changing its records
+const serialField = "$serial"
+
+// zonesRegistry is the name of the set of the zones the CoreDNS redis plugin
+// serves, within the key prefix and suffix
+const zonesRegistry = "$zones"
+
+// redisBackend publishes records to the zone hashes read by the CoreDNS redis
+// plugin: a hash per zone, holding a JSON object of records per name
+type redisBackend struct {
+	pool           *redis.Pool
+	closePools     func()
+	prefix, suffix string
+	// Updating a name is a read-modify-write, we serialize ours
+	sync.Mutex
+}
+
+// redisValue is an element of the record lists of the CoreDNS redis plugin
+type redisValue struct {
+	TTL  uint32 `json:"ttl,omitempty"`
+	IP   net.IP `json:"ip,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+// openRedisBackend connects to a redis server given as a redis:// URL, or to
+// the master of sentinels or a cluster given as described by predis.ParseURL.
+// The key prefix and suffix configured in the CoreDNS redis plugin can be
+// given as the prefix and suffix query parameters.
+func openRedisBackend(rawurl string) (*redisBackend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	config, err := predis.ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	b := &redisBackend{
+		prefix: u.Query().Get("prefix"),
+		suffix: u.Query().Get("suffix"),
+	}
+	// records are read before they are updated, so all goes to the master
+	b.pool, _, b.closePools = config.Pools()
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		b.closePools()
+		return nil, fmt.Errorf("unable to connect to redis: %w", err)
+	}
+	return b, nil
+}
+
+func (b *redisBackend) close() {
+	b.closePools()
+}
+
+// redisField returns the field of the JSON object of a name holding records
+// of a type
+func redisField(rtype string) string {
+	return strings.ToLower(rtype)
+}
+
+// addRedisValue returns the JSON object of a name with a record added, and
+// false if it was already there. Records of other types are kept untouched.
+func addRedisValue(entry string, r record) (string, bool, error) {
+	fields := make(map[string]json.RawMessage)
+	if entry != "" {
+		if err := json.Unmarshal([]byte(entry), &fields); err != nil {
+			return "", false, err
+		}
+	}
+	var values []redisValue
+	if raw, ok := fields[redisField(r.Type)]; ok {
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return "", false, err
+		}
+	}
+	for _, v := range values {
+		if v.IP.Equal(r.IP) && v.Host == r.Host {
+			return entry, false, nil
+		}
+	}
+	values = append(values, redisValue{TTL: r.TTL, IP: r.IP, Host: r.Host})
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return "", false, err
+	}
+	fields[redisField(r.Type)] = raw
+	b, err := json.Marshal(fields)
+	return string(b), true, err
+}
+
+// removeRedisValue returns the JSON object of a name with a record removed,
+// and false if it wasn't there. An empty string means no record is left.
+func removeRedisValue(entry string, r record) (string, bool, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(entry), &fields); err != nil {
+		return "", false, err
+	}
+	raw, ok := fields[redisField(r.Type)]
+	if !ok {
+		return entry, false, nil
+	}
+	var values, kept []redisValue
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return "", false, err
+	}
+	for _, v := range values {
+		if !(v.IP.Equal(r.IP) && v.Host == r.Host) {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == len(values) {
+		return entry, false, nil
+	}
+	if len(kept) == 0 {
+		delete(fields, redisField(r.Type))
+	} else {
+		raw, err := json.Marshal(kept)
+		if err != nil {
+			return "", false, err
+		}
+		fields[redisField(r.Type)] = raw
+	}
+	if len(fields) == 0 {
+		return "", true, nil
+	}
+	b, err := json.Marshal(fields)
+	return string(b), true, err
+}
+
+// location returns the field of a name in the hash of its zone
+func location(r record) string {
+	if r.Name == "" {
+		return "@"
+	}
+	return r.Name
+}
+
+func (b *redisBackend) publish(r record) error {
+	b.Lock()
+	defer b.Unlock()
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	key := b.prefix + r.Zone + b.suffix
+	entry, err := redis.String(conn.Do("HGET", key, location(r)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return fmt.Errorf("HGET failed: %w", err)
+	}
+	entry, changed, err := addRedisValue(entry, r)
+	if err != nil {
+		return fmt.Errorf("malformed records for %s in %s: %w", location(r), key, err)
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := conn.Do("HSET", key, location(r), entry); err != nil {
+		return fmt.Errorf("HSET failed: %w", err)
+	}
+	if _, err := conn.Do("HINCRBY", key, serialField, 1); err != nil {
+		return fmt.Errorf("HINCRBY failed: %w", err)
+	}
+	if _, err := conn.Do("SADD", b.prefix+zonesRegistry+b.suffix, r.Zone); err != nil {
+		return fmt.Errorf("SADD failed: %w", err)
+	}
+	return nil
+}
+
+func (b *redisBackend) remove(r record) error {
+	b.Lock()
+	defer b.Unlock()
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	key := b.prefix + r.Zone + b.suffix
+	entry, err := redis.String(conn.Do("HGET", key, location(r)))
+	if errors.Is(err, redis.ErrNil) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("HGET failed: %w", err)
+	}
+	entry, changed, err := removeRedisValue(entry, r)
+	if err != nil {
+		return fmt.Errorf("malformed records for %s in %s: %w", location(r), key, err)
+	}
+	switch {
+	case !changed:
+		return nil
+	case entry == "":
+		_, err = conn.Do("HDEL", key, location(r))
+	default:
+		_, err = conn.Do("HSET", key, location(r), entry)
+	}
+	if err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	if _, err := conn.Do("HINCRBY", key, serialField, 1); err != nil {
+		return fmt.Errorf("HINCRBY failed: %w", err)
+	}
+	return nil
+}
+
+func (b *redisBackend) loadRegistrations(family string) (map[string]*registration, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", registrationsKey))
+	if err != nil {
+		return nil, fmt.Errorf("HGETALL failed: %w", err)
+	}
+	regs := make(map[string]*registration, len(values))
+	for client, v := range values {
+		if !strings.HasPrefix(client, family) {
+			continue
+		}
+		var reg registration
+		if err := json.Unmarshal([]byte(v), &reg); err != nil {
+			return nil, fmt.Errorf("malformed registration for %s: %w", client, err)
+		}
+		regs[client] = &reg
+	}
+	return regs, nil
+}
+
+func (b *redisBackend) loadRegistration(client string) (*registration, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	v, err := redis.Bytes(conn.Do("HGET", registrationsKey, client))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("HGET failed: %w", err)
+	}
+	var reg registration
+	if err := json.Unmarshal(v, &reg); err != nil {
+		return nil, fmt.Errorf("malformed registration for %s: %w", client, err)
+	}
+	return &reg, nil
+}
+
+func (b *redisBackend) saveRegistration(client string, reg *registration) error {
+	v, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", registrationsKey, client, string(v)); err != nil {
+		return fmt.Errorf("HSET failed: %w", err)
+	}
+	return nil
+}
+
+func (b *redisBackend) deleteRegistration(client string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HDEL", registrationsKey, client); err != nil {
+		return fmt.Errorf("HDEL failed: %w", err)
+	}
+	return nil
+}
@@ -33,14 +33,16 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if len(args) < 1 {
 		return nil, errors.New("need at least one DNS server")
 	}
+	var servers []net.IP
 	for _, arg := range args {
 		server := net.ParseIP(arg)
 		if server.To16() == nil {
 			return Handler6, errors.New("expected an DNS server address, got: " + arg)
 		}
-		dnsServers6 = append(dnsServers6, server)
+		servers = append(servers, server)
 	}
-	log.Infof("loaded %d DNS servers.", len(dnsServers6))
+	plugins.OnCommit(func() { dnsServers6 = servers })
+	log.Infof("loaded %d DNS servers.", len(servers))
 	return Handler6, nil
 }
 
@@ -49,14 +51,16 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) < 1 {
 		return nil, errors.New("need at least one DNS server")
 	}
+	var servers []net.IP
 	for _, arg := range args {
 		DNSServer := net.ParseIP(arg)
 		if DNSServer.To4() == nil {
 			return Handler4, errors.New("expected an DNS server address, got: " + arg)
 		}
-		dnsServers4 = append(dnsServers4, DNSServer)
+		servers = append(servers, DNSServer)
 	}
-	log.Infof("loaded %d DNS servers.", len(dnsServers4))
+	plugins.OnCommit(func() { dnsServers4 = servers })
+	log.Infof("loaded %d DNS servers.", len(servers))
 	return Handler4, nil
 }
 
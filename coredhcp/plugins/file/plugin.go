@@ -210,7 +210,6 @@ func setup4(args ...string) (handler.Handler4, error) {
 }
 
 func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
-	var err error
 	if len(args) < 1 {
 		return nil, nil, errors.New("need a file name")
 	}
@@ -220,26 +219,36 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 	}
 
 	// load initial database from lease file
-	if err = loadFromFile(v6, filename); err != nil {
+	records, err := readRecords(v6, filename)
+	if err != nil {
 		return nil, nil, err
 	}
 
 	// when the 'autorefresh' argument was passed, watch the lease file for
 	// changes and reload the lease mapping on any event
+	var watcher *fsnotify.Watcher
 	if len(args) > 1 && args[1] == autoRefreshArg {
 		// creates a new file watcher
-		watcher, err := fsnotify.NewWatcher()
+		watcher, err = fsnotify.NewWatcher()
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create watcher: %w", err)
 		}
 
 		// have file watcher watch over lease file
 		if err = watcher.Add(filename); err != nil {
+			watcher.Close()
 			return nil, nil, fmt.Errorf("failed to watch %s: %w", filename, err)
 		}
+		plugins.OnClose(func() { watcher.Close() })
+	}
 
-		// very simple watcher on the lease file to trigger a refresh on any event
-		// on the file
+	plugins.OnCommit(func() {
+		storeRecords(records)
+		if watcher == nil {
+			return
+		}
+		// very simple watcher on the lease file to trigger a refresh on any
+		// event on the file, until the plugin is torn down and closes it
 		go func() {
 			for range watcher.Events {
 				err := loadFromFile(v6, filename)
@@ -252,13 +261,14 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 				log.Infof("updated to %d leases from %s", len(StaticRecords), filename)
 			}
 		}()
-	}
+	})
 
-	log.Infof("loaded %d leases from %s", len(StaticRecords), filename)
+	log.Infof("loaded %d leases from %s", len(records), filename)
 	return Handler6, Handler4, nil
 }
 
-func loadFromFile(v6 bool, filename string) error {
+// readRecords reads the DHCPv6 or DHCPv4 records of a lease file
+func readRecords(v6 bool, filename string) (map[string]net.IP, error) {
 	var err error
 	var records map[string]net.IP
 	var protver int
@@ -270,13 +280,23 @@ func loadFromFile(v6 bool, filename string) error {
 		records, err = LoadDHCPv4Records(filename)
 	}
 	if err != nil {
-		return fmt.Errorf("failed to load DHCPv%d records: %w", protver, err)
+		return nil, fmt.Errorf("failed to load DHCPv%d records: %w", protver, err)
 	}
+	return records, nil
+}
 
+func storeRecords(records map[string]net.IP) {
 	recLock.Lock()
 	defer recLock.Unlock()
 
 	StaticRecords = records
+}
 
+func loadFromFile(v6 bool, filename string) error {
+	records, err := readRecords(v6, filename)
+	if err != nil {
+		return err
+	}
+	storeRecords(records)
 	return nil
 }
@@ -36,17 +36,19 @@ var Plugin = plugins.Plugin{
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
+	var wait time.Duration
 	if len(args) > 0 {
 		dur, err := time.ParseDuration(args[0])
 		if err != nil {
 			log.Errorf("invalid duration: %v", args[0])
 			return nil, errors.New("ipv6only failed to initialize")
 		}
-		v6only_wait = dur
+		wait = dur
 	}
 	if len(args) > 1 {
 		return nil, errors.New("too many arguments")
 	}
+	plugins.OnCommit(func() { v6only_wait = wait })
 	return Handler4, nil
 }
 
@@ -0,0 +1,258 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package leasestore holds what the range and range6 plugins share to keep
+// their leases: the SQLite database the leases are persisted in, the
+// quarantine of the addresses declined by clients, and the sweeper
+// reclaiming expired leases in the background, which the prefix and ddns
+// plugins use as well, and the handover of a lease database from a running
+// instance of a plugin to the one replacing it on a reload.
+package leasestore
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+var log = logger.GetLogger("plugins/leasestore")
+
+// DeclineHoldTime is how long an address declined by a client stays out of
+// the pool, as it is likely in use by a host we don't know about
+const DeclineHoldTime = 24 * time.Hour
+
+// Store is the SQLite database a plugin persists its leases in, along with
+// the addresses quarantined after a client declined them
+type Store struct {
+	*sql.DB
+	// declined is the table of the quarantined addresses
+	declined string
+}
+
+// Open opens the database at path, which is created if it does not exist.
+// leases is the statement creating the table of the leases of the plugin, if
+// not there yet, and declined the name of the table of its quarantined
+// addresses.
+func Open(path, leases, declined string) (*Store, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database (%T): %w", err, err)
+	}
+	if _, err := db.Exec(leases); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("table creation failed: %w", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("create table if not exists %s (ip string not null, expiry int, primary key (ip))", declined)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("table creation failed: %w", err)
+	}
+	return &Store{DB: db, declined: declined}, nil
+}
+
+// loadDeclined loads the quarantined addresses, mapped to the time their
+// quarantine ends
+func (s *Store) loadDeclined() (map[string]int, error) {
+	rows, err := s.Query(fmt.Sprintf("select ip, expiry from %s", s.declined))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases database: %w", err)
+	}
+	defer rows.Close()
+	var (
+		ip       string
+		expiry   int
+		declined = make(map[string]int)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&ip, &expiry); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ipaddr := net.ParseIP(ip)
+		if ipaddr == nil {
+			return nil, fmt.Errorf("expected an IP address, got: %v", ip)
+		}
+		declined[ipaddr.String()] = expiry
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	return declined, nil
+}
+
+// saveDeclined writes out a quarantined address to storage
+func (s *Store) saveDeclined(ip net.IP, expiry int) error {
+	if _, err := s.Exec(fmt.Sprintf("insert or replace into %s(ip, expiry) values (?, ?)", s.declined), ip.String(), expiry); err != nil {
+		return fmt.Errorf("record insert/update failed: %w", err)
+	}
+	return nil
+}
+
+// deleteDeclined removes a quarantined address from storage
+func (s *Store) deleteDeclined(ip net.IP) error {
+	if _, err := s.Exec(fmt.Sprintf("delete from %s where ip = ?", s.declined), ip.String()); err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
+// Quarantine keeps the addresses declined by clients taken in the allocator of
+// a plugin for DeclineHoldTime. It is not safe for concurrent use: the plugin
+// serializes the calls with its own lock.
+type Quarantine struct {
+	store     *Store
+	allocator allocators.Allocator
+	// declined maps the quarantined addresses to the unix time their
+	// quarantine ends
+	declined map[string]int
+}
+
+// LoadQuarantine reads the addresses quarantined in the store and takes them
+// in the allocator. The quarantines over by now are ended.
+func (s *Store) LoadQuarantine(allocator allocators.Allocator, now time.Time) (*Quarantine, error) {
+	declined, err := s.loadDeclined()
+	if err != nil {
+		return nil, fmt.Errorf("could not load declined addresses: %w", err)
+	}
+	q := &Quarantine{store: s, allocator: allocator, declined: declined}
+	for k, expiry := range declined {
+		ip := net.ParseIP(k)
+		if int64(expiry) <= now.Unix() {
+			delete(declined, k)
+			if err := s.deleteDeclined(ip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		allocated, err := allocator.Allocate(net.IPNet{IP: ip})
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-allocate declined ip %v: %v", k, err)
+		}
+		if !allocated.IP.Equal(ip) {
+			return nil, fmt.Errorf("allocator did not re-allocate requested declined ip %v: %v", k, allocated.String())
+		}
+	}
+	return q, nil
+}
+
+// Add quarantines an address, which the caller leaves taken in the allocator
+func (q *Quarantine) Add(ip net.IP) error {
+	expiry := int(time.Now().Add(DeclineHoldTime).Unix())
+	q.declined[ip.String()] = expiry
+	return q.store.saveDeclined(ip, expiry)
+}
+
+// Has returns true if the address is quarantined
+func (q *Quarantine) Has(ip net.IP) bool {
+	_, ok := q.declined[ip.String()]
+	return ok
+}
+
+// Len returns the number of quarantined addresses
+func (q *Quarantine) Len() int {
+	return len(q.declined)
+}
+
+// Release ends the quarantines over at the given time, and frees their
+// addresses in the allocator. It returns the freed addresses.
+func (q *Quarantine) Release(now time.Time) []net.IP {
+	var released []net.IP
+	for k, expiry := range q.declined {
+		if int64(expiry) > now.Unix() {
+			continue
+		}
+		ip := net.ParseIP(k)
+		if err := q.allocator.Free(net.IPNet{IP: ip}); err != nil {
+			log.Errorf("Could not free declined IP %s: %v", k, err)
+		}
+		delete(q.declined, k)
+		if err := q.store.deleteDeclined(ip); err != nil {
+			log.Errorf("Could not delete declined IP %s: %v", k, err)
+		}
+		log.Printf("Quarantine of declined IP %s is over", k)
+		released = append(released, ip)
+	}
+	return released
+}
+
+// Sweep calls sweep every interval in the background, until the returned
+// function is called. That function waits for a sweep in progress to end, so
+// that the store can be closed after it.
+func Sweep(interval time.Duration, sweep func(now time.Time)) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sweep(now)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// owners holds the function retiring the instance of a plugin leasing from a
+// database, by key
+var owners = struct {
+	sync.Mutex
+	retire map[string]*func()
+}{retire: make(map[string]*func())}
+
+// takeover retires the instance leasing from the database known by key, if
+// any, and records retire as the function retiring the new one. It returns
+// the function forgetting it when it is torn down.
+func takeover(key string, retire func()) (release func()) {
+	owners.Lock()
+	defer owners.Unlock()
+	if previous, ok := owners.retire[key]; ok {
+		(*previous)()
+	}
+	owned := &retire
+	owners.retire[key] = owned
+	return func() {
+		owners.Lock()
+		defer owners.Unlock()
+		if owners.retire[key] == owned {
+			delete(owners.retire, key)
+		}
+	}
+}
+
+// Handover hands the lease database known by key over to an instance of a
+// plugin being set up, once its chains replace the running ones. Until then,
+// the instance it replaces keeps leasing from the same database, so the
+// leases read on setup may be outdated: the replaced instance is retired
+// first, after which it must not lease anything, then reload reads the leases
+// again, and the expired ones are swept every interval from then on, until
+// the chains are torn down.
+func Handover(key string, retire, reload func(), interval time.Duration, sweep func(now time.Time)) {
+	var release, stop func()
+	plugins.OnCommit(func() {
+		release = takeover(key, retire)
+		reload()
+		stop = Sweep(interval, sweep)
+	})
+	plugins.OnClose(func() {
+		if stop != nil {
+			stop()
+		}
+		if release != nil {
+			release()
+		}
+	})
+}
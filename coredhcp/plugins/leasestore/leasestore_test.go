@@ -0,0 +1,105 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+const testLeases = "create table if not exists leases4 (mac string not null, ip string not null, expiry int, hostname string not null, primary key (mac, ip))"
+
+func testAllocator(t *testing.T) allocators.Allocator {
+	alloc, err := bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 10), net.IPv4(10, 0, 0, 20))
+	require.NoError(t, err)
+	return alloc
+}
+
+func TestQuarantine(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "leases.sqlite3"), testLeases, "declined4")
+	require.NoError(t, err)
+	defer s.Close()
+	alloc := testAllocator(t)
+	q, err := s.LoadQuarantine(alloc, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+
+	ip, err := alloc.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	require.NoError(t, q.Add(ip.IP))
+	assert.True(t, q.Has(ip.IP))
+	assert.Equal(t, 1, q.Len())
+
+	// the quarantine is loaded again, and takes the address in the allocator
+	alloc = testAllocator(t)
+	q, err = s.LoadQuarantine(alloc, time.Now())
+	require.NoError(t, err)
+	assert.True(t, q.Has(ip.IP))
+	other, err := alloc.Allocate(net.IPNet{IP: ip.IP})
+	require.NoError(t, err)
+	assert.False(t, other.IP.Equal(ip.IP))
+
+	assert.Empty(t, q.Release(time.Now()))
+	released := q.Release(time.Now().Add(DeclineHoldTime))
+	require.Len(t, released, 1)
+	assert.True(t, released[0].Equal(ip.IP))
+	assert.False(t, q.Has(ip.IP))
+
+	q, err = s.LoadQuarantine(testAllocator(t), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestLoadQuarantineEndsOver(t *testing.T) {
+	s, err := Open(":memory:", testLeases, "declined4")
+	require.NoError(t, err)
+	defer s.Close()
+	q, err := s.LoadQuarantine(testAllocator(t), time.Now())
+	require.NoError(t, err)
+	require.NoError(t, q.Add(net.IPv4(10, 0, 0, 10)))
+
+	q, err = s.LoadQuarantine(testAllocator(t), time.Now().Add(DeclineHoldTime))
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestSweepStops(t *testing.T) {
+	var sweeps atomic.Int32
+	stop := Sweep(time.Millisecond, func(time.Time) { sweeps.Add(1) })
+	assert.Eventually(t, func() bool { return sweeps.Load() > 0 }, time.Second, time.Millisecond)
+	stop()
+	n := sweeps.Load()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, n, sweeps.Load())
+}
+
+func TestTakeover(t *testing.T) {
+	var retired []string
+	retire := func(name string) func() {
+		return func() { retired = append(retired, name) }
+	}
+	releaseFirst := takeover("test", retire("first"))
+	assert.Empty(t, retired)
+	releaseSecond := takeover("test", retire("second"))
+	assert.Equal(t, []string{"first"}, retired)
+
+	// tearing down the replaced instance leaves the new one in charge
+	releaseFirst()
+	takeover("test", retire("third"))
+	assert.Equal(t, []string{"first", "second"}, retired)
+
+	releaseSecond()
+	takeover("other", retire("other"))
+	assert.Equal(t, []string{"first", "second"}, retired)
+}
@@ -51,7 +51,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 		log.Errorf("invalid duration: %v", args[0])
 		return nil, errors.New("lease_time failed to initialize")
 	}
-	v4LeaseTime = leaseTime
+	plugins.OnCommit(func() { v4LeaseTime = leaseTime })
 
 	return Handler4, nil
 }
@@ -33,11 +33,12 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) != 1 {
 		return nil, errors.New("need one mtu value")
 	}
-	var err error
-	if mtu, err = strconv.Atoi(args[0]); err != nil {
+	value, err := strconv.Atoi(args[0])
+	if err != nil {
 		return nil, fmt.Errorf("invalid mtu: %v", args[0])
 	}
-	log.Infof("loaded mtu %d.", mtu)
+	plugins.OnCommit(func() { mtu = value })
+	log.Infof("loaded mtu %d.", value)
 	return Handler4, nil
 }
 
@@ -68,14 +68,16 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err != nil {
 		return nil, err
 	}
-	opt59 = dhcpv6.OptBootFileURL(u.String())
+	bootURL := dhcpv6.OptBootFileURL(u.String())
+	var param dhcpv6.Option
 	params := u.Query().Get("params")
 	if params != "" {
-		opt60 = &dhcpv6.OptionGeneric{
+		param = &dhcpv6.OptionGeneric{
 			OptionCode: dhcpv6.OptionBootfileParam,
 			OptionData: []byte(params),
 		}
 	}
+	plugins.OnCommit(func() { opt59, opt60 = bootURL, param })
 	log.Printf("loaded NBP plugin for DHCPv6.")
 	return nbpHandler6, nil
 }
@@ -87,16 +89,17 @@ func setup4(args ...string) (handler.Handler4, error) {
 	}
 
 	var otsn, obfn dhcpv4.Option
+	var tftpServer *dhcpv4.Option
 	switch u.Scheme {
 	case "http", "https", "ftp":
 		obfn = dhcpv4.OptBootFileName(u.String())
 	default:
 		otsn = dhcpv4.OptTFTPServerName(u.Host)
 		obfn = dhcpv4.OptBootFileName(u.Path)
-		opt66 = &otsn
+		tftpServer = &otsn
 	}
 
-	opt67 = &obfn
+	plugins.OnCommit(func() { opt66, opt67 = tftpServer, &obfn })
 	log.Printf("loaded NBP plugin for DHCPv4.")
 	return nbpHandler4, nil
 }
@@ -40,10 +40,11 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if netmaskIP == nil {
 		return nil, errors.New("expected an netmask address, got: " + args[0])
 	}
-	netmask = net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
-	if !checkValidNetmask(netmask) {
+	mask := net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
+	if !checkValidNetmask(mask) {
 		return nil, errors.New("netmask is not valid, got: " + args[0])
 	}
+	plugins.OnCommit(func() { netmask = mask })
 	log.Printf("loaded client netmask")
 	return Handler4, nil
 }
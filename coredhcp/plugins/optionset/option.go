@@ -39,23 +39,25 @@ var (
 //   plugins:
 //     - optionset: "option60=MyVendorClass" "option43=0104c0a86401"
 func setup4(args ...string) (handler.Handler4, error) {
-    // 每次初始化时都清空
-    globalOption60 = ""
-    globalOption43 = nil
-    useVendor = ""
-    acIP = ""
+    // 解析到局部变量，配置生效时才写入全局变量
+    var (
+        option60 string
+        option43 []byte
+        vendor   string
+        ip       string
+    )
 
     for _, arg := range args {
         // 1) 解析 vendor
         if strings.HasPrefix(arg, "vendor=") {
-            useVendor = strings.ToLower(strings.TrimPrefix(arg, "vendor="))
-            log.Infof("Parsed vendor=%s", useVendor)
+            vendor = strings.ToLower(strings.TrimPrefix(arg, "vendor="))
+            log.Infof("Parsed vendor=%s", vendor)
         }
 
         // 2) 解析 ac_ip
         if strings.HasPrefix(arg, "ac_ip=") {
-            acIP = strings.TrimPrefix(arg, "ac_ip=")
-            log.Infof("Parsed ac_ip=%s", acIP)
+            ip = strings.TrimPrefix(arg, "ac_ip=")
+            log.Infof("Parsed ac_ip=%s", ip)
         }
 
         // 3) 解析 option43 (手动指定)
@@ -65,28 +67,32 @@ func setup4(args ...string) (handler.Handler4, error) {
             if err != nil {
                 return nil, fmt.Errorf("failed to decode option43 hex string %q: %w", hexStr, err)
             }
-            globalOption43 = decoded
-            log.Infof("Parsed custom option43=%X", globalOption43)
+            option43 = decoded
+            log.Infof("Parsed custom option43=%X", option43)
         }
 
         // 4) 解析 option60
         if strings.HasPrefix(arg, "option60=") {
-            globalOption60 = strings.TrimPrefix(arg, "option60=")
-            log.Infof("Parsed option60=%s", globalOption60)
+            option60 = strings.TrimPrefix(arg, "option60=")
+            log.Infof("Parsed option60=%s", option60)
         }
     }
 
     // 如果用户没有手动指定 option43，而又指定了 vendor & ac_ip，则自动生成
-    if len(globalOption43) == 0 && useVendor != "" && acIP != "" {
+    if len(option43) == 0 && vendor != "" && ip != "" {
         // 根据 vendor + ac_ip 生成对应的 option43
-        generated, err := generateOption43(useVendor, acIP)
+        generated, err := generateOption43(vendor, ip)
         if err != nil {
-            return nil, fmt.Errorf("failed to generate option43 for vendor=%s ac_ip=%s: %w", useVendor, acIP, err)
+            return nil, fmt.Errorf("failed to generate option43 for vendor=%s ac_ip=%s: %w", vendor, ip, err)
         }
-        globalOption43 = generated
-        log.Infof("Automatically generated option43 for %s: %X", useVendor, globalOption43)
+        option43 = generated
+        log.Infof("Automatically generated option43 for %s: %X", vendor, option43)
     }
 
+    plugins.OnCommit(func() {
+        globalOption60, globalOption43, useVendor, acIP = option60, option43, vendor, ip
+    })
+
     // 返回我们的 handler4
     return handler4, nil
 }
@@ -6,6 +6,7 @@ package plugins
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/coredhcp/coredhcp/config"
 	"github.com/coredhcp/coredhcp/handler"
@@ -32,6 +33,20 @@ type SetupFunc6 func(args ...string) (handler.Handler6, error)
 // SetupFunc4 defines a plugin setup function for DHCPv6
 type SetupFunc4 func(args ...string) (handler.Handler4, error)
 
+// Handler6 is the DHCPv6 handler of a loaded plugin, with the name of the
+// plugin
+type Handler6 struct {
+	Name string
+	handler.Handler6
+}
+
+// Handler4 is the DHCPv4 handler of a loaded plugin, with the name of the
+// plugin
+type Handler4 struct {
+	Name string
+	handler.Handler4
+}
+
 // RegisterPlugin registers a plugin.
 func RegisterPlugin(plugin *Plugin) error {
 	if plugin == nil {
@@ -47,21 +62,137 @@ func RegisterPlugin(plugin *Plugin) error {
 	return nil
 }
 
+// Chains holds the DHCPv4 and DHCPv6 handlers of the plugins loaded from a
+// configuration, and what their setup staged: the settings to put in effect
+// once the chains are running, and what to tear down once they aren't.
+type Chains struct {
+	Handlers4 []Handler4
+	Handlers6 []Handler6
+
+	commits []func()
+	closers []func()
+
+	// inUse is held for reading while a request goes through the chains, and
+	// for writing to close them
+	inUse  sync.RWMutex
+	closed bool
+}
+
+var (
+	// loadLock serializes the loading of plugins
+	loadLock sync.Mutex
+	// loading holds the chains being loaded, nil outside of LoadPlugins
+	loading     *Chains
+	loadingLock sync.Mutex
+)
+
+// OnCommit stages a change of the settings a plugin keeps outside of its
+// handler, such as in package variables. When called from a setup function
+// run by LoadPlugins, f only runs once the loaded chains replace the running
+// ones, so that a configuration which fails to load leaves the running
+// settings alone. Otherwise f runs at once.
+func OnCommit(f func()) {
+	loadingLock.Lock()
+	chains := loading
+	if chains != nil {
+		chains.commits = append(chains.commits, f)
+	}
+	loadingLock.Unlock()
+	if chains == nil {
+		f()
+	}
+}
+
+// OnClose registers a function tearing down what a plugin set up, such as a
+// background goroutine or a database connection, to run when the chains
+// loaded by LoadPlugins stop being used. Plugins set up outside of
+// LoadPlugins, as in tests, are never torn down.
+func OnClose(f func()) {
+	loadingLock.Lock()
+	defer loadingLock.Unlock()
+	if loading != nil {
+		loading.closers = append(loading.closers, f)
+	}
+}
+
+func setLoading(chains *Chains) {
+	loadingLock.Lock()
+	defer loadingLock.Unlock()
+	loading = chains
+}
+
+// Commit puts in effect the settings staged by the setup of the plugins. It
+// is called once, when the chains replace the running ones.
+func (c *Chains) Commit() {
+	for _, f := range c.commits {
+		f()
+	}
+	c.commits = nil
+}
+
+// Acquire keeps the chains from being closed while a request goes through
+// them, until Release is called. It returns false if they are closed already.
+func (c *Chains) Acquire() bool {
+	c.inUse.RLock()
+	if c.closed {
+		c.inUse.RUnlock()
+		return false
+	}
+	return true
+}
+
+// Release lets the chains be closed again, see Acquire
+func (c *Chains) Release() {
+	c.inUse.RUnlock()
+}
+
+// Close waits for the requests going through the chains to be handled, then
+// tears down the plugins, last set up first. Closing the chains again does
+// nothing.
+func (c *Chains) Close() {
+	c.inUse.Lock()
+	defer c.inUse.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+	c.closers = nil
+}
+
 // LoadPlugins reads a Config object and loads the plugins as specified in the
 // `plugins` section, in order. For a plugin to be available, it must have been
 // previously registered with plugins.RegisterPlugin. This is normally done at
 // plugin import time.
-// This function returns the list of loaded v6 plugins, the list of loaded v4
-// plugins, and an error if any.
-func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
+// This function returns the chains of loaded v4 and v6 plugins, and an error
+// if any, in which case the plugins already set up are torn down. The caller
+// commits the chains when it starts using them, and closes them when it is
+// done with them.
+func LoadPlugins(conf *config.Config) (*Chains, error) {
 	log.Print("Loading plugins...")
-	handlers4 := make([]handler.Handler4, 0)
-	handlers6 := make([]handler.Handler6, 0)
-
 	if conf.Server6 == nil && conf.Server4 == nil {
-		return nil, nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
+		return nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
 	}
 
+	loadLock.Lock()
+	defer loadLock.Unlock()
+	chains := &Chains{
+		Handlers4: make([]Handler4, 0),
+		Handlers6: make([]Handler6, 0),
+	}
+	setLoading(chains)
+	err := chains.load(conf)
+	setLoading(nil)
+	if err != nil {
+		chains.Close()
+		return nil, err
+	}
+	return chains, nil
+}
+
+func (c *Chains) load(conf *config.Config) error {
 	// now load the plugins. We need to call its setup function with
 	// the arguments extracted above. The setup function is mapped in
 	// plugins.RegisteredPlugins .
@@ -77,13 +208,13 @@ func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, e
 				}
 				h6, err := plugin.Setup6(pluginConf.Args...)
 				if err != nil {
-					return nil, nil, err
+					return err
 				} else if h6 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
+					return config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
 				}
-				handlers6 = append(handlers6, h6)
+				c.Handlers6 = append(c.Handlers6, Handler6{Name: pluginConf.Name, Handler6: h6})
 			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
+				return config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
 			}
 		}
 	}
@@ -99,16 +230,15 @@ func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, e
 				}
 				h4, err := plugin.Setup4(pluginConf.Args...)
 				if err != nil {
-					return nil, nil, err
+					return err
 				} else if h4 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
+					return config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
 				}
-				handlers4 = append(handlers4, h4)
+				c.Handlers4 = append(c.Handlers4, Handler4{Name: pluginConf.Name, Handler4: h4})
 			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
+				return config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
 			}
 		}
 	}
-
-	return handlers4, handlers6, nil
+	return nil
 }
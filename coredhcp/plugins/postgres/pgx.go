@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"net"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metrics"
 	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -20,14 +21,7 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-var (
-	log      = logger.GetLogger("plugins/postgres")
-	pool       *pgxpool.Pool
-	rpool      *redis.Pool 
-	recLock    sync.RWMutex
-	dbConfig = ""
-	updateredis  = false
-)
+var log = logger.GetLogger("plugins/postgres")
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
@@ -36,6 +30,23 @@ var Plugin = plugins.Plugin{
 	Setup4: setup4,
 }
 
+// PluginState is the data held by an instance of the postgres plugin
+type PluginState struct {
+	pool *pgxpool.Pool
+	// rpool copies the served leases to redis, nil if they are not copied
+	rpool *redis.Pool
+	// redisTTL is the expiration of the leases copied to redis, in seconds,
+	// 0 if they don't expire
+	redisTTL int
+	// poolName is the coredhcp_pools row unknown clients are allocated from,
+	// empty when dynamic allocation is disabled
+	poolName string
+	// keyOrder is the order DHCPv6 reservations are looked up in
+	keyOrder []predis.KeyKind
+	// schema maps the reservations to the table holding them
+	schema *schema
+}
+
 type IPDetails struct {
 	mac_address string 
 	Cidr      string 
@@ -47,76 +58,131 @@ type IPDetails struct {
 	LeaseTime  time.Duration
 	T1         time.Duration
 	T2         time.Duration
+	// the DHCPv4 options below are only set by the columns mapped to them
+	Hostname   string
+	Domain     string
+	NTP        []net.IP
+	NextServer net.IP
+	BootFile   string
+	Options    []dhcpv4.Option
 }
 
 
-// Handler6 handles DHCPv6 packets for the PostgreSQL plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {    // 因为pg插件目前默认是最后一个插件，所以true/false结果都是一样的跳出循环
+// Handler6 handles DHCPv6 packets for the PostgreSQL plugin. Each IA_NA of
+// the request is answered with the reservation found first in the key order.
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {    // 因为pg插件目前默认是最后一个插件，所以true/false结果都是一样的跳出循环
 	m, err := req.GetInnerMessage()
 	if err != nil {
 		log.Errorf("BUG: could not decapsulate request: %v", err)
 		return nil, true
 	}
 
-	if m.Options.OneIANA() == nil {
+	ianas := m.Options.IANA()
+	if len(ianas) == 0 {
 		log.Debug("No address requested in the DHCPv6 message")
 		return resp, false
 	}
 
-	mac, err := dhcpv6.ExtractMAC(req)
+	client, err := predis.NewClient6(req)
 	if err != nil {
-		log.Warningf("Failed to extract MAC address: %v", err)
+		log.Warningf("Failed to identify the client: %v", err)
 		return resp, false
 	}
-	log.Debugf("Looking up IPv6 address for MAC %s", mac.String())
+	log.Debugf("Looking up IPv6 addresses for %s", client)
 
-	recLock.RLock()
-	details, err := queryFromDB(mac.String(), 6)
-	recLock.RUnlock()
+	reservations, err := p.queryFromDB6(client.Keys(p.keyOrder, ianas))
 	if err != nil {
-		log.Warningf("MAC %s error: %v", mac.String(), err)
+		log.Warningf("%s error: %v", client, err)
+		metrics.BackendErrors.WithLabelValues("postgres", "query").Inc()
 		return resp, true 
 	}
-    
-	optIAA := &dhcpv6.OptIAAddress{}
-	optIANA := &dhcpv6.OptIANA{}
+	matched := client.MatchIANA(p.keyOrder, ianas, func(key string) bool {
+		_, ok := reservations[key]
+		return ok
+	})
+
+	answered := false
+	for i, key := range matched {
+		if key == "" {
+			continue
+		}
+		details := reservations[key]
+		optIAA := &dhcpv6.OptIAAddress{}
+		optIANA := &dhcpv6.OptIANA{}
 
-	optIAA.IPv6Addr = details.IPv6
-	optIAA.PreferredLifetime = 3 * time.Hour
-	optIAA.ValidLifetime = 3 * time.Hour
+		optIAA.IPv6Addr = details.IPv6
+		optIAA.PreferredLifetime = 3 * time.Hour
+		optIAA.ValidLifetime = 3 * time.Hour
     
-	if details.T1 >= optIAA.ValidLifetime{
-		optIANA.T1 = optIAA.ValidLifetime / 2
-	} else if details.T1 != 0 {
-        optIANA.T1 = details.T1
-	}
+		if details.T1 >= optIAA.ValidLifetime{
+			optIANA.T1 = optIAA.ValidLifetime / 2
+		} else if details.T1 != 0 {
+			optIANA.T1 = details.T1
+		}
 
-	if details.T2 >= optIAA.ValidLifetime{
-		optIANA.T2 = optIAA.ValidLifetime * 4 / 5
-	} else if details.T2 != 0 {
-        optIANA.T2 = details.T2
-	}
+		if details.T2 >= optIAA.ValidLifetime{
+			optIANA.T2 = optIAA.ValidLifetime * 4 / 5
+		} else if details.T2 != 0 {
+			optIANA.T2 = details.T2
+		}
 
-    optIANA.IaId = m.Options.OneIANA().IaId
-	optIANA.Options = dhcpv6.IdentityOptions{Options: []dhcpv6.Option{optIAA}}
-	log.Printf("OK, Assigned IPv6 %s to MAC %s by pg", details.IPv6, mac.String())
-    resp.AddOption(optIANA)
-    
-	if updateredis {
-		err := redisUpdate(details, 6)
-		if err != nil {
-			fmt.Printf("update redis err:%v", err)
+		optIANA.IaId = ianas[i].IaId
+		optIANA.Options = dhcpv6.IdentityOptions{Options: []dhcpv6.Option{optIAA}}
+		log.Printf("OK, Assigned IPv6 %s to %s by pg", details.IPv6, key)
+		resp.AddOption(optIANA)
+		answered = true
+
+		if p.rpool != nil {
+			err := p.redisUpdate(details, 6)
+			if err != nil {
+				log.Printf("update redis err:%v", err)
+				metrics.BackendErrors.WithLabelValues("redis", "update").Inc()
+			}
 		}
 	}
+	if !answered {
+		log.Warningf("No IPv6 record found for %s", client)
+		return resp, true
+	}
 
 	return resp, false
 }
 
 // Handler4 handles DHCPv4 packets for the PostgreSQL plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	recLock.RLock()
-	details, err := queryFromDB(req.ClientHWAddr.String(), 4)
-	recLock.RUnlock()
+func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		// static leases are reservations and are never freed, only pool leases are
+		if p.poolName == "" {
+			return resp, false
+		}
+		var err error
+		if req.MessageType() == dhcpv4.MessageTypeRelease {
+			err = p.releaseToPool(req.ClientHWAddr.String(), req.ClientIPAddr)
+		} else {
+			err = p.declineInPool(req.ClientHWAddr.String(), req.RequestedIPAddress())
+		}
+		if err != nil {
+			log.Errorf("MAC %s %s error: %v", req.ClientHWAddr.String(), req.MessageType(), err)
+			metrics.BackendErrors.WithLabelValues("postgres", "pool").Inc()
+		}
+		return resp, false
+	}
+
+	details, err := p.queryFromDB(req.ClientHWAddr.String(), 4)
+	if errors.Is(err, errNoRecord) {
+		if req.MessageType() == dhcpv4.MessageTypeInform {
+			// the client configured its address by other means, let the
+			// other plugins answer with their options
+			return resp, false
+		}
+		if p.poolName != "" {
+			details, err = p.allocateFromPool(req.ClientHWAddr.String(), req.RequestedIPAddress())
+			if err != nil && !errors.Is(err, allocators.ErrNoAddrAvail) {
+				metrics.BackendErrors.WithLabelValues("postgres", "pool").Inc()
+			}
+		}
+	}
 	if err != nil {
 		log.Warningf("MAC %s error: %v", req.ClientHWAddr.String(), err)
 		return nil, true
@@ -134,13 +200,15 @@ func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	if details.LeaseTime != 0 {
 		resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(details.LeaseTime))
 	}
+	details.applyOptions(req, resp)
 	
 	log.Printf("Assigned IPv4 address %s with details to MAC %s by pg", details.IPv4, req.ClientHWAddr.String())
 	
-	if updateredis {
-       err := redisUpdate(details, 4)
+	if p.rpool != nil {
+       err := p.redisUpdate(details, 4)
 	   if err != nil {
 		  log.Printf("update redis err:%v", err)
+		  metrics.BackendErrors.WithLabelValues("redis", "update").Inc()
 	   }
 	}
 	return resp, true
@@ -164,6 +232,17 @@ func setup4(args ...string) (handler.Handler4, error) {
 	return h4, err
 }
 
+// setupDB parses the plugin arguments, in this order:
+// - the PostgreSQL connection url
+// - optionally, the redis server the served leases are copied to, as
+//   host:port or a URL as described by predis.ParseURL, or false to copy none
+// - optionally, the name of a coredhcp_pools row from which DHCPv4 clients
+//   without a row in coredhcp_records get an address
+// - optionally, the expiration of the leases copied to redis, such as 24h
+// - optionally, the order DHCPv6 reservations are looked up in, as described
+//   by predis.ParseKeyOrder. Defaults to predis.DefaultKeyOrder
+// - optionally, a schema file mapping the reservations to another table than
+//   coredhcp_records, as described in schema.go
 func setupDB(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
 	if len(args) < 1 {
 		return nil, nil, errors.New("postgreSQL connection url string required")
@@ -180,29 +259,50 @@ func setupDB(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error
 		log.Printf("Using pg %s for DHCPv4 static leases", args[0])
 	}
 
-
-	dbConfig = args[0]
-    
-	if len(args) > 1 && args[1] != ""{
-		if args[1] == "true" || args[1] == "1" || args[1] == "True" || args[1] == "TRUE" {
-			updateredis = true
+	p := PluginState{keyOrder: predis.DefaultKeyOrder, schema: defaultSchema()}
+	if len(args) > 1 {
+		if err := p.setupRedis(args[1]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(args) > 2 && args[2] != "" {
+		if v6 {
+			log.Warningf("Pool allocation is only supported for DHCPv4, ignoring pool %s", args[2])
 		} else {
-			updateredis = false
+			p.poolName = args[2]
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		ttl, err := time.ParseDuration(args[3])
+		if err != nil || ttl < 0 {
+			return nil, nil, fmt.Errorf("invalid redis TTL: %s", args[3])
+		}
+		if p.rpool == nil {
+			log.Warningf("Ignoring redis TTL %s, leases are not copied to redis", args[3])
+		}
+		p.redisTTL = int(ttl.Seconds())
+	}
+	if len(args) > 4 && args[4] != "" {
+		order, err := predis.ParseKeyOrder(args[4])
+		if err != nil {
+			return nil, nil, err
 		}
+		if !v6 {
+			log.Warningf("Key order %s is only used for DHCPv6, ignoring it", args[4])
+		}
+		p.keyOrder = order
 	}
-	if updateredis { // 目前pg 插件第二个参数控制redis的连接与更新
-		redisloc, redispassword := getRedisConfig()
-		rpool = &redis.Pool{
-			MaxIdle: 10,
-			IdleTimeout: 240 * time.Second,
-			Dial: func() (redis.Conn, error) {
-				return redis.Dial("tcp", redisloc, redis.DialPassword(redispassword))
-			},
+	custom := len(args) > 5 && args[5] != ""
+	if custom {
+		s, err := loadSchema(args[5])
+		if err != nil {
+			return nil, nil, err
 		}
+		p.schema = s
 	}
 
     // 连接pg
-	config, err := pgxpool.ParseConfig(dbConfig)
+	config, err := pgxpool.ParseConfig(args[0])
 
 	if err != nil {
 		log.Printf("Failed to open PostgreSQL config: %v", err)
@@ -213,79 +313,142 @@ func setupDB(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error
 	// config.MinConns = 2
 	config.MaxConnIdleTime = 240 * time.Second
     
-	pool, err = pgxpool.NewWithConfig(context.Background(), config)
+	p.pool, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		log.Printf("Failed to open PostgreSQL connection: %v", err)
 		return nil, nil, fmt.Errorf("%v", err)
 	}
+	plugins.OnClose(p.pool.Close)
 
 	log.Infof("Connected to PostgreSQL successfully")
 
-	return Handler6, Handler4, nil
+	if err := p.schema.readTypes(context.Background(), p.pool); err != nil {
+		if custom {
+			return nil, nil, fmt.Errorf("schema %s: %w", args[5], err)
+		}
+		// the default columns are text, which is what is assumed without
+		// their types
+		log.Warningf("Failed to read the columns of %s: %v", p.schema.Table, err)
+	} else if custom {
+		log.Printf("Reading reservations from table %s keyed by %s", p.schema.Table, p.schema.Key)
+	}
+
+	if p.rpool != nil {
+		p.startWarmUp()
+	}
+
+	if p.poolName != "" {
+		if err := p.setupPool(); err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Allocating unknown DHCPv4 clients from pool %s", p.poolName)
+	}
+
+	return p.Handler6, p.Handler4, nil
 }
 
-func queryFromDB(mac string, version int) (*IPDetails, error) {
-    conn, err := pool.Acquire(context.Background())
+// setupRedis connects to the redis server the served leases are copied to,
+// unless arg disables the copy
+func (p *PluginState) setupRedis(arg string) error {
+	switch strings.ToLower(arg) {
+	case "", "false", "0":
+		return nil
+	case "true", "1":
+		return errors.New("give the redis server the leases are copied to instead of true")
+	}
+	config, err := predis.ParseURL(arg)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid redis server: %w", err)
 	}
-	defer conn.Release()
+	log.Printf("Copying served leases to redis %s", config)
+	var closePools func()
+	p.rpool, _, closePools = config.Pools()
+	plugins.OnClose(closePools)
+	return nil
+}
 
-	log.Debugf("Querying details for MAC %s and IPv%d", mac, version)
-    
-	var answer = &IPDetails{}
-	if version == 6 {
-        var macAddr, ipv6, t1, t2 string 
+// queryFromDB6 returns the IPv6 reservations of the given keys, by key,
+// leaving out the keys without a valid one
+func (p *PluginState) queryFromDB6(keys []string) (map[string]*IPDetails, error) {
+	reservations := make(map[string]*IPDetails)
+	values := p.schema.columnKeys(keys)
+	if len(values) == 0 {
+		return reservations, nil
+	}
+	rows, err := p.pool.Query(context.Background(), p.schema.query(false, "ipv6", "t1", "t2"), values)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
 
-		query := `SELECT mac_address, ipv6, t1, t2 FROM coredhcp_records WHERE mac_address = $1`
-        
-		// row, err := conn.Query(context.Background(), query, "mac"+mac)
-		//  values, err := row.Values() // values可以用for range枚举
-		
-		err := conn.QueryRow(context.Background(), query, "mac:" + mac).Scan(&macAddr, &ipv6, &t1, &t2)
-		answer.mac_address = macAddr
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				log.Warningf("No IPv%v record found for MAC %s", version, mac)
-				return nil, fmt.Errorf("no record found for MAC %s", mac)
-			}
-			log.Errorf("Database query error for MAC %s: %v", mac, err)
-		    return nil, fmt.Errorf("query error: %w", err)
+	for rows.Next() {
+		var value, ipv6, t1, t2 string
+		if err := rows.Scan(&value, &ipv6, &t1, &t2); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
 		}
-
+		if ipv6 == "" {
+			// an IPv4 only reservation
+			continue
+		}
+		key := p.schema.rowKey(value)
+		answer := &IPDetails{mac_address: key}
 		answer.IPv6 = net.ParseIP(ipv6)
 		if answer.IPv6 == nil || answer.IPv6.To16() == nil {
-			log.Printf("MAC %s has invalid IPv6 address: %s", mac, ipv6)
-			return nil, fmt.Errorf("invalid IPv6 address")
+			log.Printf("%s has invalid IPv6 address: %s", key, ipv6)
+			continue
 		}
 
-		T1, err := time.ParseDuration(t1)
-		if err != nil {
-			log.Printf("MAC %s has invalid T1 time %s", mac, t1)
-		} else {
-			answer.T1 = T1
+		if t1 != "" {
+			T1, err := parseDuration(t1)
+			if err != nil {
+				log.Printf("%s has invalid T1 time %s", key, t1)
+			} else {
+				answer.T1 = T1
+			}
 		}
-
-		T2, err := time.ParseDuration(t2)
-		if err != nil {
-			log.Printf("MAC %s has invalid T2 time %s", mac, t2)
-		} else {
-			answer.T2 = T2
+		if t2 != "" {
+			T2, err := parseDuration(t2)
+			if err != nil {
+				log.Printf("%s has invalid T2 time %s", key, t2)
+			} else {
+				answer.T2 = T2
+			}
 		}
+		reservations[key] = answer
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	return reservations, nil
+}
+
+func (p *PluginState) queryFromDB(mac string, version int) (*IPDetails, error) {
+    conn, err := p.pool.Acquire(context.Background())
+	if err != nil {
+		metrics.BackendErrors.WithLabelValues("postgres", "query").Inc()
+		return nil, err
+	}
+	defer conn.Release()
 
-		return answer, nil 
-	} else if version == 4{
+	log.Debugf("Querying details for MAC %s and IPv%d", mac, version)
+    
+	var answer = &IPDetails{}
+	if version == 4{
 		var macAddr, ipv4, router, dns, leasetime string
+		var hostname, domain, ntp, nextServer, bootFile, options string
 
-		query := `SELECT mac_address, ipv4, router, dns, lease_time FROM coredhcp_records WHERE mac_address = $1`
-        err := conn.QueryRow(context.Background(), query, "mac:" + mac).Scan(&macAddr, &ipv4, &router, &dns, &leasetime)
-	    answer.mac_address = macAddr
+		query := p.schema.query(false, "ipv4", "router", "dns", "lease_time",
+			"hostname", "domain", "ntp", "next_server", "boot_file", "options")
+        err := conn.QueryRow(context.Background(), query, p.schema.columnKeys([]string{"mac:" + mac})).Scan(&macAddr, &ipv4, &router, &dns, &leasetime,
+			&hostname, &domain, &ntp, &nextServer, &bootFile, &options)
+	    answer.mac_address = p.schema.rowKey(macAddr)
 		if err != nil {
 			if errors.Is(err, pgx.ErrNoRows) {
-				log.Warningf("No IPv%v record found for MAC %s", version, mac)
-				return nil, fmt.Errorf("no record found for MAC %s", mac)
+				log.Debugf("No IPv%v record found for MAC %s", version, mac)
+				return nil, fmt.Errorf("%w for MAC %s", errNoRecord, mac)
 			}
 			log.Errorf("Database query error for MAC %s: %v", mac, err)
+			metrics.BackendErrors.WithLabelValues("postgres", "query").Inc()
 		    return nil, fmt.Errorf("query error: %w", err)
 		}
 
@@ -316,7 +479,7 @@ func queryFromDB(mac string, version int) (*IPDetails, error) {
 			answer.DNS = append(answer.DNS, DNSServer)
 		}
 
-		lt, err := time.ParseDuration(leasetime)
+		lt, err := parseDuration(leasetime)
 		if err != nil {
 			log.Printf("MAC %s has invalid lease time: %s", mac, leasetime)
 			answer.LeaseTime = 0
@@ -324,27 +487,58 @@ func queryFromDB(mac string, version int) (*IPDetails, error) {
 			answer.LeaseTime = lt
 		}
 
+		answer.Hostname = hostname
+		answer.Domain = domain
+		answer.BootFile = bootFile
+		if ntp != "" {
+			if answer.NTP, err = parseIPs(ntp); err != nil {
+				log.Printf("MAC %s has invalid NTP servers: %v", mac, err)
+			}
+		}
+		if nextServer != "" {
+			if answer.NextServer = net.ParseIP(nextServer).To4(); answer.NextServer == nil {
+				log.Printf("MAC %s has invalid next server: %s", mac, nextServer)
+			}
+		}
+		if options != "" {
+			if answer.Options, err = parseOptions(options); err != nil {
+				log.Printf("MAC %s has invalid options: %v", mac, err)
+			}
+		}
+
 		return answer, nil
 	}
     return nil, fmt.Errorf("invalid version")
 }
 
-func getRedisConfig()(string, string) {
-	var args = make([]string, 2)
-	configs := strings.Split(predis.ShareConfig, ",")
-	
-	for index, config := range configs {
-		if index == 0 {
-			args[index] = config
-		} else if index == 1 && config != "" {
-            args[index] = config
+// applyOptions sets the options of the columns mapped by the schema. The
+// options of the options column come last and override the others.
+func (d *IPDetails) applyOptions(req, resp *dhcpv4.DHCPv4) {
+	if d.Hostname != "" {
+		resp.Options.Update(dhcpv4.OptHostName(d.Hostname))
+	}
+	if d.Domain != "" {
+		resp.Options.Update(dhcpv4.OptDomainName(d.Domain))
+	}
+	if len(d.NTP) > 0 {
+		resp.Options.Update(dhcpv4.OptNTPServers(d.NTP...))
+	}
+	if d.NextServer != nil {
+		resp.ServerIPAddr = d.NextServer
+	}
+	if d.BootFile != "" {
+		resp.BootFileName = d.BootFile
+		if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
+			resp.Options.Update(dhcpv4.OptBootFileName(d.BootFile))
 		}
 	}
-	return args[0], args[1]
+	for _, opt := range d.Options {
+		resp.Options.Update(opt)
+	}
 }
 
-func redisUpdate(d *IPDetails, v int)(error){
-	conn := rpool.Get()
+func (p *PluginState) redisUpdate(d *IPDetails, v int)(error){
+	conn := p.rpool.Get()
 	defer conn.Close()
     
 	if v == 6 {
@@ -381,8 +575,8 @@ func redisUpdate(d *IPDetails, v int)(error){
 		log.Printf("update redis succeed v4")
 	}
     
-	if predis.TTLflag && predis.TTL > 0 {
-		_, err := conn.Do("EXPIRE", d.mac_address, predis.TTL)
+	if p.redisTTL > 0 {
+		_, err := conn.Do("EXPIRE", d.mac_address, p.redisTTL)
 		if err != nil {
 			log.Printf("Set redis ttl error:%v", err)
 		}
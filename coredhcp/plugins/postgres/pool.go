@@ -0,0 +1,307 @@
+package postgres
+
+// Dynamic allocation from address pools stored in PostgreSQL.
+//
+// A pool is a row of coredhcp_pools, and every address handed out of it is a
+// row of coredhcp_leases. Allocation runs in a single transaction which locks
+// the pool row first, so several coredhcp instances sharing one database
+// serialize on it and never lease the same address twice. The unique
+// constraint on (pool, ipv4) backs this up at the schema level.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	createPoolsTable = `
+		CREATE TABLE IF NOT EXISTS coredhcp_pools (
+			name VARCHAR(100) PRIMARY KEY,
+			start_ip VARCHAR(100) NOT NULL,
+			end_ip VARCHAR(100) NOT NULL,
+			netmask VARCHAR(100) NOT NULL,
+			router VARCHAR(100),
+			dns VARCHAR(255),
+			lease_time VARCHAR(100)
+		);`
+	createLeasesTable = `
+		CREATE TABLE IF NOT EXISTS coredhcp_leases (
+			pool VARCHAR(100) NOT NULL REFERENCES coredhcp_pools (name) ON DELETE CASCADE,
+			mac_address VARCHAR(100) NOT NULL,
+			ipv4 VARCHAR(100) NOT NULL,
+			expires TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (pool, mac_address),
+			UNIQUE (pool, ipv4)
+		);`
+
+	// defaultPoolLeaseTime is used when a pool row has no valid lease_time
+	defaultPoolLeaseTime = 12 * time.Hour
+	// declineHoldTime is how long an address declined by a client stays out
+	// of the pool, as it is likely in use by a host we don't know about
+	declineHoldTime = 24 * time.Hour
+)
+
+// errNoRecord is returned by queryFromDB when the client has no static row
+var errNoRecord = errors.New("no record found")
+
+// ipPool is the parsed form of a coredhcp_pools row
+type ipPool struct {
+	start     net.IP
+	end       net.IP
+	mask      net.IPMask
+	router    net.IP
+	dns       []net.IP
+	leaseTime time.Duration
+}
+
+// parsePool validates the columns of a coredhcp_pools row
+func parsePool(start, end, netmask, router, dns, leasetime string) (*ipPool, error) {
+	p := &ipPool{}
+	p.start = net.ParseIP(start).To4()
+	if p.start == nil {
+		return nil, fmt.Errorf("invalid pool start address: %s", start)
+	}
+	p.end = net.ParseIP(end).To4()
+	if p.end == nil {
+		return nil, fmt.Errorf("invalid pool end address: %s", end)
+	}
+	if ipToUint(p.start) > ipToUint(p.end) {
+		return nil, fmt.Errorf("pool start %s is after pool end %s", start, end)
+	}
+	mask := net.ParseIP(netmask).To4()
+	if mask == nil {
+		return nil, fmt.Errorf("invalid pool netmask: %s", netmask)
+	}
+	p.mask = net.IPMask(mask)
+	if _, bits := p.mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("non-canonical pool netmask: %s", netmask)
+	}
+
+	if router != "" {
+		if R := net.ParseIP(router).To4(); R != nil {
+			p.router = R
+		} else {
+			log.Printf("Pool has invalid router option: %s", router)
+		}
+	}
+	if dns != "" {
+		for _, server := range strings.Split(dns, ",") {
+			DNSServer := net.ParseIP(strings.TrimSpace(server))
+			if DNSServer.To4() == nil {
+				log.Printf("Pool has invalid dns server: %s", server)
+				break
+			}
+			p.dns = append(p.dns, DNSServer)
+		}
+	}
+
+	p.leaseTime = defaultPoolLeaseTime
+	if leasetime != "" {
+		lt, err := time.ParseDuration(leasetime)
+		if err != nil || lt <= 0 {
+			log.Printf("Pool has invalid lease time %s, using %s", leasetime, defaultPoolLeaseTime)
+		} else {
+			p.leaseTime = lt
+		}
+	}
+	return p, nil
+}
+
+func ipToUint(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+// contains returns true if ip is within the range of the pool
+func (p *ipPool) contains(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	v := ipToUint(ip)
+	return v >= ipToUint(p.start) && v <= ipToUint(p.end)
+}
+
+// pick chooses a free address of the pool, given the addresses currently
+// leased out. The hint is honoured if it is in the pool and still free.
+func (p *ipPool) pick(taken []net.IP, hint net.IP) (net.IP, error) {
+	alloc, err := bitmap.NewIPv4Allocator(p.start, p.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range taken {
+		// the pool may have shrunk since these were leased
+		if !p.contains(ip) {
+			continue
+		}
+		if _, err := alloc.Allocate(net.IPNet{IP: ip}); err != nil {
+			return nil, err
+		}
+	}
+	if !p.contains(hint) {
+		hint = nil
+	}
+	ipnet, err := alloc.Allocate(net.IPNet{IP: hint})
+	if err != nil {
+		return nil, err
+	}
+	return ipnet.IP.To4(), nil
+}
+
+// details builds the IPDetails answered to a client leasing ip from the pool
+func (p *ipPool) details(mac string, ip net.IP) *IPDetails {
+	ones, _ := p.mask.Size()
+	return &IPDetails{
+		mac_address: "mac:" + mac,
+		Cidr:        fmt.Sprintf("%s/%d", ip, ones),
+		IPv4:        ip,
+		IPnet:       &net.IPNet{IP: ip.Mask(p.mask), Mask: p.mask},
+		Router:      p.router,
+		DNS:         p.dns,
+		LeaseTime:   p.leaseTime,
+	}
+}
+
+// setupPool creates the pool and lease tables if they don't exist yet
+func (p *PluginState) setupPool() error {
+	ctx := context.Background()
+	if _, err := p.pool.Exec(ctx, createPoolsTable); err != nil {
+		return fmt.Errorf("failed to create pools table: %w", err)
+	}
+	if _, err := p.pool.Exec(ctx, createLeasesTable); err != nil {
+		return fmt.Errorf("failed to create leases table: %w", err)
+	}
+	var exists bool
+	err := p.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM coredhcp_pools WHERE name = $1)`, p.poolName).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	if !exists {
+		log.Warningf("Pool %s is not defined in coredhcp_pools yet, unknown clients will be dropped until it is", p.poolName)
+	}
+	return nil
+}
+
+// allocateFromPool leases an address of the configured pool to a client,
+// renewing the lease it already holds if any.
+func (p *PluginState) allocateFromPool(mac string, hint net.IP) (*IPDetails, error) {
+	ctx := context.Background()
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Rollback is a no-op once the transaction is committed
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Lock the pool row so that concurrent allocations, from this instance or
+	// any other sharing the database, are serialized
+	var start, end, netmask, router, dns, leasetime string
+	err = tx.QueryRow(ctx, `SELECT start_ip, end_ip, netmask, COALESCE(router, ''), COALESCE(dns, ''), COALESCE(lease_time, '')
+		FROM coredhcp_pools WHERE name = $1 FOR UPDATE`, p.poolName).Scan(&start, &end, &netmask, &router, &dns, &leasetime)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("pool %s not found", p.poolName)
+		}
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	ipp, err := parsePool(start, end, netmask, router, dns, leasetime)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", p.poolName, err)
+	}
+
+	key := "mac:" + mac
+	var ip net.IP
+	var current string
+	err = tx.QueryRow(ctx, `SELECT ipv4 FROM coredhcp_leases WHERE pool = $1 AND mac_address = $2`, p.poolName, key).Scan(&current)
+	if err == nil {
+		if ip = net.ParseIP(current).To4(); !ipp.contains(ip) {
+			log.Printf("MAC %s holds %s which is not in pool %s anymore, leasing a new address", mac, current, p.poolName)
+			ip = nil
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+
+	if ip == nil {
+		rows, err := tx.Query(ctx, `SELECT ipv4 FROM coredhcp_leases WHERE pool = $1 AND mac_address <> $2 AND expires > now()`, p.poolName, key)
+		if err != nil {
+			return nil, fmt.Errorf("query error: %w", err)
+		}
+		var taken []net.IP
+		for rows.Next() {
+			var leased string
+			if err := rows.Scan(&leased); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan row: %w", err)
+			}
+			taken = append(taken, net.ParseIP(leased))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed lease row scanning: %w", err)
+		}
+
+		ip, err = ipp.pick(taken, hint)
+		if err != nil {
+			return nil, fmt.Errorf("could not allocate from pool %s: %w", p.poolName, err)
+		}
+		// An expired lease of another client may still hold the address
+		if _, err := tx.Exec(ctx, `DELETE FROM coredhcp_leases WHERE pool = $1 AND ipv4 = $2 AND mac_address <> $3`,
+			p.poolName, ip.String(), key); err != nil {
+			return nil, fmt.Errorf("failed to reclaim expired lease: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO coredhcp_leases (pool, mac_address, ipv4, expires) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (pool, mac_address) DO UPDATE SET ipv4 = EXCLUDED.ipv4, expires = EXCLUDED.expires`,
+		p.poolName, key, ip.String(), time.Now().Add(ipp.leaseTime))
+	if err != nil {
+		return nil, fmt.Errorf("record insert/update failed: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit failed: %w", err)
+	}
+
+	return ipp.details(mac, ip), nil
+}
+
+// releaseToPool deletes the lease a client holds on ip, so that the address
+// can be allocated again.
+func (p *PluginState) releaseToPool(mac string, ip net.IP) error {
+	tag, err := p.pool.Exec(context.Background(), `DELETE FROM coredhcp_leases WHERE pool = $1 AND mac_address = $2 AND ipv4 = $3`,
+		p.poolName, "mac:"+mac, ip.String())
+	if err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		log.Printf("MAC %s released %s which it does not hold in pool %s, ignoring", mac, ip, p.poolName)
+		return nil
+	}
+	log.Printf("MAC %s released IPv4 address %s to pool %s", mac, ip, p.poolName)
+	return nil
+}
+
+// declineInPool quarantines an address a client found already in use (RFC
+// 2131 4.3.3). The lease row is handed over to a placeholder client and kept
+// for declineHoldTime, so that no instance allocates the address meanwhile,
+// while the client gets a new address when it restarts configuration.
+func (p *PluginState) declineInPool(mac string, ip net.IP) error {
+	tag, err := p.pool.Exec(context.Background(), `UPDATE coredhcp_leases SET mac_address = $4, expires = $5
+		WHERE pool = $1 AND mac_address = $2 AND ipv4 = $3`,
+		p.poolName, "mac:"+mac, ip.String(), "declined:"+ip.String(), time.Now().Add(declineHoldTime))
+	if err != nil {
+		return fmt.Errorf("record update failed: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		log.Printf("MAC %s declined %s which it was not leased from pool %s, ignoring", mac, ip, p.poolName)
+		return nil
+	}
+	log.Warningf("MAC %s declined IPv4 address %s, quarantining it for %s", mac, ip, declineHoldTime)
+	return nil
+}
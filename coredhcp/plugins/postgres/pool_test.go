@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePool(t *testing.T) {
+	p, err := parsePool("10.0.0.10", "10.0.0.20", "255.255.255.0", "10.0.0.1", "1.1.1.1,8.8.8.8", "2h")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 10).To4(), p.start)
+	assert.Equal(t, net.IPv4(10, 0, 0, 20).To4(), p.end)
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), p.router)
+	assert.Len(t, p.dns, 2)
+	assert.Equal(t, 2*time.Hour, p.leaseTime)
+
+	p, err = parsePool("10.0.0.10", "10.0.0.20", "255.255.255.0", "", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, p.router)
+	assert.Equal(t, defaultPoolLeaseTime, p.leaseTime)
+
+	_, err = parsePool("10.0.0.20", "10.0.0.10", "255.255.255.0", "", "", "")
+	assert.Error(t, err, "reversed range")
+	_, err = parsePool("10.0.0.10", "10.0.0.20", "255.0.255.0", "", "", "")
+	assert.Error(t, err, "non-canonical netmask")
+	_, err = parsePool("2001:db8::1", "10.0.0.20", "255.255.255.0", "", "", "")
+	assert.Error(t, err, "IPv6 start")
+}
+
+func TestPoolPick(t *testing.T) {
+	p, err := parsePool("10.0.0.10", "10.0.0.12", "255.255.255.0", "", "", "")
+	require.NoError(t, err)
+
+	taken := []net.IP{net.IPv4(10, 0, 0, 10), net.IPv4(192, 168, 0, 1)}
+	ip, err := p.pick(taken, nil)
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 11).To4(), ip)
+
+	ip, err = p.pick(taken, net.IPv4(10, 0, 0, 12))
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 12).To4(), ip, "free hint should be honoured")
+
+	ip, err = p.pick(taken, net.IPv4(10, 0, 0, 10))
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 11).To4(), ip, "taken hint should be ignored")
+
+	ip, err = p.pick(taken, net.IPv4(10, 0, 1, 10))
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 0, 0, 11).To4(), ip, "hint outside the pool should be ignored")
+
+	taken = append(taken, net.IPv4(10, 0, 0, 11), net.IPv4(10, 0, 0, 12))
+	_, err = p.pick(taken, nil)
+	assert.Error(t, err, "pool is exhausted")
+}
+
+func TestPoolDetails(t *testing.T) {
+	p, err := parsePool("10.0.0.10", "10.0.0.20", "255.255.255.0", "10.0.0.1", "", "1h")
+	require.NoError(t, err)
+
+	d := p.details("02:00:00:00:00:01", net.IPv4(10, 0, 0, 15).To4())
+	assert.Equal(t, "mac:02:00:00:00:00:01", d.mac_address)
+	assert.Equal(t, "10.0.0.15/24", d.Cidr)
+	assert.Equal(t, "10.0.0.0/24", d.IPnet.String())
+	assert.Equal(t, time.Hour, d.LeaseTime)
+}
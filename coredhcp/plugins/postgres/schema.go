@@ -0,0 +1,335 @@
+package postgres
+
+// Mapping of the reservations to the table holding them.
+//
+// By default reservations are the rows of coredhcp_records, keyed by the
+// mac_address column. A schema file points the plugin at another table, such
+// as the hosts table of an IPAM, by naming its columns:
+//
+//	table: ipam.hosts
+//	key: hw_address
+//	key_format: mac
+//	columns:
+//	  ipv4: address
+//	  router: gateway
+//	  dns: dns_servers
+//	  lease_time: lease
+//	  hostname: name
+//	  options: dhcp_options
+//
+// key_format is prefixed when the key column holds the keys of the redis
+// plugin, such as mac:<MAC> or duid:<DUID>, and mac when it holds bare MAC
+// addresses, in which case DHCPv6 reservations can only be found by MAC.
+//
+// Columns can be text or of the native PostgreSQL types: inet and cidr for
+// addresses, arrays of them for lists, macaddr for the key, interval or a
+// number of seconds for times. The options column is a JSON object of DHCPv4
+// options by code, whose values are a string, sent as is, an array of IP
+// addresses, or an object {"hex": "..."} giving the raw bytes.
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// keyPrefixed is the key format of keys like mac:<MAC> and duid:<DUID>
+	keyPrefixed = "prefixed"
+	// keyMAC is the key format of bare MAC addresses
+	keyMAC = "mac"
+)
+
+// fields are the fields of a reservation which can be mapped to columns
+var fields = []string{
+	"ipv4", "ipv6", "router", "dns", "lease_time", "t1", "t2",
+	"hostname", "domain", "ntp", "next_server", "boot_file", "options",
+}
+
+// schema maps the reservations to the table holding them
+type schema struct {
+	Table     string `yaml:"table"`
+	Key       string `yaml:"key"`
+	KeyFormat string `yaml:"key_format"`
+	// Columns holds the column of each field, unmapped fields are empty
+	Columns map[string]string `yaml:"columns"`
+
+	// types holds the data types of the columns, by column
+	types map[string]columnType
+}
+
+type columnType struct {
+	dataType string // such as "inet" or "ARRAY"
+	udtName  string // such as "inet" or "_inet" for an array of inet
+}
+
+// defaultSchema is the coredhcp_records table
+func defaultSchema() *schema {
+	return &schema{
+		Table:     "coredhcp_records",
+		Key:       "mac_address",
+		KeyFormat: keyPrefixed,
+		Columns: map[string]string{
+			"ipv4":       "ipv4",
+			"ipv6":       "ipv6",
+			"router":     "router",
+			"dns":        "dns",
+			"lease_time": "lease_time",
+			"t1":         "t1",
+			"t2":         "t2",
+		},
+	}
+}
+
+// loadSchema reads a schema file
+func loadSchema(filename string) (*schema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &schema{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid schema file %s: %w", filename, err)
+	}
+	if s.Table == "" || s.Key == "" {
+		return nil, fmt.Errorf("schema file %s: table and key are required", filename)
+	}
+	if s.KeyFormat == "" {
+		s.KeyFormat = keyPrefixed
+	}
+	if s.KeyFormat != keyPrefixed && s.KeyFormat != keyMAC {
+		return nil, fmt.Errorf("schema file %s: invalid key_format %q, want %s or %s", filename, s.KeyFormat, keyPrefixed, keyMAC)
+	}
+	for field := range s.Columns {
+		if !isField(field) {
+			return nil, fmt.Errorf("schema file %s: unknown field %q, want one of %s", filename, field, strings.Join(fields, ", "))
+		}
+	}
+	return s, nil
+}
+
+func isField(field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// readTypes reads the types of the columns of the schema from the database,
+// and checks that they all exist
+func (s *schema) readTypes(ctx context.Context, db interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+}) error {
+	tableSchema, table, qualified := strings.Cut(s.Table, ".")
+	if !qualified {
+		tableSchema, table = "", s.Table
+	}
+	rows, err := db.Query(ctx, `SELECT column_name, data_type, udt_name FROM information_schema.columns
+		WHERE table_name = $1 AND table_schema = COALESCE(NULLIF($2, ''), current_schema())`, table, tableSchema)
+	if err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+	s.types = make(map[string]columnType)
+	for rows.Next() {
+		var name string
+		var t columnType
+		if err := rows.Scan(&name, &t.dataType, &t.udtName); err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+		s.types[name] = t
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	if len(s.types) == 0 {
+		return fmt.Errorf("table %s not found", s.Table)
+	}
+
+	columns := []string{s.Key}
+	for _, column := range s.Columns {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	for _, column := range columns {
+		if _, ok := s.types[column]; !ok {
+			return fmt.Errorf("column %s not found in table %s", column, s.Table)
+		}
+	}
+	return nil
+}
+
+// table returns the quoted name of the table
+func (s *schema) table() string {
+	return pgx.Identifier(strings.Split(s.Table, ".")).Sanitize()
+}
+
+// expr returns the expression selecting a field as text, empty if it is not
+// mapped or NULL. Addresses are selected without their prefix length, but
+// for the IPv4 address which needs it, and times in seconds.
+func (s *schema) expr(field string) string {
+	column, ok := s.Columns[field]
+	if !ok || column == "" {
+		return "''"
+	}
+	c := pgx.Identifier{column}.Sanitize()
+	t := s.types[column]
+	var e string
+	switch {
+	case t.dataType == "inet" || t.dataType == "cidr":
+		if field == "ipv4" {
+			e = fmt.Sprintf("host(%[1]s) || '/' || masklen(%[1]s)", c)
+		} else {
+			e = fmt.Sprintf("host(%s)", c)
+		}
+	case t.udtName == "_inet" || t.udtName == "_cidr":
+		e = fmt.Sprintf("array_to_string(ARRAY(SELECT host(a) FROM unnest(%s) a), ',')", c)
+	case t.dataType == "ARRAY":
+		e = fmt.Sprintf("array_to_string(%s, ',')", c)
+	case t.dataType == "interval":
+		e = fmt.Sprintf("EXTRACT(EPOCH FROM %s)::bigint::text", c)
+	default:
+		e = c + "::text"
+	}
+	return fmt.Sprintf("COALESCE(%s, '')", e)
+}
+
+// query returns the query selecting the key and the given fields of the
+// reservations, of all of them if all is true, else of the keys given as
+// first argument
+func (s *schema) query(all bool, fields ...string) string {
+	exprs := make([]string, 0, len(fields)+1)
+	key := pgx.Identifier{s.Key}.Sanitize()
+	exprs = append(exprs, key+"::text")
+	for _, field := range fields {
+		exprs = append(exprs, s.expr(field))
+	}
+	query := "SELECT " + strings.Join(exprs, ", ") + " FROM " + s.table()
+	if all {
+		return query
+	}
+	keys := "$1::text[]"
+	switch t := s.types[s.Key]; t.udtName {
+	case "", "text", "varchar", "bpchar":
+	default:
+		keys += "::" + t.udtName + "[]"
+	}
+	return query + " WHERE " + key + " = ANY(" + keys + ")"
+}
+
+// columnKeys returns the values of the key column for keys like mac:<MAC>,
+// leaving out the keys which can't be stored in the column
+func (s *schema) columnKeys(keys []string) []string {
+	if s.KeyFormat == keyPrefixed {
+		return keys
+	}
+	var values []string
+	for _, key := range keys {
+		if mac, ok := strings.CutPrefix(key, "mac:"); ok {
+			values = append(values, mac)
+		}
+	}
+	return values
+}
+
+// rowKey returns the key like mac:<MAC> of a value of the key column
+func (s *schema) rowKey(value string) string {
+	if s.KeyFormat == keyPrefixed {
+		return value
+	}
+	if mac, err := net.ParseMAC(value); err == nil {
+		return "mac:" + mac.String()
+	}
+	return "mac:" + strings.ToLower(value)
+}
+
+// parseDuration parses a time given in seconds or as a Go duration such as
+// 12h
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseIPs parses a comma separated list of IPv4 addresses
+func parseIPs(s string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(addr)).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseOptions parses the JSON object of the options column
+func parseOptions(s string) ([]dhcpv4.Option, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &values); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, len(values))
+	for code := range values {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	options := make([]dhcpv4.Option, 0, len(values))
+	for _, code := range codes {
+		n, err := strconv.ParseUint(code, 10, 8)
+		if err != nil || n == 0 || n == 255 {
+			return nil, fmt.Errorf("invalid option code %q", code)
+		}
+		data, err := optionData(values[code])
+		if err != nil {
+			return nil, fmt.Errorf("option %s: %w", code, err)
+		}
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(n), data))
+	}
+	return options, nil
+}
+
+// optionData returns the bytes of an option value of the options column
+func optionData(value json.RawMessage) ([]byte, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return []byte(text), nil
+	}
+	var addrs []string
+	if err := json.Unmarshal(value, &addrs); err == nil {
+		ips, err := parseIPs(strings.Join(addrs, ","))
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		for _, ip := range ips {
+			data = append(data, ip...)
+		}
+		return data, nil
+	}
+	var raw struct {
+		Hex *string `json:"hex"`
+	}
+	if err := json.Unmarshal(value, &raw); err == nil && raw.Hex != nil {
+		return hex.DecodeString(*raw.Hex)
+	}
+	return nil, errors.New("want a string, an array of IP addresses or {\"hex\": ...}")
+}
@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSchema(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "schema.yml")
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0o644))
+		return filename
+	}
+
+	s, err := loadSchema(write("table: ipam.hosts\nkey: hw_address\nkey_format: mac\ncolumns:\n  ipv4: address\n  hostname: name\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "ipam.hosts", s.Table)
+	assert.Equal(t, keyMAC, s.KeyFormat)
+	assert.Equal(t, map[string]string{"ipv4": "address", "hostname": "name"}, s.Columns)
+
+	s, err = loadSchema(write("table: hosts\nkey: id\n"))
+	require.NoError(t, err)
+	assert.Equal(t, keyPrefixed, s.KeyFormat)
+
+	_, err = loadSchema(write("key: id\n"))
+	assert.Error(t, err, "the table is required")
+	_, err = loadSchema(write("table: hosts\nkey: id\nkey_format: duid\n"))
+	assert.Error(t, err, "invalid key format")
+	_, err = loadSchema(write("table: hosts\nkey: id\ncolumns:\n  gateway: gw\n"))
+	assert.Error(t, err, "unknown field")
+}
+
+func TestSchemaQuery(t *testing.T) {
+	s := defaultSchema()
+	assert.Equal(t, `SELECT "mac_address"::text, COALESCE("ipv6"::text, ''), COALESCE("t1"::text, ''), COALESCE("t2"::text, '') `+
+		`FROM "coredhcp_records" WHERE "mac_address" = ANY($1::text[])`,
+		s.query(false, "ipv6", "t1", "t2"))
+
+	s = &schema{
+		Table: "ipam.hosts",
+		Key:   "hw_address",
+		Columns: map[string]string{
+			"ipv4":        "address",
+			"dns":         "dns_servers",
+			"lease_time":  "lease",
+			"next_server": "tftp",
+		},
+		types: map[string]columnType{
+			"hw_address":  {"macaddr", "macaddr"},
+			"address":     {"inet", "inet"},
+			"dns_servers": {"ARRAY", "_inet"},
+			"lease":       {"interval", "interval"},
+			"tftp":        {"inet", "inet"},
+		},
+	}
+	assert.Equal(t, `SELECT "hw_address"::text, COALESCE(host("address") || '/' || masklen("address"), ''), `+
+		`COALESCE(array_to_string(ARRAY(SELECT host(a) FROM unnest("dns_servers") a), ','), ''), `+
+		`COALESCE(EXTRACT(EPOCH FROM "lease")::bigint::text, ''), COALESCE(host("tftp"), ''), '' `+
+		`FROM "ipam"."hosts" WHERE "hw_address" = ANY($1::text[]::macaddr[])`,
+		s.query(false, "ipv4", "dns", "lease_time", "next_server", "hostname"))
+	assert.Equal(t, `SELECT "hw_address"::text, COALESCE(host("tftp"), '') FROM "ipam"."hosts"`,
+		s.query(true, "next_server"))
+}
+
+func TestSchemaKeys(t *testing.T) {
+	s := defaultSchema()
+	keys := []string{"duid:0001/00000001", "mac:3c:07:54:5c:90:65"}
+	assert.Equal(t, keys, s.columnKeys(keys))
+	assert.Equal(t, "mac:3c:07:54:5c:90:65", s.rowKey("mac:3c:07:54:5c:90:65"))
+
+	s.KeyFormat = keyMAC
+	assert.Equal(t, []string{"3c:07:54:5c:90:65"}, s.columnKeys(keys))
+	assert.Equal(t, "mac:3c:07:54:5c:90:65", s.rowKey("3C-07-54-5C-90-65"))
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("43200")
+	require.NoError(t, err)
+	assert.Equal(t, 12*time.Hour, d)
+	d, err = parseDuration("90m")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, d)
+	_, err = parseDuration("soon")
+	assert.Error(t, err)
+}
+
+func TestParseOptions(t *testing.T) {
+	options, err := parseOptions(`{"66": "tftp.example.com", "42": ["192.168.1.1", "192.168.1.2"], "43": {"hex": "0104c0a80101"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, []dhcpv4.Option{
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(42), []byte{192, 168, 1, 1, 192, 168, 1, 2}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(43), []byte{1, 4, 192, 168, 1, 1}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(66), []byte("tftp.example.com")),
+	}, options)
+
+	_, err = parseOptions(`{"256": "x"}`)
+	assert.Error(t, err, "invalid code")
+	_, err = parseOptions(`{"42": ["fe80::1"]}`)
+	assert.Error(t, err, "not an IPv4 address")
+	_, err = parseOptions(`{"43": 12}`)
+	assert.Error(t, err, "invalid value")
+}
+
+func TestApplyOptions(t *testing.T) {
+	req, err := dhcpv4.New(dhcpv4.WithRequestedOptions(dhcpv4.OptionBootfileName))
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+
+	d := &IPDetails{
+		Hostname:   "printer",
+		NTP:        []net.IP{net.IPv4(192, 168, 1, 1).To4()},
+		NextServer: net.IPv4(192, 168, 1, 2).To4(),
+		BootFile:   "pxelinux.0",
+		Options:    []dhcpv4.Option{dhcpv4.OptHostName("scanner")},
+	}
+	d.applyOptions(req, resp)
+	assert.Equal(t, "scanner", resp.HostName(), "the options column overrides the other columns")
+	assert.Equal(t, d.NTP, resp.NTPServers())
+	assert.Equal(t, d.NextServer, resp.ServerIPAddr)
+	assert.Equal(t, "pxelinux.0", resp.BootFileName)
+	assert.Equal(t, "pxelinux.0", resp.BootFileNameOption())
+}
@@ -0,0 +1,159 @@
+package postgres
+
+// Bulk copy of the static leases to redis.
+//
+// When redis is updated, every reservation is copied to it when
+// the plugin is set up, before any request is served, so that a flushed
+// redis knows all the static leases and not only those served since. The
+// copy runs again whenever the process receives SIGUSR1, for every instance
+// of the plugin copying leases to redis.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/coredhcp/coredhcp/metrics"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/gomodule/redigo/redis"
+)
+
+// warmUpBatch is the number of commands sent to redis before reading their
+// replies
+const warmUpBatch = 1000
+
+// recordFields maps the fields of the schema to the fields of the hashes read
+// by the redis plugin
+var recordFields = []struct{ column, field string }{
+	{"ipv4", "ipv4"},
+	{"router", "router"},
+	{"dns", "dns"},
+	{"lease_time", "leaseTime"},
+	{"ipv6", "ipv6"},
+	{"t1", "t1"},
+	{"t2", "t2"},
+}
+
+// startWarmUp copies the static leases to redis, and again on SIGUSR1 until
+// the plugin is torn down
+func (p *PluginState) startWarmUp() {
+	p.warmUp()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			p.warmUp()
+		}
+	}()
+	plugins.OnClose(func() {
+		signal.Stop(sig)
+		close(sig)
+	})
+}
+
+func (p *PluginState) warmUp() {
+	start := time.Now()
+	n, err := p.warmUpRedis(context.Background())
+	if err != nil {
+		log.Errorf("Failed to copy static leases to redis: %v", err)
+		metrics.BackendErrors.WithLabelValues("redis", "warmup").Inc()
+		return
+	}
+	log.Infof("Copied %d static leases to redis in %v", n, time.Since(start))
+}
+
+// warmUpRedis copies every reservation to redis with pipelined writes, and
+// returns the number of rows copied. Empty columns are not written, and the
+// leases expire as the served ones do.
+func (p *PluginState) warmUpRedis(ctx context.Context) (int, error) {
+	columns := make([]string, 0, len(recordFields))
+	for _, f := range recordFields {
+		columns = append(columns, f.column)
+	}
+	rows, err := p.pool.Query(ctx, p.schema.query(true, columns...))
+	if err != nil {
+		return 0, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	conn := p.rpool.Get()
+	defer conn.Close()
+
+	pending := 0
+	flush := func() error {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for ; pending > 0; pending-- {
+			if _, err := conn.Receive(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	values := make([]string, len(columns)+1)
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, fmt.Errorf("scan error: %w", err)
+		}
+		key := p.schema.rowKey(values[0])
+		args := hashArgs(key, values[1:])
+		if args == nil {
+			continue
+		}
+		if err := conn.Send("HSET", args...); err != nil {
+			return n, err
+		}
+		pending++
+		if p.redisTTL > 0 {
+			if err := conn.Send("EXPIRE", key, p.redisTTL); err != nil {
+				return n, err
+			}
+			pending++
+		}
+		n++
+		if pending >= warmUpBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("query error: %w", err)
+	}
+	return n, flush()
+}
+
+// hashArgs returns the arguments of the HSET of a row, given the values of
+// its recordFields, or nil if they are all empty. Times in seconds are
+// written as durations, which the redis plugin reads.
+func hashArgs(key string, values []string) redis.Args {
+	args := redis.Args{key}
+	for i, f := range recordFields {
+		if values[i] == "" {
+			continue
+		}
+		value := values[i]
+		switch f.column {
+		case "lease_time", "t1", "t2":
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				value = (time.Duration(seconds) * time.Second).String()
+			}
+		}
+		args = append(args, f.field, value)
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	return args
+}
@@ -0,0 +1,34 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashArgs(t *testing.T) {
+	// ipv4, router, dns, lease_time, ipv6, t1, t2
+	args := hashArgs("mac:3c:07:54:5c:90:65", []string{"192.168.1.101/24", "192.168.1.1", "", "12h", "", "", ""})
+	assert.Equal(t, redis.Args{"mac:3c:07:54:5c:90:65",
+		"ipv4", "192.168.1.101/24", "router", "192.168.1.1", "leaseTime", "12h"}, args)
+
+	args = hashArgs("mac:68:a8:6d:57:6c:e7", []string{"", "", "", "", "2001:2::4", "12h", "24h"})
+	assert.Equal(t, redis.Args{"mac:68:a8:6d:57:6c:e7", "ipv6", "2001:2::4", "t1", "12h", "t2", "24h"}, args)
+
+	assert.Nil(t, hashArgs("mac:00:00:00:00:00:01", make([]string, len(recordFields))))
+}
+
+func TestSetupRedis(t *testing.T) {
+	var p PluginState
+	assert.NoError(t, p.setupRedis("false"))
+	assert.Nil(t, p.rpool)
+	assert.Error(t, p.setupRedis("true"), "the redis server must be explicit")
+
+	// instances don't share their redis servers
+	var q PluginState
+	assert.NoError(t, p.setupRedis("redis://localhost:6379/0"))
+	assert.NoError(t, q.setupRedis("redis://localhost:6380/1"))
+	assert.NotNil(t, p.rpool)
+	assert.NotSame(t, p.rpool, q.rpool)
+}
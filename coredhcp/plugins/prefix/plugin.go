@@ -9,6 +9,9 @@
 // - prefix: The base prefix from which assigned prefixes are carved
 // - max: maximum size of the prefix delegated to clients. When a client requests a larger prefix
 // than this, this is the size of the offered prefix
+// - lease storage: optional, where leases are persisted across restarts. Either a PostgreSQL
+// connection URL (postgres://...), or the path of a SQLite database. Without it, leases are only
+// kept in memory
 package prefix
 
 // FIXME: various settings will be hardcoded (default size, minimum size, lease times) pending a
@@ -18,6 +21,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"sync"
@@ -29,9 +33,11 @@ import (
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metrics"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 )
 
 var log = logger.GetLogger("plugins/prefix")
@@ -47,7 +53,7 @@ const leaseDuration = 3600 * time.Second
 func setupPrefix(args ...string) (handler.Handler6, error) {
 	// - prefix: 2001:db8::/48 64
 	if len(args) < 2 {
-		return nil, errors.New("Need both a subnet and an allocation max size")
+		return nil, errors.New("Need both a subnet and an allocation max size, and optionally a lease storage")
 	}
 
 	_, prefix, err := net.ParseCIDR(args[0])
@@ -66,10 +72,134 @@ func setupPrefix(args ...string) (handler.Handler6, error) {
 		return nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
 	}
 
-	return (&Handler{
+	h := &Handler{
 		Records:   make(map[string][]lease),
 		allocator: alloc,
-	}).Handle, nil
+	}
+	if len(args) > 2 {
+		if err := h.loadStore(args[2]); err != nil {
+			return nil, err
+		}
+		leasestore.Handover("prefix "+args[2], h.retire, func() { h.reload(*prefix, allocSize) }, sweepInterval, h.sweep)
+	} else {
+		plugins.OnClose(leasestore.Sweep(sweepInterval, h.sweep))
+	}
+	ones, _ := prefix.Mask.Size()
+	size := math.Ldexp(1, allocSize-ones)
+	// The pool is exported once the plugin replaces the running one
+	var unregister func()
+	plugins.OnCommit(func() {
+		unregister = metrics.RegisterPool("prefix", prefix.String(), func() (float64, float64) {
+			return size, h.delegated()
+		})
+	})
+	plugins.OnClose(func() {
+		if unregister != nil {
+			unregister()
+		}
+	})
+
+	return h.Handle, nil
+}
+
+// delegated returns the number of prefixes leased to clients
+func (h *Handler) delegated() float64 {
+	h.Lock()
+	defer h.Unlock()
+	var n int
+	for _, leases := range h.Records {
+		n += len(leases)
+	}
+	return float64(n)
+}
+
+// loadStore opens the lease storage, and restores the leases it holds in the
+// allocator
+func (h *Handler) loadStore(location string) error {
+	store, err := openStore(location)
+	if err != nil {
+		return fmt.Errorf("Could not setup lease storage: %w", err)
+	}
+	h.store = store
+	plugins.OnClose(store.close)
+	if err := h.loadLeases(false); err != nil {
+		return err
+	}
+	log.Printf("Loaded the delegated prefixes of %d clients from %s", len(h.Records), location)
+	return nil
+}
+
+// loadLeases reads the leases from storage into the allocator. Leases which
+// expired are skipped, and removed from storage if prune is set: they are
+// left alone while the instance replaced on a reload may still renew them.
+// The caller must hold the handler lock, if it is in use.
+func (h *Handler) loadLeases(prune bool) error {
+	records, err := h.store.load()
+	if err != nil {
+		return fmt.Errorf("Could not load leases: %w", err)
+	}
+
+	now := time.Now()
+	for client, leases := range records {
+		for _, l := range leases {
+			if !l.Expire.After(now) {
+				if prune {
+					if err := h.store.delete(client, l.Prefix); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			allocated, err := h.allocator.Allocate(l.Prefix)
+			if err != nil {
+				return fmt.Errorf("Failed to re-allocate leased prefix %s: %w", &l.Prefix, err)
+			}
+			if !samePrefix(&allocated, &l.Prefix) {
+				return fmt.Errorf("Allocator did not re-allocate leased prefix %s: %s", &l.Prefix, &allocated)
+			}
+			h.Records[client] = append(h.Records[client], l)
+		}
+	}
+	return nil
+}
+
+// retire stops the plugin from delegating, once the instance replacing it on
+// a reload took over the lease storage
+func (h *Handler) retire() {
+	h.Lock()
+	defer h.Unlock()
+	h.retired = true
+}
+
+// reload reads the leases again, with those delegated by the instance this
+// one replaces since it was set up
+func (h *Handler) reload(pool net.IPNet, allocSize int) {
+	h.Lock()
+	defer h.Unlock()
+	alloc, err := bitmap.NewBitmapAllocator(pool, allocSize)
+	if err != nil {
+		log.Errorf("Could not reload leases: %v", err)
+		return
+	}
+	h.allocator, h.Records = alloc, make(map[string][]lease)
+	if err := h.loadLeases(true); err != nil {
+		log.Errorf("Could not reload leases: %v", err)
+		return
+	}
+	log.Printf("Reloaded delegated prefixes of %d clients", len(h.Records))
+}
+
+// persist writes out the leases of a client to storage, if any. The caller
+// must hold the handler lock.
+func (h *Handler) persist(client string) {
+	if h.store == nil {
+		return
+	}
+	for _, l := range h.Records[client] {
+		if err := h.store.save(client, l); err != nil {
+			log.Errorf("Could not persist prefix %s: %v", &l.Prefix, err)
+		}
+	}
 }
 
 type lease struct {
@@ -86,6 +216,11 @@ type Handler struct {
 	// Since it's not valid utf-8 we can't use any other string function though
 	Records   map[string][]lease
 	allocator allocators.Allocator
+	// store is where leases are persisted, nil when they're only kept in memory
+	store leaseStore
+	// retired is set once an instance set up by a reload took over the
+	// lease storage, after which this one leaves it alone
+	retired bool
 }
 
 // samePrefix returns true if both prefixes are defined and equal
@@ -144,6 +279,10 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// A possible simple optimization here would be to be able to lock single map values
 		// individually instead of the whole map, since we lock for some amount of time
 		h.Lock()
+		if h.retired {
+			h.Unlock()
+			return nil, true
+		}
 		knownLeases := h.Records[recordKey(client)]
 		// Bitmap to track which leases are already given in this exchange
 		givenOut := bitset.New(uint(len(knownLeases)))
@@ -172,7 +311,7 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// have already assigned to this client
 		for hintIdx, h := range hints {
 			if satisfied.Test(uint(hintIdx)) ||
-				(h.Prefix != nil && !h.Prefix.IP.Equal(net.IPv6zero)) {
+				(h.Prefix != nil && h.Prefix.IP != nil && !h.Prefix.IP.Equal(net.IPv6zero)) {
 				continue
 			}
 			for leaseIdx, l := range knownLeases {
@@ -229,13 +368,15 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 			}
 
 			addPrefix(iapdResp, l)
-			newLeases = append(knownLeases, l)
+			knownLeases = append(knownLeases, l)
+			newLeases = knownLeases
 			log.Debugf("Allocated %s to %s (IAID: %x)", &allocated, client, iapd.IaId)
 		}
 
 		if newLeases != nil {
 			h.Records[recordKey(client)] = newLeases
 		}
+		h.persist(recordKey(client))
 		h.Unlock()
 
 		if len(iapdResp.Options.Options) == 0 {
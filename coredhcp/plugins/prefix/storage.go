@@ -0,0 +1,202 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package prefix
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// leaseStore persists delegated prefixes across restarts. Clients are
+// identified by their Records key, stored hex-encoded.
+type leaseStore interface {
+	// load returns all the stored leases, keyed like Handler.Records
+	load() (map[string][]lease, error)
+	// save inserts or updates a lease of a client
+	save(client string, l lease) error
+	// delete removes a lease of a client
+	delete(client string, prefix net.IPNet) error
+	// close releases the connections to the storage
+	close()
+}
+
+// openStore opens the lease storage described by a plugin argument: a
+// PostgreSQL connection URL, or else the path of a SQLite database
+func openStore(location string) (leaseStore, error) {
+	if strings.HasPrefix(location, "postgres://") || strings.HasPrefix(location, "postgresql://") {
+		return openPgStore(location)
+	}
+	return openSQLiteStore(location)
+}
+
+// parseLease validates a stored lease
+func parseLease(prefix string, expire time.Time) (lease, error) {
+	_, p, err := net.ParseCIDR(prefix)
+	if err != nil || p.IP.To4() != nil {
+		return lease{}, fmt.Errorf("expected an IPv6 prefix, got: %v", prefix)
+	}
+	return lease{Prefix: *p, Expire: expire}, nil
+}
+
+// parseClient decodes a stored client key
+func parseClient(client string) (string, error) {
+	b, err := hex.DecodeString(client)
+	if err != nil {
+		return "", fmt.Errorf("malformed client id: %s", client)
+	}
+	return string(b), nil
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database (%T): %w", err, err)
+	}
+	if _, err := db.Exec("create table if not exists prefixes6 (client text not null, prefix text not null, expiry int, primary key (client, prefix))"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("table creation failed: %w", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) load() (map[string][]lease, error) {
+	rows, err := s.db.Query("select client, prefix, expiry from prefixes6")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases database: %w", err)
+	}
+	defer rows.Close()
+	var (
+		client, prefix string
+		expiry         int64
+		records        = make(map[string][]lease)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&client, &prefix, &expiry); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		key, err := parseClient(client)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseLease(prefix, time.Unix(expiry, 0))
+		if err != nil {
+			return nil, err
+		}
+		records[key] = append(records[key], l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	return records, nil
+}
+
+func (s *sqliteStore) save(client string, l lease) error {
+	if _, err := s.db.Exec("insert or replace into prefixes6(client, prefix, expiry) values (?, ?, ?)",
+		hex.EncodeToString([]byte(client)), l.Prefix.String(), l.Expire.Unix()); err != nil {
+		return fmt.Errorf("record insert/update failed: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) delete(client string, prefix net.IPNet) error {
+	if _, err := s.db.Exec("delete from prefixes6 where client = ? and prefix = ?",
+		hex.EncodeToString([]byte(client)), prefix.String()); err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) close() {
+	s.db.Close()
+}
+
+type pgStore struct {
+	pool *pgxpool.Pool
+}
+
+func openPgStore(url string) (*pgStore, error) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	if _, err := pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS coredhcp_prefixes (
+			client VARCHAR(300) NOT NULL,
+			prefix VARCHAR(100) NOT NULL,
+			expires TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (client, prefix)
+		);`); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("table creation failed: %w", err)
+	}
+	return &pgStore{pool: pool}, nil
+}
+
+func (s *pgStore) load() (map[string][]lease, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT client, prefix, expires FROM coredhcp_prefixes`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases database: %w", err)
+	}
+	defer rows.Close()
+	var (
+		client, prefix string
+		expires        time.Time
+		records        = make(map[string][]lease)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&client, &prefix, &expires); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		key, err := parseClient(client)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseLease(prefix, expires)
+		if err != nil {
+			return nil, err
+		}
+		records[key] = append(records[key], l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	return records, nil
+}
+
+func (s *pgStore) save(client string, l lease) error {
+	_, err := s.pool.Exec(context.Background(), `INSERT INTO coredhcp_prefixes (client, prefix, expires) VALUES ($1, $2, $3)
+		ON CONFLICT (client, prefix) DO UPDATE SET expires = EXCLUDED.expires`,
+		hex.EncodeToString([]byte(client)), l.Prefix.String(), l.Expire)
+	if err != nil {
+		return fmt.Errorf("record insert/update failed: %w", err)
+	}
+	return nil
+}
+
+func (s *pgStore) delete(client string, prefix net.IPNet) error {
+	_, err := s.pool.Exec(context.Background(), `DELETE FROM coredhcp_prefixes WHERE client = $1 AND prefix = $2`,
+		hex.EncodeToString([]byte(client)), prefix.String())
+	if err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
+func (s *pgStore) close() {
+	s.pool.Close()
+}
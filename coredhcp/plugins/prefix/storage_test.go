@@ -0,0 +1,144 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package prefix
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+func testSolicit(t *testing.T, handler func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool)) *net.IPNet {
+	req, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{
+		HWType:        dhcpIana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}))
+	req.AddOption(&dhcpv6.OptIAPD{IaId: [4]uint8{0x12, 0x34, 0x56, 0x78}})
+	resp, err := dhcpv6.NewAdvertiseFromSolicit(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, _ := handler(req, resp)
+	iapd := result.(*dhcpv6.Message).Options.OneIAPD()
+	if iapd == nil || len(iapd.Options.Prefixes()) != 1 {
+		t.Fatalf("Expected exactly one prefix in the response, got %v", result)
+	}
+	return iapd.Options.Prefixes()[0].Prefix
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := openSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:1::/64")
+	expire := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+	client := "\x00\x03\x00\x01\xaa\xbb\xcc\xdd\xee\xff"
+
+	if err := store.save(client, lease{Prefix: *prefix, Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	// saving again updates the lease
+	expire = expire.Add(time.Hour)
+	if err := store.save(client, lease{Prefix: *prefix, Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[client]) != 1 {
+		t.Fatalf("Expected exactly one stored lease, got %v", records)
+	}
+	if l := records[client][0]; !samePrefix(&l.Prefix, prefix) || !l.Expire.Equal(expire) {
+		t.Fatalf("Stored lease doesn't match: got %v, expected %s until %s", l, prefix, expire)
+	}
+
+	if err := store.delete(client, *prefix); err != nil {
+		t.Fatal(err)
+	}
+	records, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("Expected no stored lease, got %v", records)
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prefixes.sqlite3")
+
+	handler, err := setupPrefix("2001:db8::/48", "64", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegated := testSolicit(t, handler)
+
+	// After a restart, the client gets the same prefix
+	handler, err = setupPrefix("2001:db8::/48", "64", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := testSolicit(t, handler); !samePrefix(again, delegated) {
+		t.Fatalf("Prefix changed across restarts: got %s, expected %s", again, delegated)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	store, err := openSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two prefixes
+	_, pool, _ := net.ParseCIDR("2001:db8::/63")
+	h := &Handler{Records: make(map[string][]lease), store: store}
+	h.allocator, err = bitmap.NewBitmapAllocator(*pool, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i, expire := range []time.Time{now.Add(-time.Minute), now.Add(time.Hour)} {
+		allocated, err := h.allocator.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := lease{Prefix: allocated, Expire: expire}
+		client := string([]byte{byte(i)})
+		h.Records[client] = []lease{l}
+		if err := store.save(client, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.sweep(now)
+
+	if len(h.Records) != 1 {
+		t.Fatalf("Expected only the unexpired lease to remain, got %v", h.Records)
+	}
+	records, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected only the unexpired lease to remain stored, got %v", records)
+	}
+	// the expired prefix can be allocated again
+	if _, err := h.allocator.Allocate(net.IPNet{}); err != nil {
+		t.Fatalf("Expired prefix was not freed: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package prefix
+
+import (
+	"time"
+)
+
+// sweepInterval is how often expired leases are looked for
+const sweepInterval = time.Minute
+
+// sweep returns the prefixes of expired leases to the allocator, and removes
+// them from storage
+func (h *Handler) sweep(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if h.retired {
+		return
+	}
+
+	var count int
+	for client, leases := range h.Records {
+		var kept []lease
+		for _, l := range leases {
+			if l.Expire.After(now) {
+				kept = append(kept, l)
+				continue
+			}
+			if err := h.allocator.Free(l.Prefix); err != nil {
+				log.Errorf("Could not free expired prefix %s: %v", &l.Prefix, err)
+			}
+			if h.store != nil {
+				if err := h.store.delete(client, l.Prefix); err != nil {
+					log.Errorf("Could not delete expired prefix %s: %v", &l.Prefix, err)
+				}
+			}
+			count++
+		}
+		if len(kept) == 0 {
+			delete(h.Records, client)
+		} else {
+			h.Records[client] = kept
+		}
+	}
+
+	if count > 0 {
+		log.Printf("Reclaimed %d expired delegated prefixes", count)
+	}
+}
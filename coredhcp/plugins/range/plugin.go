@@ -5,7 +5,6 @@
 package rangeplugin
 
 import (
-	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -15,9 +14,11 @@ import (
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metrics"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
@@ -43,35 +44,68 @@ type PluginState struct {
 	// Recordsv4 holds a MAC -> IP address and lease time mapping
 	Recordsv4 map[string]*Record
 	LeaseTime time.Duration
-	leasedb   *sql.DB
-	allocator allocators.Allocator
+	// GracePeriod is how long an expired lease stays reserved for its client
+	// before the address is reclaimed
+	GracePeriod time.Duration
+	leasedb     *leasestore.Store
+	allocator   allocators.Allocator
+	// rangeStart and rangeEnd bound the addresses leased by the plugin
+	rangeStart net.IP
+	rangeEnd   net.IP
+	// reclaimed holds the addresses freed by the sweeper, least recently
+	// expired first
+	reclaimed []net.IP
+	// quarantine holds the addresses declined with a DHCPDECLINE
+	quarantine *leasestore.Quarantine
+	// retired is set once an instance set up by a reload took over the
+	// lease database, after which this one leaves it alone
+	retired bool
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		p.release(req)
+		return resp, false
+	case dhcpv4.MessageTypeDecline:
+		p.decline(req)
+		return resp, false
+	case dhcpv4.MessageTypeInform:
+		// The client already has an address, there is nothing to lease
+		return resp, false
+	}
+
 	p.Lock()
 	defer p.Unlock()
-	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
+	if p.retired {
+		return nil, true
+	}
+	record := p.Recordsv4[req.ClientHWAddr.String()]
 	hostname := req.HostName()
-	if !ok {
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		var (
+			reply *dhcpv4.DHCPv4
+			stop  bool
+		)
+		record, reply, stop = p.checkRequest(req, resp, record)
+		if stop {
+			return reply, true
+		}
+	}
+	if record == nil {
 		// Allocating new address since there isn't one allocated
 		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
-		ip, err := p.allocator.Allocate(net.IPNet{})
+		var hint net.IP
+		if req.MessageType() == dhcpv4.MessageTypeDiscover && p.inRange(req.RequestedIPAddress()) {
+			hint = req.RequestedIPAddress().To4()
+		}
+		ip, err := p.allocate(hint)
 		if err != nil {
 			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
 			return nil, true
 		}
-		rec := Record{
-			IP:      ip.IP.To4(),
-			expires: int(time.Now().Add(p.LeaseTime).Unix()),
-			hostname: hostname,
-		}
-		err = p.saveIPAddress(req.ClientHWAddr, &rec)
-		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
-		}
-		p.Recordsv4[req.ClientHWAddr.String()] = &rec
-		record = &rec
+		record = p.newRecord(req.ClientHWAddr, ip.IP, hostname)
 	} else {
 		// Ensure we extend the existing lease at least past when the one we're giving expires
 		expiry := time.Unix(int64(record.expires), 0)
@@ -90,14 +124,108 @@ func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 	return resp, false
 }
 
+// newRecord stores a new lease of ip to a client. The caller must hold the
+// plugin lock.
+func (p *PluginState) newRecord(hwaddr net.HardwareAddr, ip net.IP, hostname string) *Record {
+	rec := Record{
+		IP:       ip.To4(),
+		expires:  int(time.Now().Add(p.LeaseTime).Unix()),
+		hostname: hostname,
+	}
+	err := p.saveIPAddress(hwaddr, &rec)
+	if err != nil {
+		log.Errorf("SaveIPAddress for MAC %s failed: %v", hwaddr.String(), err)
+	}
+	p.Recordsv4[hwaddr.String()] = &rec
+	return &rec
+}
+
+// release frees the lease of a client sending a DHCPRELEASE for it
+func (p *PluginState) release(req *dhcpv4.DHCPv4) {
+	p.Lock()
+	defer p.Unlock()
+	if p.retired {
+		return
+	}
+	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
+	if !ok || !record.IP.Equal(req.ClientIPAddr) {
+		log.Printf("MAC %s released IPv4 address %s it does not hold, ignoring", req.ClientHWAddr.String(), req.ClientIPAddr)
+		return
+	}
+	p.freeRecord(req.ClientHWAddr, record)
+	log.Printf("MAC %s released IPv4 address %s", req.ClientHWAddr.String(), record.IP)
+}
+
+// freeRecord drops the lease of a client, and returns its address to the
+// pool. The caller must hold the plugin lock.
+func (p *PluginState) freeRecord(hwaddr net.HardwareAddr, record *Record) {
+	if err := p.allocator.Free(net.IPNet{IP: record.IP}); err != nil {
+		log.Errorf("Could not free IP %s of MAC %s: %v", record.IP, hwaddr.String(), err)
+	}
+	delete(p.Recordsv4, hwaddr.String())
+	if err := p.deleteIPAddress(hwaddr, record.IP); err != nil {
+		log.Errorf("Could not delete lease for MAC %s: %v", hwaddr.String(), err)
+	}
+	p.reclaimed = append(p.reclaimed, record.IP)
+}
+
+// decline handles a DHCPDECLINE, sent by a client which found the address we
+// leased it already in use (RFC 2131 4.3.3). The address is quarantined, and
+// the client will get another one when it restarts configuration.
+func (p *PluginState) decline(req *dhcpv4.DHCPv4) {
+	p.Lock()
+	defer p.Unlock()
+	if p.retired {
+		return
+	}
+	ip := req.RequestedIPAddress()
+	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
+	if !ok || !record.IP.Equal(ip) {
+		log.Printf("MAC %s declined IPv4 address %s it was not leased, ignoring", req.ClientHWAddr.String(), ip)
+		return
+	}
+	delete(p.Recordsv4, req.ClientHWAddr.String())
+	if err := p.deleteIPAddress(req.ClientHWAddr, record.IP); err != nil {
+		log.Errorf("Could not delete lease for MAC %s: %v", req.ClientHWAddr.String(), err)
+	}
+	// The address stays taken in the allocator while it is quarantined
+	if err := p.quarantine.Add(record.IP); err != nil {
+		log.Errorf("Could not persist declined IP %s: %v", record.IP, err)
+	}
+	log.Warningf("MAC %s declined IPv4 address %s, quarantining it for %s", req.ClientHWAddr.String(), record.IP, leasestore.DeclineHoldTime)
+}
+
 func setupRange(args ...string) (handler.Handler4, error) {
+	p, err := newPluginState(args...)
+	if err != nil {
+		return nil, err
+	}
+	plugins.OnClose(func() { p.leasedb.Close() })
+	leasestore.Handover("range "+args[0], p.retire, p.reload, sweepInterval, p.sweep)
+	// The pool is exported once the plugin replaces the running one
+	var unregister func()
+	plugins.OnCommit(func() {
+		unregister = metrics.RegisterPool("range", fmt.Sprintf("%s-%s", p.rangeStart, p.rangeEnd), p.usage)
+	})
+	plugins.OnClose(func() {
+		if unregister != nil {
+			unregister()
+		}
+	})
+
+	return p.Handler4, nil
+}
+
+// newPluginState parses the arguments of the plugin, opens its lease database
+// and loads the leases and quarantined addresses into the allocator
+func newPluginState(args ...string) (*PluginState, error) {
 	var (
 		err error
 		p   PluginState
 	)
 
 	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time) and optionally a grace period, got: %d", len(args))
 	}
 	filename := args[0]
 	if filename == "" {
@@ -115,6 +243,7 @@ func setupRange(args ...string) (handler.Handler4, error) {
 		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
 	}
 
+	p.rangeStart, p.rangeEnd = ipRangeStart.To4(), ipRangeEnd.To4()
 	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an allocator: %w", err)
@@ -125,25 +254,78 @@ func setupRange(args ...string) (handler.Handler4, error) {
 		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
 	}
 
+	if len(args) > 4 {
+		p.GracePeriod, err = time.ParseDuration(args[4])
+		if err != nil || p.GracePeriod < 0 {
+			return nil, fmt.Errorf("invalid grace period: %v", args[4])
+		}
+	}
+
 	if err := p.registerBackingDB(filename); err != nil {
 		return nil, fmt.Errorf("could not setup lease storage: %w", err)
 	}
+	if err := p.loadLeases(); err != nil {
+		p.leasedb.Close()
+		return nil, err
+	}
+	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), filename)
+	return &p, nil
+}
+
+// loadLeases reads the leases and the quarantined addresses from the lease
+// database, and takes them in the allocator
+func (p *PluginState) loadLeases() error {
+	var err error
 	p.Recordsv4, err = loadRecords(p.leasedb)
 	if err != nil {
-		return nil, fmt.Errorf("could not load records from file: %v", err)
+		return fmt.Errorf("could not load records from file: %v", err)
 	}
 
-	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), filename)
-
 	for _, v := range p.Recordsv4 {
 		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
 		if err != nil {
-			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+			return fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
 		}
 		if ip.IP.String() != v.IP.String() {
-			return nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+			return fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
 		}
 	}
 
-	return p.Handler4, nil
+	p.quarantine, err = p.leasedb.LoadQuarantine(p.allocator, time.Now())
+	return err
+}
+
+// retire stops the plugin from leasing, once the instance replacing it on a
+// reload took over the lease database
+func (p *PluginState) retire() {
+	p.Lock()
+	defer p.Unlock()
+	p.retired = true
+}
+
+// reload reads the leases again, with those granted by the instance this one
+// replaces since it was set up
+func (p *PluginState) reload() {
+	p.Lock()
+	defer p.Unlock()
+	var err error
+	p.allocator, err = bitmap.NewIPv4Allocator(p.rangeStart, p.rangeEnd)
+	if err == nil {
+		err = p.loadLeases()
+	}
+	if err != nil {
+		log.Errorf("Could not reload leases: %v", err)
+		return
+	}
+	p.reclaimed = nil
+	log.Printf("Reloaded %d DHCPv4 leases", len(p.Recordsv4))
+}
+
+// usage returns the number of addresses of the range, and how many of them
+// are leased or quarantined
+func (p *PluginState) usage() (size, used float64) {
+	p.Lock()
+	defer p.Unlock()
+	size = float64(binary.BigEndian.Uint32(p.rangeEnd) - binary.BigEndian.Uint32(p.rangeStart) + 1)
+	return size, float64(len(p.Recordsv4) + p.quarantine.Len())
 }
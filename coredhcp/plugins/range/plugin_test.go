@@ -0,0 +1,357 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPluginState(t *testing.T) *PluginState {
+	p, err := newPluginState(":memory:", "10.0.0.10", "10.0.0.20", "1h")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.leasedb.Close() })
+	return p
+}
+
+func testRequest(t *testing.T, mt dhcpv4.MessageType, mac string, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	hwaddr, err := net.ParseMAC(mac)
+	require.NoError(t, err)
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithHwAddr(hwaddr),
+	}, modifiers...)...)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	return req, resp
+}
+
+func TestRelease(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	leased := resp.YourIPAddr
+	require.NotNil(t, leased)
+
+	// releasing someone else's address is ignored
+	req, resp = testRequest(t, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 19)))
+	p.Handler4(req, resp)
+	assert.Contains(t, p.Recordsv4, mac)
+
+	req, resp = testRequest(t, dhcpv4.MessageTypeRelease, mac, dhcpv4.WithClientIP(leased))
+	p.Handler4(req, resp)
+	assert.NotContains(t, p.Recordsv4, mac)
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// the address is free again
+	ip, err := p.allocator.Allocate(net.IPNet{IP: leased})
+	require.NoError(t, err)
+	assert.True(t, ip.IP.Equal(leased))
+}
+
+func TestReloadHandover(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.sqlite3")
+	running, err := newPluginState(filename, "10.0.0.10", "10.0.0.11", "1h")
+	require.NoError(t, err)
+	defer running.leasedb.Close()
+	// the instance of a reload is set up while the running one still leases
+	reloaded, err := newPluginState(filename, "10.0.0.10", "10.0.0.11", "1h")
+	require.NoError(t, err)
+	defer reloaded.leasedb.Close()
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, "02:00:00:00:00:01")
+	resp, _ = running.Handler4(req, resp)
+	require.NotNil(t, resp)
+	leased := resp.YourIPAddr
+
+	running.retire()
+	reloaded.reload()
+	req, resp = testRequest(t, dhcpv4.MessageTypeDiscover, "02:00:00:00:00:02")
+	resp, stop := running.Handler4(req, resp)
+	assert.Nil(t, resp, "the replaced instance must not lease anymore")
+	assert.True(t, stop)
+
+	// the lease granted meanwhile is known to the new instance
+	require.Contains(t, reloaded.Recordsv4, "02:00:00:00:00:01")
+	req, resp = testRequest(t, dhcpv4.MessageTypeDiscover, "02:00:00:00:00:02")
+	resp, _ = reloaded.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, resp.YourIPAddr.Equal(leased))
+}
+
+func TestDecline(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	declined := resp.YourIPAddr
+
+	req, resp = testRequest(t, dhcpv4.MessageTypeDecline, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(declined)))
+	p.Handler4(req, resp)
+	assert.NotContains(t, p.Recordsv4, mac)
+	assert.True(t, p.quarantine.Has(declined))
+
+	// the client gets another address
+	req, resp = testRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, resp.YourIPAddr.Equal(declined))
+}
+
+func TestInformDoesNotLease(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeInform, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 15)))
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.NotContains(t, p.Recordsv4, mac)
+}
+
+func TestSweep(t *testing.T) {
+	p := testPluginState(t)
+	p.GracePeriod = time.Minute
+	now := time.Now()
+
+	leases := []struct {
+		mac     string
+		ip      net.IP
+		expires time.Time
+	}{
+		{"02:00:00:00:00:01", net.IPv4(10, 0, 0, 10), now.Add(-2 * time.Hour)},
+		{"02:00:00:00:00:02", net.IPv4(10, 0, 0, 11), now.Add(-3 * time.Hour)},
+		{"02:00:00:00:00:03", net.IPv4(10, 0, 0, 12), now.Add(-30 * time.Second)},
+		{"02:00:00:00:00:04", net.IPv4(10, 0, 0, 13), now.Add(time.Hour)},
+	}
+	for _, l := range leases {
+		ip, err := p.allocator.Allocate(net.IPNet{IP: l.ip})
+		require.NoError(t, err)
+		require.True(t, ip.IP.Equal(l.ip))
+		hwaddr, _ := net.ParseMAC(l.mac)
+		rec := &Record{IP: l.ip.To4(), expires: int(l.expires.Unix())}
+		p.Recordsv4[hwaddr.String()] = rec
+		require.NoError(t, p.saveIPAddress(hwaddr, rec))
+	}
+
+	p.sweep(now)
+
+	// only the leases past their grace period are gone, oldest first
+	assert.NotContains(t, p.Recordsv4, leases[0].mac)
+	assert.NotContains(t, p.Recordsv4, leases[1].mac)
+	assert.Contains(t, p.Recordsv4, leases[2].mac)
+	assert.Contains(t, p.Recordsv4, leases[3].mac)
+	require.Len(t, p.reclaimed, 2)
+	assert.True(t, p.reclaimed[0].Equal(leases[1].ip))
+	assert.True(t, p.reclaimed[1].Equal(leases[0].ip))
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+
+	// new clients get the least recently expired address first
+	p.Lock()
+	ip, err := p.allocate(nil)
+	p.Unlock()
+	require.NoError(t, err)
+	assert.True(t, ip.IP.Equal(leases[1].ip))
+	assert.Len(t, p.reclaimed, 1)
+}
+
+func TestAllocateReclaimsWhenExhausted(t *testing.T) {
+	p, err := newPluginState(":memory:", "10.0.0.10", "10.0.0.11", "1h", "1h")
+	require.NoError(t, err)
+	defer p.leasedb.Close()
+	now := time.Now()
+
+	for i, expires := range []time.Time{now.Add(-time.Minute), now.Add(-2 * time.Minute)} {
+		ip, err := p.allocator.Allocate(net.IPNet{})
+		require.NoError(t, err)
+		hwaddr := net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}
+		p.Recordsv4[hwaddr.String()] = &Record{IP: ip.IP.To4(), expires: int(expires.Unix())}
+	}
+
+	// both leases are within their grace period, but the pool is full
+	p.Lock()
+	ip, err := p.allocate(nil)
+	p.Unlock()
+	require.NoError(t, err)
+	assert.True(t, ip.IP.Equal(net.IPv4(10, 0, 0, 11)), "the least recently expired lease should be reclaimed")
+	assert.Len(t, p.Recordsv4, 1)
+}
+
+func TestGetRequestState(t *testing.T) {
+	const mac = "02:00:00:00:00:01"
+	ip := net.IPv4(10, 0, 0, 15)
+
+	req, _ := testRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	assert.Equal(t, stateSelecting, getRequestState(req))
+	assert.True(t, requestedAddress(req, stateSelecting).Equal(ip))
+
+	req, _ = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	assert.Equal(t, stateInitReboot, getRequestState(req))
+
+	req, _ = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip))
+	assert.Equal(t, stateRenewing, getRequestState(req))
+	assert.True(t, requestedAddress(req, stateRenewing).Equal(ip))
+
+	req, _ = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip), dhcpv4.WithBroadcast(true))
+	assert.Equal(t, stateRebinding, getRequestState(req))
+}
+
+func TestRequestNak(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	leased := resp.YourIPAddr
+
+	// the offered address is acknowledged
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(leased)))
+	resp, stop := p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.Equal(leased))
+
+	// asking for another address is refused, and the lease is kept
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 19))))
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1)))
+	resp, stop = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.True(t, resp.ServerIdentifier().Equal(net.IPv4(10, 0, 0, 1)))
+	assert.True(t, resp.YourIPAddr.IsUnspecified())
+	assert.True(t, p.Recordsv4[mac].IP.Equal(leased))
+
+	// renewing someone else's address is refused
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, "02:00:00:00:00:02", dhcpv4.WithClientIP(leased))
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	// as is selecting an address outside of the range
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, "02:00:00:00:00:02",
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 168, 0, 10))))
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:02")
+}
+
+func TestRequestOtherServer(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+	ours := dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, mac)
+	resp.UpdateOption(ours)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	offered := resp.YourIPAddr
+
+	// the client chose another server: our offer is freed, and we stay silent
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 2))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 200))))
+	resp.UpdateOption(ours)
+	resp, stop := p.Handler4(req, resp)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.NotContains(t, p.Recordsv4, mac)
+	assert.True(t, p.isFree(offered))
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// selecting us is acknowledged
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offered)))
+	resp.UpdateOption(ours)
+	resp, stop = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.Equal(offered))
+}
+
+func TestRequestUnknownClient(t *testing.T) {
+	p := testPluginState(t)
+	const mac = "02:00:00:00:00:01"
+	ip := net.IPv4(10, 0, 0, 15)
+
+	// rebooting clients we have no record of are not answered
+	req, resp := testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	resp, stop := p.Handler4(req, resp)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+
+	// nor are requests without any address, which get none
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac)
+	resp, stop = p.Handler4(req, resp)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.NotContains(t, p.Recordsv4, mac)
+
+	// selecting us without an offer nor an address is refused
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))))
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1)))
+	resp, stop = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.NotContains(t, p.Recordsv4, mac)
+
+	// nor are rebinding clients holding an address that isn't ours
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(net.IPv4(192, 168, 0, 10)), dhcpv4.WithBroadcast(true))
+	resp, stop = p.Handler4(req, resp)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+
+	// renewing a free address of the range gives it back to the client
+	req, resp = testRequest(t, dhcpv4.MessageTypeRequest, mac, dhcpv4.WithClientIP(ip))
+	resp, stop = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.Equal(ip))
+	require.Contains(t, p.Recordsv4, mac)
+	assert.True(t, p.Recordsv4[mac].IP.Equal(ip))
+	other, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	require.NoError(t, err)
+	assert.False(t, other.IP.Equal(ip), "the address should be taken in the allocator")
+}
+
+func TestDiscoverHint(t *testing.T) {
+	p := testPluginState(t)
+	ip := net.IPv4(10, 0, 0, 17)
+
+	req, resp := testRequest(t, dhcpv4.MessageTypeDiscover, "02:00:00:00:00:01", dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(ip))
+
+	// taken hints are not honoured
+	req, resp = testRequest(t, dhcpv4.MessageTypeDiscover, "02:00:00:00:00:02", dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, resp.YourIPAddr.Equal(ip))
+}
@@ -0,0 +1,196 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// requestState is the client state a DHCPREQUEST is sent from, as described
+// in RFC 2131 section 4.3.2
+type requestState int
+
+const (
+	stateSelecting requestState = iota
+	stateInitReboot
+	stateRenewing
+	stateRebinding
+)
+
+func (s requestState) String() string {
+	switch s {
+	case stateSelecting:
+		return "SELECTING"
+	case stateInitReboot:
+		return "INIT-REBOOT"
+	case stateRenewing:
+		return "RENEWING"
+	case stateRebinding:
+		return "REBINDING"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+func isSet(ip net.IP) bool {
+	return ip != nil && !ip.IsUnspecified()
+}
+
+// getRequestState tells apart the client states a DHCPREQUEST can be sent
+// from. Renewing clients unicast to the server, and rebinding ones broadcast,
+// but handlers don't see the destination address: a request with the
+// broadcast flag or coming through a relay is taken as REBINDING.
+func getRequestState(req *dhcpv4.DHCPv4) requestState {
+	switch {
+	case req.ServerIdentifier() != nil:
+		return stateSelecting
+	case !isSet(req.ClientIPAddr):
+		return stateInitReboot
+	case req.IsBroadcast() || isSet(req.GatewayIPAddr):
+		return stateRebinding
+	default:
+		return stateRenewing
+	}
+}
+
+// requestedAddress returns the address a client asks for in a DHCPREQUEST,
+// which is in the requested IP address option when selecting or rebooting,
+// and in ciaddr otherwise. It is nil if the client did not fill it.
+func requestedAddress(req *dhcpv4.DHCPv4, state requestState) net.IP {
+	var ip net.IP
+	switch state {
+	case stateSelecting, stateInitReboot:
+		ip = req.RequestedIPAddress()
+	default:
+		ip = req.ClientIPAddr
+	}
+	if !isSet(ip) {
+		return nil
+	}
+	return ip.To4()
+}
+
+// inRange returns true if the address is part of the range of the plugin
+func (p *PluginState) inRange(ip net.IP) bool {
+	if ip.To4() == nil || p.rangeStart == nil || p.rangeEnd == nil {
+		return false
+	}
+	v := binary.BigEndian.Uint32(ip.To4())
+	return v >= binary.BigEndian.Uint32(p.rangeStart.To4()) && v <= binary.BigEndian.Uint32(p.rangeEnd.To4())
+}
+
+// isFree returns true if no client holds the address and it isn't
+// quarantined. The caller must hold the plugin lock.
+func (p *PluginState) isFree(ip net.IP) bool {
+	if p.quarantine.Has(ip) {
+		return false
+	}
+	for _, record := range p.Recordsv4 {
+		if record.IP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// nak builds a DHCPNAK in reply to a request. It only carries the server
+// identifier set by the plugins before us, and a message for the client
+// (RFC 2131 table 3).
+func nak(req, resp *dhcpv4.DHCPv4, msg string) *dhcpv4.DHCPv4 {
+	reply, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptMessage(msg)),
+	)
+	if err != nil {
+		log.Errorf("Could not build DHCPNAK: %v", err)
+		return nil
+	}
+	if sid := resp.ServerIdentifier(); sid != nil {
+		reply.UpdateOption(dhcpv4.OptServerIdentifier(sid))
+	}
+	return reply
+}
+
+// checkRequest validates a DHCPREQUEST against the lease held by the client,
+// if any. It returns the record to acknowledge; or a DHCPNAK and true to stop
+// there, in which case a nil DHCPNAK means staying silent.
+// The caller must hold the plugin lock.
+func (p *PluginState) checkRequest(req, resp *dhcpv4.DHCPv4, record *Record) (*Record, *dhcpv4.DHCPv4, bool) {
+	mac := req.ClientHWAddr.String()
+	state := getRequestState(req)
+	addr := requestedAddress(req, state)
+
+	if state == stateSelecting {
+		// RFC 2131 4.3.2: a client selecting another server declines our
+		// offer, which is freed, and the request isn't for us to answer
+		if ours := resp.ServerIdentifier(); ours != nil && !req.ServerIdentifier().Equal(ours) {
+			if record != nil {
+				log.Printf("MAC %s selected server %s, freeing offered address %s", mac, req.ServerIdentifier(), record.IP)
+				p.freeRecord(req.ClientHWAddr, record)
+			}
+			return nil, nil, true
+		}
+	}
+
+	if record != nil {
+		if addr != nil && !addr.Equal(record.IP) {
+			log.Printf("MAC %s requested %s in state %s but holds %s, sending DHCPNAK", mac, addr, state, record.IP)
+			return nil, nak(req, resp, "requested address is not leased to this client"), true
+		}
+		return record, nil, false
+	}
+	if addr == nil {
+		// There is neither a lease nor an address to check, and requests
+		// never get fresh addresses
+		if state == stateSelecting {
+			log.Printf("MAC %s selected us without an offer nor a requested address, sending DHCPNAK", mac)
+			return nil, nak(req, resp, "no address was offered to this client"), true
+		}
+		log.Printf("MAC %s sent a request in state %s without an address, which we have no record of, ignoring", mac, state)
+		return nil, nil, true
+	}
+
+	// We have no lease for this client
+	if !p.inRange(addr) {
+		if state == stateRebinding {
+			// The address may be leased by another server
+			log.Printf("MAC %s is rebinding %s which is not ours, ignoring", mac, addr)
+			return nil, nil, true
+		}
+		log.Printf("MAC %s requested %s in state %s which is outside of the range, sending DHCPNAK", mac, addr, state)
+		return nil, nak(req, resp, "requested address is not on this network"), true
+	}
+	if state == stateInitReboot {
+		// RFC 2131 4.3.2: the server MUST remain silent if it has no record of the client
+		log.Printf("MAC %s is rebooting with %s which we have no record of, ignoring", mac, addr)
+		return nil, nil, true
+	}
+	if !p.isFree(addr) {
+		if state == stateRebinding {
+			log.Printf("MAC %s is rebinding %s which is leased to another client, ignoring", mac, addr)
+			return nil, nil, true
+		}
+		log.Printf("MAC %s requested %s in state %s which is leased to another client, sending DHCPNAK", mac, addr, state)
+		return nil, nak(req, resp, "requested address is not available"), true
+	}
+
+	// The address is ours and free: the lease was likely lost, e.g. swept
+	// after its grace period, so the client can have it back
+	ip, err := p.allocate(addr)
+	if err != nil || !ip.IP.Equal(addr) {
+		log.Errorf("Could not allocate requested IP %s for MAC %s: %v", addr, mac, err)
+		if err == nil {
+			if err := p.allocator.Free(ip); err != nil {
+				log.Errorf("Could not free IP %s: %v", ip.IP, err)
+			}
+		}
+		return nil, nak(req, resp, "requested address is not available"), true
+	}
+	log.Printf("MAC %s requested %s in state %s which we have no record of, leasing it", mac, addr, state)
+	return p.newRecord(req.ClientHWAddr, ip.IP, req.HostName()), nil, false
+}
@@ -5,29 +5,24 @@
 package rangeplugin
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"net"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 )
 
-func loadDB(path string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", path))  // 不存在会自动创建，配置文件默认是leases.txt
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database (%T): %w", err, err)
-	}
-	if _, err := db.Exec("create table if not exists leases4 (mac string not null, ip string not null, expiry int, hostname string not null, primary key (mac, ip))"); err != nil {
-		return nil, fmt.Errorf("table creation failed: %w", err)
-	}
-	return db, nil
+func loadDB(path string) (*leasestore.Store, error) {
+	// 不存在会自动创建，配置文件默认是leases.txt
+	return leasestore.Open(path,
+		"create table if not exists leases4 (mac string not null, ip string not null, expiry int, hostname string not null, primary key (mac, ip))",
+		"declined4")
 }
 
 // loadRecords loads the DHCPv6/v4 Records global map with records stored on
 // the specified file. The records have to be one per line, a mac address and an
 // IP address.
-func loadRecords(db *sql.DB) (map[string]*Record, error) {
+func loadRecords(db *leasestore.Store) (map[string]*Record, error) {
 	rows, err := db.Query("select mac, ip, expiry, hostname from leases4")
 	if err != nil {
 		return nil, fmt.Errorf("failed to query leases database: %w", err)
@@ -76,12 +71,21 @@ func (p *PluginState) saveIPAddress(mac net.HardwareAddr, record *Record) error
 	return nil
 }
 
+// deleteIPAddress removes the lease of an address to a client from storage.
+// Matching the address too keeps a lease stored since by another instance
+// sharing the database, such as the one replacing us on a reload.
+func (p *PluginState) deleteIPAddress(mac net.HardwareAddr, ip net.IP) error {
+	if _, err := p.leasedb.Exec("delete from leases4 where mac = ? and ip = ?", mac.String(), ip.String()); err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
 // registerBackingDB installs a database connection string as the backing store for leases
 func (p *PluginState) registerBackingDB(filename string) error {
 	if p.leasedb != nil {
 		return errors.New("cannot swap out a lease database while running")
 	}
-	// We never close this, but that's ok because plugins are never stopped/unregistered
 	newLeaseDB, err := loadDB(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open lease database %s: %w", filename, err)
@@ -5,16 +5,17 @@
 package rangeplugin
 
 import (
-	"database/sql"
 	"fmt"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 )
 
-func testDBSetup() (*sql.DB, error) {
+func testDBSetup() (*leasestore.Store, error) {
 	db, err := loadDB(":memory:")
 	if err != nil {
 		return nil, err
@@ -97,3 +98,37 @@ func TestWriteRecords(t *testing.T) {
 
 	assert.Equal(t, mapRec, parsedRec, "Loaded records differ from what's in the DB")
 }
+
+func TestDeleteRecordOfAddress(t *testing.T) {
+	pl := PluginState{}
+	if err := pl.registerBackingDB(":memory:"); err != nil {
+		t.Fatalf("Could not setup file")
+	}
+	hwaddr, err := net.ParseMAC(records[0].mac)
+	if err != nil {
+		panic(err)
+	}
+	renewed := &Record{IP: net.IPv4(10, 0, 0, 9), expires: expire, hostname: "renewed"}
+	if err := pl.saveIPAddress(hwaddr, renewed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease of another address to the same client is kept
+	if err := pl.deleteIPAddress(hwaddr, records[0].ip.IP); err != nil {
+		t.Fatal(err)
+	}
+	parsedRec, err := loadRecords(pl.leasedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, parsedRec, 1)
+
+	if err := pl.deleteIPAddress(hwaddr, renewed.IP); err != nil {
+		t.Fatal(err)
+	}
+	parsedRec, err = loadRecords(pl.leasedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, parsedRec)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// sweepInterval is how often expired leases are looked for
+const sweepInterval = time.Minute
+
+// expiredLease is a lease found expired by the sweeper
+type expiredLease struct {
+	mac     string
+	record  *Record
+	expires int
+}
+
+// allocate leases a new address to a client. The hint is honoured if it is
+// free; otherwise the address reclaimed the longest ago is preferred, so that
+// a recently expired client coming back has the best chance of finding its
+// address still available. When the allocator is full, the least recently
+// expired lease is reclaimed even if it is still within its grace period.
+// The caller must hold the plugin lock.
+func (p *PluginState) allocate(hint net.IP) (net.IPNet, error) {
+	if hint == nil && len(p.reclaimed) > 0 {
+		hint = p.reclaimed[0]
+	}
+	ip, err := p.allocator.Allocate(net.IPNet{IP: hint})
+	if errors.Is(err, allocators.ErrNoAddrAvail) {
+		if oldest := p.reclaimOldest(time.Now()); oldest != nil {
+			ip, err = p.allocator.Allocate(net.IPNet{IP: oldest})
+		}
+	}
+	if err != nil {
+		return ip, err
+	}
+	p.forgetReclaimed(ip.IP)
+	return ip, nil
+}
+
+// forgetReclaimed removes an address that was allocated again from the
+// reclaimed queue
+func (p *PluginState) forgetReclaimed(ip net.IP) {
+	for i, r := range p.reclaimed {
+		if r.Equal(ip) {
+			p.reclaimed = append(p.reclaimed[:i], p.reclaimed[i+1:]...)
+			return
+		}
+	}
+}
+
+// expired returns the leases which expired before the given time, least
+// recently expired first
+func (p *PluginState) expired(before time.Time) []expiredLease {
+	var leases []expiredLease
+	for mac, record := range p.Recordsv4 {
+		if int64(record.expires) <= before.Unix() {
+			leases = append(leases, expiredLease{mac: mac, record: record, expires: record.expires})
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].expires < leases[j].expires
+	})
+	return leases
+}
+
+// reclaim frees an expired lease back to the allocator and removes it from
+// storage. The caller must hold the plugin lock.
+func (p *PluginState) reclaim(l expiredLease) {
+	if err := p.allocator.Free(net.IPNet{IP: l.record.IP}); err != nil {
+		log.Errorf("Could not free expired IP %s of MAC %s: %v", l.record.IP, l.mac, err)
+	}
+	delete(p.Recordsv4, l.mac)
+	hwaddr, err := net.ParseMAC(l.mac)
+	if err == nil {
+		err = p.deleteIPAddress(hwaddr, l.record.IP)
+	}
+	if err != nil {
+		log.Errorf("Could not delete expired lease for MAC %s: %v", l.mac, err)
+	}
+	p.reclaimed = append(p.reclaimed, l.record.IP)
+	log.Debugf("Reclaimed IP %s from MAC %s, expired at %s", l.record.IP, l.mac, time.Unix(int64(l.expires), 0))
+}
+
+// reclaimOldest reclaims the least recently expired lease regardless of the
+// grace period, and returns its address. It returns nil if no lease has
+// expired. The caller must hold the plugin lock.
+func (p *PluginState) reclaimOldest(now time.Time) net.IP {
+	leases := p.expired(now)
+	if len(leases) == 0 {
+		return nil
+	}
+	log.Printf("Pool exhausted, reclaiming IP %s from MAC %s before the end of its grace period", leases[0].record.IP, leases[0].mac)
+	p.reclaim(leases[0])
+	return leases[0].record.IP
+}
+
+// sweep reclaims the leases expired for longer than the grace period, and
+// ends the quarantine of declined addresses
+func (p *PluginState) sweep(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	if p.retired {
+		return
+	}
+
+	leases := p.expired(now.Add(-p.GracePeriod))
+	for _, l := range leases {
+		p.reclaim(l)
+	}
+
+	p.reclaimed = append(p.reclaimed, p.quarantine.Release(now)...)
+
+	if len(leases) > 0 {
+		log.Printf("Reclaimed %d expired DHCPv4 leases", len(leases))
+	}
+}
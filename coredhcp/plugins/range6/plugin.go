@@ -0,0 +1,474 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package range6 implements a plugin leasing IA_NA addresses out of a range of
+// IPv6 addresses.
+//
+// Leases are bound to an identity association, that is a client DUID and the
+// IAID of one of its IA_NA options, and persisted to a SQLite database so
+// that they survive server restarts.
+//
+// Arguments for the plugin configuration are as follows, in this order:
+// - lease file: the database where leases are stored
+// - start IP, end IP: the range addresses are allocated from, inclusive
+// - preferred lifetime: the preferred lifetime of the leased addresses. T1
+// and T2 are 0.5 and 0.8 times this value, as recommended by RFC 8415
+// - valid lifetime: optional, the valid lifetime of the leased addresses.
+// Defaults to the preferred lifetime
+package range6
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metrics"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+)
+
+var log = logger.GetLogger("plugins/range6")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:   "range6",
+	Setup6: setupRange6,
+}
+
+// Record holds an IPv6 lease record
+type Record struct {
+	IP net.IP
+	// expires is the unix time the valid lifetime of the lease ends
+	expires int
+}
+
+// PluginState is the data held by an instance of the range6 plugin
+type PluginState struct {
+	// Rough lock for the whole plugin, as in the range plugin
+	sync.Mutex
+	// Recordsv6 holds a DUID/IAID -> IP address and lease time mapping
+	Recordsv6         map[string]*Record
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	leasedb           *leasestore.Store
+	allocator         allocators.Allocator
+	// rangeStart and rangeEnd bound the addresses leased by the plugin
+	rangeStart net.IP
+	rangeEnd   net.IP
+	// quarantine holds the addresses declined with a Decline
+	quarantine *leasestore.Quarantine
+	// retired is set once an instance set up by a reload took over the
+	// lease database, after which this one leaves it alone
+	retired bool
+}
+
+// recordKey computes the key of the Recordsv6 map for an IA_NA of a client
+func recordKey(duid dhcpv6.DUID, iaid [4]byte) string {
+	return hex.EncodeToString(duid.ToBytes()) + "/" + hex.EncodeToString(iaid[:])
+}
+
+// Handler6 handles DHCPv6 packets for the range6 plugin
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Error(err)
+		return nil, true
+	}
+
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew,
+		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+	default:
+		// Nothing to lease
+		return resp, false
+	}
+
+	client := msg.Options.ClientID()
+	if client == nil {
+		log.Error("Invalid packet received, no clientID")
+		return nil, true
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.retired {
+		return nil, true
+	}
+	for _, iana := range msg.Options.IANA() {
+		key := recordKey(client, iana.IaId)
+		var ia *dhcpv6.OptIANA
+		switch msg.Type() {
+		case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest:
+			ia = p.lease(key, iana)
+		case dhcpv6.MessageTypeRenew:
+			ia = p.renew(key, iana, false)
+		case dhcpv6.MessageTypeRebind:
+			ia = p.renew(key, iana, true)
+		case dhcpv6.MessageTypeRelease:
+			ia = p.release(key, iana)
+		case dhcpv6.MessageTypeDecline:
+			ia = p.decline(key, iana)
+		}
+		if ia != nil {
+			resp.AddOption(ia)
+		}
+	}
+
+	if msg.Type() == dhcpv6.MessageTypeRelease || msg.Type() == dhcpv6.MessageTypeDecline {
+		// RFC 8415 18.3.7 and 18.3.8: the reply carries a success status,
+		// along with an IA for each binding we could not find
+		resp.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: dhcpIana.StatusSuccess})
+	}
+	return resp, false
+}
+
+// inRange returns true if the address is part of the range of the plugin
+func (p *PluginState) inRange(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+	return bytes.Compare(ip, p.rangeStart) >= 0 && bytes.Compare(ip, p.rangeEnd) <= 0
+}
+
+// isFree returns true if no client holds the address and it isn't
+// quarantined. The caller must hold the plugin lock.
+func (p *PluginState) isFree(ip net.IP) bool {
+	if p.quarantine.Has(ip) {
+		return false
+	}
+	for _, record := range p.Recordsv6 {
+		if record.IP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAddress returns true if the IA_NA sent by a client contains ip
+func hasAddress(iana *dhcpv6.OptIANA, ip net.IP) bool {
+	for _, addr := range iana.Options.Addresses() {
+		if addr.IPv6Addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate leases a new address, honouring the hint if it is free. When the
+// allocator is full, expired leases are reclaimed first.
+// The caller must hold the plugin lock.
+func (p *PluginState) allocate(hint net.IP) (net.IP, error) {
+	ip, err := p.allocator.Allocate(net.IPNet{IP: hint})
+	if errors.Is(err, allocators.ErrNoAddrAvail) && p.reclaim(time.Now()) > 0 {
+		ip, err = p.allocator.Allocate(net.IPNet{IP: hint})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ip.IP.To16(), nil
+}
+
+// newRecord stores a new lease of ip for an IA_NA. The caller must hold the
+// plugin lock.
+func (p *PluginState) newRecord(key string, ip net.IP) *Record {
+	rec := Record{
+		IP:      ip.To16(),
+		expires: int(time.Now().Add(p.ValidLifetime).Unix()),
+	}
+	if err := p.saveIPAddress(key, &rec); err != nil {
+		log.Errorf("Could not persist lease for %s: %v", key, err)
+	}
+	p.Recordsv6[key] = &rec
+	return &rec
+}
+
+// extend pushes the end of a lease past the lifetimes we are giving out
+func (p *PluginState) extend(key string, record *Record) {
+	expiry := time.Now().Add(p.ValidLifetime).Round(time.Second)
+	if time.Unix(int64(record.expires), 0).Before(expiry) {
+		record.expires = int(expiry.Unix())
+		if err := p.saveIPAddress(key, record); err != nil {
+			log.Errorf("Could not persist lease for %s: %v", key, err)
+		}
+	}
+}
+
+// reply builds the IA_NA answered for a lease. Other addresses the client
+// asked for are returned with zero lifetimes, telling it to stop using them.
+func (p *PluginState) reply(iana *dhcpv6.OptIANA, record *Record) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{
+		IaId: iana.IaId,
+		T1:   p.PreferredLifetime / 2,
+		T2:   p.PreferredLifetime * 4 / 5,
+	}
+	ia.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          record.IP,
+		PreferredLifetime: p.PreferredLifetime,
+		ValidLifetime:     p.ValidLifetime,
+	})
+	for _, addr := range iana.Options.Addresses() {
+		if !addr.IPv6Addr.Equal(record.IP) {
+			ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: addr.IPv6Addr})
+		}
+	}
+	return ia
+}
+
+// status builds an IA_NA carrying only a status code
+func status(iana *dhcpv6.OptIANA, code dhcpIana.StatusCode) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{IaId: iana.IaId}
+	ia.Options.Add(&dhcpv6.OptStatusCode{StatusCode: code})
+	return ia
+}
+
+// lease handles an IA_NA in a Solicit or a Request, giving out the address
+// bound to it or a new one.
+func (p *PluginState) lease(key string, iana *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	record, ok := p.Recordsv6[key]
+	if ok {
+		p.extend(key, record)
+		return p.reply(iana, record)
+	}
+
+	var hint net.IP
+	if addr := iana.Options.OneAddress(); addr != nil && p.inRange(addr.IPv6Addr) {
+		hint = addr.IPv6Addr
+	}
+	ip, err := p.allocate(hint)
+	if err != nil {
+		log.Errorf("Could not allocate IP for %s: %v", key, err)
+		return status(iana, dhcpIana.StatusNoAddrsAvail)
+	}
+	log.Printf("Leasing new IPv6 address %s to %s", ip, key)
+	return p.reply(iana, p.newRecord(key, ip))
+}
+
+// renew handles an IA_NA in a Renew or a Rebind. A rebinding client may have
+// been leased its address by another server, or by us before its lease was
+// lost: it is given the address back if it is ours and free.
+func (p *PluginState) renew(key string, iana *dhcpv6.OptIANA, rebind bool) *dhcpv6.OptIANA {
+	record, ok := p.Recordsv6[key]
+	if ok {
+		p.extend(key, record)
+		return p.reply(iana, record)
+	}
+	if !rebind || len(iana.Options.Addresses()) == 0 {
+		log.Printf("No binding for %s, cannot renew", key)
+		return status(iana, dhcpIana.StatusNoBinding)
+	}
+
+	for _, addr := range iana.Options.Addresses() {
+		if !p.inRange(addr.IPv6Addr) || !p.isFree(addr.IPv6Addr) {
+			continue
+		}
+		ip, err := p.allocate(addr.IPv6Addr)
+		if err != nil {
+			continue
+		}
+		if !ip.Equal(addr.IPv6Addr) {
+			if err := p.allocator.Free(net.IPNet{IP: ip}); err != nil {
+				log.Errorf("Could not free IP %s: %v", ip, err)
+			}
+			continue
+		}
+		log.Printf("No binding for %s, leasing it back %s", key, ip)
+		return p.reply(iana, p.newRecord(key, ip))
+	}
+
+	// None of the addresses are ours to give: tell the client to stop using them
+	log.Printf("No binding for %s, and its addresses are not available", key)
+	ia := &dhcpv6.OptIANA{IaId: iana.IaId}
+	for _, addr := range iana.Options.Addresses() {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: addr.IPv6Addr})
+	}
+	return ia
+}
+
+// release frees the address bound to an IA_NA in a Release
+func (p *PluginState) release(key string, iana *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	record, ok := p.Recordsv6[key]
+	if !ok || !hasAddress(iana, record.IP) {
+		log.Printf("%s released an address it does not hold, ignoring", key)
+		return status(iana, dhcpIana.StatusNoBinding)
+	}
+	if err := p.allocator.Free(net.IPNet{IP: record.IP}); err != nil {
+		log.Errorf("Could not free IP %s released by %s: %v", record.IP, key, err)
+	}
+	delete(p.Recordsv6, key)
+	if err := p.deleteIPAddress(key); err != nil {
+		log.Errorf("Could not delete lease for %s: %v", key, err)
+	}
+	log.Printf("%s released IPv6 address %s", key, record.IP)
+	return nil
+}
+
+// decline handles an IA_NA in a Decline, sent by a client which found the
+// address we leased it already in use. The address is quarantined, and the
+// client will get another one when it restarts configuration.
+func (p *PluginState) decline(key string, iana *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	record, ok := p.Recordsv6[key]
+	if !ok || !hasAddress(iana, record.IP) {
+		log.Printf("%s declined an address it was not leased, ignoring", key)
+		return status(iana, dhcpIana.StatusNoBinding)
+	}
+	delete(p.Recordsv6, key)
+	if err := p.deleteIPAddress(key); err != nil {
+		log.Errorf("Could not delete lease for %s: %v", key, err)
+	}
+	// The address stays taken in the allocator while it is quarantined
+	if err := p.quarantine.Add(record.IP); err != nil {
+		log.Errorf("Could not persist declined IP %s: %v", record.IP, err)
+	}
+	log.Warningf("%s declined IPv6 address %s, quarantining it for %s", key, record.IP, leasestore.DeclineHoldTime)
+	return nil
+}
+
+func setupRange6(args ...string) (handler.Handler6, error) {
+	p, err := newPluginState(args...)
+	if err != nil {
+		return nil, err
+	}
+	plugins.OnClose(func() { p.leasedb.Close() })
+	leasestore.Handover("range6 "+args[0], p.retire, p.reload, sweepInterval, p.sweep)
+	// The pool is exported once the plugin replaces the running one
+	var unregister func()
+	plugins.OnCommit(func() {
+		unregister = metrics.RegisterPool("range6", fmt.Sprintf("%s-%s", p.rangeStart, p.rangeEnd), p.usage)
+	})
+	plugins.OnClose(func() {
+		if unregister != nil {
+			unregister()
+		}
+	})
+
+	return p.Handler6, nil
+}
+
+// retire stops the plugin from leasing, once the instance replacing it on a
+// reload took over the lease database
+func (p *PluginState) retire() {
+	p.Lock()
+	defer p.Unlock()
+	p.retired = true
+}
+
+// reload reads the leases again, with those granted by the instance this one
+// replaces since it was set up, and drops what expired meanwhile
+func (p *PluginState) reload() {
+	p.Lock()
+	defer p.Unlock()
+	var err error
+	p.allocator, err = bitmap.NewIPv6Allocator(p.rangeStart, p.rangeEnd)
+	if err == nil {
+		err = p.loadLeases()
+	}
+	if err != nil {
+		log.Errorf("Could not reload leases: %v", err)
+		return
+	}
+	log.Printf("Reloaded %d DHCPv6 leases", len(p.Recordsv6))
+	if n := p.reclaim(time.Now()); n > 0 {
+		log.Printf("Reclaimed %d expired DHCPv6 addresses", n)
+	}
+}
+
+// usage returns the number of addresses of the range, and how many of them
+// are leased or quarantined
+func (p *PluginState) usage() (size, used float64) {
+	p.Lock()
+	defer p.Unlock()
+	// the range is bounded by the allocator, so this can't fail
+	distance, _ := allocators.Offset(p.rangeEnd, p.rangeStart, 128)
+	return float64(distance + 1), float64(len(p.Recordsv6) + p.quarantine.Len())
+}
+
+// newPluginState parses the arguments of the plugin, opens its lease database
+// and loads the leases and quarantined addresses into the allocator
+func newPluginState(args ...string) (*PluginState, error) {
+	var (
+		err error
+		p   PluginState
+	)
+
+	if len(args) < 4 {
+		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, preferred lifetime) and optionally a valid lifetime, got: %d", len(args))
+	}
+	filename := args[0]
+	if filename == "" {
+		return nil, errors.New("file name cannot be empty")
+	}
+	p.rangeStart = net.ParseIP(args[1])
+	if p.rangeStart == nil || p.rangeStart.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 address: %v", args[1])
+	}
+	p.rangeEnd = net.ParseIP(args[2])
+	if p.rangeEnd == nil || p.rangeEnd.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 address: %v", args[2])
+	}
+	if bytes.Compare(p.rangeStart, p.rangeEnd) >= 0 {
+		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	}
+
+	p.allocator, err = bitmap.NewIPv6Allocator(p.rangeStart, p.rangeEnd)
+	if err != nil {
+		return nil, fmt.Errorf("could not create an allocator: %w", err)
+	}
+
+	p.PreferredLifetime, err = time.ParseDuration(args[3])
+	if err != nil || p.PreferredLifetime <= 0 {
+		return nil, fmt.Errorf("invalid preferred lifetime: %v", args[3])
+	}
+	p.ValidLifetime = p.PreferredLifetime
+	if len(args) > 4 {
+		p.ValidLifetime, err = time.ParseDuration(args[4])
+		if err != nil || p.ValidLifetime < p.PreferredLifetime {
+			return nil, fmt.Errorf("invalid valid lifetime, it cannot be shorter than the preferred lifetime: %v", args[4])
+		}
+	}
+
+	if err := p.registerBackingDB(filename); err != nil {
+		return nil, fmt.Errorf("could not setup lease storage: %w", err)
+	}
+	if err := p.loadLeases(); err != nil {
+		p.leasedb.Close()
+		return nil, err
+	}
+	log.Printf("Loaded %d DHCPv6 leases from %s", len(p.Recordsv6), filename)
+	return &p, nil
+}
+
+// loadLeases reads the leases and the quarantined addresses from the lease
+// database, and takes them in the allocator
+func (p *PluginState) loadLeases() error {
+	var err error
+	p.Recordsv6, err = loadRecords(p.leasedb)
+	if err != nil {
+		return fmt.Errorf("could not load records from file: %v", err)
+	}
+
+	for _, v := range p.Recordsv6 {
+		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
+		if err != nil {
+			return fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+		}
+		if !ip.IP.Equal(v.IP) {
+			return fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+		}
+	}
+
+	p.quarantine, err = p.leasedb.LoadQuarantine(p.allocator, time.Now())
+	return err
+}
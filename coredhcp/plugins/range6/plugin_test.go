@@ -0,0 +1,203 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+)
+
+var testIAID = [4]byte{0x12, 0x34, 0x56, 0x78}
+
+func testPluginState(t *testing.T) *PluginState {
+	p, err := newPluginState(":memory:", "2001:db8::10", "2001:db8::20", "1h", "2h")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.leasedb.Close() })
+	return p
+}
+
+// testExchange sends a message with a single IA_NA, holding the given
+// addresses, and returns the IA_NA of the reply
+func testExchange(t *testing.T, h func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool), mt dhcpv6.MessageType, addrs ...net.IP) (*dhcpv6.Message, *dhcpv6.OptIANA) {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{
+		HWType:        dhcpIana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}))
+	iana := &dhcpv6.OptIANA{IaId: testIAID}
+	for _, addr := range addrs {
+		iana.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: addr})
+	}
+	req.AddOption(iana)
+
+	// the core builds Advertise and Reply messages alike
+	resp := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: req.TransactionID}
+	resp.AddOption(req.GetOneOption(dhcpv6.OptionClientID))
+	result, stop := h(req, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	msg := result.(*dhcpv6.Message)
+	return msg, msg.Options.OneIANA()
+}
+
+func TestLease(t *testing.T) {
+	p := testPluginState(t)
+
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeSolicit)
+	require.NotNil(t, ia)
+	assert.Equal(t, testIAID, ia.IaId)
+	assert.Equal(t, 30*time.Minute, ia.T1)
+	assert.Equal(t, 48*time.Minute, ia.T2)
+	addr := ia.Options.OneAddress()
+	require.NotNil(t, addr)
+	assert.True(t, p.inRange(addr.IPv6Addr))
+	assert.Equal(t, time.Hour, addr.PreferredLifetime)
+	assert.Equal(t, 2*time.Hour, addr.ValidLifetime)
+	leased := addr.IPv6Addr
+
+	// the same IA gets the same address, and stale addresses are invalidated
+	_, ia = testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest, net.ParseIP("2001:db8::1"))
+	addrs := ia.Options.Addresses()
+	require.Len(t, addrs, 2)
+	assert.True(t, addrs[0].IPv6Addr.Equal(leased))
+	assert.True(t, addrs[1].IPv6Addr.Equal(net.ParseIP("2001:db8::1")))
+	assert.Zero(t, addrs[1].ValidLifetime)
+
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+}
+
+func TestLeaseHint(t *testing.T) {
+	p := testPluginState(t)
+	hint := net.ParseIP("2001:db8::18")
+
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeSolicit, hint)
+	require.NotNil(t, ia.Options.OneAddress())
+	assert.True(t, ia.Options.OneAddress().IPv6Addr.Equal(hint))
+}
+
+func TestRenew(t *testing.T) {
+	p := testPluginState(t)
+
+	// no binding for this IA yet
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRenew, net.ParseIP("2001:db8::18"))
+	require.NotNil(t, ia.Options.Status())
+	assert.Equal(t, dhcpIana.StatusNoBinding, ia.Options.Status().StatusCode)
+
+	// a rebinding client gets its address back if it is free
+	_, ia = testExchange(t, p.Handler6, dhcpv6.MessageTypeRebind, net.ParseIP("2001:db8::18"))
+	require.NotNil(t, ia.Options.OneAddress())
+	assert.True(t, ia.Options.OneAddress().IPv6Addr.Equal(net.ParseIP("2001:db8::18")))
+	assert.Equal(t, 2*time.Hour, ia.Options.OneAddress().ValidLifetime)
+
+	_, ia = testExchange(t, p.Handler6, dhcpv6.MessageTypeRenew, net.ParseIP("2001:db8::18"))
+	require.NotNil(t, ia.Options.OneAddress())
+	assert.True(t, ia.Options.OneAddress().IPv6Addr.Equal(net.ParseIP("2001:db8::18")))
+	assert.Nil(t, ia.Options.Status())
+}
+
+func TestRebindForeignAddress(t *testing.T) {
+	p := testPluginState(t)
+
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRebind, net.ParseIP("2001:db8:1::1"))
+	addrs := ia.Options.Addresses()
+	require.Len(t, addrs, 1)
+	assert.Zero(t, addrs[0].PreferredLifetime)
+	assert.Zero(t, addrs[0].ValidLifetime)
+	assert.Empty(t, p.Recordsv6)
+}
+
+func TestRelease(t *testing.T) {
+	p := testPluginState(t)
+
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest)
+	leased := ia.Options.OneAddress().IPv6Addr
+
+	msg, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRelease, leased)
+	assert.Nil(t, ia)
+	require.NotNil(t, msg.Options.Status())
+	assert.Equal(t, dhcpIana.StatusSuccess, msg.Options.Status().StatusCode)
+	assert.Empty(t, p.Recordsv6)
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// the binding is gone now
+	_, ia = testExchange(t, p.Handler6, dhcpv6.MessageTypeRelease, leased)
+	require.NotNil(t, ia)
+	assert.Equal(t, dhcpIana.StatusNoBinding, ia.Options.Status().StatusCode)
+}
+
+func TestDecline(t *testing.T) {
+	p := testPluginState(t)
+
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest)
+	declined := ia.Options.OneAddress().IPv6Addr
+
+	msg, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeDecline, declined)
+	assert.Nil(t, ia)
+	assert.Equal(t, dhcpIana.StatusSuccess, msg.Options.Status().StatusCode)
+	assert.True(t, p.quarantine.Has(declined))
+
+	_, ia = testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest, declined)
+	assert.False(t, ia.Options.OneAddress().IPv6Addr.Equal(declined))
+
+	// the quarantine ends eventually
+	p.sweep(time.Now().Add(leasestore.DeclineHoldTime))
+	assert.False(t, p.quarantine.Has(declined))
+}
+
+func TestUsage(t *testing.T) {
+	p := testPluginState(t)
+	_, ia := testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest)
+	testExchange(t, p.Handler6, dhcpv6.MessageTypeDecline, ia.Options.OneAddress().IPv6Addr)
+	testExchange(t, p.Handler6, dhcpv6.MessageTypeRequest)
+
+	size, used := p.usage()
+	assert.Equal(t, float64(17), size)
+	assert.Equal(t, float64(2), used, "a lease and a quarantined address")
+}
+
+func TestSetupReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases6.sqlite3")
+	h, err := setupRange6(filename, "2001:db8::10", "2001:db8::20", "1h", "2h")
+	require.NoError(t, err)
+	_, ia := testExchange(t, h, dhcpv6.MessageTypeRequest)
+	leased := ia.Options.OneAddress().IPv6Addr
+
+	h, err = setupRange6(filename, "2001:db8::10", "2001:db8::20", "1h", "2h")
+	require.NoError(t, err)
+	_, ia = testExchange(t, h, dhcpv6.MessageTypeRenew, leased)
+	require.NotNil(t, ia.Options.OneAddress())
+	assert.True(t, ia.Options.OneAddress().IPv6Addr.Equal(leased))
+
+	_, err = setupRange6(filename, "2001:db8::10", "2001:db8::20", "1h", "30m")
+	assert.Error(t, err, "valid lifetime shorter than the preferred lifetime")
+	_, err = setupRange6(filename, "10.0.0.1", "2001:db8::20", "1h")
+	assert.Error(t, err, "IPv4 start")
+}
+
+func TestStorageNumericKeys(t *testing.T) {
+	p := testPluginState(t)
+	// hex keys made only of digits must not be mangled by the database
+	key := "00030001000000000001/00000001"
+	rec := &Record{IP: net.ParseIP("2001:db8::10"), expires: 1}
+	require.NoError(t, p.saveIPAddress(key, rec))
+	stored, err := loadRecords(p.leasedb)
+	require.NoError(t, err)
+	assert.Contains(t, stored, key)
+}
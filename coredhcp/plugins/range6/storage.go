@@ -0,0 +1,95 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+)
+
+func loadDB(path string) (*leasestore.Store, error) {
+	return leasestore.Open(path,
+		"create table if not exists leases6 (duid text not null, iaid text not null, ip text not null, expiry int, primary key (duid, iaid))",
+		"declined6")
+}
+
+// loadRecords loads the leases stored in the database, keyed by DUID and IAID
+func loadRecords(db *leasestore.Store) (map[string]*Record, error) {
+	rows, err := db.Query("select duid, iaid, ip, expiry from leases6")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases database: %w", err)
+	}
+	defer rows.Close()
+	var (
+		duid, iaid, ip string
+		expiry         int
+		records        = make(map[string]*Record)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&duid, &iaid, &ip, &expiry); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ipaddr := net.ParseIP(ip)
+		if ipaddr.To16() == nil || ipaddr.To4() != nil {
+			return nil, fmt.Errorf("expected an IPv6 address, got: %v", ipaddr)
+		}
+		records[duid+"/"+iaid] = &Record{IP: ipaddr, expires: expiry}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed lease database row scanning: %w", err)
+	}
+	return records, nil
+}
+
+// splitKey returns the DUID and IAID parts of a record key
+func splitKey(key string) (string, string, error) {
+	duid, iaid, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", "", fmt.Errorf("malformed record key: %s", key)
+	}
+	return duid, iaid, nil
+}
+
+// saveIPAddress writes out a lease to storage
+func (p *PluginState) saveIPAddress(key string, record *Record) error {
+	duid, iaid, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := p.leasedb.Exec("insert or replace into leases6(duid, iaid, ip, expiry) values (?, ?, ?, ?)",
+		duid, iaid, record.IP.String(), record.expires); err != nil {
+		return fmt.Errorf("record insert/update failed: %w", err)
+	}
+	return nil
+}
+
+// deleteIPAddress removes a lease from storage
+func (p *PluginState) deleteIPAddress(key string) error {
+	duid, iaid, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := p.leasedb.Exec("delete from leases6 where duid = ? and iaid = ?", duid, iaid); err != nil {
+		return fmt.Errorf("record delete failed: %w", err)
+	}
+	return nil
+}
+
+// registerBackingDB installs a database connection string as the backing store for leases
+func (p *PluginState) registerBackingDB(filename string) error {
+	if p.leasedb != nil {
+		return errors.New("cannot swap out a lease database while running")
+	}
+	newLeaseDB, err := loadDB(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open lease database %s: %w", filename, err)
+	}
+	p.leasedb = newLeaseDB
+	return nil
+}
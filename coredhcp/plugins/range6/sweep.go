@@ -0,0 +1,48 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"net"
+	"time"
+)
+
+// sweepInterval is how often expired leases are looked for
+const sweepInterval = time.Minute
+
+// reclaim frees the leases whose valid lifetime is over, and the declined
+// addresses whose quarantine is over. It returns how many addresses went back
+// to the allocator. The caller must hold the plugin lock.
+func (p *PluginState) reclaim(now time.Time) int {
+	var n int
+	for key, record := range p.Recordsv6 {
+		if int64(record.expires) > now.Unix() {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: record.IP}); err != nil {
+			log.Errorf("Could not free expired IP %s of %s: %v", record.IP, key, err)
+		}
+		delete(p.Recordsv6, key)
+		if err := p.deleteIPAddress(key); err != nil {
+			log.Errorf("Could not delete expired lease for %s: %v", key, err)
+		}
+		log.Debugf("Reclaimed IP %s from %s, expired at %s", record.IP, key, time.Unix(int64(record.expires), 0))
+		n++
+	}
+
+	return n + len(p.quarantine.Release(now))
+}
+
+// sweep reclaims the expired leases and declined addresses
+func (p *PluginState) sweep(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	if p.retired {
+		return
+	}
+	if n := p.reclaim(now); n > 0 {
+		log.Printf("Reclaimed %d expired DHCPv6 addresses", n)
+	}
+}
@@ -0,0 +1,713 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	maxIdle     = 10
+	idleTimeout = 240 * time.Second
+	// roleCheck is how long a pooled connection may stay idle before its
+	// role is checked again, to notice failovers of sentinel masters
+	roleCheck = time.Second
+	// clusterSlots is the number of hash slots of a cluster
+	clusterSlots = 16384
+	// maxRedirects bounds the MOVED and ASK redirections of a command
+	maxRedirects = 5
+	// minSlotsRefresh is the minimum time between two reads of the slots
+	minSlotsRefresh = 100 * time.Millisecond
+)
+
+// Config holds the settings of the connections to a redis server, to the
+// master found by sentinels, or to a cluster
+type Config struct {
+	// Addrs are the server, the sentinels or the nodes of the cluster
+	Addrs []string
+	// Master is the name of the master monitored by the sentinels at Addrs
+	Master string
+	// Cluster is true if Addrs are nodes of a cluster
+	Cluster          bool
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	// TLS is set to connect with TLS
+	TLS *tls.Config
+	// Replicas is true if reads may be served by the replicas of the
+	// master, or of the masters of the cluster
+	Replicas bool
+}
+
+// ParseURL returns the settings given by a host:port address or a URL:
+//   - redis://[user:password@]host:port[/db] or rediss:// with TLS
+//   - redis-sentinel://[user:password@]host:port[,host:port...]/master[/db]
+//     where the sentinels are given, and master is the name of the master
+//   - redis-cluster://[user:password@]host:port[,host:port...]
+//     where some nodes of the cluster are given
+//
+// The tls=true query parameter connects with TLS with the sentinel and
+// cluster schemes, and insecure=true skips the verification of the server
+// certificates. replicas=true lets the replicas serve the reads, and
+// sentinel_password gives the password of the sentinels. Other parameters are
+// ignored.
+func ParseURL(rawurl string) (*Config, error) {
+	if !strings.Contains(rawurl, "://") {
+		return &Config{Addrs: []string{rawurl}}, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	c := &Config{Addrs: strings.Split(u.Host, ",")}
+	for _, addr := range c.Addrs {
+		if addr == "" {
+			return nil, fmt.Errorf("invalid redis URL %s: empty address", u.Redacted())
+		}
+	}
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	query := u.Query()
+	useTLS := query.Get("tls") == "true"
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch u.Scheme {
+	case "rediss":
+		useTLS = true
+		fallthrough
+	case "redis":
+		if len(c.Addrs) != 1 {
+			return nil, fmt.Errorf("invalid redis URL %s: a single server is expected", u.Redacted())
+		}
+	case "redis-sentinel":
+		if path[0] == "" {
+			return nil, fmt.Errorf("invalid redis URL %s: no master name", u.Redacted())
+		}
+		c.Master, path = path[0], path[1:]
+	case "redis-cluster":
+		c.Cluster = true
+	default:
+		return nil, fmt.Errorf("invalid redis URL %s: unknown scheme %s", u.Redacted(), u.Scheme)
+	}
+	if len(path) > 0 && path[0] != "" {
+		if c.Cluster {
+			return nil, fmt.Errorf("invalid redis URL %s: a cluster has no database", u.Redacted())
+		}
+		if c.DB, err = strconv.Atoi(path[0]); err != nil {
+			return nil, fmt.Errorf("invalid redis URL %s: invalid database %s", u.Redacted(), path[0])
+		}
+	}
+	if useTLS {
+		c.TLS = &tls.Config{InsecureSkipVerify: query.Get("insecure") == "true"}
+	}
+	c.Replicas = query.Get("replicas") == "true"
+	if c.Replicas && c.Master == "" && !c.Cluster {
+		return nil, fmt.Errorf("invalid redis URL %s: replicas requires sentinels or a cluster", u.Redacted())
+	}
+	c.SentinelPassword = query.Get("sentinel_password")
+	return c, nil
+}
+
+// String returns the addresses of the servers, for logs
+func (c *Config) String() string {
+	switch {
+	case c.Cluster:
+		return "cluster " + strings.Join(c.Addrs, ",")
+	case c.Master != "":
+		return "master " + c.Master + " of sentinels " + strings.Join(c.Addrs, ",")
+	}
+	return c.Addrs[0]
+}
+
+// dial opens a connection to a server, sentinel or node
+func (c *Config) dial(addr, password string, db int) (redis.Conn, error) {
+	opts := []redis.DialOption{redis.DialDatabase(db)}
+	if c.Username != "" {
+		opts = append(opts, redis.DialUsername(c.Username))
+	}
+	if password != "" {
+		opts = append(opts, redis.DialPassword(password))
+	}
+	if c.TLS != nil {
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(c.TLS))
+	}
+	return redis.Dial("tcp", addr, opts...)
+}
+
+// Pools returns a pool of connections for writes, and a pool of connections
+// for reads which is the same unless the replicas serve the reads, along with
+// a function closing the connections of both
+func (c *Config) Pools() (write, read *redis.Pool, closePools func()) {
+	closePools = func() {
+		write.Close()
+		read.Close()
+	}
+	if c.Cluster {
+		cl := newCluster(c.Addrs, c.Replicas, func(addr string) (redis.Conn, error) {
+			return c.dial(addr, c.Password, 0)
+		})
+		write = &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return &clusterConn{cluster: cl}, nil
+			},
+		}
+		read = &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return &clusterConn{cluster: cl, read: true}, nil
+			},
+		}
+		return write, read, func() {
+			write.Close()
+			read.Close()
+			cl.close()
+		}
+	}
+	if c.Master == "" {
+		write = &redis.Pool{
+			MaxIdle:     maxIdle,
+			IdleTimeout: idleTimeout,
+			Dial: func() (redis.Conn, error) {
+				return c.dial(c.Addrs[0], c.Password, c.DB)
+			},
+		}
+		read = write
+		return write, read, closePools
+	}
+
+	s := &sentinel{
+		master: c.Master,
+		addrs:  append([]string(nil), c.Addrs...),
+		dial: func(addr string) (redis.Conn, error) {
+			return c.dial(addr, c.SentinelPassword, 0)
+		},
+	}
+	dialMaster := func() (redis.Conn, error) {
+		addr, err := s.masterAddr()
+		if err != nil {
+			return nil, err
+		}
+		return c.dial(addr, c.Password, c.DB)
+	}
+	write = &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		Dial:        dialMaster,
+		// A failover turns the master into a replica, which refuses writes
+		TestOnBorrow: checkRole("master"),
+	}
+	if !c.Replicas {
+		read = write
+		return write, read, closePools
+	}
+	read = &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			addrs, err := s.replicaAddrs()
+			if err != nil || len(addrs) == 0 {
+				return dialMaster()
+			}
+			return c.dial(addrs[rand.Intn(len(addrs))], c.Password, c.DB)
+		},
+		TestOnBorrow: checkRole("slave", "master"),
+	}
+	return write, read, closePools
+}
+
+// sentinel finds the master and the replicas of a set of servers monitored
+// by sentinels
+type sentinel struct {
+	master string
+	dial   func(addr string) (redis.Conn, error)
+
+	sync.Mutex
+	addrs []string // the sentinel which answered last comes first
+}
+
+// do runs a command on the first sentinel which answers it
+func (s *sentinel) do(cmd string, args ...interface{}) (interface{}, error) {
+	s.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.Unlock()
+
+	var errs []error
+	for i, addr := range addrs {
+		reply, err := s.doAddr(addr, cmd, args...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sentinel %s: %w", addr, err))
+			continue
+		}
+		if i > 0 {
+			s.Lock()
+			for j, a := range s.addrs {
+				if a == addr {
+					s.addrs[0], s.addrs[j] = s.addrs[j], s.addrs[0]
+				}
+			}
+			s.Unlock()
+		}
+		return reply, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *sentinel) doAddr(addr, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := s.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// masterAddr returns the address of the master
+func (s *sentinel) masterAddr() (string, error) {
+	addr, err := redis.Strings(s.do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err != nil {
+		return "", fmt.Errorf("no master %s: %w", s.master, err)
+	}
+	if len(addr) != 2 {
+		return "", fmt.Errorf("no master %s", s.master)
+	}
+	return addr[0] + ":" + addr[1], nil
+}
+
+// replicaAddrs returns the addresses of the replicas which are up
+func (s *sentinel) replicaAddrs() ([]string, error) {
+	replies, err := redis.Values(s.do("SENTINEL", "replicas", s.master))
+	if err != nil {
+		return nil, fmt.Errorf("no replicas of %s: %w", s.master, err)
+	}
+	var addrs []string
+	for _, reply := range replies {
+		replica, err := redis.StringMap(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !replicaUp(replica["flags"]) || replica["master-link-status"] != "ok" {
+			continue
+		}
+		addrs = append(addrs, replica["ip"]+":"+replica["port"])
+	}
+	return addrs, nil
+}
+
+// replicaUp returns false if the flags given by a sentinel show a replica is
+// down or disconnected
+func replicaUp(flags string) bool {
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	return true
+}
+
+// checkRole returns a function checking that a pooled connection is still
+// to a server of the given role
+func checkRole(roles ...string) func(redis.Conn, time.Time) error {
+	return func(conn redis.Conn, t time.Time) error {
+		if time.Since(t) < roleCheck {
+			return nil
+		}
+		reply, err := redis.Values(conn.Do("ROLE"))
+		if err != nil {
+			return err
+		}
+		if len(reply) == 0 {
+			return errors.New("empty ROLE reply")
+		}
+		role, err := redis.String(reply[0], nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range roles {
+			if role == r {
+				return nil
+			}
+		}
+		return fmt.Errorf("server is now a %s", role)
+	}
+}
+
+// slotRange is a range of hash slots and the nodes serving it, the master
+// first
+type slotRange struct {
+	start, end int
+	nodes      []string
+}
+
+// cluster routes the commands to the nodes of a redis cluster owning the
+// slots of their keys
+type cluster struct {
+	seeds []string
+	// replicas is true if the reads may be served by replicas
+	replicas bool
+	dial     func(addr string) (redis.Conn, error)
+
+	sync.RWMutex
+	slots     []slotRange // sorted
+	pools     map[string]*redis.Pool
+	refreshed time.Time
+}
+
+func newCluster(seeds []string, replicas bool, dial func(addr string) (redis.Conn, error)) *cluster {
+	return &cluster{seeds: seeds, replicas: replicas, dial: dial, pools: make(map[string]*redis.Pool)}
+}
+
+// refresh reads the slots of the nodes from the first node which answers
+func (c *cluster) refresh() error {
+	c.Lock()
+	defer c.Unlock()
+	if time.Since(c.refreshed) < minSlotsRefresh {
+		return nil
+	}
+	var errs []error
+	addrs := c.masterAddrs()
+	for _, addr := range c.seeds {
+		if !containsAddr(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range addrs {
+		slots, err := c.readSlots(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", addr, err))
+			continue
+		}
+		c.slots = slots
+		c.refreshed = time.Now()
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// masterAddrs returns the masters of the slots, with the lock held
+func (c *cluster) masterAddrs() []string {
+	var addrs []string
+	for _, s := range c.slots {
+		if !containsAddr(addrs, s.nodes[0]) {
+			addrs = append(addrs, s.nodes[0])
+		}
+	}
+	return addrs
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cluster) readSlots(addr string) ([]slotRange, error) {
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	replies, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	host := addr[:strings.LastIndex(addr, ":")]
+	var slots []slotRange
+	for _, reply := range replies {
+		values, err := redis.Values(reply, nil)
+		if err != nil || len(values) < 3 {
+			return nil, errors.New("malformed CLUSTER SLOTS reply")
+		}
+		var s slotRange
+		if s.start, err = redis.Int(values[0], nil); err != nil {
+			return nil, err
+		}
+		if s.end, err = redis.Int(values[1], nil); err != nil {
+			return nil, err
+		}
+		for _, v := range values[2:] {
+			node, err := redis.Values(v, nil)
+			if err != nil || len(node) < 2 {
+				return nil, errors.New("malformed CLUSTER SLOTS node")
+			}
+			ip, _ := redis.String(node[0], nil)
+			port, err := redis.Int(node[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			// an empty or unknown endpoint is the node which answered
+			if ip == "" || ip == "?" {
+				ip = host
+			}
+			s.nodes = append(s.nodes, ip+":"+strconv.Itoa(port))
+		}
+		slots = append(slots, s)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+	return slots, nil
+}
+
+// addr returns the address of a node serving a slot, a replica if read is
+// true and replicas may serve reads, and false if the slot is not known
+func (c *cluster) addr(slot int, read bool) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	i := sort.Search(len(c.slots), func(i int) bool { return c.slots[i].end >= slot })
+	if i == len(c.slots) || c.slots[i].start > slot {
+		return "", false
+	}
+	nodes := c.slots[i].nodes
+	if read && c.replicas && len(nodes) > 1 {
+		return nodes[1+rand.Intn(len(nodes)-1)], true
+	}
+	return nodes[0], true
+}
+
+// close closes the connections to the nodes
+func (c *cluster) close() {
+	c.Lock()
+	defer c.Unlock()
+	for addr, p := range c.pools {
+		p.Close()
+		delete(c.pools, addr)
+	}
+}
+
+// pool returns the pool of the connections to a node
+func (c *cluster) pool(addr string) *redis.Pool {
+	c.RLock()
+	p, ok := c.pools[addr]
+	c.RUnlock()
+	if ok {
+		return p
+	}
+	c.Lock()
+	defer c.Unlock()
+	if p, ok := c.pools[addr]; ok {
+		return p
+	}
+	p = &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			conn, err := c.dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			if c.replicas {
+				if _, err := conn.Do("READONLY"); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		},
+	}
+	c.pools[addr] = p
+	return p
+}
+
+// do runs a command on the node serving its key, following the redirections
+// of the cluster
+func (c *cluster) do(read bool, cmd string, args ...interface{}) (interface{}, error) {
+	c.RLock()
+	known := len(c.slots) > 0
+	c.RUnlock()
+	if !known {
+		if err := c.refresh(); err != nil {
+			return nil, fmt.Errorf("failed to read the cluster slots: %w", err)
+		}
+	}
+
+	addr := c.seeds[0]
+	if key, ok := commandKey(cmd, args); ok {
+		slot := keySlot(key)
+		if addr, ok = c.addr(slot, read); !ok {
+			return nil, fmt.Errorf("no node serves slot %d", slot)
+		}
+	} else {
+		c.RLock()
+		if masters := c.masterAddrs(); len(masters) > 0 {
+			addr = masters[0]
+		}
+		c.RUnlock()
+	}
+
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := c.doAddr(addr, asking, cmd, args...)
+		var rerr redis.Error
+		if !errors.As(err, &rerr) || i == maxRedirects {
+			return reply, err
+		}
+		fields := strings.Fields(string(rerr))
+		switch {
+		case len(fields) == 3 && fields[0] == "MOVED":
+			addr, asking = fields[2], false
+			if err := c.refresh(); err != nil {
+				log.Errorf("failed to read the cluster slots: %v", err)
+			}
+		case len(fields) == 3 && fields[0] == "ASK":
+			addr, asking = fields[2], true
+		case len(fields) > 0 && (fields[0] == "TRYAGAIN" || fields[0] == "CLUSTERDOWN"):
+			time.Sleep(minSlotsRefresh)
+		default:
+			return reply, err
+		}
+	}
+}
+
+func (c *cluster) doAddr(addr string, asking bool, cmd string, args ...interface{}) (interface{}, error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+	if asking {
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Do(cmd, args...)
+}
+
+// clusterConn is a connection to a whole cluster. Pipelined commands are run
+// one after the other, on their nodes, when they are flushed.
+type clusterConn struct {
+	cluster *cluster
+	read    bool
+	pending [][]interface{}
+	replies []clusterReply
+	closed  bool
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+func (c *clusterConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	if c.closed {
+		return errors.New("redis: closed")
+	}
+	return nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	if cmd == "" {
+		replies := make([]interface{}, len(c.replies))
+		for i, r := range c.replies {
+			replies[i] = r.reply
+			if r.err != nil {
+				replies[i] = r.err
+			}
+		}
+		c.replies = nil
+		return replies, nil
+	}
+	c.replies = nil
+	return c.cluster.do(c.read, cmd, args...)
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	for _, p := range c.pending {
+		reply, err := c.cluster.do(c.read, p[0].(string), p[1:]...)
+		c.replies = append(c.replies, clusterReply{reply, err})
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		return nil, errors.New("redis: no pending reply")
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	return r.reply, r.err
+}
+
+// commandKey returns the key of a command, which gives its slot, and false
+// for the commands without keys
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 || argString(args[1]) == "0" {
+			return "", false
+		}
+		return argString(args[2]), true
+	case "PING", "ECHO", "INFO", "CONFIG", "SCAN", "ROLE", "CLUSTER", "READONLY",
+		"READWRITE", "ASKING", "AUTH", "SELECT", "SCRIPT", "TIME", "DBSIZE", "CLIENT",
+		"KEYS", "FLUSHDB", "FLUSHALL", "MULTI", "EXEC", "DISCARD", "UNWATCH":
+		return "", false
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	default:
+		return fmt.Sprint(a)
+	}
+}
+
+// keySlot returns the hash slot of a key. Only the part of the key within its
+// first braces is hashed if it is not empty, so that keys can share a slot.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XModem) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,159 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package redis
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// KeyKind is a way of identifying a DHCPv6 client, which gives the format of
+// the keys of its reservations. The keys are shared with the postgres plugin.
+type KeyKind int
+
+const (
+	// KeyDUIDIAID identifies an IA_NA of a client: duid:<DUID>/<IAID>, both
+	// in hexadecimal, as the range6 plugin does
+	KeyDUIDIAID KeyKind = iota
+	// KeyDUID identifies a client by its DUID: duid:<DUID>
+	KeyDUID
+	// KeyMAC identifies a client by the MAC address found in its DUID or in
+	// the relay options: mac:<MAC>
+	KeyMAC
+)
+
+func (k KeyKind) String() string {
+	switch k {
+	case KeyDUIDIAID:
+		return "duid-iaid"
+	case KeyDUID:
+		return "duid"
+	case KeyMAC:
+		return "mac"
+	}
+	return fmt.Sprintf("KeyKind(%d)", int(k))
+}
+
+// DefaultKeyOrder looks reservations up from the most to the least specific
+var DefaultKeyOrder = []KeyKind{KeyDUIDIAID, KeyDUID, KeyMAC}
+
+// ParseKeyOrder parses a comma separated list of key kinds, such as
+// "duid-iaid,duid,mac", giving the order reservations are looked up in
+func ParseKeyOrder(s string) ([]KeyKind, error) {
+	var order []KeyKind
+	seen := make(map[KeyKind]bool)
+	for _, name := range strings.Split(s, ",") {
+		var kind KeyKind
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "duid-iaid", "duid+iaid":
+			kind = KeyDUIDIAID
+		case "duid":
+			kind = KeyDUID
+		case "mac":
+			kind = KeyMAC
+		default:
+			return nil, fmt.Errorf("invalid key kind %q, want duid-iaid, duid or mac", name)
+		}
+		if seen[kind] {
+			return nil, fmt.Errorf("key kind %s given twice", kind)
+		}
+		seen[kind] = true
+		order = append(order, kind)
+	}
+	return order, nil
+}
+
+// Client6 holds what identifies a DHCPv6 client
+type Client6 struct {
+	DUID dhcpv6.DUID
+	// MAC is nil if it can't be derived from the request
+	MAC net.HardwareAddr
+}
+
+// NewClient6 returns the identity of the client of a request, which must
+// carry a client ID
+func NewClient6(req dhcpv6.DHCPv6) (*Client6, error) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		return nil, err
+	}
+	duid := msg.Options.ClientID()
+	if duid == nil {
+		return nil, errors.New("no client ID")
+	}
+	c := &Client6{DUID: duid}
+	if mac, err := dhcpv6.ExtractMAC(req); err == nil {
+		c.MAC = mac
+	}
+	return c, nil
+}
+
+func (c *Client6) String() string {
+	if c.MAC != nil {
+		return fmt.Sprintf("DUID %s (MAC %s)", hex.EncodeToString(c.DUID.ToBytes()), c.MAC)
+	}
+	return "DUID " + hex.EncodeToString(c.DUID.ToBytes())
+}
+
+// Key returns the key of a kind for an IA_NA of the client, and false if the
+// client can't be identified that way
+func (c *Client6) Key(kind KeyKind, iaid [4]byte) (string, bool) {
+	switch kind {
+	case KeyDUIDIAID:
+		return "duid:" + hex.EncodeToString(c.DUID.ToBytes()) + "/" + hex.EncodeToString(iaid[:]), true
+	case KeyDUID:
+		return "duid:" + hex.EncodeToString(c.DUID.ToBytes()), true
+	case KeyMAC:
+		if c.MAC == nil {
+			return "", false
+		}
+		return "mac:" + c.MAC.String(), true
+	}
+	return "", false
+}
+
+// Keys returns all the keys the reservations of IA_NAs of the client can have
+func (c *Client6) Keys(order []KeyKind, ianas []*dhcpv6.OptIANA) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, iana := range ianas {
+		for _, kind := range order {
+			if key, ok := c.Key(kind, iana.IaId); ok && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// MatchIANA returns the keys of the reservations given to IA_NAs of the
+// client, in the order of the IA_NAs, empty for those without one. The
+// reservations are looked up in the given order of key kinds. A reservation
+// of the whole client, by DUID or MAC, is only given to one IA_NA, as an
+// address can't be in several of them.
+func (c *Client6) MatchIANA(order []KeyKind, ianas []*dhcpv6.OptIANA, found func(key string) bool) []string {
+	matched := make([]string, len(ianas))
+	given := make(map[string]bool)
+	for i, iana := range ianas {
+		for _, kind := range order {
+			key, ok := c.Key(kind, iana.IaId)
+			if !ok || given[key] || !found(key) {
+				continue
+			}
+			matched[i] = key
+			if kind != KeyDUIDIAID {
+				given[key] = true
+			}
+			break
+		}
+	}
+	return matched
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package redis
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyOrder(t *testing.T) {
+	order, err := ParseKeyOrder("mac, duid+iaid")
+	require.NoError(t, err)
+	assert.Equal(t, []KeyKind{KeyMAC, KeyDUIDIAID}, order)
+
+	_, err = ParseKeyOrder("duid,duid")
+	assert.Error(t, err, "duplicate kind")
+	_, err = ParseKeyOrder("uuid")
+	assert.Error(t, err, "unknown kind")
+}
+
+func TestClient6Keys(t *testing.T) {
+	mac, _ := net.ParseMAC("68:a8:6d:57:6c:e7")
+	client := &Client6{
+		DUID: &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: mac},
+		MAC:  mac,
+	}
+	iaid := [4]byte{0, 0, 0, 1}
+
+	key, ok := client.Key(KeyDUIDIAID, iaid)
+	assert.True(t, ok)
+	assert.Equal(t, "duid:0003000168a86d576ce7/00000001", key)
+	key, _ = client.Key(KeyDUID, iaid)
+	assert.Equal(t, "duid:0003000168a86d576ce7", key)
+	key, _ = client.Key(KeyMAC, iaid)
+	assert.Equal(t, "mac:68:a8:6d:57:6c:e7", key)
+
+	// A DUID-UUID carries no MAC
+	uuid := &Client6{DUID: &dhcpv6.DUIDUUID{UUID: [16]byte{1}}}
+	_, ok = uuid.Key(KeyMAC, iaid)
+	assert.False(t, ok)
+	keys := uuid.Keys(DefaultKeyOrder, []*dhcpv6.OptIANA{{IaId: iaid}})
+	assert.Equal(t, []string{
+		"duid:000401000000000000000000000000000000/00000001",
+		"duid:000401000000000000000000000000000000",
+	}, keys)
+}
+
+func TestMatchIANA(t *testing.T) {
+	mac, _ := net.ParseMAC("68:a8:6d:57:6c:e7")
+	client := &Client6{DUID: &dhcpv6.DUIDUUID{UUID: [16]byte{1}}, MAC: mac}
+	ianas := []*dhcpv6.OptIANA{{IaId: [4]byte{0, 0, 0, 1}}, {IaId: [4]byte{0, 0, 0, 2}}, {IaId: [4]byte{0, 0, 0, 3}}}
+	second, _ := client.Key(KeyDUIDIAID, ianas[1].IaId)
+	reservations := map[string]bool{second: true, "mac:68:a8:6d:57:6c:e7": true}
+	found := func(key string) bool { return reservations[key] }
+
+	// The reservation of the second IA_NA is its own, the MAC one goes to the
+	// first IA_NA only
+	assert.Equal(t, []string{"mac:68:a8:6d:57:6c:e7", second, ""}, client.MatchIANA(DefaultKeyOrder, ianas, found))
+
+	// Without the MAC in the order, only the second IA_NA is answered
+	assert.Equal(t, []string{"", second, ""}, client.MatchIANA([]KeyKind{KeyDUIDIAID, KeyDUID}, ianas, found))
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metrics"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/gomodule/redigo/redis"
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -26,17 +27,19 @@ var Plugin = plugins.Plugin{
 	Setup4: setup4,
 }
 
-// various global variables
-var (
-	log  = logger.GetLogger("plugins/redis")
+var log = logger.GetLogger("plugins/redis")
+
+// PluginState is the data held by an instance of the redis plugin
+type PluginState struct {
+	// pool reads the static leases, from the replicas if they are enabled
 	pool *redis.Pool
-	TTL  int 
-	TTLflag = false 
-)
+	// keyOrder is the order DHCPv6 reservations are looked up in
+	keyOrder []KeyKind
+}
 
-// Handler6 handles DHCPv6 packets for the redis plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	// TODO add IPv6 support
+// Handler6 handles DHCPv6 packets for the redis plugin. Each IA_NA of the
+// request is answered with the reservation found first in the key order.
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	m, err := req.GetInnerMessage()
 
 	if err != nil {
@@ -44,95 +47,124 @@ func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		return resp, false 
 	}
 
-	if m.Options.OneIANA() == nil {
+	ianas := m.Options.IANA()
+	if len(ianas) == 0 {
 		log.Debug("No address requested")
 		return resp, false
 	}
-	// 查看duid，duid对一台电脑是默认的。
-	// duid :=m.Options.ClientID()
-	// log.Printf("DUID: %v", duid)
 
-	mac, err := dhcpv6.ExtractMAC(req)
-    if err != nil {
-		log.Warningf("Could not find client MAC, passing")
+	client, err := NewClient6(req)
+	if err != nil {
+		log.Warningf("Could not identify the client: %v, passing", err)
 		return resp, false
 	}
-	log.Debugf("looking up an IPv6 address for MAC %s", mac.String())
-
-    // 其他插件里可能会有var recLock sync.RWMutex  是因为全局变量
-	// recLock.RLock()   // 这里是一个读锁  
-	// defer recLock.RUnlock() // 但是由于我用的是redis读取，支持多个客户端读取，暂时并没有需要读锁的场景
-    // 目前场景也比较单一，暂时不考虑加锁和多客户端的阻塞
+	log.Debugf("looking up IPv6 addresses for %s", client)
 
 	// Get redis connection from pool
-	conn := pool.Get()
+	conn := p.pool.Get()
 	defer conn.Close()
-    
-	options, err := redis.StringMap(conn.Do("HGETALL", "mac:"+mac.String()))
-	
+
+	reservations, err := hgetall(conn, client.Keys(p.keyOrder, ianas))
 	if err != nil {
 		log.Printf("Redis error: %s...dropping request", err)
+		metrics.BackendErrors.WithLabelValues("redis", "query").Inc()
 		return resp, false
 	}
-
-	if len(options) == 0 {
-		log.Printf("MAC %s not found...dropping request", mac.String())
+	matched := client.MatchIANA(p.keyOrder, ianas, func(key string) bool {
+		return reservations[key]["ipv6"] != ""
+	})
+
+	answered := false
+	for i, key := range matched {
+		if key == "" {
+			continue
+		}
+		optIANA, err := ianaFromHash(key, ianas[i].IaId, reservations[key])
+		if err != nil {
+			log.Printf("%s %v...IA_NA skipped", key, err)
+			continue
+		}
+		log.Printf("OK, Assigned IPv6 %s to %s by redis", optIANA.Options.OneAddress().IPv6Addr, key)
+		resp.AddOption(optIANA)
+		answered = true
+	}
+	if !answered {
+		log.Printf("%s not found...dropping request", client)
 		return resp, false
 	}
-    
-	optIAA := &dhcpv6.OptIAAddress{}
-    optIANA := &dhcpv6.OptIANA{}
-	// Parse options and update response
-	for option, value := range options {
-		switch option {
-		case "ipv6":
-			ip := net.ParseIP(value)
-			if ip == nil || ip.To16() == nil {
-				log.Printf("MAC %s has invalid IPv6 address: %s...dropping request", mac.String(), value)
-				return resp, false
-			}
+	return resp, true
+}
 
-			optIAA.IPv6Addr = ip
-			optIAA.PreferredLifetime = 3*time.Hour
-			optIAA.ValidLifetime = 3*time.Hour 
-		
-        case "t1":
-			T1, err := time.ParseDuration(value)
-			if err != nil {
-				log.Printf("MAC %s invalid T1 time %s...option skipped", mac.String(), value)
-				break
-			}
-            if T1 > optIAA.ValidLifetime{
-				optIANA.T1 = optIAA.ValidLifetime/2
-			} else {
-				optIANA.T1 = T1 
-			}
-			     
-		case "t2":
-			T2, err := time.ParseDuration(value)
-			if err != nil {
-				log.Printf("MAC %s invalid T2 time %s...option skipped", mac.String(), value)
-				break
-			}
-			if T2 > optIAA.ValidLifetime{
-				optIANA.T2 = optIAA.ValidLifetime * 4 / 5
-			} else {
-				optIANA.T2 = T2
-			}
+// hgetall reads the hashes of keys with a pipeline, leaving out those which
+// don't exist
+func hgetall(conn redis.Conn, keys []string) (map[string]map[string]string, error) {
+	for _, key := range keys {
+		if err := conn.Send("HGETALL", key); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]map[string]string, len(keys))
+	for _, key := range keys {
+		hash, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if len(hash) > 0 {
+			hashes[key] = hash
 		}
 	}
+	return hashes, nil
+}
 
-	optIANA.IaId = m.Options.OneIANA().IaId
-	optIANA.Options = dhcpv6.IdentityOptions{Options: []dhcpv6.Option{optIAA}}
-    log.Printf("OK, Assigned IPv6 %s to MAC %s by redis", optIAA.IPv6Addr, mac.String())
+// ianaFromHash builds the IA_NA iaid from the fields of the reservation key
+func ianaFromHash(key string, iaid [4]byte, options map[string]string) (*dhcpv6.OptIANA, error) {
+	ip := net.ParseIP(options["ipv6"])
+	if ip == nil || ip.To16() == nil {
+		return nil, fmt.Errorf("has invalid IPv6 address: %s", options["ipv6"])
+	}
+	optIAA := &dhcpv6.OptIAAddress{
+		IPv6Addr:          ip,
+		PreferredLifetime: 3 * time.Hour,
+		ValidLifetime:     3 * time.Hour,
+	}
+	optIANA := &dhcpv6.OptIANA{IaId: iaid}
 
-	resp.AddOption(optIANA)
-	return resp, true
+	if value, ok := options["t1"]; ok {
+		T1, err := time.ParseDuration(value)
+		if err != nil {
+			log.Printf("%s invalid T1 time %s...option skipped", key, value)
+		} else if T1 > optIAA.ValidLifetime {
+			optIANA.T1 = optIAA.ValidLifetime / 2
+		} else {
+			optIANA.T1 = T1
+		}
+	}
+	if value, ok := options["t2"]; ok {
+		T2, err := time.ParseDuration(value)
+		if err != nil {
+			log.Printf("%s invalid T2 time %s...option skipped", key, value)
+		} else if T2 > optIAA.ValidLifetime {
+			optIANA.T2 = optIAA.ValidLifetime * 4 / 5
+		} else {
+			optIANA.T2 = T2
+		}
+	}
+
+	optIANA.Options = dhcpv6.IdentityOptions{Options: []dhcpv6.Option{optIAA}}
+	return optIANA, nil
 }
 
 // Handler4 handles DHCPv4 packets for the redis plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {  // bool的意思是 true 结束处理输出响应  false继续处理 方法在server/handle.go
-	
+func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {  // bool的意思是 true 结束处理输出响应  false继续处理 方法在server/handle.go
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		// redis only holds static reservations, there is nothing to free
+		return resp, false
+	}
+
 	// optionValue := resp.Options.Get(dhcpv4.OptionDomainNameServer) // 获取dns
 	// if optionValue != nil {
 	// 	log.Printf("DNS option: %v", optionValue)
@@ -140,7 +172,7 @@ func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {  // bool的意
 	// 	log.Printf("DNS option not set")
 	// }
 	// Get redis connection from pool
-	conn := pool.Get()
+	conn := p.pool.Get()
 
 	// defer redis connection close so we don't leak connections
 	defer conn.Close()
@@ -153,6 +185,7 @@ func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {  // bool的意
 	// Handle redis error
 	if err != nil {
 		log.Printf("Redis error: %s...dropping request", err)
+		metrics.BackendErrors.WithLabelValues("redis", "query").Inc()
 		return resp, false
 	}
 
@@ -235,8 +268,12 @@ func setup4(args ...string) (handler.Handler4, error) {
 	return h4, err
 }
 
-var ShareConfig string
-
+// setupRedis parses the plugin arguments, in this order:
+// - the redis server as host:port, or a URL as described by ParseURL, to
+// connect to the master found by sentinels or to a cluster
+// - optionally, the password, which overrides the password of the URL
+// - optionally, the order DHCPv6 reservations are looked up in, as described
+// by ParseKeyOrder. Defaults to DefaultKeyOrder
 func setupRedis(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
 	if len(args) < 1 {
 		return nil, nil, fmt.Errorf("invalid number of arguments, want: 1 (redis server:port), got: %d", len(args))
@@ -244,44 +281,31 @@ func setupRedis(v6 bool, args ...string) (handler.Handler6, handler.Handler4, er
 	if args[0] == "" {
 		return nil, nil, errors.New("redis server can't be empty")
 	}
-
-	if v6 {    
-		log.Printf("Using redis server %s for DHCPv6 static leases", args[0])
-	} else {
-		log.Printf("Using redis server %s for DHCPv4 static leases", args[0])
+	config, err := ParseURL(args[0])
+	if err != nil {
+		return nil, nil, err
 	}
-
-
-    if len(args) > 2 {
-		var err error  
-		TTL, err = ParseToSeconds(args[2])
-		if err != nil {
-			log.Printf("invalid TTL, canceled redis update: %v", err)
-			TTLflag = false 
-		} else {
-			TTLflag = true
+	if len(args) > 1 && args[1] != "" {
+		config.Password = args[1]
+	}
+	p := PluginState{keyOrder: DefaultKeyOrder}
+	if len(args) > 2 && args[2] != "" {
+		if _, err := time.ParseDuration(args[2]); err == nil {
+			// the TTL this argument used to be
+			log.Warningf("Ignoring TTL %s, the TTL of the leases copied to redis is an argument of the postgres plugin", args[2])
+		} else if p.keyOrder, err = ParseKeyOrder(args[2]); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	// Initialize Redis Pool     // 最大空闲连接10  超时时间240秒
-	pool = &redis.Pool{
-		MaxIdle:     10,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", args[0], redis.DialPassword(args[1]))
-		},
+	if v6 {
+		log.Printf("Using redis %s for DHCPv6 static leases, looked up by %v", config, p.keyOrder)
+	} else {
+		log.Printf("Using redis %s for DHCPv4 static leases", config)
 	}
 
-	ShareConfig = args[0] + "," + args[1]
-
-	return Handler6, Handler4, nil
+	_, pool, closePools := config.Pools()
+	plugins.OnClose(closePools)
+	p.pool = pool
+	return p.Handler6, p.Handler4, nil
 }
-
-// 解析时间参数并返回秒数
-func ParseToSeconds(in string) (int, error) {
-	duration, err := time.ParseDuration(in)
-	if err != nil {
-		return 0, err 
-	}
-	return int(duration.Seconds()), nil
-}
\ No newline at end of file
@@ -31,14 +31,16 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) < 1 {
 		return nil, errors.New("need at least one router IP address")
 	}
+	var addrs []net.IP
 	for _, arg := range args {
 		router := net.ParseIP(arg)
 		if router.To4() == nil {
 			return Handler4, errors.New("expected an router IP address, got: " + arg)
 		}
-		routers = append(routers, router)
+		addrs = append(addrs, router)
 	}
-	log.Infof("loaded %d router IP addresses.", len(routers))
+	plugins.OnCommit(func() { routers = addrs })
+	log.Infof("loaded %d router IP addresses.", len(addrs))
 	return Handler4, nil
 }
 
@@ -51,14 +51,14 @@ func copySlice(original []string) []string {
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
-	v6SearchList = args
-	log.Printf("Registered domain search list (DHCPv6) %s", v6SearchList)
+	plugins.OnCommit(func() { v6SearchList = args })
+	log.Printf("Registered domain search list (DHCPv6) %s", args)
 	return domainSearchListHandler6, nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
-	v4SearchList = args
-	log.Printf("Registered domain search list (DHCPv4) %s", v4SearchList)
+	plugins.OnCommit(func() { v4SearchList = args })
+	log.Printf("Registered domain search list (DHCPv4) %s", args)
 	return domainSearchListHandler4, nil
 }
 
@@ -107,7 +107,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if serverID.To4() == nil {
 		return nil, errors.New("not a valid IPv4 address")
 	}
-	v4ServerID = serverID.To4()
+	plugins.OnCommit(func() { v4ServerID = serverID.To4() })
 	return Handler4, nil
 }
 
@@ -129,15 +129,16 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err != nil {
 		return nil, err
 	}
+	var duid dhcpv6.DUID
 	switch duidType {
 	case "ll", "duid-ll", "duid_ll":
-		v6ServerID = &dhcpv6.DUIDLL{
+		duid = &dhcpv6.DUIDLL{
 			// sorry, only ethernet for now
 			HWType:        iana.HWTypeEthernet,
 			LinkLayerAddr: hwaddr,
 		}
 	case "llt", "duid-llt", "duid_llt":
-		v6ServerID = &dhcpv6.DUIDLLT{
+		duid = &dhcpv6.DUIDLLT{
 			// sorry, zero-time for now
 			Time: 0,
 			// sorry, only ethernet for now
@@ -149,6 +150,7 @@ func setup6(args ...string) (handler.Handler6, error) {
 	default:
 		return nil, errors.New("Opaque DUID type not supported yet")
 	}
+	plugins.OnCommit(func() { v6ServerID = duid })
 	log.Printf("using %s %s", duidType, duidValue)
 
 	return Handler6, nil
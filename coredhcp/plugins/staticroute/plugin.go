@@ -27,7 +27,7 @@ var routes dhcpv4.Routes
 
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Printf("loaded plugin for DHCPv4.")
-	routes = make(dhcpv4.Routes, 0)
+	staged := make(dhcpv4.Routes, 0)
 
 	if len(args) < 1 {
 		return nil, errors.New("need at least one static route")
@@ -51,11 +51,12 @@ func setup4(args ...string) (handler.Handler4, error) {
 			return Handler4, errors.New("expected a gateway address, got: " + fields[1])
 		}
 
-		routes = append(routes, route)
+		staged = append(staged, route)
 		log.Debugf("adding static route %s", route)
 	}
 
-	log.Printf("loaded %d static routes.", len(routes))
+	plugins.OnCommit(func() { routes = staged })
+	log.Printf("loaded %d static routes.", len(staged))
 
 	return Handler4, nil
 }
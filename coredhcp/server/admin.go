@@ -0,0 +1,78 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// adminServer serves the administrative endpoints over HTTP:
+// - POST /reload reloads the configuration file, like SIGHUP
+// The endpoints are not authenticated, so they only answer requests coming
+// from a loopback address.
+type adminServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// listenAdmin binds the admin endpoints to addr, given as host:port
+func listenAdmin(addr string, reload func() error) (*adminServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", serveReload(reload))
+	return &adminServer{listener: ln, server: &http.Server{Handler: mux}}, nil
+}
+
+func serveReload(reload func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fromLoopback(r) {
+			log.Warningf("Refusing reload requested by non-loopback address %s", r.RemoteAddr)
+			http.Error(w, "the admin endpoints are only served to loopback addresses", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to reload the configuration", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Printf("Reloading configuration requested by %s", r.RemoteAddr)
+		if err := reload(); err != nil {
+			log.Errorf("Failed to reload configuration, keeping the running one: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "configuration reloaded")
+	}
+}
+
+// fromLoopback tells whether r was sent from a loopback address
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve serves the admin endpoints until the server is closed
+func (a *adminServer) Serve() error {
+	log.Printf("Serving admin endpoints on http://%s", a.listener.Addr())
+	if err := a.server.Serve(a.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close stops serving the admin endpoints
+func (a *adminServer) Close() error {
+	return a.server.Close()
+}
@@ -0,0 +1,36 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeReloadOnlyFromLoopback(t *testing.T) {
+	var reloads int
+	handle := serveReload(func() error { reloads++; return nil })
+
+	for _, tc := range []struct {
+		remote string
+		code   int
+	}{
+		{"127.0.0.1:4242", http.StatusOK},
+		{"[::1]:4242", http.StatusOK},
+		{"192.0.2.1:4242", http.StatusForbidden},
+		{"[2001:db8::1]:4242", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.remote)
+	}
+	assert.Equal(t, 2, reloads)
+}
@@ -9,14 +9,87 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
+	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 )
 
+// newReplyFromDecline builds the reply to a Decline, which the dhcpv6 package
+// doesn't do for us
+func newReplyFromDecline(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	cid := msg.GetOneOption(dhcpv6.OptionClientID)
+	if cid == nil {
+		return nil, errors.New("Client ID cannot be nil when building REPLY")
+	}
+	rep := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	rep.AddOption(cid)
+	return rep, nil
+}
+
+// acquireChains returns the running chains, kept from being closed until they
+// are released. It returns nil once the servers stopped and closed them.
+func acquireChains(running *atomic.Pointer[plugins.Chains]) *plugins.Chains {
+	for {
+		chains := running.Load()
+		if chains.Acquire() {
+			return chains
+		}
+		if running.Load() == chains {
+			return nil
+		}
+		// A reload closed them after swapping in the new ones
+	}
+}
+
+// handle6 runs a request through the handlers of the plugins, until one of
+// them stops the chain, and returns the response
+func (l *listener6) handle6(req, resp dhcpv6.DHCPv6) dhcpv6.DHCPv6 {
+	chains := acquireChains(&l.chains)
+	if chains == nil {
+		return nil
+	}
+	defer chains.Release()
+	var stop bool
+	for _, handler := range chains.Handlers6 {
+		start := time.Now()
+		resp, stop = handler.Handler6(req, resp)
+		pluginDuration.WithLabelValues("6", handler.Name).Observe(time.Since(start).Seconds())
+		if stop {
+			break
+		}
+	}
+	return resp
+}
+
+// handle4 runs a request through the handlers of the plugins, until one of
+// them stops the chain, and returns the response
+func (l *listener4) handle4(req, resp *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	chains := acquireChains(&l.chains)
+	if chains == nil {
+		return nil
+	}
+	defer chains.Release()
+	var stop bool
+	for _, handler := range chains.Handlers4 {
+		start := time.Now()
+		resp, stop = handler.Handler4(req, resp)
+		pluginDuration.WithLabelValues("4", handler.Name).Observe(time.Since(start).Seconds())
+		if stop {
+			break
+		}
+	}
+	return resp
+}
+
 // HandleMsg6 runs for every received DHCPv6 packet. It will run every
 // registered handler in sequence, and reply with the resulting response.
 // It will not reply if the resulting response is `nil`.
@@ -25,6 +98,7 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	bufpool.Put(&buf)
 	if err != nil {
 		log.Printf("Error parsing DHCPv6 request: %v", err)
+		droppedCount.WithLabelValues("6", dropMalformed).Inc()
 		return
 	}
 
@@ -32,8 +106,10 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	msg, err := d.GetInnerMessage()
 	if err != nil {
 		log.Warningf("DHCPv6: cannot get inner message: %v", err)
+		droppedCount.WithLabelValues("6", dropMalformed).Inc()
 		return
 	}
+	requestCount.WithLabelValues("6", msg.Type().String()).Inc()
 
 	// Create a suitable basic response packet
 	var resp dhcpv6.DHCPv6
@@ -47,25 +123,24 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRenew,
 		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeInformationRequest:
 		resp, err = dhcpv6.NewReplyFromMessage(msg)
+	case dhcpv6.MessageTypeDecline:
+		resp, err = newReplyFromDecline(msg)
 	default:
 		err = fmt.Errorf("MainHandler6: message type %d not supported", msg.Type())
 	}
 	if err != nil {
 		log.Printf("MainHandler6: NewReplyFromDHCPv6Message failed: %v", err)
+		droppedCount.WithLabelValues("6", dropUnsupported).Inc()
 		return
 	}
 
-	var stop bool
-	for _, handler := range l.handlers {
-		resp, stop = handler(d, resp)
-		if stop {
-			break
-		}
-	}
+	resp = l.handle6(d, resp)
 	if resp == nil {
 		log.Print("MainHandler6: dropping request because response is nil")
+		droppedCount.WithLabelValues("6", dropNoResponse).Inc()
 		return
 	}
+	respType := resp.Type()
 
 	// if the request was relayed, re-encapsulate the response
 	if d.IsRelay() {
@@ -75,6 +150,7 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 			tmp, err := dhcpv6.NewRelayReplFromRelayForw(d.(*dhcpv6.RelayMessage), rmsg)
 			if err != nil {
 				log.Warningf("DHCPv6: cannot create relay-repl from relay-forw: %v", err)
+				droppedCount.WithLabelValues("6", dropSendError).Inc()
 				return
 			}
 			resp = tmp
@@ -96,30 +172,36 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	}
 	if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
 		log.Printf("MainHandler6: conn.Write to %v failed: %v", peer, err)
+		droppedCount.WithLabelValues("6", dropSendError).Inc()
+		return
 	}
+	responseCount.WithLabelValues("6", respType.String()).Inc()
 }
 
 func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr) {
 	var (
 		resp, tmp *dhcpv4.DHCPv4
 		err       error
-		stop      bool
 	)
 
 	req, err := dhcpv4.FromBytes(buf)
 	bufpool.Put(&buf)
 	if err != nil {
 		log.Printf("Error parsing DHCPv4 request: %v", err)
+		droppedCount.WithLabelValues("4", dropMalformed).Inc()
 		return
 	}
 
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
 		log.Printf("MainHandler4: unsupported opcode %d. Only BootRequest (%d) is supported", req.OpCode, dhcpv4.OpcodeBootRequest)
+		droppedCount.WithLabelValues("4", dropUnsupported).Inc()
 		return
 	}
+	requestCount.WithLabelValues("4", req.MessageType().String()).Inc()
 	tmp, err = dhcpv4.NewReplyFromRequest(req)
 	if err != nil {
 		log.Printf("MainHandler4: failed to build reply: %v", err)
+		droppedCount.WithLabelValues("4", dropMalformed).Inc()
 		return
 	}
 	switch mt := req.MessageType(); mt {
@@ -127,16 +209,30 @@ func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.A
 		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
 	case dhcpv4.MessageTypeRequest:
 		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	case dhcpv4.MessageTypeInform:
+		// RFC 2131 4.3.5: acknowledge with configuration parameters only, the
+		// client already has an address
+		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		// RFC 2131 4.3.3 and 4.3.4: these get no reply, but they still go
+		// through the plugins so that lease holders can free or quarantine the
+		// address. The response is discarded below.
 	default:
 		log.Printf("plugins/server: Unhandled message type: %v", mt)
+		droppedCount.WithLabelValues("4", dropUnsupported).Inc()
 		return
 	}
 
-	resp = tmp
-	for _, handler := range l.handlers {
-		resp, stop = handler(req, resp)
-		if stop {
-			break
+	resp = l.handle4(req, tmp)
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		return
+	case dhcpv4.MessageTypeInform:
+		if resp != nil {
+			// RFC 2131 table 3: no yiaddr and no lease time in an ACK to an INFORM
+			resp.YourIPAddr = net.IPv4zero
+			resp.Options.Del(dhcpv4.OptionIPAddressLeaseTime)
 		}
 	}
 
@@ -177,19 +273,26 @@ func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.A
 			intf, err := net.InterfaceByIndex(woob.IfIndex)
 			if err != nil {
 				log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
+				droppedCount.WithLabelValues("4", dropSendError).Inc()
 				return
 			}
 			err = sendEthernet(*intf, resp)
 			if err != nil {
 				log.Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
+				droppedCount.WithLabelValues("4", dropSendError).Inc()
+				return
 			}
 		} else {
 			if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
 				log.Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
+				droppedCount.WithLabelValues("4", dropSendError).Inc()
+				return
 			}
 		}
+		responseCount.WithLabelValues("4", resp.MessageType().String()).Inc()
 	} else {
 		log.Print("MainHandler4: dropping request because response is nil")
+		droppedCount.WithLabelValues("4", dropNoResponse).Inc()
 	}
 }
 
@@ -0,0 +1,47 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"github.com/coredhcp/coredhcp/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a request is dropped without a response
+const (
+	dropMalformed   = "malformed"
+	dropUnsupported = "unsupported"
+	dropNoResponse  = "no_response"
+	dropSendError   = "send_error"
+)
+
+var (
+	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "requests_total",
+		Help:      "Counter of DHCP requests received, by message type.",
+	}, []string{"version", "type"})
+
+	responseCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "responses_total",
+		Help:      "Counter of DHCP responses sent, by message type.",
+	}, []string{"version", "type"})
+
+	droppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "dropped_total",
+		Help:      "Counter of DHCP packets dropped without a response, by reason.",
+	}, []string{"version", "reason"})
+
+	pluginDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "plugin",
+		Name:      "duration_seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 9), // 50µs to 3.3s
+		Help:      "Histogram of the time each plugin of the chains takes to handle a request.",
+	}, []string{"version", "plugin"})
+)
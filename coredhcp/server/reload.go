@@ -0,0 +1,186 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/metrics"
+	"github.com/coredhcp/coredhcp/plugins"
+)
+
+// binding is a listener the configuration asks for
+type binding struct {
+	key    string
+	listen func() (listener, error)
+}
+
+// bindings returns the listeners of a configuration, by key
+func (s *Servers) bindings(conf *config.Config) []binding {
+	var b []binding
+	if conf.Server6 != nil {
+		for _, addr := range conf.Server6.Addresses {
+			addr := addr
+			b = append(b, binding{"dhcpv6 " + addr.String(), func() (listener, error) { return listen6(&addr) }})
+		}
+	}
+	if conf.Server4 != nil {
+		for _, addr := range conf.Server4.Addresses {
+			addr := addr
+			b = append(b, binding{"dhcpv4 " + addr.String(), func() (listener, error) { return listen4(&addr) }})
+		}
+	}
+	if conf.Metrics != "" {
+		b = append(b, binding{"metrics " + conf.Metrics, func() (listener, error) {
+			return metrics.Listen(conf.Metrics)
+		}})
+	}
+	if conf.Admin != "" {
+		b = append(b, binding{"admin " + conf.Admin, func() (listener, error) {
+			return listenAdmin(conf.Admin, s.reloadFile)
+		}})
+	}
+	return b
+}
+
+// Reload applies a new configuration to the running servers. The plugins are
+// set up again, and their chains replace the running ones at once: a request
+// being handled finishes with the chain it started with, after which the
+// plugins of the previous chains are torn down. Only the listeners whose
+// address changed are opened or closed. If a plugin fails to set up or an
+// address can't be bound, the running configuration is kept, and so are the
+// settings of the running plugins.
+func (s *Servers) Reload(conf *config.Config) error {
+	if err := s.apply(conf); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if path := conf.Path(); path != "" {
+		s.path = path
+	}
+	log.Printf("Reloaded configuration")
+	return nil
+}
+
+// apply sets up the plugins of a configuration and swaps them in, then tears
+// down the plugins they replace
+func (s *Servers) apply(conf *config.Config) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	chains, err := plugins.LoadPlugins(conf)
+	if err != nil {
+		return err
+	}
+	previous, err := s.swap(conf, chains)
+	if err != nil {
+		chains.Close()
+		return err
+	}
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// swap binds the new addresses of a configuration, then commits the chains
+// and swaps them into the listeners, and closes the listeners the
+// configuration doesn't have anymore. It returns the chains it replaced.
+func (s *Servers) swap(conf *config.Config, chains *plugins.Chains) (*plugins.Chains, error) {
+	s.Lock()
+	defer s.Unlock()
+	bindings := s.bindings(conf)
+	wanted := make(map[string]bool, len(bindings))
+	added := make(map[string]listener)
+	for _, b := range bindings {
+		wanted[b.key] = true
+		if _, ok := s.listeners[b.key]; ok {
+			continue
+		}
+		if _, ok := added[b.key]; ok {
+			continue
+		}
+		l, err := b.listen()
+		if err != nil {
+			for _, l := range added {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", b.key, err)
+		}
+		added[b.key] = l
+	}
+
+	chains.Commit()
+	previous := s.chains
+	s.chains = chains
+	for key, l := range added {
+		log.Printf("Starting %s", key)
+		s.listeners[key] = l
+	}
+	for _, l := range s.listeners {
+		switch l := l.(type) {
+		case *listener4:
+			l.chains.Store(chains)
+		case *listener6:
+			l.chains.Store(chains)
+		}
+	}
+	for _, l := range added {
+		s.serve(l)
+	}
+	for key, l := range s.listeners {
+		if wanted[key] {
+			continue
+		}
+		log.Printf("Stopping %s", key)
+		s.retired[l] = true
+		delete(s.listeners, key)
+		l.Close()
+	}
+	return previous, nil
+}
+
+// reloadFile reads the configuration file again and applies it
+func (s *Servers) reloadFile() error {
+	s.Lock()
+	path := s.path
+	s.Unlock()
+	if path == "" {
+		return errors.New("the configuration was not read from a file")
+	}
+	conf, err := config.Load(path)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return s.Reload(conf)
+}
+
+// handleSignals reloads the configuration on SIGHUP until the servers stop.
+// The signal is caught from when it returns.
+func (s *Servers) handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go s.reloadOnSignal(sig)
+}
+
+func (s *Servers) reloadOnSignal(sig chan os.Signal) {
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			log.Printf("Received SIGHUP, reloading configuration")
+			if err := s.reloadFile(); err != nil {
+				log.Errorf("Failed to reload configuration, keeping the running one: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
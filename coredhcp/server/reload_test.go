@@ -0,0 +1,113 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/serverid"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// probe is a plugin recording which of its instances, named by their
+// argument, were torn down. It fails to set up when named "fail".
+var (
+	probeLock   sync.Mutex
+	probeClosed = make(map[string]bool)
+)
+
+func setupProbe(args ...string) (handler.Handler4, error) {
+	name := args[0]
+	if name == "fail" {
+		return nil, errors.New("probe failed to set up")
+	}
+	plugins.OnClose(func() {
+		probeLock.Lock()
+		defer probeLock.Unlock()
+		probeClosed[name] = true
+	})
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		return resp, false
+	}, nil
+}
+
+func isClosed(name string) bool {
+	probeLock.Lock()
+	defer probeLock.Unlock()
+	return probeClosed[name]
+}
+
+func init() {
+	_ = plugins.RegisterPlugin(&serverid.Plugin)
+	_ = plugins.RegisterPlugin(&plugins.Plugin{Name: "probe", Setup4: setupProbe})
+}
+
+func testConfig(admin, serverID, probe string) *config.Config {
+	return &config.Config{
+		Server4: &config.ServerConfig{
+			Addresses: []net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{serverID}},
+				{Name: "probe", Args: []string{probe}},
+			},
+		},
+		Admin: admin,
+	}
+}
+
+// serverIDOf runs a DHCPDISCOVER through the chains of the listener
+func serverIDOf(t *testing.T, s *Servers) net.IP {
+	s.Lock()
+	l, ok := s.listeners["dhcpv4 127.0.0.1:0"].(*listener4)
+	s.Unlock()
+	require.True(t, ok)
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01})
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp = l.handle4(req, resp)
+	require.NotNil(t, resp)
+	return resp.ServerIdentifier()
+}
+
+func TestReloadFailureKeepsRunningChains(t *testing.T) {
+	s, err := Start(testConfig("", "10.0.0.1", "first"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", serverIDOf(t, s).String())
+
+	// a plugin failing to set up
+	err = s.Reload(testConfig("", "10.0.0.2", "fail"))
+	assert.Error(t, err)
+	assert.Equal(t, "10.0.0.1", serverIDOf(t, s).String())
+	assert.False(t, isClosed("first"))
+
+	// an address which can't be bound
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+	err = s.Reload(testConfig(busy.Addr().String(), "10.0.0.3", "unbound"))
+	assert.Error(t, err)
+	assert.Equal(t, "10.0.0.1", serverIDOf(t, s).String())
+	assert.False(t, isClosed("first"))
+	assert.True(t, isClosed("unbound"))
+
+	// the chains replaced by a reload are torn down
+	require.NoError(t, s.Reload(testConfig("", "10.0.0.4", "second")))
+	assert.Equal(t, "10.0.0.4", serverIDOf(t, s).String())
+	assert.True(t, isClosed("first"))
+	assert.False(t, isClosed("second"))
+
+	s.Close()
+	assert.NoError(t, s.Wait())
+	assert.True(t, isClosed("second"))
+}
@@ -9,12 +9,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
 	"github.com/coredhcp/coredhcp/config"
-	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
@@ -26,23 +27,43 @@ var log = logger.GetLogger("server")
 type listener6 struct {
 	*ipv6.PacketConn
 	net.Interface
-	handlers []handler.Handler6
+	// chains are the plugin chains, swapped when the configuration is reloaded
+	chains atomic.Pointer[plugins.Chains]
 }
 
 type listener4 struct {
 	*ipv4.PacketConn
 	net.Interface
-	handlers []handler.Handler4
+	// chains are the plugin chains, swapped when the configuration is reloaded
+	chains atomic.Pointer[plugins.Chains]
 }
 
 type listener interface {
 	io.Closer
+	Serve() error
 }
 
 // Servers contains state for a running server (with possibly multiple interfaces/listeners)
 type Servers struct {
-	listeners []listener
-	errors    chan error
+	sync.Mutex
+	// reloading serializes the reloads
+	reloading sync.Mutex
+	// path is the configuration file, read again to reload it
+	path string
+	// chains are the plugin chains the listeners run
+	chains *plugins.Chains
+	// listeners holds the running listeners by what they listen on, such as
+	// "dhcpv4 0.0.0.0:67"
+	listeners map[string]listener
+	// retired holds the listeners closed by a reload, whose end is expected
+	retired map[listener]bool
+	// running counts the listeners still serving
+	running sync.WaitGroup
+	// done is closed when the first listener stops on its own or the
+	// servers are closed, and errs holds why they stopped
+	done chan struct{}
+	stop sync.Once
+	errs []error
 }
 
 func listen4(a *net.UDPAddr) (*listener4, error) {
@@ -112,74 +133,59 @@ func listen6(a *net.UDPAddr) (*listener6, error) {
 }
 
 // Start will start the server asynchronously. See `Wait` to wait until
-// the execution ends.
+// the execution ends. The configuration is reloaded on SIGHUP, see `Reload`.
 func Start(config *config.Config) (*Servers, error) {
-	handlers4, handlers6, err := plugins.LoadPlugins(config)
-	if err != nil {
-		return nil, err
-	}
-	srv := Servers{
-		errors: make(chan error),
+	srv := &Servers{
+		path:      config.Path(),
+		listeners: make(map[string]listener),
+		retired:   make(map[listener]bool),
+		done:      make(chan struct{}),
 	}
-
-	// listen
-	if config.Server6 != nil {
-		log.Println("Starting DHCPv6 server")
-		for _, addr := range config.Server6.Addresses {
-			var l6 *listener6
-			l6, err = listen6(&addr)
-			if err != nil {
-				goto cleanup
-			}
-			l6.handlers = handlers6
-			srv.listeners = append(srv.listeners, l6)
-			go func() {
-				srv.errors <- l6.Serve()
-			}()
-		}
+	if err := srv.apply(config); err != nil {
+		return nil, err
 	}
+	srv.handleSignals()
+	return srv, nil
+}
 
-	if config.Server4 != nil {
-		log.Println("Starting DHCPv4 server")
-		for _, addr := range config.Server4.Addresses {
-			var l4 *listener4
-			l4, err = listen4(&addr)
-			if err != nil {
-				goto cleanup
-			}
-			l4.handlers = handlers4
-			srv.listeners = append(srv.listeners, l4)
-			go func() {
-				srv.errors <- l4.Serve()
-			}()
+// serve runs a listener until it is closed. The servers stop when it stops,
+// unless a reload retired it.
+func (s *Servers) serve(l listener) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		err := l.Serve()
+		s.Lock()
+		defer s.Unlock()
+		if s.retired[l] {
+			delete(s.retired, l)
+			return
 		}
-	}
-
-	return &srv, nil
-
-cleanup:
-	srv.Close()
-	return nil, err
+		s.errs = append(s.errs, err)
+		s.stop.Do(func() { close(s.done) })
+	}()
 }
 
 // Wait waits until the end of the execution of the server.
 func (s *Servers) Wait() error {
 	log.Debug("Waiting")
-	errs := make([]error, 1, len(s.listeners))
-	errs[0] = <-s.errors
+	<-s.done
 	s.Close()
 	// Wait for the other listeners to close
-	for i := 1; i < len(s.listeners); i++ {
-		errs = append(errs, <-s.errors)
-	}
-	return errors.Join(errs...)
+	s.running.Wait()
+	s.Lock()
+	chains := s.chains
+	s.Unlock()
+	chains.Close()
+	return errors.Join(s.errs...)
 }
 
 // Close closes all listening connections
 func (s *Servers) Close() {
+	s.Lock()
+	defer s.Unlock()
 	for _, srv := range s.listeners {
-		if srv != nil {
-			srv.Close()
-		}
+		srv.Close()
 	}
+	s.stop.Do(func() { close(s.done) })
 }
@@ -0,0 +1,384 @@
+package coredns_postgresql
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// listenerPingInterval is how often the connection of the listener is
+	// checked, to notice it is lost even when no notification comes
+	listenerPingInterval = 90 * time.Second
+	minReconnectInterval = 10 * time.Second
+	maxReconnectInterval = time.Minute
+)
+
+// zoneCache is an in-memory index of the records table, by zone and name, so
+// that lookups don't hit the database
+type zoneCache struct {
+	sync.RWMutex
+	zones map[string]*cachedZone
+	list  []string // the sorted names of zones
+}
+
+type cachedZone struct {
+	// names holds the records by lowercased name, relative to the zone
+	names map[string][]*Record
+	// nodes holds the names which exist in the zone: those with records and
+	// their ancestors, the empty non-terminals
+	nodes map[string]struct{}
+	// serial is the serial from the zones table, 0 if unknown
+	serial uint32
+}
+
+// index fills the nodes of a zone from its names
+func (z *cachedZone) index() {
+	z.nodes = make(map[string]struct{}, len(z.names))
+	for name := range z.names {
+		for {
+			if _, ok := z.nodes[name]; ok {
+				break
+			}
+			z.nodes[name] = struct{}{}
+			if name == "" {
+				break
+			}
+			if i := strings.IndexByte(name, '.'); i >= 0 {
+				name = name[i+1:]
+			} else {
+				name = ""
+			}
+		}
+	}
+}
+
+func newZoneCache() *zoneCache {
+	return &zoneCache{zones: make(map[string]*cachedZone)}
+}
+
+// names returns the zones in the cache. The list must not be modified.
+func (c *zoneCache) names() []string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.list
+}
+
+// lookup returns copies of the records of a name, of the given types or of
+// all types if none is given
+func (c *zoneCache) lookup(zone, name string, types ...string) []*Record {
+	c.RLock()
+	defer c.RUnlock()
+	z, ok := c.zones[zone]
+	if !ok {
+		return nil
+	}
+	records := make([]*Record, 0)
+	for _, rec := range z.names[strings.ToLower(name)] {
+		if len(types) == 0 {
+			r := *rec
+			records = append(records, &r)
+			continue
+		}
+		for _, t := range types {
+			if rec.RecordType == t {
+				r := *rec
+				records = append(records, &r)
+				break
+			}
+		}
+	}
+	return records
+}
+
+// exists returns true if a name exists in a zone, with records or as an
+// empty non-terminal
+func (c *zoneCache) exists(zone, name string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	z, ok := c.zones[zone]
+	if !ok {
+		return false
+	}
+	_, ok = z.nodes[strings.ToLower(name)]
+	return ok
+}
+
+// all returns copies of all the records of a zone
+func (c *zoneCache) all(zone string) []*Record {
+	c.RLock()
+	defer c.RUnlock()
+	z, ok := c.zones[zone]
+	if !ok {
+		return nil
+	}
+	records := make([]*Record, 0)
+	for _, recs := range z.names {
+		for _, rec := range recs {
+			r := *rec
+			records = append(records, &r)
+		}
+	}
+	return records
+}
+
+// serial returns the serial of a zone, and false if it is not known
+func (c *zoneCache) serial(zone string) (uint32, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	z, ok := c.zones[zone]
+	if !ok || z.serial == 0 {
+		return 0, false
+	}
+	return z.serial, true
+}
+
+// replace sets the content of some zones. If all is true, the zones which are
+// not given are dropped, else only the given zones are replaced and the
+// listed zones which are not given are dropped.
+func (c *zoneCache) replace(zones map[string]*cachedZone, all bool, listed ...string) {
+	for _, z := range zones {
+		z.index()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if all {
+		c.zones = zones
+	} else {
+		for _, zone := range listed {
+			delete(c.zones, zone)
+		}
+		for zone, z := range zones {
+			c.zones[zone] = z
+		}
+	}
+	// The list is replaced rather than updated, as callers may hold it
+	list := make([]string, 0, len(c.zones))
+	for zone := range c.zones {
+		list = append(list, zone)
+	}
+	sort.Strings(list)
+	c.list = list
+}
+
+// readZones reads the records of the given zones from the database, or of all
+// of them if none is given
+func (handler *CoreDNSPostgreSql) readZones(only ...string) (map[string]*cachedZone, error) {
+	db, err := handler.db()
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT name, zone, ttl, record_type, content FROM %s", handler.tableName)
+	var args []interface{}
+	if len(only) > 0 {
+		query += " WHERE zone = ANY($1)"
+		args = append(args, pq.Array(only))
+	}
+	result, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	zones := make(map[string]*cachedZone)
+	for result.Next() {
+		rec := &Record{handler: handler}
+		if err := result.Scan(&rec.Name, &rec.Zone, &rec.Ttl, &rec.RecordType, &rec.Content); err != nil {
+			return nil, err
+		}
+		z, ok := zones[rec.Zone]
+		if !ok {
+			z = &cachedZone{names: make(map[string][]*Record)}
+			zones[rec.Zone] = z
+		}
+		name := strings.ToLower(rec.Name)
+		z.names[name] = append(z.names[name], rec)
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	if handler.zonesTable == "" {
+		return zones, nil
+	}
+	query = fmt.Sprintf("SELECT zone, serial FROM %s", handler.zonesTable)
+	if len(only) > 0 {
+		query += " WHERE zone = ANY($1)"
+	}
+	serials, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer serials.Close()
+	for serials.Next() {
+		var (
+			zone   string
+			serial int64
+		)
+		if err := serials.Scan(&zone, &serial); err != nil {
+			return nil, err
+		}
+		if z, ok := zones[zone]; ok {
+			z.serial = uint32(serial)
+		}
+	}
+	return zones, serials.Err()
+}
+
+// reload reads the given zones again, or all of them if none is given, and
+// mirrors them to redis if it is on
+func (handler *CoreDNSPostgreSql) reload(zones ...string) error {
+	since := time.Now()
+	z, err := handler.readZones(zones...)
+	if err != nil {
+		if handler.mirror != nil {
+			handler.mirror.changed(since, handler.cache, zones...)
+		}
+		return err
+	}
+	handler.cache.replace(z, len(zones) == 0, zones...)
+	if handler.mirror != nil {
+		handler.mirror.sync(since, handler.cache, zones...)
+	}
+	return nil
+}
+
+// setupNotify creates the trigger notifying the changes of the records table
+// on the channel named after it, with the zone of the changed records as
+// payload. An empty payload means that every zone changed.
+func (handler *CoreDNSPostgreSql) setupNotify() error {
+	db, err := handler.db()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %[1]s_notify() RETURNS TRIGGER AS $$
+		BEGIN
+			IF TG_OP = 'TRUNCATE' THEN
+				PERFORM pg_notify('%[1]s', '');
+				RETURN NULL;
+			END IF;
+			IF TG_OP <> 'INSERT' THEN
+				PERFORM pg_notify('%[1]s', OLD.zone);
+			END IF;
+			IF TG_OP <> 'DELETE' THEN
+				PERFORM pg_notify('%[1]s', NEW.zone);
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS %[1]s_notify ON %[1]s;
+		CREATE TRIGGER %[1]s_notify AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+			FOR EACH ROW EXECUTE PROCEDURE %[1]s_notify();
+		DROP TRIGGER IF EXISTS %[1]s_notify_truncate ON %[1]s;
+		CREATE TRIGGER %[1]s_notify_truncate AFTER TRUNCATE ON %[1]s
+			FOR EACH STATEMENT EXECUTE PROCEDURE %[1]s_notify();`, handler.tableName))
+	return err
+}
+
+// watch keeps the cache up to date until the listener is closed: zones are
+// read again when they are notified to change, and all of them every
+// zone_update_interval, or when notifications may have been lost.
+func (handler *CoreDNSPostgreSql) watch(l *pq.Listener) {
+	refresh := time.NewTicker(handler.zoneUpdateTime)
+	defer refresh.Stop()
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-l.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification follows a reconnection
+			if n == nil || n.Extra == "" {
+				handler.reloadAndNotify()
+				continue
+			}
+			// Changes come in bursts, take all the pending ones at once
+			zones := map[string]struct{}{n.Extra: {}}
+			all := false
+		drain:
+			for {
+				select {
+				case n, ok := <-l.Notify:
+					if !ok {
+						return
+					}
+					if n == nil || n.Extra == "" {
+						all = true
+						continue
+					}
+					zones[n.Extra] = struct{}{}
+				default:
+					break drain
+				}
+			}
+			if all {
+				handler.reloadAndNotify()
+				continue
+			}
+			changed := make([]string, 0, len(zones))
+			for zone := range zones {
+				changed = append(changed, zone)
+			}
+			handler.reloadAndNotify(changed...)
+		case done := <-handler.warmups:
+			done <- handler.warmUp()
+		case <-refresh.C:
+			if err := handler.reload(); err != nil {
+				log.Printf("[ERROR] pg failed to reload zones: %v", err)
+			}
+		case <-ping.C:
+			go l.Ping()
+			if handler.mirror != nil {
+				handler.mirror.reportLag()
+			}
+		}
+	}
+}
+
+// reloadAndNotify reads changed zones again, and notifies their secondaries.
+// All zones are read again if none is given.
+func (handler *CoreDNSPostgreSql) reloadAndNotify(zones ...string) {
+	if err := handler.reload(zones...); err != nil {
+		log.Printf("[ERROR] pg failed to reload zones %v: %v", zones, err)
+		return
+	}
+	if len(zones) == 0 {
+		zones = handler.cache.names()
+	}
+	for _, zone := range zones {
+		handler.transfer.Notify(zone)
+	}
+}
+
+// listen starts listening to the changes of the records table, and keeps the
+// cache up to date until the returned listener is closed.
+func (handler *CoreDNSPostgreSql) listen() (*pq.Listener, error) {
+	l := pq.NewListener(handler.Datasource, minReconnectInterval, maxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[ERROR] pg listener: %v", err)
+		}
+	})
+	if err := l.Listen(handler.tableName); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Changes made before the listener was up would have been missed
+	if err := handler.reload(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go handler.watch(l)
+	return l, nil
+}
@@ -0,0 +1,68 @@
+package coredns_postgresql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func cachedTestZone(serial uint32, records ...*Record) *cachedZone {
+	z := &cachedZone{names: make(map[string][]*Record), serial: serial}
+	for _, rec := range records {
+		z.names[rec.Name] = append(z.names[rec.Name], rec)
+	}
+	return z
+}
+
+func TestZoneCache(t *testing.T) {
+	c := newZoneCache()
+	c.replace(map[string]*cachedZone{
+		"example.org.": cachedTestZone(7,
+			&Record{Name: "www", Zone: "example.org.", RecordType: "A", Content: `{"ip":"192.0.2.1"}`},
+			&Record{Name: "www", Zone: "example.org.", RecordType: "AAAA", Content: `{"ip":"2001:db8::1"}`},
+		),
+		"example.net.": cachedTestZone(0,
+			&Record{Name: "", Zone: "example.net.", RecordType: "NS", Content: `{"host":"ns1.example.net."}`},
+		),
+	}, true)
+
+	if got := c.names(); !reflect.DeepEqual(got, []string{"example.net.", "example.org."}) {
+		t.Errorf("unexpected zones %v", got)
+	}
+	if recs := c.lookup("example.org.", "WWW", "A"); len(recs) != 1 || recs[0].RecordType != "A" {
+		t.Errorf("expected the A record of www, got %v", recs)
+	}
+	if recs := c.lookup("example.org.", "www", "A", "AAAA"); len(recs) != 2 {
+		t.Errorf("expected 2 records for www, got %v", recs)
+	}
+	if recs := c.lookup("example.com.", "www", "A"); len(recs) != 0 {
+		t.Errorf("expected no records out of the zones, got %v", recs)
+	}
+	if serial, ok := c.serial("example.org."); !ok || serial != 7 {
+		t.Errorf("expected serial 7, got %d, %v", serial, ok)
+	}
+	if _, ok := c.serial("example.net."); ok {
+		t.Errorf("expected no serial for example.net.")
+	}
+
+	// Callers get copies, the cache is not changed through them
+	c.lookup("example.org.", "www", "A")[0].Ttl = 42
+	if recs := c.all("example.org."); len(recs) != 2 || recs[0].Ttl != 0 || recs[1].Ttl != 0 {
+		t.Errorf("the cached records were changed: %v", recs)
+	}
+
+	// Replacing a listed zone which is no longer in the table drops it
+	c.replace(map[string]*cachedZone{
+		"example.org.": cachedTestZone(8,
+			&Record{Name: "mail", Zone: "example.org.", RecordType: "A", Content: `{"ip":"192.0.2.2"}`},
+		),
+	}, false, "example.org.", "example.net.")
+	if got := c.names(); !reflect.DeepEqual(got, []string{"example.org."}) {
+		t.Errorf("unexpected zones %v", got)
+	}
+	if recs := c.lookup("example.org.", "www", "A"); len(recs) != 0 {
+		t.Errorf("expected the old records to be gone, got %v", recs)
+	}
+	if recs := c.lookup("example.org.", "mail", "A"); len(recs) != 1 {
+		t.Errorf("expected the new record of mail, got %v", recs)
+	}
+}
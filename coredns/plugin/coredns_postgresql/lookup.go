@@ -0,0 +1,268 @@
+package coredns_postgresql
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// maxChase is the number of CNAMEs followed for a query, longer chains are
+// answered as far as they were followed
+const maxChase = 8
+
+// lookupResult is the outcome of a lookup
+type lookupResult int
+
+const (
+	// lookupSuccess means records were found for the name and type
+	lookupSuccess lookupResult = iota
+	// lookupNameError means the name doesn't exist
+	lookupNameError
+	// lookupNoData means the name exists but has no records of the type
+	lookupNoData
+	// lookupDelegation means the name is in a delegated child zone
+	lookupDelegation
+)
+
+// lookupResponse holds the sections of a response, and the records they were
+// built from
+type lookupResponse struct {
+	answer, ns, extra []dns.RR
+	records           []*Record
+	result            lookupResult
+}
+
+// lookup answers a query for qname in zone like plugin/file does: names below
+// an NS set are referred to the child zone, names which don't exist are
+// synthesized from wildcards (RFC 4592), and CNAMEs are followed within and
+// across the served zones.
+func (handler *CoreDNSPostgreSql) lookup(zone, qname, qtype string) (*lookupResponse, error) {
+	res := &lookupResponse{}
+	chased := map[string]bool{}
+	for {
+		chased[qname] = true
+		cname, err := handler.lookupName(res, zone, qname, qtype)
+		if err != nil || cname == "" {
+			return res, err
+		}
+		// Only the names of the zones we serve are followed
+		next := plugin.Zones(handler.cache.names()).Matches(cname)
+		if next == "" || chased[cname] || len(chased) > maxChase {
+			return res, nil
+		}
+		zone, qname = next, cname
+	}
+}
+
+// lookupName adds the answer for qname in zone to res. If qname is an alias,
+// it returns the target of its CNAME, which is to be looked up next.
+func (handler *CoreDNSPostgreSql) lookupName(res *lookupResponse, zone, qname, qtype string) (string, error) {
+	name, ok := relativeName(qname, zone)
+	if !ok {
+		return "", nil
+	}
+
+	// Look for a DNAME above qname or a delegation from the apex down, the
+	// apex NS set is not one
+	labels := dns.SplitDomainName(name)
+	for i := len(labels); i >= 0; i-- {
+		cut := strings.Join(labels[i:], ".")
+		if i > 0 {
+			if dname := handler.cache.lookup(zone, cut, "DNAME"); len(dname) > 0 {
+				return handler.synthesize(res, qname, qtype, dname[0])
+			}
+		}
+		if i == len(labels) {
+			continue
+		}
+		// DS records are in the parent side of the delegation
+		if i == 0 && qtype == "DS" {
+			break
+		}
+		ns := handler.cache.lookup(zone, cut, "NS")
+		if len(ns) == 0 {
+			continue
+		}
+		// The addresses of the name servers are only given as glue
+		for _, rec := range ns {
+			rec.handler = nil
+		}
+		rrs, err := handler.asRRs(res, ns)
+		if err != nil {
+			return "", err
+		}
+		glue, err := handler.glue(zone, rrs)
+		if err != nil {
+			return "", err
+		}
+		res.ns = append(res.ns, rrs...)
+		res.extra = append(res.extra, glue...)
+		res.result = lookupDelegation
+		return "", nil
+	}
+
+	records := handler.cache.lookup(zone, name)
+	if len(records) == 0 {
+		if handler.cache.exists(zone, name) {
+			// an empty non-terminal
+			return "", handler.negative(res, zone, lookupNoData)
+		}
+		records = handler.wildcard(zone, name)
+		if len(records) == 0 {
+			return "", handler.negative(res, zone, lookupNameError)
+		}
+	}
+
+	if qtype != "CNAME" {
+		if cname := ofType(records, "CNAME"); len(cname) > 0 {
+			rrs, err := handler.asRRs(res, cname[:1])
+			if err != nil {
+				return "", err
+			}
+			res.answer = append(res.answer, rrs...)
+			res.result = lookupSuccess
+			if len(rrs) == 0 {
+				return "", nil
+			}
+			return strings.ToLower(rrs[0].(*dns.CNAME).Target), nil
+		}
+	}
+
+	records = ofType(records, qtype)
+	if len(records) == 0 {
+		return "", handler.negative(res, zone, lookupNoData)
+	}
+	rrs, err := handler.asRRs(res, records)
+	if err != nil {
+		return "", err
+	}
+	res.answer = append(res.answer, rrs...)
+	res.result = lookupSuccess
+	return "", nil
+}
+
+// synthesize adds a DNAME and the CNAME it substitutes for qname to the
+// answer of res (RFC 6672 section 3.3). It returns the target of the CNAME if
+// it is to be followed.
+func (handler *CoreDNSPostgreSql) synthesize(res *lookupResponse, qname, qtype string, rec *Record) (string, error) {
+	rrs, err := handler.asRRs(res, []*Record{rec})
+	if err != nil || len(rrs) == 0 {
+		return "", err
+	}
+	dname := rrs[0].(*dns.DNAME)
+	res.answer = append(res.answer, dname)
+	res.result = lookupSuccess
+
+	target := strings.TrimSuffix(qname, strings.ToLower(dname.Hdr.Name)) + dname.Target
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+		// the substituted name is too long
+		return "", nil
+	}
+	res.answer = append(res.answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.Hdr.Ttl},
+		Target: target,
+	})
+	if qtype == "CNAME" {
+		return "", nil
+	}
+	return strings.ToLower(target), nil
+}
+
+// wildcard returns the records synthesized for a name which doesn't exist
+// from the wildcard at its closest encloser, if any (RFC 4592 section 3.3.1)
+func (handler *CoreDNSPostgreSql) wildcard(zone, name string) []*Record {
+	encloser := name
+	for encloser != "" {
+		if i := strings.IndexByte(encloser, '.'); i >= 0 {
+			encloser = encloser[i+1:]
+		} else {
+			encloser = ""
+		}
+		if handler.cache.exists(zone, encloser) {
+			break
+		}
+	}
+
+	source := "*"
+	if encloser != "" {
+		source += "." + encloser
+	}
+	records := handler.cache.lookup(zone, source)
+	for _, rec := range records {
+		rec.Name = name
+	}
+	return records
+}
+
+// negative adds the SOA of a zone to the authority section of res, for a
+// name which doesn't exist or has no records of the type asked for. Its TTL
+// is the one negative answers are cached for: the lowest of its own TTL and
+// its minimum field (RFC 2308 section 3).
+func (handler *CoreDNSPostgreSql) negative(res *lookupResponse, zone string, result lookupResult) error {
+	rrs, err := handler.asRRs(res, handler.cache.lookup(zone, "", "SOA"))
+	if err != nil {
+		return err
+	}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+	}
+	res.ns = append(res.ns, rrs...)
+	res.result = result
+	return nil
+}
+
+// asRRs converts records, keeping track of them in res and adding the hosts
+// they refer to to its additional section
+func (handler *CoreDNSPostgreSql) asRRs(res *lookupResponse, records []*Record) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, rec := range records {
+		rr, extras, err := rec.AsRR()
+		if errors.Is(err, errUnsupportedType) {
+			// the name still exists, the type is just never answered
+			log.Printf("[WARNING] pg skipped %s record %s", rec.RecordType, rec.fqdn())
+			continue
+		}
+		if errors.Is(err, errInvalidRdata) {
+			log.Printf("[WARNING] pg skipped record %s: %v", rec.fqdn(), err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.records = append(res.records, rec)
+		res.extra = append(res.extra, extras...)
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+// glue returns the addresses of the name servers of a delegation which are
+// within the zone
+func (handler *CoreDNSPostgreSql) glue(zone string, nsrrs []dns.RR) ([]dns.RR, error) {
+	var glue []dns.RR
+	for _, rr := range nsrrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name, ok := relativeName(ns.Ns, zone)
+		if !ok {
+			continue
+		}
+		for _, rec := range handler.cache.lookup(zone, name, "A", "AAAA") {
+			rr, _, err := rec.AsRR()
+			if err != nil {
+				return nil, err
+			}
+			glue = append(glue, rr)
+		}
+	}
+	return glue, nil
+}
@@ -0,0 +1,233 @@
+package coredns_postgresql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func lookupTestHandler() *CoreDNSPostgreSql {
+	handler := &CoreDNSPostgreSql{cache: newZoneCache()}
+	soa := `{"ns":"ns1.example.org.","MBox":"hostmaster.example.org.","refresh":44,"retry":55,"expire":66,"minttl":100}`
+	zones := map[string][]*Record{
+		"example.org.": {
+			{Name: "", RecordType: "SOA", Content: soa},
+			{Name: "", RecordType: "NS", Content: `{"host":"ns1.example.org."}`},
+			{Name: "ns1", RecordType: "A", Content: `{"ip":"192.0.2.53"}`},
+			{Name: "www", RecordType: "A", Content: `{"ip":"192.0.2.1"}`},
+			{Name: "*", RecordType: "A", Content: `{"ip":"192.0.2.2"}`},
+			{Name: "*", RecordType: "TXT", Content: `{"text":"wild"}`},
+			{Name: "host.ent", RecordType: "A", Content: `{"ip":"192.0.2.3"}`},
+			{Name: "*.wild", RecordType: "CNAME", Content: `{"host":"www.example.org."}`},
+			{Name: "alias", RecordType: "CNAME", Content: `{"host":"www.example.org."}`},
+			{Name: "remote", RecordType: "CNAME", Content: `{"host":"web.example.net."}`},
+			{Name: "outside", RecordType: "CNAME", Content: `{"host":"www.example.com."}`},
+			{Name: "dangling", RecordType: "CNAME", Content: `{"host":"none.ent.example.org."}`},
+			{Name: "loop1", RecordType: "CNAME", Content: `{"host":"loop2.example.org."}`},
+			{Name: "loop2", RecordType: "CNAME", Content: `{"host":"loop1.example.org."}`},
+			{Name: "sub", RecordType: "NS", Content: `{"host":"ns.sub.example.org."}`},
+			{Name: "sub", RecordType: "NS", Content: `{"host":"ns.example.net."}`},
+			{Name: "ns.sub", RecordType: "A", Content: `{"ip":"192.0.2.54"}`},
+			{Name: "old", RecordType: "DNAME", Content: `{"rdata":"example.net."}`},
+			{Name: "_443._tcp.www", RecordType: "TLSA", Content: `{"rdata":"3 1 1 0123456789abcdef"}`},
+			{Name: "_443._tcp.www", RecordType: "TLSA", Content: `{"rdata":"not an rdata"}`},
+			{Name: "www", RecordType: "TYPE65534", Content: `{"rdata":"\\# 2 abcd"}`},
+		},
+		"example.net.": {
+			{Name: "", RecordType: "SOA", Content: soa},
+			{Name: "web", RecordType: "AAAA", Content: `{"ip":"2001:db8::1"}`},
+		},
+	}
+	cached := make(map[string]*cachedZone)
+	for zone, records := range zones {
+		z := &cachedZone{names: make(map[string][]*Record)}
+		for _, rec := range records {
+			rec.Zone, rec.Ttl, rec.handler = zone, 300, handler
+			z.names[rec.Name] = append(z.names[rec.Name], rec)
+		}
+		cached[zone] = z
+	}
+	handler.cache.replace(cached, true)
+	return handler
+}
+
+func TestLookup(t *testing.T) {
+	handler := lookupTestHandler()
+
+	tests := []struct {
+		zone, qname, qtype string
+		result             lookupResult
+		answer, ns, extra  []string
+	}{
+		{
+			zone: "example.org.", qname: "www.example.org.", qtype: "A",
+			answer: []string{"www.example.org.\t300\tIN\tA\t192.0.2.1"},
+		},
+		// no wildcard for existing names
+		{
+			zone: "example.org.", qname: "www.example.org.", qtype: "TXT",
+			result: lookupNoData,
+			ns:     []string{"example.org.\t100\tIN\tSOA\tns1.example.org. hostmaster.example.org. 0 44 55 66 100"},
+		},
+		{
+			zone: "example.org.", qname: "foo.example.org.", qtype: "TXT",
+			answer: []string{"foo.example.org.\t300\tIN\tTXT\t\"wild\""},
+		},
+		{
+			zone: "example.org.", qname: "a.b.example.org.", qtype: "A",
+			answer: []string{"a.b.example.org.\t300\tIN\tA\t192.0.2.2"},
+		},
+		// the closest encloser of a.ent is ent, which has no wildcard
+		{
+			zone: "example.org.", qname: "ent.example.org.", qtype: "A",
+			result: lookupNoData,
+			ns:     []string{"example.org.\t100\tIN\tSOA\tns1.example.org. hostmaster.example.org. 0 44 55 66 100"},
+		},
+		{
+			zone: "example.org.", qname: "a.ent.example.org.", qtype: "A",
+			result: lookupNameError,
+			ns:     []string{"example.org.\t100\tIN\tSOA\tns1.example.org. hostmaster.example.org. 0 44 55 66 100"},
+		},
+		// wildcard CNAME, followed
+		{
+			zone: "example.org.", qname: "x.wild.example.org.", qtype: "A",
+			answer: []string{
+				"x.wild.example.org.\t300\tIN\tCNAME\twww.example.org.",
+				"www.example.org.\t300\tIN\tA\t192.0.2.1",
+			},
+		},
+		{
+			zone: "example.org.", qname: "alias.example.org.", qtype: "CNAME",
+			answer: []string{"alias.example.org.\t300\tIN\tCNAME\twww.example.org."},
+		},
+		{
+			zone: "example.org.", qname: "remote.example.org.", qtype: "AAAA",
+			answer: []string{
+				"remote.example.org.\t300\tIN\tCNAME\tweb.example.net.",
+				"web.example.net.\t300\tIN\tAAAA\t2001:db8::1",
+			},
+		},
+		// the target is not served, the CNAME is the answer
+		{
+			zone: "example.org.", qname: "outside.example.org.", qtype: "A",
+			answer: []string{"outside.example.org.\t300\tIN\tCNAME\twww.example.com."},
+		},
+		{
+			zone: "example.org.", qname: "loop1.example.org.", qtype: "A",
+			answer: []string{
+				"loop1.example.org.\t300\tIN\tCNAME\tloop2.example.org.",
+				"loop2.example.org.\t300\tIN\tCNAME\tloop1.example.org.",
+			},
+		},
+		{
+			zone: "example.org.", qname: "www.sub.example.org.", qtype: "A",
+			result: lookupDelegation,
+			ns: []string{
+				"sub.example.org.\t300\tIN\tNS\tns.sub.example.org.",
+				"sub.example.org.\t300\tIN\tNS\tns.example.net.",
+			},
+			extra: []string{"ns.sub.example.org.\t300\tIN\tA\t192.0.2.54"},
+		},
+		{
+			zone: "example.org.", qname: "web.old.example.org.", qtype: "AAAA",
+			answer: []string{
+				"old.example.org.\t300\tIN\tDNAME\texample.net.",
+				"web.old.example.org.\t300\tIN\tCNAME\tweb.example.net.",
+				"web.example.net.\t300\tIN\tAAAA\t2001:db8::1",
+			},
+		},
+		// the owner of a DNAME is not substituted
+		{
+			zone: "example.org.", qname: "old.example.org.", qtype: "DNAME",
+			answer: []string{"old.example.org.\t300\tIN\tDNAME\texample.net."},
+		},
+		// records whose rdata doesn't parse are skipped
+		{
+			zone: "example.org.", qname: "_443._tcp.www.example.org.", qtype: "TLSA",
+			answer: []string{"_443._tcp.www.example.org.\t300\tIN\tTLSA\t3 1 1 0123456789abcdef"},
+		},
+		// records of unknown types are printed with an unknown class too
+		{
+			zone: "example.org.", qname: "www.example.org.", qtype: "TYPE65534",
+			answer: []string{"www.example.org.\t300\tCLASS1\tTYPE65534\t\\# 2 abcd"},
+		},
+		// DS queries are answered by the parent, not referred
+		{
+			zone: "example.org.", qname: "sub.example.org.", qtype: "DS",
+			result: lookupNoData,
+			ns:     []string{"example.org.\t100\tIN\tSOA\tns1.example.org. hostmaster.example.org. 0 44 55 66 100"},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := handler.lookup(tt.zone, tt.qname, tt.qtype)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %v", tt.qname, tt.qtype, err)
+			continue
+		}
+		if res.result != tt.result {
+			t.Errorf("%s %s: expected result %d, got %d", tt.qname, tt.qtype, tt.result, res.result)
+		}
+		checkSection(t, tt.qname+" "+tt.qtype+" answer", res.answer, tt.answer)
+		checkSection(t, tt.qname+" "+tt.qtype+" authority", res.ns, tt.ns)
+		checkSection(t, tt.qname+" "+tt.qtype+" additional", res.extra, tt.extra)
+	}
+}
+
+func TestServeDNSNegative(t *testing.T) {
+	handler := lookupTestHandler()
+	soa := test.SOA("example.org.\t100\tIN\tSOA\tns1.example.org. hostmaster.example.org. 0 44 55 66 100")
+
+	tests := []test.Case{
+		{Qname: "www.example.org.", Qtype: dns.TypeTXT, Rcode: dns.RcodeSuccess, Ns: []dns.RR{soa}},
+		{Qname: "ent.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess, Ns: []dns.RR{soa}},
+		{Qname: "a.ent.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError, Ns: []dns.RR{soa}},
+		// types without converter are NODATA as any other
+		{Qname: "www.example.org.", Qtype: dns.TypeHINFO, Rcode: dns.RcodeSuccess, Ns: []dns.RR{soa}},
+		{
+			Qname: "dangling.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError,
+			Answer: []dns.RR{test.CNAME("dangling.example.org.\t300\tIN\tCNAME\tnone.ent.example.org.")},
+			Ns:     []dns.RR{soa},
+		},
+	}
+
+	for _, tc := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := handler.ServeDNS(context.Background(), rec, tc.Msg()); err != nil {
+			t.Errorf("%s %d: unexpected error %v", tc.Qname, tc.Qtype, err)
+			continue
+		}
+		// the serial depends on the time
+		for _, rr := range rec.Msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Serial = 0
+			}
+		}
+		if err := test.SortAndCheck(rec.Msg, tc); err != nil {
+			t.Errorf("%s %d: %v", tc.Qname, tc.Qtype, err)
+		}
+	}
+}
+
+func checkSection(t *testing.T, name string, rrs []dns.RR, expected []string) {
+	t.Helper()
+	if len(rrs) != len(expected) {
+		t.Errorf("%s: expected %d records, got %v", name, len(expected), rrs)
+		return
+	}
+	for i, rr := range rrs {
+		// serials of SOA records depend on the time, they are not compared
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa = dns.Copy(soa).(*dns.SOA)
+			soa.Serial = 0
+			rr = soa
+		}
+		if rr.String() != expected[i] {
+			t.Errorf("%s: expected %q, got %q", name, expected[i], rr.String())
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package coredns_postgresql
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// redisSyncLag is the age of the oldest change of the records table not
+	// mirrored to redis yet.
+	redisSyncLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "postgresql",
+		Name:      "redis_sync_lag_seconds",
+		Help:      "Age of the oldest change of the records table not mirrored to redis yet, 0 when redis is in sync.",
+	})
+	// redisSyncPending is the number of zones waiting to be mirrored to redis.
+	redisSyncPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "postgresql",
+		Name:      "redis_sync_pending_zones",
+		Help:      "The number of zones with changes not mirrored to redis yet.",
+	})
+	// redisSyncWrites counts the writes to redis by operation: set and delete
+	// of locations, and delete_zone.
+	redisSyncWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "postgresql",
+		Name:      "redis_sync_writes_total",
+		Help:      "Counter of the locations and zones written to redis by the sync, by operation.",
+	}, []string{"op"})
+	// redisSyncErrors counts the zones which failed to be mirrored to redis.
+	redisSyncErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "postgresql",
+		Name:      "redis_sync_errors_total",
+		Help:      "Counter of the failures to mirror a zone to redis.",
+	})
+)
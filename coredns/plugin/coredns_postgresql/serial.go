@@ -0,0 +1,69 @@
+package coredns_postgresql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// maxSerialIncrement is the largest increment of a serial which is still seen
+// as an increase by RFC 1982 serial arithmetic
+const maxSerialIncrement uint32 = 2147483647
+
+// serialLess returns true if serial a is older than b, per RFC 1982.
+func serialLess(a, b uint32) bool {
+	if a < b {
+		return (b - a) <= maxSerialIncrement
+	}
+	return (a - b) > maxSerialIncrement
+}
+
+// setupSerials creates the <prefix>zones table holding the serial of each
+// zone, and a trigger incrementing it whenever a record of the zone changes.
+// New zones start with the current Unix time, so that secondaries which were
+// given time based serials before still see the zone as newer.
+func (handler *CoreDNSPostgreSql) setupSerials(db *sql.DB) error {
+	t := handler.TablePrefix + "zones"
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			zone VARCHAR(255) PRIMARY KEY,
+			serial BIGINT NOT NULL
+		);
+
+		CREATE OR REPLACE FUNCTION %[1]s_bump(z TEXT) RETURNS VOID AS $$
+		BEGIN
+			INSERT INTO %[1]s (zone, serial) VALUES (z, EXTRACT(EPOCH FROM now())::BIGINT %% 4294967296)
+			ON CONFLICT (zone) DO UPDATE SET serial =
+				CASE WHEN %[1]s.serial >= 4294967295 THEN 1 ELSE %[1]s.serial + 1 END;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE OR REPLACE FUNCTION %[1]s_changed() RETURNS TRIGGER AS $$
+		BEGIN
+			IF TG_OP <> 'INSERT' THEN
+				PERFORM %[1]s_bump(OLD.zone);
+			END IF;
+			IF TG_OP = 'INSERT' OR NEW.zone IS DISTINCT FROM OLD.zone THEN
+				PERFORM %[1]s_bump(NEW.zone);
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS %[1]s_serial ON %[2]s;
+		CREATE TRIGGER %[1]s_serial AFTER INSERT OR UPDATE OR DELETE ON %[2]s
+			FOR EACH ROW EXECUTE PROCEDURE %[1]s_changed();
+
+		INSERT INTO %[1]s (zone, serial)
+			SELECT DISTINCT zone, EXTRACT(EPOCH FROM now())::BIGINT %% 4294967296 FROM %[2]s
+			ON CONFLICT (zone) DO NOTHING;`, t, handler.tableName))
+	if err != nil {
+		return err
+	}
+	handler.zonesTable = t
+	return nil
+}
+
+// zoneSerial returns the serial of a zone, and false if it is not known.
+func (handler *CoreDNSPostgreSql) zoneSerial(zone string) (uint32, bool) {
+	return handler.cache.serial(zone)
+}
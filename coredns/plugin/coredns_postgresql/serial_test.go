@@ -0,0 +1,24 @@
+package coredns_postgresql
+
+import "testing"
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		// the serial wrapped around
+		{4294967295, 1, true},
+		{1, 4294967295, false},
+		{0, 2147483647, true},
+		{0, 2147483648, false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("serialLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
@@ -2,14 +2,20 @@ package coredns_postgresql
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/redis"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
 )
 
 const (
@@ -42,6 +48,52 @@ func setup(c *caddy.Controller) error {
 		return r
 	})
 
+	c.OnStartup(func() error {
+		// get the transfer plugin before watching the changes, which notify
+		// its secondaries
+		if t := dnsserver.GetConfig(c).Handler("transfer"); t != nil {
+			r.transfer = t.(*transfer.Transfer)
+		}
+
+		l, err := r.listen()
+		if err != nil {
+			return plugin.Error("postgresql", err)
+		}
+		r.listener = l
+
+		if r.warmupAddr != "" {
+			if r.mirror == nil {
+				log.Printf("[WARNING] pg warmup_listen %s ignored, redis is off", r.warmupAddr)
+			} else if err := r.listenWarmUp(); err != nil {
+				return plugin.Error("postgresql", err)
+			}
+		}
+
+		// send notifies for the zones on startup
+		if r.transfer == nil {
+			return nil
+		}
+		go func() {
+			for _, zone := range r.cache.names() {
+				r.transfer.Notify(zone)
+			}
+		}()
+		return nil
+	})
+
+	c.OnShutdown(func() error {
+		if r.listener != nil {
+			r.listener.Close()
+		}
+		if r.warmupListener != nil {
+			r.warmupListener.Close()
+		}
+		if r.pool != nil {
+			return r.pool.Close()
+		}
+		return nil
+	})
+
 	return nil
 }
 
@@ -52,6 +104,8 @@ func postgresqlParse(c *caddy.Controller) (*CoreDNSPostgreSql, error) {
 		redisOn:      false,
 		redisTtl:    -1,  
         batchUpdateRedis:  true,
+		zoneUpdateTime:   defaultZoneUpdateTime,
+		cache:            newZoneCache(),
 	}
 	var err error
 
@@ -105,7 +159,7 @@ func postgresqlParse(c *caddy.Controller) (*CoreDNSPostgreSql, error) {
 				}
 				var val time.Duration
 				val, err = time.ParseDuration(c.Val())
-				if err != nil {
+				if err != nil || val <= 0 {
 					val = defaultZoneUpdateTime
 				}
 				postgresql.zoneUpdateTime = val
@@ -149,6 +203,20 @@ func postgresqlParse(c *caddy.Controller) (*CoreDNSPostgreSql, error) {
 					val = defaultBatchUpdate
 				}
 				postgresql.batchUpdateRedis = val
+			case "warmup_listen":
+				if !c.NextArg() {
+					return &CoreDNSPostgreSql{}, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+					return &CoreDNSPostgreSql{}, c.Errf("invalid warmup_listen address '%s': %v", c.Val(), err)
+				}
+				postgresql.warmupAddr = c.Val()
+			case "allow_update":
+				// Only updates signed with TSIG, verified by the tsig plugin, are applied
+				postgresql.updateOn = true
+				for _, zone := range c.RemainingArgs() {
+					postgresql.updateZones = append(postgresql.updateZones, dns.Fqdn(strings.ToLower(zone)))
+				}
 			default:
 				if c.Val() != "}" {
 					return &CoreDNSPostgreSql{}, c.Errf("unknown property '%s'", c.Val())
@@ -168,6 +236,11 @@ func postgresqlParse(c *caddy.Controller) (*CoreDNSPostgreSql, error) {
 			postgresql.redisOn = false 
 		} else {
 			PgUseRedis.Connect()
+			postgresql.mirror = newRedisMirror(&PgUseRedis)
+			postgresql.warmups = make(chan chan error)
+		}
+		if postgresql.redisTtl > 0 {
+			log.Printf("[WARNING] pg redisTtl is ignored: zones are kept in sync in redis rather than expired")
 		}
 	}
 
@@ -181,14 +254,40 @@ func postgresqlParse(c *caddy.Controller) (*CoreDNSPostgreSql, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
 
 	postgresql.tableName = postgresql.TablePrefix + "records"
+	if err := postgresql.setupSerials(db); err != nil {
+		log.Printf("[WARNING] pg could not set up zone serials, the current time is used instead: %v", err)
+	}
+	if err := postgresql.setupNotify(); err != nil {
+		log.Printf("[WARNING] pg could not set up change notifications, zones are only reloaded every %v: %v", postgresql.zoneUpdateTime, err)
+	} else {
+		postgresql.notifyOn = true
+	}
+	if postgresql.mirror == nil {
+		if err := postgresql.reload(); err != nil {
+			return nil, err
+		}
+	} else if err := postgresql.warmUp(); err != nil {
+		// Redis is filled before serving, but is not required to serve
+		if !errors.Is(err, errNotMirrored) {
+			return nil, err
+		}
+		log.Printf("[WARNING] pg could not fill redis before serving, retrying on the next reload: %v", err)
+	}
 
 	return &postgresql, nil
 }
 
+// db returns the connection pool of the plugin, opening it on first use. It
+// is shared by all lookups and must not be closed.
 func (handler *CoreDNSPostgreSql) db() (*sql.DB, error) {
+	handler.poolMu.Lock()
+	defer handler.poolMu.Unlock()
+	if handler.pool != nil {
+		return handler.pool, nil
+	}
+
 	db, err := sql.Open("postgres", handler.Datasource)
 	if err != nil {
 		return nil, err
@@ -198,5 +297,6 @@ func (handler *CoreDNSPostgreSql) db() (*sql.DB, error) {
 	db.SetMaxOpenConns(handler.MaxOpenConnections)
 	db.SetMaxIdleConns(handler.MaxIdleConnections)
 
+	handler.pool = db
 	return db, nil
 }
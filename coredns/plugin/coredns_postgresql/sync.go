@@ -0,0 +1,184 @@
+package coredns_postgresql
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/redis"
+)
+
+// redisMirror keeps the zone hashes of the redis plugin in sync with the
+// records table: whenever zones are read again into the cache, their records
+// are written to redis, and the locations and zones which are no longer in
+// the table are deleted from it. Zones failing to be mirrored are retried on
+// the next reload. A full reload mirrors every zone, which fills a flushed
+// redis again.
+type redisMirror struct {
+	sync.Mutex
+	redis *redis.Redis
+	// pending holds the zones whose changes are not mirrored yet, with the
+	// time of the oldest of them
+	pending map[string]time.Time
+	// mirrored holds the zones written to redis, to delete them when they are
+	// dropped from the records table
+	mirrored map[string]struct{}
+}
+
+func newRedisMirror(r *redis.Redis) *redisMirror {
+	return &redisMirror{
+		redis:    r,
+		pending:  make(map[string]time.Time),
+		mirrored: make(map[string]struct{}),
+	}
+}
+
+// changed records that zones changed at the given time, or all of them if
+// none is given, to mirror them on the next sync
+func (m *redisMirror) changed(since time.Time, c *zoneCache, zones ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.changedLocked(since, c, zones...)
+	m.report()
+}
+
+func (m *redisMirror) changedLocked(since time.Time, c *zoneCache, zones ...string) {
+	if len(zones) == 0 {
+		zones = c.names()
+		for zone := range m.mirrored {
+			zones = append(zones, zone)
+		}
+	}
+	for _, zone := range zones {
+		if _, ok := m.pending[zone]; !ok {
+			m.pending[zone] = since
+		}
+	}
+}
+
+// sync mirrors the zones which changed at the given time, or all of them if
+// none is given, and those which failed to be mirrored before. The records
+// of all the zones are read and written with a pipeline each way.
+func (m *redisMirror) sync(since time.Time, c *zoneCache, zones ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.changedLocked(since, c, zones...)
+	if len(m.pending) == 0 {
+		m.report()
+		return
+	}
+
+	if err := m.syncPending(c); err != nil {
+		log.Printf("[ERROR] pg failed to mirror %d zones to redis: %v", len(m.pending), err)
+		redisSyncErrors.Inc()
+	}
+	m.report()
+}
+
+// syncPending makes the hashes of the pending zones in redis match their
+// records in the cache
+func (m *redisMirror) syncPending(c *zoneCache) error {
+	wanted := make(map[string]map[string]string, len(m.pending))
+	var live []string
+	for zone := range m.pending {
+		if records := c.all(zone); len(records) > 0 {
+			wanted[zone] = redisEntries(records)
+			live = append(live, zone)
+		}
+	}
+	sort.Strings(live)
+	current, err := m.redis.ZoneEntries(live)
+	if err != nil {
+		return err
+	}
+
+	changes := make([]redis.ZoneChange, 0, len(m.pending))
+	var set, deleted, dropped int
+	for zone := range m.pending {
+		entries, ok := wanted[zone]
+		if !ok {
+			changes = append(changes, redis.ZoneChange{Zone: zone, Drop: true})
+			dropped++
+			continue
+		}
+		change := redis.ZoneChange{Zone: zone}
+		change.Set, change.Delete = diffEntries(current[zone], entries)
+		if len(change.Set) == 0 && len(change.Delete) == 0 {
+			continue
+		}
+		changes = append(changes, change)
+		set += len(change.Set)
+		deleted += len(change.Delete)
+	}
+	if err := m.redis.Apply(changes); err != nil {
+		return err
+	}
+
+	redisSyncWrites.WithLabelValues("set").Add(float64(set))
+	redisSyncWrites.WithLabelValues("delete").Add(float64(deleted))
+	redisSyncWrites.WithLabelValues("delete_zone").Add(float64(dropped))
+	for zone := range m.pending {
+		if _, ok := wanted[zone]; ok {
+			m.mirrored[zone] = struct{}{}
+		} else {
+			delete(m.mirrored, zone)
+		}
+	}
+	m.pending = make(map[string]time.Time)
+	return nil
+}
+
+// lag returns how long the oldest change not mirrored yet has been waiting,
+// 0 if redis is in sync
+func (m *redisMirror) lag() time.Duration {
+	var oldest time.Time
+	for _, since := range m.pending {
+		if oldest.IsZero() || since.Before(oldest) {
+			oldest = since
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// report updates the metrics of the sync, the lag growing while changes wait
+func (m *redisMirror) report() {
+	redisSyncLag.Set(m.lag().Seconds())
+	redisSyncPending.Set(float64(len(m.pending)))
+}
+
+// pendingZones returns the number of zones not mirrored yet
+func (m *redisMirror) pendingZones() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.pending)
+}
+
+// reportLag updates the metrics of the sync between reloads
+func (m *redisMirror) reportLag() {
+	m.Lock()
+	defer m.Unlock()
+	m.report()
+}
+
+// diffEntries returns the entries to write to turn current into wanted, and
+// the locations to delete
+func diffEntries(current, wanted map[string]string) (map[string]string, []string) {
+	set := make(map[string]string)
+	for name, value := range wanted {
+		if v, ok := current[name]; !ok || v != value {
+			set[name] = value
+		}
+	}
+	var orphans []string
+	for name := range current {
+		if _, ok := wanted[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	return set, orphans
+}
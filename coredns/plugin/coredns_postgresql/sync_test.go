@@ -0,0 +1,70 @@
+package coredns_postgresql
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/redis"
+)
+
+func TestRedisEntries(t *testing.T) {
+	entries := redisEntries([]*Record{
+		{Name: "", Zone: "example.org.", Ttl: 300, RecordType: "NS", Content: `{"host":"ns1.example.org."}`},
+		{Name: "WWW", Zone: "example.org.", Ttl: 60, RecordType: "A", Content: `{"ip":"192.0.2.1"}`},
+		{Name: "www", Zone: "example.org.", Ttl: 60, RecordType: "AAAA", Content: `{"ip":"2001:db8::1"}`},
+		{Name: "bad", Zone: "example.org.", Ttl: 60, RecordType: "A", Content: `not json`},
+	})
+	if len(entries) != 2 {
+		t.Fatalf("expected entries for @ and www, got %v", entries)
+	}
+	var www redis.Record
+	if err := json.Unmarshal([]byte(entries["www"]), &www); err != nil {
+		t.Fatal(err)
+	}
+	if len(www.A) != 1 || www.A[0].Ip.String() != "192.0.2.1" || www.A[0].Ttl != 60 || len(www.AAAA) != 1 {
+		t.Errorf("unexpected entry for www: %s", entries["www"])
+	}
+	if _, ok := entries["@"]; !ok {
+		t.Errorf("expected the apex to be stored as @")
+	}
+}
+
+func TestDiffEntries(t *testing.T) {
+	current := map[string]string{"@": "ns", "www": "old", "gone": "x"}
+	wanted := map[string]string{"@": "ns", "www": "new", "mail": "mx"}
+	set, orphans := diffEntries(current, wanted)
+	if !reflect.DeepEqual(set, map[string]string{"www": "new", "mail": "mx"}) {
+		t.Errorf("unexpected entries to set %v", set)
+	}
+	if !reflect.DeepEqual(orphans, []string{"gone"}) {
+		t.Errorf("unexpected orphans %v", orphans)
+	}
+}
+
+func TestRedisMirrorLag(t *testing.T) {
+	c := newZoneCache()
+	c.replace(map[string]*cachedZone{
+		"example.org.": cachedTestZone(0),
+		"example.net.": cachedTestZone(0),
+	}, true)
+	m := newRedisMirror(&redis.Redis{})
+	if lag := m.lag(); lag != 0 {
+		t.Errorf("expected no lag, got %v", lag)
+	}
+
+	// The oldest change is kept until the zone is mirrored
+	m.changed(time.Now().Add(-time.Minute), c, "example.org.")
+	m.changed(time.Now(), c, "example.org.")
+	if lag := m.lag(); lag < time.Minute {
+		t.Errorf("expected a lag of a minute, got %v", lag)
+	}
+	m.mirrored["example.com."] = struct{}{}
+	m.changed(time.Now(), c)
+	for _, zone := range []string{"example.org.", "example.net.", "example.com."} {
+		if _, ok := m.pending[zone]; !ok {
+			t.Errorf("expected %s to be pending", zone)
+		}
+	}
+}
@@ -2,7 +2,11 @@ package coredns_postgresql
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -57,6 +61,7 @@ type SOARecord struct {
 	Retry   uint32 `json:"retry"`
 	Expire  uint32 `json:"expire"`
 	MinTtl  uint32 `json:"minttl"`
+	Serial  uint32 `json:"serial,omitempty"`
 }
 
 type CAARecord struct {
@@ -65,6 +70,47 @@ type CAARecord struct {
 	Value string `json:"value"`
 }
 
+// GenericRecord is the content of the records of the other types, PTR, NAPTR,
+// SSHFP, TLSA, DS, HTTPS, SVCB or DNAME for instance: their rdata in
+// presentation format, or in the RFC 3597 syntax (\# <length> <hex>) for the
+// types unknown to the server.
+type GenericRecord struct {
+	Rdata string `json:"rdata"`
+}
+
+var (
+	errUnsupportedType = errors.New("unsupported record type")
+	// errInvalidRdata is returned for the generic records whose rdata doesn't
+	// parse, which are skipped like the unsupported types
+	errInvalidRdata = errors.New("invalid rdata")
+)
+
+// AsRR returns a record as a dns.RR, along with the records to add to the
+// additional section of an answer
+func (rec *Record) AsRR() (record dns.RR, extras []dns.RR, err error) {
+	switch rec.RecordType {
+	case "A":
+		return rec.AsARecord()
+	case "AAAA":
+		return rec.AsAAAARecord()
+	case "CNAME":
+		return rec.AsCNAMERecord()
+	case "SOA":
+		return rec.AsSOARecord()
+	case "SRV":
+		return rec.AsSRVRecord()
+	case "NS":
+		return rec.AsNSRecord()
+	case "MX":
+		return rec.AsMXRecord()
+	case "TXT":
+		return rec.AsTXTRecord()
+	case "CAA":
+		return rec.AsCAARecord()
+	}
+	return rec.AsGenericRecord()
+}
+
 func (rec *Record) AsARecord() (record dns.RR, extras []dns.RR, err error) {
 	r := new(dns.A)
 	r.Hdr = dns.RR_Header{
@@ -170,9 +216,12 @@ func (rec *Record) AsNSRecord() (record dns.RR, extras []dns.RR, err error) {
 	}
 
 	r.Ns = aRec.Host
-	extras, err = rec.handler.hosts(rec.Zone, r.Ns)
-	if err != nil {
-		return nil, nil, err
+	// Glue is only looked up for records read by a handler
+	if rec.handler != nil {
+		extras, err = rec.handler.hosts(rec.Zone, r.Ns)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	return r, extras, nil
 }
@@ -197,9 +246,12 @@ func (rec *Record) AsMXRecord() (record dns.RR, extras []dns.RR, err error) {
 
 	r.Mx = aRec.Host
 	r.Preference = aRec.Preference
-	extras, err = rec.handler.hosts(rec.Zone, aRec.Host)
-	if err != nil {
-		return nil, nil, err
+	// Glue is only looked up for records read by a handler
+	if rec.handler != nil {
+		extras, err = rec.handler.hosts(rec.Zone, aRec.Host)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	return r, extras, nil
@@ -265,7 +317,7 @@ func (rec *Record) AsSOARecord() (record dns.RR, extras []dns.RR, err error) {
 		r.Expire = aRec.Expire
 		r.Minttl = aRec.MinTtl
 	}
-	r.Serial = rec.serial()
+	r.Serial = rec.serial(aRec.Serial)
 
 	return r, nil, nil
 }
@@ -295,6 +347,45 @@ func (rec *Record) AsCAARecord() (record dns.RR, extras []dns.RR, err error) {
 	return r, nil, nil
 }
 
+func (rec *Record) AsGenericRecord() (record dns.RR, extras []dns.RR, err error) {
+	rrtype, ok := parseType(rec.RecordType)
+	if !ok {
+		return nil, nil, errUnsupportedType
+	}
+	var aRec *GenericRecord
+	err = json.Unmarshal([]byte(rec.Content), &aRec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if aRec.Rdata == "" {
+		return nil, nil, nil
+	}
+
+	r, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.fqdn()), rec.minTtl(), dns.Type(rrtype), aRec.Rdata))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s %q: %v", errInvalidRdata, rec.RecordType, aRec.Rdata, err)
+	}
+	if r == nil || r.Header().Rrtype != rrtype {
+		return nil, nil, fmt.Errorf("%w: %s %q", errInvalidRdata, rec.RecordType, aRec.Rdata)
+	}
+	return r, nil, nil
+}
+
+// parseType returns the type of a record from its name, such as "PTR" or
+// "TYPE65534" (RFC 3597)
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	if !strings.HasPrefix(s, "TYPE") {
+		return 0, false
+	}
+	t, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+	return uint16(t), err == nil
+}
+
 func (rec *Record) minTtl() uint32 {
 	if rec.Ttl == 0 {
 		return defaultTtl
@@ -302,7 +393,17 @@ func (rec *Record) minTtl() uint32 {
 	return rec.Ttl
 }
 
-func (rec *Record) serial() uint32 {
+// serial returns the serial of the zone of a record: the one maintained in
+// the zones table, or else the one of the SOA record, or else the current time
+func (rec *Record) serial(soaSerial uint32) uint32 {
+	if rec.handler != nil {
+		if serial, ok := rec.handler.zoneSerial(rec.Zone); ok {
+			return serial
+		}
+	}
+	if soaSerial != 0 {
+		return soaSerial
+	}
 	return uint32(time.Now().Unix())
 }
 
@@ -0,0 +1,511 @@
+package coredns_postgresql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// updateMu serializes the dynamic updates handled by this server, so that
+// prerequisites can't change between their check and the update.
+var updateMu sync.Mutex
+
+// updateTx is the view of a zone an UPDATE message is applied to. Names are
+// relative to the zone, an empty name standing for the apex.
+type updateTx interface {
+	records(name string) ([]*Record, error)
+	insert(rec *Record) error
+	remove(rec *Record) error
+	setTtl(rec *Record, ttl uint32) error
+}
+
+// serveUpdate handles an RFC 2136 UPDATE message for one of the zones served
+// by the plugin. Only updates signed with TSIG are applied: the signature is
+// verified by the tsig plugin, which has to come before this one.
+func (handler *CoreDNSPostgreSql) serveUpdate(state request.Request, zone string) (int, error) {
+	r := state.Req
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return handler.errorResponse(state, dns.RcodeFormatError, nil)
+	}
+	if r.Question[0].Qclass != dns.ClassINET {
+		return handler.errorResponse(state, dns.RcodeNotAuth, nil)
+	}
+	if r.IsTsig() == nil {
+		log.Printf("[INFO] pg refused unsigned update of zone %s from %s", zone, state.IP())
+		return handler.errorResponse(state, dns.RcodeRefused, nil)
+	}
+	if state.W.TsigStatus() != nil {
+		log.Printf("[INFO] pg refused update of zone %s from %s with a bad signature", zone, state.IP())
+		return handler.errorResponse(state, dns.RcodeNotAuth, nil)
+	}
+	if !handler.updateAllowed(zone) {
+		log.Printf("[INFO] pg refused update of zone %s from %s", zone, state.IP())
+		return handler.errorResponse(state, dns.RcodeRefused, nil)
+	}
+	// Updates are only accepted at the apex of a zone
+	if !strings.EqualFold(dns.Fqdn(r.Question[0].Name), zone) {
+		return handler.errorResponse(state, dns.RcodeNotAuth, nil)
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	db, err := handler.db()
+	if err != nil {
+		return handler.errorResponse(state, dns.RcodeServerFailure, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return handler.errorResponse(state, dns.RcodeServerFailure, err)
+	}
+	defer tx.Rollback()
+
+	rcode, err := applyUpdate(&pgUpdateTx{tx: tx, handler: handler, zone: zone}, zone, r)
+	if err != nil {
+		return handler.errorResponse(state, dns.RcodeServerFailure, err)
+	}
+	if rcode == dns.RcodeSuccess {
+		if err := tx.Commit(); err != nil {
+			return handler.errorResponse(state, dns.RcodeServerFailure, err)
+		}
+		log.Printf("[INFO] pg applied update of zone %s from %s", zone, state.IP())
+		// Without notifications from the table, the change must be read here
+		if !handler.notifyOn {
+			handler.reloadAndNotify(zone)
+		}
+	}
+	return handler.errorResponse(state, rcode, nil)
+}
+
+// updateAllowed returns true if updates of a zone are enabled
+func (handler *CoreDNSPostgreSql) updateAllowed(zone string) bool {
+	if !handler.updateOn {
+		return false
+	}
+	if len(handler.updateZones) == 0 {
+		return true
+	}
+	for _, z := range handler.updateZones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpdate checks the prerequisites of an UPDATE message and applies its
+// update section, following RFC 2136 sections 3.2 to 3.4. It returns the
+// rcode of the response; the changes must only be kept if it is RcodeSuccess.
+func applyUpdate(tx updateTx, zone string, r *dns.Msg) (int, error) {
+	if rcode, err := checkPrerequisites(tx, zone, r.Answer); rcode != dns.RcodeSuccess || err != nil {
+		return rcode, err
+	}
+	if rcode := prescanUpdates(zone, r.Ns); rcode != dns.RcodeSuccess {
+		return rcode, nil
+	}
+	for _, rr := range r.Ns {
+		if err := applyUpdateRR(tx, zone, rr); err != nil {
+			return dns.RcodeServerFailure, err
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// relativeName returns a name relative to a zone, and false if the name is
+// not within it
+func relativeName(name, zone string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == zone {
+		return "", true
+	}
+	if !dns.IsSubDomain(zone, name) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+zone), true
+}
+
+// rrsetKey identifies the RRset of a prerequisite
+type rrsetKey struct {
+	name   string
+	rrtype string
+}
+
+// checkPrerequisites checks the prerequisite section of an UPDATE message
+// (RFC 2136 3.2)
+func checkPrerequisites(tx updateTx, zone string, prereqs []dns.RR) (int, error) {
+	// RRsets which must exist with exactly the given records
+	wanted := make(map[rrsetKey][]string)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		name, ok := relativeName(hdr.Name, zone)
+		if !ok {
+			return dns.RcodeNotZone, nil
+		}
+		rrtype := dns.Type(hdr.Rrtype).String()
+
+		switch hdr.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+			recs, err := tx.records(name)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			if hdr.Rrtype != dns.TypeANY {
+				recs = ofType(recs, rrtype)
+			}
+			switch {
+			case hdr.Class == dns.ClassANY && len(recs) == 0 && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeNameError, nil
+			case hdr.Class == dns.ClassANY && len(recs) == 0:
+				return dns.RcodeNXRrset, nil
+			case hdr.Class == dns.ClassNONE && len(recs) > 0 && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeYXDomain, nil
+			case hdr.Class == dns.ClassNONE && len(recs) > 0:
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			_, content, err := rrContent(rr)
+			if err != nil {
+				return dns.RcodeFormatError, nil
+			}
+			key := rrsetKey{name, rrtype}
+			if !containsString(wanted[key], content) {
+				wanted[key] = append(wanted[key], content)
+			}
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+
+	for key, contents := range wanted {
+		recs, err := tx.records(key.name)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		var have []string
+		for _, rec := range ofType(recs, key.rrtype) {
+			content, err := rec.canonicalContent()
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			if !containsString(have, content) {
+				have = append(have, content)
+			}
+		}
+		if len(have) != len(contents) {
+			return dns.RcodeNXRrset, nil
+		}
+		for _, content := range contents {
+			if !containsString(have, content) {
+				return dns.RcodeNXRrset, nil
+			}
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// isMetaType returns true for the types which can't be the type of records
+func isMetaType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+	return false
+}
+
+// prescanUpdates checks the update section of an UPDATE message before any
+// change is made (RFC 2136 3.4.1)
+func prescanUpdates(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if _, ok := relativeName(hdr.Name, zone); !ok {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+			if _, _, err := rrContent(rr); err != nil {
+				// Records of types we can't store
+				return dns.RcodeNotImplemented
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 || (isMetaType(hdr.Rrtype) && hdr.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdateRR applies a record of the update section of an UPDATE message
+// (RFC 2136 3.4.2)
+func applyUpdateRR(tx updateTx, zone string, rr dns.RR) error {
+	hdr := rr.Header()
+	name, _ := relativeName(hdr.Name, zone)
+	apex := name == ""
+	rrtype := dns.Type(hdr.Rrtype).String()
+
+	recs, err := tx.records(name)
+	if err != nil {
+		return err
+	}
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		_, content, _ := rrContent(rr)
+		switch {
+		case hdr.Rrtype == dns.TypeSOA && !apex:
+			return nil
+		case hdr.Rrtype == dns.TypeCNAME && len(recs) > len(ofType(recs, "CNAME")):
+			// A CNAME can't be added to a name with other records
+			return nil
+		case hdr.Rrtype != dns.TypeCNAME && len(ofType(recs, "CNAME")) > 0:
+			return nil
+		}
+		for _, rec := range ofType(recs, rrtype) {
+			existing, err := rec.canonicalContent()
+			if err != nil {
+				return err
+			}
+			if existing == content {
+				if rec.Ttl == hdr.Ttl {
+					return nil
+				}
+				return tx.setTtl(rec, hdr.Ttl)
+			}
+			// SOA and CNAME RRsets hold a single record, which is replaced
+			if hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeCNAME {
+				if err := tx.remove(rec); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.insert(&Record{Zone: zone, Name: name, RecordType: rrtype, Ttl: hdr.Ttl, Content: content})
+
+	case dns.ClassANY:
+		for _, rec := range recs {
+			if hdr.Rrtype != dns.TypeANY && rec.RecordType != rrtype {
+				continue
+			}
+			// The SOA and NS RRsets of the apex can't be deleted this way
+			if apex && (rec.RecordType == "SOA" || rec.RecordType == "NS") {
+				continue
+			}
+			if err := tx.remove(rec); err != nil {
+				return err
+			}
+		}
+
+	case dns.ClassNONE:
+		if hdr.Rrtype == dns.TypeSOA {
+			return nil
+		}
+		_, content, err := rrContent(rr)
+		if err != nil {
+			// We have no record of this type to delete
+			return nil
+		}
+		same := ofType(recs, rrtype)
+		for _, rec := range same {
+			existing, err := rec.canonicalContent()
+			if err != nil {
+				return err
+			}
+			if existing != content {
+				continue
+			}
+			// The last NS record of the apex is kept
+			if apex && hdr.Rrtype == dns.TypeNS && len(same) == 1 {
+				return nil
+			}
+			if err := tx.remove(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ofType returns the records of a type
+func ofType(recs []*Record, rrtype string) []*Record {
+	var res []*Record
+	for _, rec := range recs {
+		if strings.EqualFold(rec.RecordType, rrtype) {
+			res = append(res, rec)
+		}
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost returns a host name the way it is stored
+func normalizeHost(host string) string {
+	return strings.ToLower(dns.Fqdn(host))
+}
+
+// rrContent returns the type and the JSON content a record is stored with
+func rrContent(rr dns.RR) (string, string, error) {
+	var v interface{}
+	switch rr := rr.(type) {
+	case *dns.A:
+		v = &ARecord{Ip: rr.A}
+	case *dns.AAAA:
+		v = &AAAARecord{Ip: rr.AAAA}
+	case *dns.TXT:
+		v = &TXTRecord{Text: strings.Join(rr.Txt, "")}
+	case *dns.CNAME:
+		v = &CNAMERecord{Host: rr.Target}
+	case *dns.NS:
+		v = &NSRecord{Host: rr.Ns}
+	case *dns.MX:
+		v = &MXRecord{Host: rr.Mx, Preference: rr.Preference}
+	case *dns.SRV:
+		v = &SRVRecord{Priority: rr.Priority, Weight: rr.Weight, Port: rr.Port, Target: rr.Target}
+	case *dns.SOA:
+		v = &SOARecord{Ns: rr.Ns, MBox: rr.Mbox, Refresh: rr.Refresh, Retry: rr.Retry, Expire: rr.Expire, MinTtl: rr.Minttl, Serial: rr.Serial}
+	case *dns.CAA:
+		v = &CAARecord{Flag: rr.Flag, Tag: rr.Tag, Value: rr.Value}
+	default:
+		v = &GenericRecord{Rdata: rdata(rr)}
+	}
+	content, err := marshalContent(v)
+	return dns.Type(rr.Header().Rrtype).String(), content, err
+}
+
+// rdata returns the rdata of a record in presentation format
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// canonicalContent returns the content of a stored record the way rrContent
+// would, so that records can be compared whatever their JSON formatting.
+func (rec *Record) canonicalContent() (string, error) {
+	var v interface{}
+	switch strings.ToUpper(rec.RecordType) {
+	case "A":
+		v = &ARecord{}
+	case "AAAA":
+		v = &AAAARecord{}
+	case "TXT":
+		v = &TXTRecord{}
+	case "CNAME":
+		v = &CNAMERecord{}
+	case "NS":
+		v = &NSRecord{}
+	case "MX":
+		v = &MXRecord{}
+	case "SRV":
+		v = &SRVRecord{}
+	case "SOA":
+		v = &SOARecord{}
+	case "CAA":
+		v = &CAARecord{}
+	default:
+		// the rdata is formatted the way the server would
+		rr, _, err := rec.AsGenericRecord()
+		if err != nil || rr == nil {
+			return rec.Content, nil
+		}
+		v = &GenericRecord{Rdata: rdata(rr)}
+		return marshalContent(v)
+	}
+	if err := json.Unmarshal([]byte(rec.Content), v); err != nil {
+		return "", err
+	}
+	return marshalContent(v)
+}
+
+// marshalContent normalizes the host names and addresses of a record and
+// returns its JSON content
+func marshalContent(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case *ARecord:
+		v.Ip = v.Ip.To4()
+	case *AAAARecord:
+		v.Ip = v.Ip.To16()
+	case *CNAMERecord:
+		v.Host = normalizeHost(v.Host)
+	case *NSRecord:
+		v.Host = normalizeHost(v.Host)
+	case *MXRecord:
+		v.Host = normalizeHost(v.Host)
+	case *SRVRecord:
+		v.Target = normalizeHost(v.Target)
+	case *SOARecord:
+		v.Ns = normalizeHost(v.Ns)
+		v.MBox = normalizeHost(v.MBox)
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// pgUpdateTx applies an update to the records table within a transaction
+type pgUpdateTx struct {
+	tx      *sql.Tx
+	handler *CoreDNSPostgreSql
+	zone    string
+}
+
+func (t *pgUpdateTx) records(name string) ([]*Record, error) {
+	result, err := t.tx.Query(fmt.Sprintf("SELECT name, zone, ttl, record_type, content FROM %s WHERE zone = $1 AND name = $2 FOR UPDATE",
+		t.handler.tableName), t.zone, name)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	records := make([]*Record, 0)
+	for result.Next() {
+		rec := &Record{handler: t.handler}
+		if err := result.Scan(&rec.Name, &rec.Zone, &rec.Ttl, &rec.RecordType, &rec.Content); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, result.Err()
+}
+
+func (t *pgUpdateTx) insert(rec *Record) error {
+	_, err := t.tx.Exec(fmt.Sprintf("INSERT INTO %s (name, zone, ttl, record_type, content) VALUES ($1, $2, $3, $4, $5)",
+		t.handler.tableName), rec.Name, rec.Zone, rec.Ttl, rec.RecordType, rec.Content)
+	return err
+}
+
+func (t *pgUpdateTx) remove(rec *Record) error {
+	_, err := t.tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE zone = $1 AND name = $2 AND record_type = $3 AND content = $4",
+		t.handler.tableName), rec.Zone, rec.Name, rec.RecordType, rec.Content)
+	return err
+}
+
+func (t *pgUpdateTx) setTtl(rec *Record, ttl uint32) error {
+	_, err := t.tx.Exec(fmt.Sprintf("UPDATE %s SET ttl = $1 WHERE zone = $2 AND name = $3 AND record_type = $4 AND content = $5",
+		t.handler.tableName), ttl, rec.Zone, rec.Name, rec.RecordType, rec.Content)
+	return err
+}
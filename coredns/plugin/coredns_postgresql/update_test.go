@@ -0,0 +1,242 @@
+package coredns_postgresql
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// memUpdateTx is an in-memory zone to apply updates to
+type memUpdateTx struct {
+	recs []*Record
+}
+
+func (t *memUpdateTx) records(name string) ([]*Record, error) {
+	var res []*Record
+	for _, rec := range t.recs {
+		if rec.Name == name {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+func (t *memUpdateTx) insert(rec *Record) error {
+	t.recs = append(t.recs, rec)
+	return nil
+}
+
+func (t *memUpdateTx) remove(rec *Record) error {
+	var kept []*Record
+	for _, r := range t.recs {
+		if !(r.Zone == rec.Zone && r.Name == rec.Name && r.RecordType == rec.RecordType && r.Content == rec.Content) {
+			kept = append(kept, r)
+		}
+	}
+	t.recs = kept
+	return nil
+}
+
+func (t *memUpdateTx) setTtl(rec *Record, ttl uint32) error {
+	rec.Ttl = ttl
+	return nil
+}
+
+const testZone = "example.org."
+
+func testZoneTx() *memUpdateTx {
+	return &memUpdateTx{recs: []*Record{
+		{Zone: testZone, Name: "", RecordType: "SOA", Ttl: 300, Content: `{"ns":"ns1.example.org.","MBox":"hostmaster.example.org.","refresh":44,"retry":55,"expire":66,"minttl":100}`},
+		{Zone: testZone, Name: "", RecordType: "NS", Ttl: 300, Content: `{"host":"ns1.example.org."}`},
+		// stored without the trailing dot nor the same formatting
+		{Zone: testZone, Name: "www", RecordType: "CNAME", Ttl: 300, Content: `{ "host": "Web.example.org" }`},
+		{Zone: testZone, Name: "web", RecordType: "A", Ttl: 300, Content: `{"ip":"10.0.0.1"}`},
+		{Zone: testZone, Name: "web", RecordType: "A", Ttl: 300, Content: `{"ip":"10.0.0.2"}`},
+	}}
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record %q: %v", s, err)
+	}
+	return rr
+}
+
+// wire packs and unpacks an update, as the server would receive it
+func wire(t *testing.T, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack update: %v", err)
+	}
+	res := new(dns.Msg)
+	if err := res.Unpack(b); err != nil {
+		t.Fatalf("failed to unpack update: %v", err)
+	}
+	return res
+}
+
+func TestUpdatePrerequisites(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(m *dns.Msg)
+		rcode int
+	}{
+		{"name used", func(m *dns.Msg) { m.NameUsed([]dns.RR{newRR(t, "web.example.org. A 0.0.0.0")}) }, dns.RcodeSuccess},
+		{"name not used", func(m *dns.Msg) { m.NameUsed([]dns.RR{newRR(t, "nope.example.org. A 0.0.0.0")}) }, dns.RcodeNameError},
+		{"name not used ok", func(m *dns.Msg) { m.NameNotUsed([]dns.RR{newRR(t, "nope.example.org. A 0.0.0.0")}) }, dns.RcodeSuccess},
+		{"name used ko", func(m *dns.Msg) { m.NameNotUsed([]dns.RR{newRR(t, "web.example.org. A 0.0.0.0")}) }, dns.RcodeYXDomain},
+		{"rrset used", func(m *dns.Msg) { m.RRsetUsed([]dns.RR{newRR(t, "web.example.org. A 0.0.0.0")}) }, dns.RcodeSuccess},
+		{"rrset not used", func(m *dns.Msg) { m.RRsetUsed([]dns.RR{newRR(t, "web.example.org. AAAA ::")}) }, dns.RcodeNXRrset},
+		{"rrset used ko", func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{newRR(t, "web.example.org. A 0.0.0.0")}) }, dns.RcodeYXRrset},
+		{"value", func(m *dns.Msg) {
+			m.Used([]dns.RR{newRR(t, "web.example.org. A 10.0.0.2"), newRR(t, "web.example.org. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"value normalized", func(m *dns.Msg) { m.Used([]dns.RR{newRR(t, "www.example.org. CNAME web.example.org.")}) }, dns.RcodeSuccess},
+		{"value partial", func(m *dns.Msg) { m.Used([]dns.RR{newRR(t, "web.example.org. A 10.0.0.1")}) }, dns.RcodeNXRrset},
+		{"value mismatch", func(m *dns.Msg) {
+			m.Used([]dns.RR{newRR(t, "web.example.org. A 10.0.0.1"), newRR(t, "web.example.org. A 10.0.0.3")})
+		}, dns.RcodeNXRrset},
+		{"not zone", func(m *dns.Msg) { m.NameUsed([]dns.RR{newRR(t, "web.example.net. A 0.0.0.0")}) }, dns.RcodeNotZone},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.SetUpdate(testZone)
+		tt.build(m)
+		tx := testZoneTx()
+		rcode, err := applyUpdate(tx, testZone, wire(t, m))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if rcode != tt.rcode {
+			t.Errorf("%s: expected rcode %s, got %s", tt.name, dns.RcodeToString[tt.rcode], dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestUpdateAddDelete(t *testing.T) {
+	tx := testZoneTx()
+
+	m := new(dns.Msg)
+	m.SetUpdate(testZone)
+	m.Insert([]dns.RR{
+		newRR(t, "host.example.org. 60 A 10.0.0.5"),
+		newRR(t, "host.example.org. 60 TXT \"hello\""),
+		// already there, only the TTL changes
+		newRR(t, "web.example.org. 600 A 10.0.0.1"),
+		// a CNAME can't be added to a name with other records
+		newRR(t, "web.example.org. 60 CNAME other.example.org."),
+		// a CNAME is replaced
+		newRR(t, "www.example.org. 60 CNAME host.example.org."),
+	})
+	if rcode, err := applyUpdate(tx, testZone, wire(t, m)); rcode != dns.RcodeSuccess || err != nil {
+		t.Fatalf("update failed: %s %v", dns.RcodeToString[rcode], err)
+	}
+
+	host, _ := tx.records("host")
+	if len(host) != 2 || host[0].Content != `{"ip":"10.0.0.5"}` || host[0].RecordType != "A" || host[0].Ttl != 60 {
+		t.Errorf("unexpected records for host: %+v", host)
+	}
+	web, _ := tx.records("web")
+	if len(web) != 2 || web[0].Ttl != 600 {
+		t.Errorf("unexpected records for web: %+v", web)
+	}
+	www, _ := tx.records("www")
+	if len(www) != 1 || www[0].Content != `{"host":"host.example.org."}` {
+		t.Errorf("unexpected records for www: %+v", www)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate(testZone)
+	m.Remove([]dns.RR{newRR(t, "web.example.org. A 10.0.0.2")})
+	m.RemoveRRset([]dns.RR{newRR(t, "host.example.org. TXT \"\"")})
+	m.RemoveName([]dns.RR{newRR(t, "www.example.org. A 0.0.0.0")})
+	// the apex SOA and NS are kept
+	m.RemoveName([]dns.RR{newRR(t, "example.org. A 0.0.0.0")})
+	m.Remove([]dns.RR{newRR(t, "example.org. NS ns1.example.org.")})
+	if rcode, err := applyUpdate(tx, testZone, wire(t, m)); rcode != dns.RcodeSuccess || err != nil {
+		t.Fatalf("update failed: %s %v", dns.RcodeToString[rcode], err)
+	}
+
+	for name, want := range map[string]int{"": 2, "web": 1, "host": 1, "www": 0} {
+		recs, _ := tx.records(name)
+		if len(recs) != want {
+			t.Errorf("expected %d records for %q, got %+v", want, name, recs)
+		}
+	}
+}
+
+func TestUpdatePrescan(t *testing.T) {
+	tx := testZoneTx()
+
+	m := new(dns.Msg)
+	m.SetUpdate(testZone)
+	m.Insert([]dns.RR{
+		newRR(t, "host.example.org. 60 A 10.0.0.5"),
+		newRR(t, "host.example.net. 60 A 10.0.0.6"),
+	})
+	if rcode, _ := applyUpdate(tx, testZone, wire(t, m)); rcode != dns.RcodeNotZone {
+		t.Errorf("expected NOTZONE, got %s", dns.RcodeToString[rcode])
+	}
+	// nothing was applied
+	if host, _ := tx.records("host"); len(host) != 0 {
+		t.Errorf("unexpected records for host: %+v", host)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate(testZone)
+	m.Insert([]dns.RR{newRR(t, "host.example.org. 60 HINFO cpu os")})
+	if rcode, _ := applyUpdate(tx, testZone, wire(t, m)); rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR, got %s", dns.RcodeToString[rcode])
+	}
+	// stored as generic records
+	host, _ := tx.records("host")
+	if len(host) != 1 || host[0].RecordType != "HINFO" || host[0].Content != `{"rdata":"\"cpu\" \"os\""}` {
+		t.Errorf("unexpected records for host: %+v", host)
+	}
+}
+
+// tsigWriter reports the outcome of the verification of the TSIG of a message
+type tsigWriter struct {
+	*dnstest.Recorder
+	status error
+}
+
+func (w *tsigWriter) TsigStatus() error { return w.status }
+
+func TestUpdateAuthentication(t *testing.T) {
+	handler := &CoreDNSPostgreSql{updateOn: true}
+	tests := []struct {
+		name   string
+		signed bool
+		status error
+		rcode  int
+	}{
+		{name: "unsigned", rcode: dns.RcodeRefused},
+		{name: "bad signature", signed: true, status: dns.ErrSig, rcode: dns.RcodeNotAuth},
+		{name: "unsigned with a verification error", status: errors.New("no signature"), rcode: dns.RcodeRefused},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetUpdate(testZone)
+		m.Insert([]dns.RR{newRR(t, "host.example.org. 60 A 10.0.0.5")})
+		if tc.signed {
+			m.SetTsig("key.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &tsigWriter{Recorder: dnstest.NewRecorder(&test.ResponseWriter{}), status: tc.status}
+		if _, err := handler.serveUpdate(request.Request{W: w, Req: m}, testZone); err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if w.Rcode != tc.rcode {
+			t.Errorf("%s: expected %s, got %s", tc.name, dns.RcodeToString[tc.rcode], dns.RcodeToString[w.Rcode])
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package coredns_postgresql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+// errNotMirrored is returned by warmUp when zones were read but could not
+// all be written to redis. They are retried on the next reload.
+var errNotMirrored = errors.New("zones could not be mirrored to redis")
+
+// warmUp reads every zone of the records table again and mirrors it to
+// redis, with pipelined reads and writes, which fills a flushed redis. Once
+// the plugin is started, it must only run in the goroutine watching the
+// table, so that it doesn't race with the reloads.
+func (handler *CoreDNSPostgreSql) warmUp() error {
+	start := time.Now()
+	if err := handler.reload(); err != nil {
+		return err
+	}
+	if n := handler.mirror.pendingZones(); n > 0 {
+		return fmt.Errorf("%d %w", n, errNotMirrored)
+	}
+	log.Printf("[INFO] pg mirrored %d zones to redis in %v", len(handler.cache.names()), time.Since(start))
+	return nil
+}
+
+// listenWarmUp serves POST requests on /warmup at the warmup_listen
+// address, to fill redis on demand
+func (handler *CoreDNSPostgreSql) listenWarmUp() error {
+	ln, err := reuseport.Listen("tcp", handler.warmupAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/warmup", handler.serveWarmUp)
+	handler.warmupListener = ln
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func (handler *CoreDNSPostgreSql) serveWarmUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	done := make(chan error, 1)
+	select {
+	case handler.warmups <- done:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("[ERROR] pg warm-up of redis failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, http.StatusText(http.StatusOK))
+	case <-r.Context().Done():
+	}
+}
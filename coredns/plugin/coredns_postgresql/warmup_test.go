@@ -0,0 +1,37 @@
+package coredns_postgresql
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeWarmUp(t *testing.T) {
+	handler := &CoreDNSPostgreSql{warmups: make(chan chan error)}
+	results := make(chan error, 2)
+	results <- nil
+	results <- errors.New("redis is down")
+	go func() {
+		for done := range handler.warmups {
+			done <- <-results
+		}
+	}()
+	defer close(handler.warmups)
+
+	tests := []struct {
+		method string
+		code   int
+	}{
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPost, http.StatusOK},
+		{http.MethodPost, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.serveWarmUp(w, httptest.NewRequest(tt.method, "/warmup", nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.method, tt.code, w.Code)
+		}
+	}
+}
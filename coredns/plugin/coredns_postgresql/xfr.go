@@ -0,0 +1,102 @@
+package coredns_postgresql
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// transferBatch is the number of records sent per message of a transfer
+const transferBatch = 100
+
+// Transfer implements the transfer.Transferer interface.
+func (handler *CoreDNSPostgreSql) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if !handler.servesZone(zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	records, err := handler.findAllRecords(zone)
+	if err != nil {
+		return nil, err
+	}
+	rrs, err := transferRecords(records)
+	if err != nil {
+		return nil, fmt.Errorf("zone %s: %v", zone, err)
+	}
+	soa := rrs[0]
+	if current, ok := handler.zoneSerial(zone); ok {
+		soa.(*dns.SOA).Serial = current
+	}
+
+	ch := make(chan []dns.RR)
+	go func() {
+		// ixfr fallback, only send the SOA if the secondary is up to date
+		if serial != 0 && !serialLess(serial, soa.(*dns.SOA).Serial) {
+			ch <- []dns.RR{soa}
+			close(ch)
+			return
+		}
+		for i := 0; i < len(rrs); i += transferBatch {
+			end := i + transferBatch
+			if end > len(rrs) {
+				end = len(rrs)
+			}
+			ch <- rrs[i:end]
+		}
+		ch <- []dns.RR{soa}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// servesZone returns true if zone is one of the zones found in the records
+// table
+func (handler *CoreDNSPostgreSql) servesZone(zone string) bool {
+	for _, z := range handler.cache.names() {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// transferRecords returns the records of a zone in transfer order: the SOA
+// of the apex first, followed by every other record.
+func transferRecords(records []*Record) ([]dns.RR, error) {
+	var soa dns.RR
+	rrs := []dns.RR{nil}
+	for _, rec := range records {
+		// The whole zone is transferred, glue included
+		rec.handler = nil
+		rr, _, err := rec.AsRR()
+		if errors.Is(err, errUnsupportedType) {
+			log.Printf("[WARNING] pg skipped %s record %s in transfer", rec.RecordType, rec.fqdn())
+			continue
+		}
+		if errors.Is(err, errInvalidRdata) {
+			log.Printf("[WARNING] pg skipped record %s in transfer: %v", rec.fqdn(), err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if rec.Name == "" && soa == nil {
+				soa = rr
+			}
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if soa == nil {
+		return nil, errors.New("no SOA record")
+	}
+	rrs[0] = soa
+	return rrs, nil
+}
@@ -0,0 +1,40 @@
+package coredns_postgresql
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTransferRecords(t *testing.T) {
+	handler := &CoreDNSPostgreSql{}
+	records := []*Record{
+		{Zone: testZone, Name: "www", RecordType: "A", Ttl: 300, Content: `{"ip":"10.0.0.1"}`, handler: handler},
+		{Zone: testZone, Name: "", RecordType: "NS", Ttl: 300, Content: `{"host":"ns1.example.org."}`, handler: handler},
+		{Zone: testZone, Name: "", RecordType: "SOA", Ttl: 300, Content: `{"ns":"ns1.example.org.","MBox":"hostmaster.example.org.","refresh":44,"retry":55,"expire":66,"minttl":100,"serial":42}`, handler: handler},
+		{Zone: testZone, Name: "", RecordType: "MX", Ttl: 300, Content: `{"host":"mail.example.org.","preference":10}`, handler: handler},
+		{Zone: testZone, Name: "host", RecordType: "BOGUS", Ttl: 300, Content: `{}`, handler: handler},
+	}
+
+	rrs, err := transferRecords(records)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rrs) != 4 {
+		t.Fatalf("expected 4 records, got %d: %v", len(rrs), rrs)
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("expected the SOA first, got %v", rrs[0])
+	}
+	if soa.Serial != 42 {
+		t.Errorf("expected the serial of the SOA record, got %d", soa.Serial)
+	}
+	if rrs[1].Header().Name != "www.example.org." {
+		t.Errorf("unexpected record %v", rrs[1])
+	}
+
+	if _, err := transferRecords(records[:2]); err == nil {
+		t.Errorf("expected an error for a zone without SOA")
+	}
+}
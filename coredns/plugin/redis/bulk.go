@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"fmt"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+const (
+	// maxBatch is the largest number of fields written or deleted by a
+	// command
+	maxBatch = 500
+	// maxPipeline is the largest number of commands sent before reading
+	// their replies
+	maxPipeline = 1000
+)
+
+// ZoneChange is a change of the records of a zone, written by Apply
+type ZoneChange struct {
+	Zone string
+	// Set holds the records to write, by location
+	Set map[string]string
+	// Delete holds the locations to delete
+	Delete []string
+	// Drop deletes the whole zone instead
+	Drop bool
+}
+
+// command is a command of a pipeline
+type command struct {
+	name string
+	args redisCon.Args
+}
+
+// pipeline sends commands on a connection, maxPipeline at a time, and
+// returns their replies. It fails on the first error reply.
+func pipeline(conn redisCon.Conn, cmds []command) ([]interface{}, error) {
+	replies := make([]interface{}, 0, len(cmds))
+	for len(cmds) > 0 {
+		n := len(cmds)
+		if n > maxPipeline {
+			n = maxPipeline
+		}
+		for _, cmd := range cmds[:n] {
+			if err := conn.Send(cmd.name, cmd.args...); err != nil {
+				return nil, err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for _, cmd := range cmds[:n] {
+			reply, err := conn.Receive()
+			if err != nil {
+				return nil, fmt.Errorf("%s failed: %v", cmd.name, err)
+			}
+			replies = append(replies, reply)
+		}
+		cmds = cmds[n:]
+	}
+	return replies, nil
+}
+
+// ZoneEntries returns the records of zones as stored, by zone and location,
+// without the meta fields. The map of a zone which doesn't exist is empty.
+func (redis *Redis) ZoneEntries(zones []string) (map[string]map[string]string, error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	cmds := make([]command, len(zones))
+	for i, zone := range zones {
+		cmds[i] = command{"HGETALL", redisCon.Args{redis.keyPrefix + zone + redis.keySuffix}}
+	}
+	replies, err := pipeline(conn, cmds)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]map[string]string, len(zones))
+	for i, zone := range zones {
+		fields, err := redisCon.StringMap(replies[i], nil)
+		if err != nil {
+			return nil, fmt.Errorf("HGETALL %s failed: %v", zone, err)
+		}
+		for name := range fields {
+			if isMeta(name) {
+				delete(fields, name)
+			}
+		}
+		entries[zone] = fields
+	}
+	return entries, nil
+}
+
+// Apply writes changes of zones with pipelined commands, registering the
+// zones which are written and unregistering the dropped ones
+func (redis *Redis) Apply(changes []ZoneChange) error {
+	var cmds []command
+	for _, change := range changes {
+		key := redis.keyPrefix + change.Zone + redis.keySuffix
+		if change.Drop {
+			cmds = append(cmds,
+				command{"DEL", redisCon.Args{key}},
+				command{"SREM", redisCon.Args{redis.registryKey(), change.Zone}})
+			continue
+		}
+		args := redisCon.Args{key}
+		for name, value := range change.Set {
+			args = append(args, name, value)
+			if len(args) > 2*maxBatch {
+				cmds = append(cmds, command{"HSET", args})
+				args = redisCon.Args{key}
+			}
+		}
+		if len(args) > 1 {
+			cmds = append(cmds, command{"HSET", args})
+		}
+		for names := change.Delete; len(names) > 0; {
+			n := len(names)
+			if n > maxBatch {
+				n = maxBatch
+			}
+			cmds = append(cmds, command{"HDEL", redisCon.Args{key}.AddFlat(names[:n])})
+			names = names[n:]
+		}
+		if len(change.Set) > 0 {
+			cmds = append(cmds, command{"SADD", redisCon.Args{redis.registryKey(), change.Zone}})
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	if _, err := pipeline(conn, cmds); err != nil {
+		return err
+	}
+	zones := make([]string, len(changes))
+	for i, change := range changes {
+		zones[i] = change.Zone
+	}
+	redis.written(zones...)
+	return nil
+}
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// pipelineConn records the commands sent to it, and answers them once they
+// are flushed
+type pipelineConn struct {
+	fakeNode
+	sent    []string
+	flushed int
+	replies []interface{}
+}
+
+func (c *pipelineConn) Send(cmd string, args ...interface{}) error {
+	s := make([]string, 0, len(args)+1)
+	s = append(s, cmd)
+	for _, arg := range args {
+		s = append(s, fmt.Sprint(arg))
+	}
+	c.sent = append(c.sent, strings.Join(s, " "))
+	return nil
+}
+
+func (c *pipelineConn) Flush() error {
+	for c.flushed < len(c.sent) {
+		cmd := c.sent[c.flushed]
+		switch {
+		case strings.HasPrefix(cmd, "HGETALL example.org."):
+			c.replies = append(c.replies, []interface{}{[]byte("@"), []byte("soa"), []byte("$serial"), []byte("1")})
+		case strings.HasPrefix(cmd, "HGETALL"):
+			c.replies = append(c.replies, []interface{}{})
+		default:
+			c.replies = append(c.replies, int64(1))
+		}
+		c.flushed++
+	}
+	return nil
+}
+
+func (c *pipelineConn) Receive() (interface{}, error) {
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply, nil
+}
+
+func TestApply(t *testing.T) {
+	conn := &pipelineConn{}
+	// the serials of the written zones are bumped
+	var bumped []string
+	conn.do = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "EVALSHA" {
+			return nil, fmt.Errorf("unexpected command %s", cmd)
+		}
+		bumped = append(bumped, fmt.Sprint(args[2]))
+		return int64(2), nil
+	}
+	redis := &Redis{Pool: &redisCon.Pool{Dial: func() (redisCon.Conn, error) { return conn, nil }}, index: newZoneIndex()}
+
+	entries, err := redis.ZoneEntries([]string{"example.org.", "example.net."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{"example.org.": {"@": "soa"}, "example.net.": {}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected entries %v without meta fields, got %v", expected, entries)
+	}
+
+	conn.sent, conn.flushed = nil, 0
+	err = redis.Apply([]ZoneChange{
+		{Zone: "example.org.", Set: map[string]string{"www": "a"}, Delete: []string{"old"}},
+		{Zone: "example.com.", Drop: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := []string{
+		"HSET example.org. www a",
+		"HDEL example.org. old",
+		"SADD $zones example.org.",
+		"DEL example.com.",
+		"SREM $zones example.com.",
+	}
+	if !reflect.DeepEqual(conn.sent, sent) {
+		t.Errorf("expected commands %q, got %q", sent, conn.sent)
+	}
+	if expected := []string{"example.org.", "example.com."}; !reflect.DeepEqual(bumped, expected) {
+		t.Errorf("expected the serials of %q to be bumped, got %q", expected, bumped)
+	}
+}
+
+func TestApplyBatches(t *testing.T) {
+	conn := &pipelineConn{}
+	conn.do = func(cmd string, args ...interface{}) (interface{}, error) {
+		return int64(2), nil
+	}
+	redis := &Redis{Pool: &redisCon.Pool{Dial: func() (redisCon.Conn, error) { return conn, nil }}, index: newZoneIndex()}
+
+	set := make(map[string]string)
+	for i := 0; i < maxBatch+1; i++ {
+		set[fmt.Sprint("host", i)] = "a"
+	}
+	if err := redis.Apply([]ZoneChange{{Zone: "example.org.", Set: set}}); err != nil {
+		t.Fatal(err)
+	}
+	// Two HSET and the SADD
+	if len(conn.sent) != 3 || !strings.HasPrefix(conn.sent[1], "HSET") {
+		t.Errorf("expected the fields to be written by 2 commands, got %d commands", len(conn.sent))
+	}
+}
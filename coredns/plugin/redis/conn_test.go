@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 0x31c3},
+		{"foo", 12182},
+		{"{foo}.zones", 12182},
+		{"_dns:{foo}", 12182},
+		// empty hash tags are not hash tags
+		{"{}foo", keySlot("{}foo")},
+		{"example.com.", int(crc16("example.com.")) % clusterSlots},
+	}
+	for _, tt := range tests {
+		if slot := keySlot(tt.key); slot != tt.slot {
+			t.Errorf("%s: expected slot %d, got %d", tt.key, tt.slot, slot)
+		}
+	}
+	if keySlot("{}foo") == keySlot("foo") {
+		t.Errorf("{}foo: expected the whole key to be hashed")
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+		ok   bool
+	}{
+		{"HGET", []interface{}{"example.com.", "@"}, "example.com.", true},
+		{"hkeys", []interface{}{[]byte("example.net.")}, "example.net.", true},
+		{"EVALSHA", []interface{}{"sha", 1, "example.com.", 42}, "example.com.", true},
+		{"EVAL", []interface{}{"return 1", 0}, "", false},
+		{"SCAN", []interface{}{0, "MATCH", "*"}, "", false},
+		{"PING", nil, "", false},
+	}
+	for _, tt := range tests {
+		key, ok := commandKey(tt.cmd, tt.args)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("%s %v: expected %q %v, got %q %v", tt.cmd, tt.args, tt.key, tt.ok, key, ok)
+		}
+	}
+}
+
+func TestReplicaUp(t *testing.T) {
+	for flags, up := range map[string]bool{
+		"slave":              true,
+		"slave,s_down":       false,
+		"slave,disconnected": false,
+		"o_down,slave":       false,
+	} {
+		if replicaUp(flags) != up {
+			t.Errorf("%s: expected %v", flags, up)
+		}
+	}
+}
+
+// fakeNode is a connection to a node of a cluster, answering with the given
+// function
+type fakeNode struct {
+	do func(cmd string, args ...interface{}) (interface{}, error)
+}
+
+func (n *fakeNode) Close() error                      { return nil }
+func (n *fakeNode) Err() error                        { return nil }
+func (n *fakeNode) Send(string, ...interface{}) error { return errors.New("not supported") }
+func (n *fakeNode) Flush() error                      { return nil }
+func (n *fakeNode) Receive() (interface{}, error)     { return nil, errors.New("not supported") }
+func (n *fakeNode) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// flushes the pending commands when returned to the pool
+		return nil, nil
+	}
+	return n.do(cmd, args...)
+}
+
+func TestClusterRedirections(t *testing.T) {
+	// node a and its replica c serve all slots, but node b serves the keys
+	// moved or being migrated
+	slots := []interface{}{
+		[]interface{}{int64(0), int64(clusterSlots - 1),
+			[]interface{}{[]byte("10.0.0.1"), int64(7000)},
+			[]interface{}{[]byte("10.0.0.3"), int64(7000)}},
+	}
+	movedSlot := keySlot("moved")
+	var asked bool
+	nodes := map[string]func(cmd string, args ...interface{}) (interface{}, error){
+		"10.0.0.1:7000": func(cmd string, args ...interface{}) (interface{}, error) {
+			switch cmd {
+			case "CLUSTER":
+				return slots, nil
+			case "READONLY":
+				return "OK", nil
+			}
+			switch argString(args[0]) {
+			case "moved":
+				return nil, redisCon.Error("MOVED " + strconv.Itoa(movedSlot) + " 10.0.0.2:7000")
+			case "asked":
+				return nil, redisCon.Error("ASK 1 10.0.0.2:7000")
+			}
+			return []byte("a"), nil
+		},
+		"10.0.0.2:7000": func(cmd string, args ...interface{}) (interface{}, error) {
+			switch cmd {
+			case "CLUSTER":
+				return slots, nil
+			case "ASKING":
+				asked = true
+				return "OK", nil
+			case "READONLY":
+				return "OK", nil
+			}
+			if argString(args[0]) == "asked" && !asked {
+				return nil, redisCon.Error("MOVED 1 10.0.0.1:7000")
+			}
+			return []byte("b"), nil
+		},
+		"10.0.0.3:7000": func(cmd string, args ...interface{}) (interface{}, error) {
+			if cmd == "READONLY" {
+				return "OK", nil
+			}
+			return []byte("c"), nil
+		},
+	}
+	dial := func(addr string) (redisCon.Conn, error) {
+		do, ok := nodes[addr]
+		if !ok {
+			return nil, errors.New("unknown node " + addr)
+		}
+		return &fakeNode{do: do}, nil
+	}
+
+	c := newCluster([]string{"10.0.0.1:7000"}, true, dial)
+	tests := []struct {
+		read     bool
+		key      string
+		expected string
+	}{
+		{false, "example.com.", "a"},
+		{true, "example.com.", "c"},
+		{false, "moved", "b"},
+		{false, "asked", "b"},
+	}
+	for _, tt := range tests {
+		reply, err := redisCon.String(c.do(tt.read, "HGET", tt.key, "@"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.key, err)
+			continue
+		}
+		if reply != tt.expected {
+			t.Errorf("%s: expected node %s, got %s", tt.key, tt.expected, reply)
+		}
+	}
+	if !asked {
+		t.Errorf("expected ASKING before the redirected command")
+	}
+
+	// pipelined commands are answered in order
+	conn := &clusterConn{cluster: c}
+	conn.Send("HGET", "example.com.", "@")
+	conn.Send("HGET", "moved", "@")
+	replies, err := redisCon.Strings(conn.Do(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[0] != "a" || replies[1] != "b" {
+		t.Errorf("expected replies [a b], got %v", replies)
+	}
+}
+
+func TestCheckRole(t *testing.T) {
+	role := "master"
+	conn := &fakeNode{do: func(cmd string, args ...interface{}) (interface{}, error) {
+		return []interface{}{[]byte(role)}, nil
+	}}
+	check := checkRole("master")
+	if err := check(conn, time.Now().Add(-time.Minute)); err != nil {
+		t.Errorf("expected the master to be kept, got %v", err)
+	}
+	role = "slave"
+	if err := check(conn, time.Now()); err != nil {
+		t.Errorf("expected a recently used connection not to be checked, got %v", err)
+	}
+	if err := check(conn, time.Now().Add(-time.Minute)); err == nil {
+		t.Errorf("expected a former master to be discarded")
+	}
+}
@@ -3,7 +3,6 @@ package redis
 import (
 	"fmt"
 	// "fmt"
-	"time"
     //"log"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
@@ -23,11 +22,7 @@ func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	// 新增代码传递实例到下一个插件 但是不推荐这么做，因为传递数据最好轻量
 	// ctx = context.WithValue(ctx, "redis_instance", redis)
 
-	if time.Since(redis.LastZoneUpdate) > zoneUpdateTime {
-		redis.LoadZones()  // 如果更新redis.zones的时间距离上次超过10分钟，重新获取一遍
-	}
-
-	zone := plugin.Zones(redis.Zones).Matches(qname)  // 匹配父域名和子域名 同时解析标签个数来判断
+	zone := plugin.Zones(redis.zones()).Matches(qname)  // 匹配父域名和子域名 同时解析标签个数来判断
 	fmt.Printf(", zone = %v end.\n", zone)
 	if zone == "" { // redis没有父域名
 		return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
@@ -38,53 +33,27 @@ func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 		return redis.errorResponse(state, zone, dns.RcodeServerFailure, nil)
 	}
 
-	if qtype == "AXFR" {  // 区域传输功能，redis支持，但是pg插件目前不支持
-		records := redis.AXFR(z)
-
-		ch := make(chan *dns.Envelope)   // dns.Envelope是dns的传输单元
-		tr := new(dns.Transfer)
-		tr.TsigSecret = nil   // 表示没有启用 TSIG（Transaction Signature，DNS 事务签名）认证。
-
-		go func(ch chan *dns.Envelope) {
-			j, l := 0, 0
-
-			for i, r := range records {
-				l += dns.Len(r)
-				if l > transferLength {
-					ch <- &dns.Envelope{RR: records[j:i]}
-					l = 0
-					j = i
-				}
-			}
-			if j < len(records) {
-				ch <- &dns.Envelope{RR: records[j:]}
-			}
-			close(ch)
-		}(ch)
-
-		err := tr.Out(w, r, ch)  
-		if err != nil {
-			fmt.Println(err)
-		}
-		w.Hijack()  // 劫持 HTTP 连接。劫持后，HTTP 底层的 TCP 连接可由程序直接控制，适用于长连接（如 AXFR
-		return dns.RcodeSuccess, nil
-	}
 	// fmt.Printf("qname and z: %v, %v\n",qname, z)
 
 	location := redis.findLocation(qname, z) 
-	if len(location) == 0 { // empty, no results
+	// PTR records may be synthesized for names which are not stored
+	synthesize := qtype == "PTR" && redis.ptrs != nil
+	if len(location) == 0 && !synthesize { // empty, no results
 		// fmt.Printf("没有找到field\n")
 		if redis.Fall.Through(qname){ // 新增fallthrough方法 遇到特定域名再去查找pg 
 			// 因为match函数是解析父域名和子域名，所以默认值根域名时，所有查询都会进入
 			return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
 		}
-		return redis.errorResponse(state, zone, dns.RcodeNameError, nil)
+		return redis.negativeResponse(state, z, location)
 	}
 
 	answers := make([]dns.RR, 0, 10)
 	extras := make([]dns.RR, 0, 10)
 
-	record := redis.get(location, z)  // zone记录的location(也就是field)，反序列化为record结构体
+	var record *Record
+	if len(location) > 0 {
+		record = redis.get(location, z)  // zone记录的location(也就是field)，反序列化为record结构体
+	}
     fmt.Printf("找到了记录：%v\n", record)
 	switch qtype {
 	case "A":
@@ -103,17 +72,39 @@ func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 		answers, extras = redis.SRV(qname, z, record)
 	case "SOA":
 		answers, extras = redis.SOA(qname, z, record)
+		redis.setSerial(zone, answers)
 	case "CAA":
 		answers, extras = redis.CAA(qname, z, record)
+	case "PTR":
+		answers, extras = redis.PTR(qname, z, record)
+		generic, _ := redis.RR(qname, z, record, qtype)
+		answers = append(answers, generic...)
+		if len(answers) == 0 && synthesize {
+			answers = redis.synthesizePTR(qname)
+		}
 
 	default:
-		return redis.errorResponse(state, zone, dns.RcodeNotImplemented, nil)
+		answers, extras = redis.RR(qname, z, record, qtype)
+	}
+	// An alias answers for all the types
+	if len(answers) == 0 && qtype != "CNAME" && record != nil {
+		answers, extras = redis.CNAME(qname, z, record)
+	}
+
+	if len(location) == 0 && len(answers) == 0 {
+		if redis.Fall.Through(qname) {
+			return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
+		}
+		return redis.negativeResponse(state, z, location)
 	}
 
     // 新增代码 pg单条更新redis时 redis如果存在域名但找不到单条数据，还是需要去找pg
 	if !redis.pgBatchUpdate && len(answers) == 0{
 		return plugin.NextOrFailure(qname, redis.Next, ctx, w, r)
 	}
+	if len(answers) == 0 {
+		return redis.negativeResponse(state, z, location)
+	}
 
 
 	m := new(dns.Msg)
@@ -132,6 +123,43 @@ func (redis *Redis) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 // Name implements the Handler interface.
 func (redis *Redis) Name() string { return "redis" }
 
+// negativeResponse answers that the name of the query doesn't exist, or that
+// it has no records of the type, with the SOA of the zone for the answer to be
+// cached (RFC 2308). The name exists if it has a location, which may be a
+// wildcard, or names below it do.
+func (redis *Redis) negativeResponse(state request.Request, z *Zone, location string) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
+	if name, ok := relativeName(state.Name(), z); location == "" && ok && !nameExists(name, z) {
+		m.Rcode = dns.RcodeNameError
+	}
+	m.Ns = redis.negativeSOA(z)
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// negativeSOA returns the SOA of a zone with the TTL negative answers are
+// cached for: the lowest of its own TTL and its minimum field (RFC 2308
+// section 3)
+func (redis *Redis) negativeSOA(z *Zone) []dns.RR {
+	record := redis.get(z.Name, z)
+	if record == nil {
+		return nil
+	}
+	soa, _ := redis.SOA(z.Name, z, record)
+	redis.setSerial(z.Name, soa)
+	for _, rr := range soa {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+	}
+	return soa
+}
+
 func (redis *Redis) errorResponse(state request.Request, zone string, rcode int, err error) (int, error) {
 	m := new(dns.Msg)
 	m.SetRcode(state.Req, rcode)
@@ -0,0 +1,359 @@
+package redis
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+const (
+	// registryName is the name of the set of the zones, within the key
+	// prefix and suffix. It is not a zone name, as these end with a dot.
+	registryName = "$zones"
+
+	// minWatchRetry and maxWatchRetry bound the time to wait before
+	// subscribing again to keyspace notifications, after a failure
+	minWatchRetry = time.Second
+	maxWatchRetry = time.Minute
+)
+
+// zoneIndex caches the zones found in redis and the locations of each zone,
+// so that queries don't read them from redis. The locations are only cached
+// while keyspace notifications are received, to know when they change.
+type zoneIndex struct {
+	sync.RWMutex
+	zones     []string // sorted
+	updated   time.Time
+	locations map[string]*Zone
+	watching  bool
+	// generation changes whenever cached locations may become stale
+	generation uint64
+	// serials holds the serials of the zones, so that queries don't read
+	// them
+	serials map[string]serialEntry
+}
+
+func newZoneIndex() *zoneIndex {
+	return &zoneIndex{locations: make(map[string]*Zone), serials: make(map[string]serialEntry)}
+}
+
+// registryKey returns the key of the set of the zones
+func (redis *Redis) registryKey() string {
+	return redis.keyPrefix + registryName + redis.keySuffix
+}
+
+// zoneOfKey returns the zone of a key, and false if the key is not the hash
+// of a zone
+func (redis *Redis) zoneOfKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, redis.keyPrefix) || !strings.HasSuffix(key, redis.keySuffix) {
+		return "", false
+	}
+	zone := strings.TrimSuffix(strings.TrimPrefix(key, redis.keyPrefix), redis.keySuffix)
+	if !strings.HasSuffix(zone, ".") || isMeta(zone) {
+		return "", false
+	}
+	return zone, true
+}
+
+// zones returns the zones in redis, reading them again every zoneUpdateTime
+func (redis *Redis) zones() []string {
+	redis.index.RLock()
+	zones, updated := redis.index.zones, redis.index.updated
+	redis.index.RUnlock()
+	if time.Since(updated) > zoneUpdateTime {
+		redis.LoadZones()
+		redis.index.RLock()
+		zones = redis.index.zones
+		redis.index.RUnlock()
+	}
+	return zones
+}
+
+// LoadZones reads the zones from their registry set. If the registry is
+// empty, the zones are found by scanning the keys, and registered.
+func (redis *Redis) LoadZones() {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	zones, err := redisCon.Strings(conn.Do("SMEMBERS", redis.registryKey()))
+	if err != nil {
+		log.Printf("[ERROR] redis failed to read the zones: %v", err)
+		return
+	}
+	if len(zones) == 0 {
+		zones, err = redis.scanZones(conn)
+		if err != nil {
+			log.Printf("[ERROR] redis failed to scan the zones: %v", err)
+			return
+		}
+		if len(zones) > 0 {
+			args := redisCon.Args{}.Add(redis.registryKey()).AddFlat(zones)
+			if _, err := conn.Do("SADD", args...); err != nil {
+				log.Printf("[ERROR] redis failed to register the zones: %v", err)
+			}
+		}
+	}
+	sort.Strings(zones)
+
+	redis.index.Lock()
+	redis.index.zones = zones
+	redis.index.updated = time.Now()
+	redis.index.Unlock()
+}
+
+// scanZones returns the zones found among the keys, on every master of a
+// cluster
+func (redis *Redis) scanZones(conn redisCon.Conn) ([]string, error) {
+	if redis.cluster == nil {
+		return redis.scanNode(conn)
+	}
+	var zones []string
+	for _, addr := range redis.cluster.masters() {
+		node := redis.cluster.pool(addr).Get()
+		found, err := redis.scanNode(node)
+		node.Close()
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", addr, err)
+		}
+		zones = append(zones, found...)
+	}
+	return zones, nil
+}
+
+// scanNode returns the zones found among the keys of a server
+func (redis *Redis) scanNode(conn redisCon.Conn) ([]string, error) {
+	var zones []string
+	cursor := 0
+	for {
+		values, err := redisCon.Values(conn.Do("SCAN", cursor, "MATCH", escapePattern(redis.keyPrefix)+"*"+escapePattern(redis.keySuffix), "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redisCon.Scan(values, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if zone, ok := redis.zoneOfKey(key); ok {
+				zones = append(zones, zone)
+			}
+		}
+		if cursor == 0 {
+			return zones, nil
+		}
+	}
+}
+
+// register adds a zone to the registry set
+func (redis *Redis) register(conn redisCon.Conn, zone string) error {
+	if _, err := conn.Do("SADD", redis.registryKey(), zone); err != nil {
+		return fmt.Errorf("SADD failed: %v", err)
+	}
+	return nil
+}
+
+// cachedLocations returns the cached locations of a zone, or else the
+// generation of the cache to give to cacheLocations
+func (redis *Redis) cachedLocations(zone string) (*Zone, uint64) {
+	redis.index.RLock()
+	defer redis.index.RUnlock()
+	return redis.index.locations[zone], redis.index.generation
+}
+
+// isWatching returns true if the changes of the zones are notified, so that
+// their locations are cached
+func (redis *Redis) isWatching() bool {
+	redis.index.RLock()
+	defer redis.index.RUnlock()
+	return redis.index.watching
+}
+
+// cacheLocations keeps the locations of a zone read at the given generation
+// of the cache, if they are invalidated when they change and didn't change
+// since
+func (redis *Redis) cacheLocations(z *Zone, generation uint64) {
+	redis.index.Lock()
+	defer redis.index.Unlock()
+	if redis.index.watching && redis.index.generation == generation {
+		redis.index.locations[z.Name] = z
+	}
+}
+
+// invalidate drops the cached locations of a zone, or of all zones if zone is
+// empty
+func (redis *Redis) invalidate(zone string) {
+	redis.index.Lock()
+	defer redis.index.Unlock()
+	redis.index.generation++
+	if zone == "" {
+		redis.index.locations = make(map[string]*Zone)
+		return
+	}
+	delete(redis.index.locations, zone)
+}
+
+// setWatching records whether keyspace notifications are received
+func (redis *Redis) setWatching(watching bool) {
+	redis.index.Lock()
+	defer redis.index.Unlock()
+	redis.index.watching = watching
+	redis.index.generation++
+	redis.index.locations = make(map[string]*Zone)
+	// Changes made while not watching were not notified
+	redis.index.serials = make(map[string]serialEntry)
+}
+
+// watch subscribes to the keyspace notifications of the zones and of their
+// registry until done is closed, subscribing again after failures. The
+// notifications must be enabled on the server, with notify-keyspace-events
+// set to at least "Khgs" ("x" and "e" add expired and evicted zones).
+func (redis *Redis) watch(done <-chan struct{}) {
+	if redis.cluster != nil {
+		// Each node only notifies the changes of its own keys
+		log.Printf("[INFO] redis locations are not cached with a cluster")
+		return
+	}
+	if err := redis.checkNotifications(); err != nil {
+		log.Printf("[WARNING] redis locations are not cached: %v", err)
+		return
+	}
+	retry := minWatchRetry
+	for {
+		start := time.Now()
+		err := redis.subscribe(done)
+		redis.setWatching(false)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Printf("[WARNING] redis keyspace notifications lost, locations are not cached: %v", err)
+
+		if time.Since(start) > maxWatchRetry {
+			retry = minWatchRetry
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxWatchRetry {
+			retry = maxWatchRetry
+		}
+	}
+}
+
+// subscribe receives keyspace notifications until the connection fails or
+// done is closed
+func (redis *Redis) subscribe(done <-chan struct{}) error {
+	conn, err := redis.dial(false)
+	if err != nil {
+		return err
+	}
+	psc := redisCon.PubSubConn{Conn: conn}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+		case <-stop:
+		}
+		psc.Close()
+	}()
+
+	pattern := "__keyspace@*__:" + escapePattern(redis.keyPrefix) + "*" + escapePattern(redis.keySuffix)
+	if err := psc.PSubscribe(pattern); err != nil {
+		return err
+	}
+	for {
+		switch m := psc.Receive().(type) {
+		case redisCon.Subscription:
+			if m.Kind == "psubscribe" {
+				// Changes made before were not notified
+				redis.setWatching(true)
+				redis.LoadZones()
+			}
+		case redisCon.Message:
+			redis.notified(m.Channel[strings.Index(m.Channel, ":")+1:], string(m.Data))
+		case error:
+			return m
+		}
+	}
+}
+
+// checkNotifications returns an error if the keyspace notifications of the
+// changes of hashes, sets and keys are not enabled on the server
+func (redis *Redis) checkNotifications() error {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	config, err := redisCon.StringMap(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return fmt.Errorf("failed to read notify-keyspace-events: %v", err)
+	}
+	flags := config["notify-keyspace-events"]
+	if !strings.Contains(flags, "K") {
+		return fmt.Errorf("keyspace notifications are disabled, notify-keyspace-events is %q", flags)
+	}
+	for _, class := range "hgs" {
+		if !strings.ContainsRune(flags, class) && !strings.Contains(flags, "A") {
+			return fmt.Errorf("notify-keyspace-events %q lacks %q", flags, class)
+		}
+	}
+	return nil
+}
+
+// notified handles the notification of an event on a key. The serial of a
+// changed zone is read again, which notifies its secondaries if it was bumped
+// by its writer.
+func (redis *Redis) notified(key, event string) {
+	if key == redis.registryKey() {
+		redis.LoadZones()
+		return
+	}
+	zone, ok := redis.zoneOfKey(key)
+	if !ok {
+		return
+	}
+	redis.invalidate(zone)
+	redis.readSerial(zone)
+	redis.ptrsChanged(zone)
+
+	// Keep the registry up to date with the zones written by others
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	switch event {
+	case "hset", "hsetnx", "hmset", "hincrby", "hincrbyfloat":
+		redis.index.RLock()
+		i := sort.SearchStrings(redis.index.zones, zone)
+		known := i < len(redis.index.zones) && redis.index.zones[i] == zone
+		redis.index.RUnlock()
+		if !known {
+			if err := redis.register(conn, zone); err != nil {
+				log.Printf("[ERROR] redis failed to register zone %s: %v", zone, err)
+			}
+		}
+	case "del", "expired", "evicted":
+		if _, err := conn.Do("SREM", redis.registryKey(), zone); err != nil {
+			log.Printf("[ERROR] redis failed to unregister zone %s: %v", zone, err)
+		}
+	}
+}
+
+// escapePattern escapes the glob characters of s, for PSUBSCRIBE and SCAN
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
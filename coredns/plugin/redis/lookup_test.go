@@ -139,6 +139,23 @@ var testCases = [][]test.Case{
 		{
 			Qname: "notexists.example.com.", Qtype: dns.TypeA,
 			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
+			},
+		},
+		// NODATA Test
+		{
+			Qname: "ns1.example.com.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{
+				test.SOA("example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1460498836 44 55 66 100"),
+			},
+		},
+		// CNAME for another type
+		{
+			Qname: "y.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("y.example.com. 300 IN CNAME x.example.com."),
+			},
 		},
 		// SOA Test
 		{
@@ -161,6 +178,9 @@ var testCases = [][]test.Case{
 		},
 		{
 			Qname: "host3.example.net.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "foo.bar.example.net.", Qtype: dns.TypeTXT,
@@ -170,17 +190,42 @@ var testCases = [][]test.Case{
 		},
 		{
 			Qname: "host1.example.net.", Qtype: dns.TypeMX,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "sub.*.example.net.", Qtype: dns.TypeMX,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "host.subdel.example.net.", Qtype: dns.TypeA,
 			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "ghost.*.example.net.", Qtype: dns.TypeMX,
 			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "_telnet._tcp.host1.example.net.", Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
+		},
+		{
+			Qname: "_tcp.host1.example.net.", Qtype: dns.TypeSRV,
+			Ns: []dns.RR{
+				test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+			},
 		},
 		{
 			Qname: "f.h.g.f.t.r.e.example.net.", Qtype: dns.TypeTXT,
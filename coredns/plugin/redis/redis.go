@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -12,6 +13,8 @@ import (
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/fall"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/coredns/coredns/plugin/transfer"
 
 	redisCon "github.com/gomodule/redigo/redis"
 )
@@ -21,49 +24,36 @@ var SharedRedisConfig map[string]string // 新增，用以pg插件
 type Redis struct {
 	Next           plugin.Handler
 	Pool           *redisCon.Pool
+	readPool       *redisCon.Pool // replicas for queries if readReplicas, else Pool
 	redisAddress   string
+	redisUsername  string
 	redisPassword  string
 	connectTimeout int
 	readTimeout    int
 	keyPrefix      string
 	keySuffix      string
 	Ttl            uint32   // ttl default ttl for dns records, 300 if not provided
-	Zones          []string
-	LastZoneUpdate time.Time
+	index          *zoneIndex // the zones and their locations
 
 	Fall           fall.F
 	pgBatchUpdate  bool 
-}
 
-func (redis *Redis) LoadZones() {
-	var (
-		reply interface{}
-		err error
-		zones []string
-	)
+	tlsArgs      []string // certificate, key and CA files if tls is set
+	tlsConfig    *tls.Config
+	readReplicas bool // queries are answered from replicas
 
-	conn := redis.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return
-	}
-	defer conn.Close()
+	sentinelMaster    string // the master is found by sentinels if set
+	sentinelAddresses []string
+	sentinelPassword  string
+	sentinel          *sentinel
 
-	reply, err = conn.Do("KEYS", redis.keyPrefix + "*" + redis.keySuffix)
-	if err != nil {
-		return
-	}
-	// 转换成字符串数组
-	zones, err = redisCon.Strings(reply, nil)
-	if err != nil {
-		log.Printf("redis func loadzones err:%v", err)
-	}
-	for i, _ := range zones { // 再去掉前缀和后缀
-		zones[i] = strings.TrimPrefix(zones[i], redis.keyPrefix)
-		zones[i] = strings.TrimSuffix(zones[i], redis.keySuffix)
-	}
-	redis.LastZoneUpdate = time.Now()  // 记录下更新时间
-	redis.Zones = zones
+	clusterAddresses []string // the keys are routed to the nodes of a cluster if set
+	cluster          *cluster
+
+	transfer *transfer.Transfer // set if the transfer plugin is loaded, to send notifies
+
+	ptrRefresh time.Duration // PTR records are synthesized from the forward zones if not 0
+	ptrs       *ptrIndex
 }
 
 func (redis *Redis) A(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
@@ -192,7 +182,10 @@ func (redis *Redis) SOA(name string, z *Zone, record *Record) (answers, extras [
 		r.Expire = record.SOA.Expire
 		r.Minttl = record.SOA.MinTtl
 	}
-	r.Serial = redis.serial()
+	r.Serial = record.SOA.Serial
+	if r.Serial == 0 {
+		r.Serial = redis.serial()
+	}
 	answers = append(answers, r)
 	return
 }
@@ -215,61 +208,67 @@ func (redis *Redis) CAA(name string, z *Zone, record *Record) (answers, extras [
 	return
 }
 
-func (redis *Redis) AXFR(z *Zone) (records []dns.RR) {
-	//soa, _ := redis.SOA(z.Name, z, record)
-	soa := make([]dns.RR, 0)
-	answers := make([]dns.RR, 0, 10)
-	extras := make([]dns.RR, 0, 10)
-
-	// Allocate slices for rr Records
-	records = append(records, soa...)
-	for key := range z.Locations {
-		if key == "@"  {
-			location := redis.findLocation(z.Name, z)
-			record := redis.get(location, z)
-			soa, _ = redis.SOA(z.Name, z, record)
-		} else {
-			fqdnKey := dns.Fqdn(key) + z.Name
-			var as []dns.RR
-			var xs []dns.RR
-
-			location := redis.findLocation(fqdnKey, z)
-			record := redis.get(location, z)
-
-			// Pull all zone records
-			as, xs = redis.A(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = redis.AAAA(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = redis.CNAME(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+// RR returns the records of the given types among the records of the other
+// types, or all of them if no type is given
+func (redis *Redis) RR(name string, z *Zone, record *Record, types ...string) (answers, extras []dns.RR) {
+	if record == nil {
+		return
+	}
+	for _, rr := range record.RR {
+		if rr.Rdata == "" {
+			continue
+		}
+		if len(types) > 0 && !containsType(types, rr.Type) {
+			continue
+		}
+		r, err := newRR(name, redis.minTtl(rr.Ttl), rr.Type, rr.Rdata)
+		if err != nil {
+			log.Printf("[ERROR] redis skipped %s record of %s: %v", rr.Type, name, err)
+			continue
+		}
+		answers = append(answers, r)
+	}
+	return
+}
 
-			as, xs = redis.MX(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+// newRR returns a record of any type from its rdata in presentation format
+func newRR(name string, ttl uint32, rrtype, rdata string) (dns.RR, error) {
+	t, ok := parseType(rrtype)
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s", rrtype)
+	}
+	r, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, dns.Type(t), rdata))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || r.Header().Rrtype != t {
+		return nil, fmt.Errorf("invalid %s rdata %q", rrtype, rdata)
+	}
+	return r, nil
+}
 
-			as, xs = redis.SRV(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+// parseType returns the type of a record from its name, such as "PTR" or
+// "TYPE65534" (RFC 3597)
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	if !strings.HasPrefix(s, "TYPE") {
+		return 0, false
+	}
+	t, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+	return uint16(t), err == nil
+}
 
-			as, xs = redis.TXT(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+// containsType returns true if rrtype is one of types, whatever its case
+func containsType(types []string, rrtype string) bool {
+	for _, t := range types {
+		if strings.EqualFold(t, rrtype) {
+			return true
 		}
 	}
-
-	records = soa
-	records = append(records, answers...)
-	records = append(records, extras...)
-	records = append(records, soa...)
-
-	fmt.Println(records)
- 	return
+	return false
 }
 
 func (redis *Redis) hosts(name string, z *Zone) []dns.RR {
@@ -311,49 +310,54 @@ func (redis *Redis) minTtl(ttl uint32) uint32 {
 	return  ttl
 }
 
-func (redis *Redis) findLocation(query string, z *Zone) string { // z是传入的该zone下的所有信息
-	var (
-		ok bool
-		closestEncloser, sourceOfSynthesis string
-	)
-
-	// request for zone records
-	if query == z.Name { // 字段等于zone本身
+// findLocation returns the location holding the records of a name: the name
+// itself, or else the wildcard at its closest encloser (RFC 4592 section
+// 3.3.1). It returns "" if there is none, or if the name exists without
+// records of its own, as an empty non-terminal.
+func (redis *Redis) findLocation(query string, z *Zone) string {
+	if query == z.Name {
 		return query
 	}
-   //  log.Println("执行查找")
-	query = strings.TrimSuffix(query, "." + z.Name)  // 去掉后缀
-	// 假如输入example.com   而zone是example.com. 不会变
-
-	if _, ok = z.Locations[query]; ok {  // 子域名如果直接存在数据库，直接返回
-		return query
+	name, ok := relativeName(query, z)
+	if !ok {
+		return ""
 	}
-    // 逐层递归匹配
-	closestEncloser, sourceOfSynthesis, ok = splitQuery(query) // 为了获取子域名中的上级域名和 *.上级域名 
-	for ok { // 递归查找
-		ceExists := keyMatches(closestEncloser, z) || keyExists(closestEncloser, z)
-		ssExists := keyExists(sourceOfSynthesis, z)
-		// log.Printf("ceExists:%v, ssExists:%v",ceExists,ssExists )
-		if ceExists { // 子域名的上级域名存在于zone.field
-			if ssExists {    // 说明*.上级域名 直接存在    e.g 假如传入p.a.d.baidu.com 匹配 a.d. 和 *.a.d
-				return sourceOfSynthesis
-			} else { // 说明 上级域名存在，但是*.上级域名不存在 说明数据库没有该完整域名的信息
-				return ""
-			}
-		} else { // 不存在，继续匹配  d. 和 *.d. 还是不存在 则 "" 和 "*" 此时再去匹配空字段和*字段，已经是最顶级的域名了，没有最后返回空
-			closestEncloser, sourceOfSynthesis, ok = splitQuery(closestEncloser) // 如果没有匹配到再细分
-		}
+	if keyExists(name, z) {
+		return name
+	}
+	if nameExists(name, z) {
+		// wildcards don't match the names which exist
+		return ""
+	}
+	source := "*"
+	if encloser := closestEncloser(name, z); encloser != "" {
+		source += "." + encloser
+	}
+	if keyExists(source, z) {
+		return source
 	}
 	return ""
 }
 
+// relativeName returns a name relative to the zone, "" for its apex, and
+// false if the name is not in the zone
+func relativeName(query string, z *Zone) (string, bool) {
+	if query == z.Name {
+		return "", true
+	}
+	if !dns.IsSubDomain(z.Name, query) {
+		return "", false
+	}
+	return strings.TrimSuffix(query, "."+z.Name), true
+}
+
 func (redis *Redis) get(key string, z *Zone) *Record {
 	var (
 		err error
 		reply interface{}
 		val string
 	)
-	conn := redis.Pool.Get()
+	conn := redis.readPool.Get()
 	if conn == nil {
 		fmt.Println("error connecting to redis")
 		return nil
@@ -389,53 +393,90 @@ func keyExists(key string, z *Zone) bool {
 	return ok
 }
 
-func keyMatches(key string, z *Zone) bool {
-	for value := range z.Locations {
-		if strings.HasSuffix(value, key) {
-			return true
-		}
+// nameExists returns true if a name relative to the zone has records, or
+// names below it do (RFC 4592 section 2.2.2). The apex always exists.
+func nameExists(name string, z *Zone) bool {
+	if name == "" {
+		return true
 	}
-	return false
+	_, ok := z.names[name]
+	return ok
 }
 
-func splitQuery(query string) (string, string, bool) {
-	if query == "" {
-		return "", "", false
+// closestEncloser returns the longest ancestor of a name relative to the zone
+// which exists, "" for the apex
+func closestEncloser(name string, z *Zone) string {
+	for name != "" {
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+		if nameExists(name, z) {
+			return name
+		}
 	}
-	var (
-		splits []string
-		closestEncloser string   // 存储域名中的剩余部分。
-		sourceOfSynthesis string // 存储合成域名
-	)
-	splits = strings.SplitAfterN(query, ".", 2) // 按照第一个出现"." 分成最多两个字符串
-	if len(splits) == 2 {  // 如果是两部分，解析分为，一组上级域名，一组通配符.上级域名
-		closestEncloser = splits[1]
-		sourceOfSynthesis = "*." + closestEncloser
-	} else { // 如果为1，没有上级域名了，保留一个通配符*
-		closestEncloser = ""
-		sourceOfSynthesis = "*"
-	}
-	log.Printf("解析过程：close %v, source %v", closestEncloser, sourceOfSynthesis)
-	return closestEncloser, sourceOfSynthesis, true
+	return ""
 }
 
 func (redis *Redis) Connect() {
+	if redis.index == nil {
+		redis.index = newZoneIndex()
+	}
+	switch {
+	case len(redis.clusterAddresses) > 0:
+		redis.cluster = newCluster(redis.clusterAddresses, redis.readReplicas, func(addr string) (redisCon.Conn, error) {
+			return redis.dialAddr(addr, redis.redisPassword, true)
+		})
+		redis.Pool = &redisCon.Pool{
+			Dial: func() (redisCon.Conn, error) {
+				return &clusterConn{cluster: redis.cluster}, nil
+			},
+		}
+		redis.readPool = &redisCon.Pool{
+			Dial: func() (redisCon.Conn, error) {
+				return &clusterConn{cluster: redis.cluster, read: true}, nil
+			},
+		}
+		return
+	case redis.sentinelMaster != "":
+		redis.sentinel = &sentinel{
+			master: redis.sentinelMaster,
+			addrs:  append([]string(nil), redis.sentinelAddresses...),
+			dial: func(addr string) (redisCon.Conn, error) {
+				return redis.dialAddr(addr, redis.sentinelPassword, true)
+			},
+		}
+	}
 	redis.Pool = &redisCon.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
 		Dial: func () (redisCon.Conn, error) {
-			opts := []redisCon.DialOption{}
-			if redis.redisPassword != "" {
-				opts = append(opts, redisCon.DialPassword(redis.redisPassword))
-			}
-			if redis.connectTimeout != 0 {
-				opts = append(opts, redisCon.DialConnectTimeout(time.Duration(redis.connectTimeout)*time.Millisecond))
-			}
-			if redis.readTimeout != 0 {
-				opts = append(opts, redisCon.DialReadTimeout(time.Duration(redis.readTimeout)*time.Millisecond))
+			return redis.dial(true)
+		},
+	}
+	redis.readPool = redis.Pool
+	if redis.sentinel != nil {
+		// A failover turns the master into a replica, which refuses writes
+		redis.Pool.TestOnBorrow = checkRole("master")
+		if redis.readReplicas {
+			redis.readPool = &redisCon.Pool{
+				MaxIdle:      maxIdle,
+				IdleTimeout:  idleTimeout,
+				Dial:         redis.dialReplica,
+				TestOnBorrow: checkRole("slave", "master"),
 			}
+		}
+	}
+}
 
-			return redisCon.Dial("tcp", redis.redisAddress, opts...)
-		},
+// dial opens a connection to the server, or to the master of the sentinels.
+// Connections which wait for notifications have no read timeout.
+func (redis *Redis) dial(readTimeout bool) (redisCon.Conn, error) {
+	if redis.sentinel != nil {
+		return redis.dialMaster(readTimeout)
 	}
+	return redis.dialAddr(redis.redisAddress, redis.redisPassword, readTimeout)
 }
 
 func (redis *Redis) Save(zone string, subdomain string, value string) error {
@@ -449,7 +490,11 @@ func (redis *Redis) Save(zone string, subdomain string, value string) error {
 	defer conn.Close()
 
 	_, err = conn.Do("HSET", redis.keyPrefix + zone + redis.keySuffix, subdomain, value)
-	return err
+	if err != nil {
+		return err
+	}
+	defer redis.written(zone)
+	return redis.register(conn, zone)
 }
 
 func (redis *Redis) load(zone string) *Zone {
@@ -459,7 +504,18 @@ func (redis *Redis) load(zone string) *Zone {
 		vals []string
 	)
 
-	conn := redis.Pool.Get()
+	cached, generation := redis.cachedLocations(zone)
+	if cached != nil {
+		return cached
+	}
+
+	// Locations which get cached are read from the master: replicas may lag
+	// behind the notifications invalidating them
+	pool := redis.readPool
+	if redis.isWatching() {
+		pool = redis.Pool
+	}
+	conn := pool.Get()
 	if conn == nil {
 		fmt.Println("error connecting to redis")
 		return nil
@@ -470,17 +526,20 @@ func (redis *Redis) load(zone string) *Zone {
 	if err != nil {
 		return nil
 	}
-	z := new(Zone)
-	z.Name = zone
 	vals, err = redisCon.Strings(reply, nil)
 	if err != nil {
 		return nil
 	}
-	z.Locations = make(map[string]struct{})
+	locations := make(map[string]struct{}, len(vals))
 	for _, val := range vals {
-		z.Locations[val] = struct{}{}
+		if isMeta(val) {
+			continue
+		}
+		locations[val] = struct{}{}
 	}
+	z := newZone(zone, locations)
 
+	redis.cacheLocations(z, generation)
 	return z
 }
 
@@ -508,7 +567,7 @@ const (
 	defaultTtl = 360
 	hostmaster = "hostmaster"
 	zoneUpdateTime = 10*time.Minute
-	transferLength = 1000
+	transferBatch = 100 // records per message of a transfer
 	defaultBatchUpdate = true
 )
 
@@ -519,8 +578,21 @@ func (p *Redis) SetRedisConfig(r map[string]string) error{
 
 	p.redisPassword = r["redisPassword"]
 	p.redisAddress = r["redisAddress"]
+	p.redisUsername = r["redisUsername"]
 	p.keyPrefix = r["keyPrefix"]
 	p.keySuffix = r["keySuffix"]
+	p.sentinelMaster = r["sentinelMaster"]
+	p.sentinelAddresses = strings.Fields(r["sentinelAddresses"])
+	p.sentinelPassword = r["sentinelPassword"]
+	p.clusterAddresses = strings.Fields(r["clusterAddresses"])
+	p.readReplicas = r["readReplicas"] == "true"
+	if tlsArgs, ok := r["tls"]; ok {
+		tlsConfig, err := pkgtls.NewTLSConfigFromArgs(strings.Fields(tlsArgs)...)
+		if err != nil {
+			return fmt.Errorf("SetRedisConfig err:%v", err)
+		}
+		p.tlsArgs, p.tlsConfig = strings.Fields(tlsArgs), tlsConfig
+	}
 	if connectTimeout, err := strconv.Atoi(r["connectTimeout"]); err == nil {
 		p.connectTimeout = connectTimeout
 	} else {
@@ -560,5 +632,6 @@ func (redis *Redis) SavePlus(zone string, subdomain string, value string, t time
     if err != nil {
 		return fmt.Errorf("EXPIRE failed:%v", err)
 	}
-	return err
+	defer redis.written(zone)
+	return redis.register(conn, zone)
 }
\ No newline at end of file
@@ -0,0 +1,245 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+func TestRR(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	record := &Record{RR: []RR_Record{
+		{Type: "PTR", Rdata: "host.example.net."},
+		{Type: "naptr", Ttl: 60, Rdata: `10 100 "S" "SIP+D2U" "" _sip._udp.example.net.`},
+		{Type: "TYPE65534", Rdata: `\# 2 abcd`},
+		{Type: "TLSA", Rdata: "not an rdata"},
+		{Type: "BOGUS", Rdata: "1"},
+	}}
+
+	tests := []struct {
+		types    []string
+		expected []string
+	}{
+		{[]string{"PTR"}, []string{"1.2.0.192.in-addr.arpa.\t300\tIN\tPTR\thost.example.net."}},
+		{[]string{"NAPTR"}, []string{"1.2.0.192.in-addr.arpa.\t60\tIN\tNAPTR\t10 100 \"S\" \"SIP+D2U\" \"\" _sip._udp.example.net."}},
+		{[]string{"TYPE65534"}, []string{"1.2.0.192.in-addr.arpa.\t300\tCLASS1\tTYPE65534\t\\# 2 abcd"}},
+		// invalid records are skipped
+		{[]string{"TLSA"}, nil},
+		{[]string{"A"}, nil},
+		{nil, []string{
+			"1.2.0.192.in-addr.arpa.\t300\tIN\tPTR\thost.example.net.",
+			"1.2.0.192.in-addr.arpa.\t60\tIN\tNAPTR\t10 100 \"S\" \"SIP+D2U\" \"\" _sip._udp.example.net.",
+			"1.2.0.192.in-addr.arpa.\t300\tCLASS1\tTYPE65534\t\\# 2 abcd",
+		}},
+	}
+	for _, tt := range tests {
+		answers, _ := r.RR("1.2.0.192.in-addr.arpa.", nil, record, tt.types...)
+		if len(answers) != len(tt.expected) {
+			t.Errorf("%v: expected %d records, got %v", tt.types, len(tt.expected), answers)
+			continue
+		}
+		for i, rr := range answers {
+			if rr.String() != tt.expected[i] {
+				t.Errorf("%v: expected %q, got %q", tt.types, tt.expected[i], rr.String())
+			}
+		}
+	}
+}
+
+func TestSynthesizePTR(t *testing.T) {
+	// queries only read the index
+	r := &Redis{Ttl: 300, ptrRefresh: time.Hour, ptrs: &ptrIndex{
+		hosts: map[string][]ptrHost{
+			"192.0.2.1":   {{name: "a.example.net.", ttl: 60}, {name: "b.example.net."}},
+			"2001:db8::1": {{name: "c.example.net."}},
+		},
+	}}
+
+	tests := []struct {
+		qname    string
+		expected []string
+	}{
+		{"1.2.0.192.in-addr.arpa.", []string{
+			"1.2.0.192.in-addr.arpa.\t60\tIN\tPTR\ta.example.net.",
+			"1.2.0.192.in-addr.arpa.\t300\tIN\tPTR\tb.example.net.",
+		}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", []string{
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t300\tIN\tPTR\tc.example.net.",
+		}},
+		{"2.2.0.192.in-addr.arpa.", nil},
+		// not an address
+		{"2.0.192.in-addr.arpa.", nil},
+	}
+	for _, tt := range tests {
+		answers := r.synthesizePTR(tt.qname)
+		if len(answers) != len(tt.expected) {
+			t.Errorf("%s: expected %d records, got %v", tt.qname, len(tt.expected), answers)
+			continue
+		}
+		for i, rr := range answers {
+			if rr.String() != tt.expected[i] {
+				t.Errorf("%s: expected %q, got %q", tt.qname, tt.expected[i], rr.String())
+			}
+		}
+	}
+}
+
+func TestPtrsChanged(t *testing.T) {
+	r := &Redis{ptrs: newPtrIndex()}
+
+	// changes of reverse zones don't change the addresses
+	r.ptrsChanged("2.0.192.in-addr.arpa.")
+	if len(r.ptrs.changed) != 0 {
+		t.Fatalf("unexpected rebuild after a change of a reverse zone")
+	}
+	// those of forward zones are coalesced into one rebuild
+	r.ptrsChanged("example.net.")
+	r.ptrsChanged("example.org.")
+	if len(r.ptrs.changed) != 1 {
+		t.Fatalf("expected one rebuild, got %d", len(r.ptrs.changed))
+	}
+	// no index, nothing to rebuild
+	(&Redis{}).ptrsChanged("example.net.")
+}
+
+func TestZoneOfKey(t *testing.T) {
+	r := &Redis{keyPrefix: "dns:", keySuffix: ":*"}
+	tests := []struct {
+		key, zone string
+		ok        bool
+	}{
+		{key: "dns:example.org.:*", zone: "example.org.", ok: true},
+		{key: "dns:$zones:*"},
+		{key: "dns:example.org.:"},
+		{key: "example.org.:*"},
+	}
+	for _, tt := range tests {
+		zone, ok := r.zoneOfKey(tt.key)
+		if zone != tt.zone || ok != tt.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", tt.key, tt.zone, tt.ok, zone, ok)
+		}
+	}
+	if p := escapePattern(r.keySuffix); p != `:\*` {
+		t.Errorf("expected the suffix to be escaped, got %q", p)
+	}
+}
+
+func TestCacheLocations(t *testing.T) {
+	r := &Redis{index: newZoneIndex()}
+	z := &Zone{Name: "example.org.", Locations: map[string]struct{}{"www": {}}}
+
+	// nothing is cached unless changes are notified
+	_, generation := r.cachedLocations(z.Name)
+	r.cacheLocations(z, generation)
+	if cached, _ := r.cachedLocations(z.Name); cached != nil {
+		t.Fatalf("unexpected cached locations without notifications")
+	}
+
+	r.setWatching(true)
+	_, generation = r.cachedLocations(z.Name)
+	r.cacheLocations(z, generation)
+	if cached, _ := r.cachedLocations(z.Name); cached != z {
+		t.Fatalf("expected the locations to be cached")
+	}
+
+	// locations read before a change are not cached
+	r.invalidate(z.Name)
+	if cached, _ := r.cachedLocations(z.Name); cached != nil {
+		t.Fatalf("expected the locations to be invalidated")
+	}
+	_, generation = r.cachedLocations(z.Name)
+	r.invalidate("other.org.")
+	r.cacheLocations(z, generation)
+	if cached, _ := r.cachedLocations(z.Name); cached != nil {
+		t.Errorf("unexpected cached locations read before a change")
+	}
+}
+
+func TestLoadFromMasterWhenCaching(t *testing.T) {
+	var master, replica int
+	pool := func(reads *int) *redisCon.Pool {
+		node := &fakeNode{do: func(cmd string, args ...interface{}) (interface{}, error) {
+			*reads++
+			return []interface{}{[]byte("www")}, nil
+		}}
+		return &redisCon.Pool{Dial: func() (redisCon.Conn, error) { return node, nil }}
+	}
+	r := &Redis{Pool: pool(&master), readPool: pool(&replica), index: newZoneIndex()}
+
+	// uncached locations are read from the replicas
+	r.load("example.org.")
+	if master != 0 || replica != 1 {
+		t.Fatalf("expected the locations to be read from a replica, got %d master and %d replica reads", master, replica)
+	}
+
+	// cached ones from the master, which notifies their changes
+	r.setWatching(true)
+	r.load("example.org.")
+	r.load("example.org.")
+	if master != 1 || replica != 1 {
+		t.Errorf("expected the locations to be read once from the master, got %d master and %d replica reads", master, replica)
+	}
+}
+
+func TestFindLocation(t *testing.T) {
+	r := &Redis{}
+	// the zone of RFC 4592 section 2.2.1
+	z := newZone("example.", map[string]struct{}{
+		"@": {}, "*": {}, "sub.*": {}, "host1": {}, "_ssh._tcp.host1": {},
+		"_ssh._tcp.host2": {}, "subdel": {},
+	})
+
+	tests := []struct {
+		qname    string
+		location string
+		exists   bool
+	}{
+		{"example.", "example.", true},
+		{"host1.example.", "host1", true},
+		{"host3.example.", "*", false},
+		{"foo.bar.example.", "*", false},
+		{"sub.*.example.", "sub.*", true},
+		// an empty non-terminal exists, wildcards don't match it
+		{"_tcp.host1.example.", "", true},
+		{"*.example.", "*", true},
+		// the closest encloser is _tcp.host1, which has no wildcard
+		{"_telnet._tcp.host1.example.", "", false},
+		{"host.subdel.example.", "", false},
+		// the closest encloser is the asterisk label itself
+		{"ghost.*.example.", "", false},
+	}
+	for _, tt := range tests {
+		if location := r.findLocation(tt.qname, z); location != tt.location {
+			t.Errorf("%s: expected location %q, got %q", tt.qname, tt.location, location)
+		}
+		name, _ := relativeName(tt.qname, z)
+		if exists := nameExists(name, z); exists != tt.exists {
+			t.Errorf("%s: expected exists %v, got %v", tt.qname, tt.exists, exists)
+		}
+	}
+}
+
+func TestClosestEncloser(t *testing.T) {
+	z := newZone("com.", map[string]struct{}{
+		"@": {}, "*": {}, "www.example": {},
+	})
+
+	tests := []struct {
+		name, encloser string
+	}{
+		// ample is not an ancestor of example
+		{"foo.ample", ""},
+		{"foo.example", "example"},
+		{"a.b.www.example", "www.example"},
+		{"xwww.example", "example"},
+	}
+	for _, tt := range tests {
+		if encloser := closestEncloser(tt.name, z); encloser != tt.encloser {
+			t.Errorf("%s: expected closest encloser %q, got %q", tt.name, tt.encloser, encloser)
+		}
+	}
+	if r := (&Redis{}); r.findLocation("foo.ample.com.", z) != "*" {
+		t.Errorf("foo.ample.com.: expected the wildcard of the apex")
+	}
+}
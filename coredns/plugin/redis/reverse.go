@@ -0,0 +1,149 @@
+package redis
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// defaultPtrRefresh is how often the addresses of the forward zones are read
+// again to synthesize PTR records
+const defaultPtrRefresh = 30 * time.Second
+
+// ptrIndex maps the addresses of the A and AAAA records of the forward zones
+// to the names they belong to. It is rebuilt in the background, queries only
+// read it.
+type ptrIndex struct {
+	sync.Mutex
+	hosts map[string][]ptrHost
+	// changed is signaled when a forward zone changes, for the index to be
+	// rebuilt without waiting for its refresh
+	changed chan struct{}
+}
+
+func newPtrIndex() *ptrIndex {
+	return &ptrIndex{changed: make(chan struct{}, 1)}
+}
+
+type ptrHost struct {
+	name string
+	ttl  uint32
+}
+
+// PTR returns the PTR records of the ptr field of a name
+func (redis *Redis) PTR(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if record == nil {
+		return
+	}
+	for _, ptr := range record.PTR {
+		if len(ptr.Host) == 0 {
+			continue
+		}
+		r := new(dns.PTR)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypePTR,
+			Class: dns.ClassINET, Ttl: redis.minTtl(ptr.Ttl)}
+		r.Ptr = dns.Fqdn(ptr.Host)
+		answers = append(answers, r)
+	}
+	return
+}
+
+// synthesizePTR returns PTR records for a reverse name, pointing to the names
+// of the forward zones which have its address
+func (redis *Redis) synthesizePTR(qname string) []dns.RR {
+	ip := net.ParseIP(dnsutil.ExtractAddressFromReverse(qname))
+	if ip == nil {
+		return nil
+	}
+
+	redis.ptrs.Lock()
+	hosts := redis.ptrs.hosts[ip.String()]
+	redis.ptrs.Unlock()
+
+	answers := make([]dns.RR, 0, len(hosts))
+	for _, host := range hosts {
+		r := new(dns.PTR)
+		r.Hdr = dns.RR_Header{Name: qname, Rrtype: dns.TypePTR,
+			Class: dns.ClassINET, Ttl: redis.minTtl(host.ttl)}
+		r.Ptr = host.name
+		answers = append(answers, r)
+	}
+	return answers
+}
+
+// refreshPTRs rebuilds the index of the addresses every ptrRefresh, and when
+// a forward zone changes, until done is closed
+func (redis *Redis) refreshPTRs(done <-chan struct{}) {
+	for {
+		hosts := redis.indexAddresses()
+		redis.ptrs.Lock()
+		redis.ptrs.hosts = hosts
+		redis.ptrs.Unlock()
+
+		select {
+		case <-done:
+			return
+		case <-redis.ptrs.changed:
+		case <-time.After(redis.ptrRefresh):
+		}
+	}
+}
+
+// ptrsChanged has the index of the addresses rebuilt after a change of a
+// zone, if it is a forward one. Changes made during a rebuild are coalesced
+// into the next one.
+func (redis *Redis) ptrsChanged(zone string) {
+	if redis.ptrs == nil || dnsutil.IsReverse(zone) > 0 {
+		return
+	}
+	select {
+	case redis.ptrs.changed <- struct{}{}:
+	default:
+	}
+}
+
+// indexAddresses reads the addresses of the A and AAAA records of all the
+// forward zones. Wildcards are not indexed.
+func (redis *Redis) indexAddresses() map[string][]ptrHost {
+	hosts := make(map[string][]ptrHost)
+	for _, zone := range redis.zones() {
+		if dnsutil.IsReverse(zone) > 0 {
+			continue
+		}
+		entries, err := redis.getAll(zone)
+		if err != nil {
+			log.Printf("[ERROR] redis failed to read the addresses of zone %s: %v", zone, err)
+			continue
+		}
+		for location, record := range entries {
+			if strings.Contains(location, "*") {
+				continue
+			}
+			name := zone
+			if location != "@" {
+				name = dns.Fqdn(location) + zone
+			}
+			for _, a := range record.A {
+				if a.Ip != nil {
+					hosts[a.Ip.String()] = append(hosts[a.Ip.String()], ptrHost{name: name, ttl: a.Ttl})
+				}
+			}
+			for _, aaaa := range record.AAAA {
+				if aaaa.Ip != nil {
+					hosts[aaaa.Ip.String()] = append(hosts[aaaa.Ip.String()], ptrHost{name: name, ttl: aaaa.Ttl})
+				}
+			}
+		}
+	}
+	// Answers don't depend on the order of the hashes
+	for _, h := range hosts {
+		sort.Slice(h, func(i, j int) bool { return h[i].name < h[j].name })
+	}
+	return hosts
+}
@@ -0,0 +1,157 @@
+package redis
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+const (
+	// serialField is kept in the hash of a zone along with its records. Fields
+	// starting with metaPrefix are not locations.
+	metaPrefix  = "$"
+	serialField = metaPrefix + "serial"
+
+	// maxSerialIncrement is the largest increment of a serial which is still
+	// seen as an increase by RFC 1982 serial arithmetic
+	maxSerialIncrement uint32 = 2147483647
+)
+
+// bumpScript increments the serial of a zone and returns it, or returns 0
+// if the zone doesn't exist. The writers of a zone bump its serial after
+// changing its records, which takes constant time whatever the size of the
+// zone. A zone without serial starts with the time given as argument, so that
+// secondaries which were given time based serials before still see it as
+// newer.
+var bumpScript = redisCon.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local serial = tonumber(redis.call('HGET', KEYS[1], '`+serialField+`'))
+if not serial then
+	serial = tonumber(ARGV[1])
+elseif serial >= 4294967295 then
+	serial = 1
+else
+	serial = serial + 1
+end
+redis.call('HSET', KEYS[1], '`+serialField+`', serial)
+return serial
+`)
+
+// serialScript returns the serial of a zone, or 0 if the zone doesn't exist.
+// A zone without serial is given the time given as argument.
+var serialScript = redisCon.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local serial = redis.call('HGET', KEYS[1], '`+serialField+`')
+if not serial then
+	serial = ARGV[1]
+	redis.call('HSET', KEYS[1], '`+serialField+`', serial)
+end
+return tonumber(serial)
+`)
+
+// isMeta returns true for the fields of a zone hash which are not locations
+func isMeta(field string) bool {
+	return strings.HasPrefix(field, metaPrefix)
+}
+
+// serialLess returns true if serial a is older than b, per RFC 1982.
+func serialLess(a, b uint32) bool {
+	if a < b {
+		return (b - a) <= maxSerialIncrement
+	}
+	return (a - b) > maxSerialIncrement
+}
+
+// serialEntry is the serial of a zone, as of when it was last bumped
+type serialEntry struct {
+	serial  uint32
+	checked time.Time
+}
+
+// bumpSerial increments the serial of a zone we wrote, and caches it in the
+// zone index. It returns false if the zone doesn't exist.
+func (redis *Redis) bumpSerial(zone string) (uint32, bool) {
+	return redis.updateSerial(zone, bumpScript)
+}
+
+// readSerial reads the serial of a zone, and caches it in the zone index. It
+// returns false if the zone doesn't exist.
+func (redis *Redis) readSerial(zone string) (uint32, bool) {
+	return redis.updateSerial(zone, serialScript)
+}
+
+// updateSerial runs script to get the serial of a zone, caches it in the zone
+// index, and notifies the secondaries of the zone when it changed
+func (redis *Redis) updateSerial(zone string, script *redisCon.Script) (uint32, bool) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redisCon.Int64(script.Do(conn, redis.keyPrefix+zone+redis.keySuffix, time.Now().Unix()%(1<<32)))
+	if err != nil {
+		log.Printf("[ERROR] redis failed to get the serial of zone %s: %v", zone, err)
+		return 0, false
+	}
+	// Serials incremented past 2^32 by other writers wrap around
+	serial := uint32(reply)
+
+	redis.index.Lock()
+	previous, known := redis.index.serials[zone]
+	if serial == 0 {
+		delete(redis.index.serials, zone)
+	} else {
+		redis.index.serials[zone] = serialEntry{serial: serial, checked: time.Now()}
+	}
+	redis.index.Unlock()
+	if serial == 0 {
+		return 0, false
+	}
+	if (!known || previous.serial != serial) && redis.transfer != nil {
+		go redis.transfer.Notify(zone)
+	}
+	return serial, true
+}
+
+// zoneSerial returns the serial of a zone from the zone index, and false if
+// it is not known. The serial is read again when the changes of the zone are
+// notified; without keyspace notifications, it is read again every
+// zoneUpdateTime.
+func (redis *Redis) zoneSerial(zone string) (uint32, bool) {
+	redis.index.RLock()
+	entry, ok := redis.index.serials[zone]
+	watching := redis.index.watching
+	redis.index.RUnlock()
+	if ok && (watching || time.Since(entry.checked) < zoneUpdateTime) {
+		return entry.serial, true
+	}
+	return redis.readSerial(zone)
+}
+
+// written bumps the serials of zones written by us, and has the addresses
+// they hold indexed again
+func (redis *Redis) written(zones ...string) {
+	for _, zone := range zones {
+		redis.bumpSerial(zone)
+		redis.ptrsChanged(zone)
+	}
+}
+
+// setSerial sets the serial of the zone in the SOA records among rrs
+func (redis *Redis) setSerial(zone string, rrs []dns.RR) {
+	for _, rr := range rrs {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if serial, ok := redis.zoneSerial(zone); ok {
+			soa.Serial = serial
+		}
+	}
+}
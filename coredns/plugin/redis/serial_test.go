@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		// the serial wrapped around
+		{4294967295, 1, true},
+		{1, 4294967295, false},
+		{0, 2147483647, true},
+		{0, 2147483648, false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("serialLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
+
+func TestZoneSerial(t *testing.T) {
+	// the serial of the zone is read as serial, and bumped to serial+1
+	var (
+		reads, bumps int
+		serial       int64 = 7
+	)
+	conn := &fakeNode{do: func(cmd string, args ...interface{}) (interface{}, error) {
+		switch {
+		case cmd == "EVALSHA" && args[0] == serialScript.Hash():
+			reads++
+			return serial, nil
+		case cmd == "EVALSHA" && args[0] == bumpScript.Hash():
+			bumps++
+			serial++
+			return serial, nil
+		case cmd == "SADD":
+			return int64(1), nil
+		}
+		return nil, fmt.Errorf("unexpected command %s", cmd)
+	}}
+	r := &Redis{Pool: &redisCon.Pool{Dial: func() (redisCon.Conn, error) { return conn, nil }}, index: newZoneIndex()}
+
+	// the serial is read once, then from the index
+	for i := 0; i < 2; i++ {
+		if serial, ok := r.zoneSerial("example.org."); !ok || serial != 7 {
+			t.Fatalf("expected serial 7, got %d %v", serial, ok)
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("expected the serial to be read once, got %d", reads)
+	}
+
+	// without notifications, it is read again every zoneUpdateTime
+	r.index.serials["example.org."] = serialEntry{serial: 7, checked: time.Now().Add(-zoneUpdateTime)}
+	r.zoneSerial("example.org.")
+	if reads != 2 {
+		t.Fatalf("expected the serial to be read again, got %d reads", reads)
+	}
+
+	// with notifications, it is only read again when the zone changes
+	r.setWatching(true)
+	r.zoneSerial("example.org.")
+	r.index.serials["example.org."] = serialEntry{serial: 7, checked: time.Now().Add(-zoneUpdateTime)}
+	r.zoneSerial("example.org.")
+	if reads != 3 {
+		t.Fatalf("expected the serial to be kept while watching, got %d reads", reads)
+	}
+	serial = 8
+	r.notified("example.org.", "hincrby")
+	if got, _ := r.zoneSerial("example.org."); reads != 4 || got != 8 {
+		t.Fatalf("expected a notified change to read serial 8, got %d after %d reads", got, reads)
+	}
+
+	// our writes bump it, without reading the zone
+	r.written("example.org.")
+	if got, _ := r.zoneSerial("example.org."); bumps != 1 || got != 9 {
+		t.Fatalf("expected a write to bump the serial to 9, got %d after %d bumps", got, bumps)
+	}
+}
@@ -2,10 +2,14 @@ package redis
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/coredns/coredns/plugin/transfer"
 )
 
 func init() {
@@ -26,6 +30,37 @@ func setup(c *caddy.Controller) error {
 		return r
 	})
 
+	// get the transfer plugin, so we can send notifies for the zones on startup
+	// and when they change, before changes are watched
+	c.OnStartup(func() error {
+		t := dnsserver.GetConfig(c).Handler("transfer")
+		if t == nil {
+			return nil
+		}
+		r.transfer = t.(*transfer.Transfer)
+		go func() {
+			for _, zone := range r.zones() {
+				r.transfer.Notify(zone)
+			}
+		}()
+		return nil
+	})
+
+	// cache the locations of the zones while their changes are notified, and
+	// index the addresses of the forward zones to synthesize PTR records
+	done := make(chan struct{})
+	c.OnStartup(func() error {
+		go r.watch(done)
+		if r.ptrs != nil {
+			go r.refreshPTRs(done)
+		}
+		return nil
+	})
+	c.OnShutdown(func() error {
+		close(done)
+		return nil
+	})
+
 	return nil
 }
 
@@ -49,11 +84,42 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 						return &Redis{}, c.ArgErr()
 					}
 					redis.redisAddress = c.Val()
+				case "username":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.redisUsername = c.Val()
 				case "password":
 					if !c.NextArg() {
 						return &Redis{}, c.ArgErr()
 					}
 					redis.redisPassword = c.Val()
+				case "tls": // cert key cacertfile
+					args := c.RemainingArgs()
+					redis.tlsConfig, err = pkgtls.NewTLSConfigFromArgs(args...)
+					if err != nil {
+						return &Redis{}, err
+					}
+					redis.tlsArgs = args
+				case "sentinel":
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.sentinelMaster = args[0]
+					redis.sentinelAddresses = args[1:]
+				case "sentinel_password":
+					if !c.NextArg() {
+						return &Redis{}, c.ArgErr()
+					}
+					redis.sentinelPassword = c.Val()
+				case "cluster":
+					redis.clusterAddresses = c.RemainingArgs()
+					if len(redis.clusterAddresses) == 0 {
+						return &Redis{}, c.ArgErr()
+					}
+				case "read_replicas":
+					redis.readReplicas = true
 				case "prefix":
 					if !c.NextArg() {
 						return &Redis{}, c.ArgErr()
@@ -92,6 +158,15 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 					redis.Ttl = uint32(val)
 				case "fallthrough": // 如果为空默认设置 root "."
 					redis.Fall.SetZonesFromArgs(c.RemainingArgs())
+				case "synthesize_ptr":
+					redis.ptrRefresh = defaultPtrRefresh
+					if c.NextArg() {
+						redis.ptrRefresh, err = time.ParseDuration(c.Val())
+						if err != nil || redis.ptrRefresh <= 0 {
+							return &Redis{}, c.Errf("invalid synthesize_ptr refresh interval '%s'", c.Val())
+						}
+					}
+					redis.ptrs = newPtrIndex()
 				case "pgBatchUpdate":
 					if !c.NextArg() {
 						return &Redis{}, c.ArgErr()
@@ -115,6 +190,13 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 
 		}
 
+		if redis.sentinelMaster != "" && len(redis.clusterAddresses) > 0 {
+			return &Redis{}, c.Err("sentinel and cluster are mutually exclusive")
+		}
+		if redis.readReplicas && redis.sentinelMaster == "" && len(redis.clusterAddresses) == 0 {
+			return &Redis{}, c.Err("read_replicas requires sentinel or cluster")
+		}
+
 		redis.Connect()
 		redis.LoadZones()
 
@@ -122,11 +204,20 @@ func redisParse(c *caddy.Controller) (*Redis, error) {
 		SharedRedisConfig = map[string]string{
 			"redisPassword":  redis.redisPassword,
 			"redisAddress":   redis.redisAddress,
+			"redisUsername":  redis.redisUsername,
 			"keyPrefix":      redis.keyPrefix,
 			"keySuffix":      redis.keySuffix,
 			"connectTimeout": strconv.Itoa(redis.connectTimeout),
 			"readTimeout":    strconv.Itoa(redis.readTimeout),
 			"ttl":            strconv.Itoa(int(redis.Ttl)),
+			"sentinelMaster":    redis.sentinelMaster,
+			"sentinelAddresses": strings.Join(redis.sentinelAddresses, " "),
+			"sentinelPassword":  redis.sentinelPassword,
+			"clusterAddresses":  strings.Join(redis.clusterAddresses, " "),
+			"readReplicas":      strconv.FormatBool(redis.readReplicas),
+		}
+		if redis.tlsConfig != nil {
+			SharedRedisConfig["tls"] = strings.Join(redis.tlsArgs, " ")
 		}
 		return &redis, nil
 	}
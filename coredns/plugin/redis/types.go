@@ -1,10 +1,37 @@
 package redis
 
-import "net"
+import (
+	"net"
+	"strings"
+)
 
 type Zone struct {
 	Name      string
 	Locations map[string]struct{}
+	// names holds the locations and the names above them, the empty
+	// non-terminals, so that finding whether a name exists doesn't scan the
+	// zone
+	names map[string]struct{}
+}
+
+// newZone returns a zone with the given locations, indexing the names which
+// exist in it
+func newZone(name string, locations map[string]struct{}) *Zone {
+	z := &Zone{Name: name, Locations: locations, names: make(map[string]struct{}, len(locations))}
+	for location := range locations {
+		for n := location; n != ""; {
+			if _, ok := z.names[n]; ok {
+				break
+			}
+			z.names[n] = struct{}{}
+			if i := strings.IndexByte(n, '.'); i >= 0 {
+				n = n[i+1:]
+			} else {
+				n = ""
+			}
+		}
+	}
+	return z
 }
 
 type Record struct {
@@ -17,6 +44,8 @@ type Record struct {
 	SRV   []SRV_Record `json:"srv,omitempty"`
 	CAA   []CAA_Record `json:"caa,omitempty"`
 	SOA   SOA_Record `json:"soa,omitempty"`
+	PTR   []PTR_Record `json:"ptr,omitempty"`
+	RR    []RR_Record `json:"rr,omitempty"`
 }
 
 type A_Record struct {
@@ -66,6 +95,7 @@ type SOA_Record struct {
 	Retry   uint32 `json:"retry"`
 	Expire  uint32 `json:"expire"`
 	MinTtl  uint32 `json:"minttl"`
+	Serial  uint32 `json:"serial,omitempty"`
 }
 
 type CAA_Record struct {
@@ -74,6 +104,21 @@ type CAA_Record struct {
 	Value string `json:"value"`
 }
 
+type PTR_Record struct {
+	Ttl  uint32 `json:"ttl,omitempty"`
+	Host string `json:"host"`
+}
+
+// RR_Record is a record of the other types, NAPTR, SSHFP, TLSA, DS,
+// HTTPS, SVCB or DNAME for instance, with its rdata in presentation format or
+// in the RFC 3597 syntax (\# <length> <hex>) for the types unknown to the
+// server.
+type RR_Record struct {
+	Ttl   uint32 `json:"ttl,omitempty"`
+	Type  string `json:"type"`
+	Rdata string `json:"rdata"`
+}
+
 func (a *Record) IsEmpty() bool {
 	return len(a.A) == 0 &&
 	len(a.AAAA) == 0 &&
@@ -83,5 +128,7 @@ func (a *Record) IsEmpty() bool {
 	len(a.MX) == 0 &&
 	len(a.SRV) == 0 &&
 	a.SOA == SOA_Record{} &&
-	len(a.CAA) == 0
+	len(a.CAA) == 0 &&
+	len(a.PTR) == 0 &&
+	len(a.RR) == 0
 }
\ No newline at end of file
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/coredns/coredns/plugin/transfer"
+
+	redisCon "github.com/gomodule/redigo/redis"
+	"github.com/miekg/dns"
+)
+
+// Transfer implements the transfer.Transferer interface.
+func (redis *Redis) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if !redis.servesZone(zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	entries, err := redis.getAll(zone)
+	if err != nil {
+		return nil, err
+	}
+	records := redis.transferRecords(zone, entries)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("zone %s has no SOA record", zone)
+	}
+	soa := records[0]
+	redis.setSerial(zone, records[:1])
+
+	ch := make(chan []dns.RR)
+	go func() {
+		// ixfr fallback, only send the SOA if the secondary is up to date
+		if serial != 0 && !serialLess(serial, soa.(*dns.SOA).Serial) {
+			ch <- []dns.RR{soa}
+			close(ch)
+			return
+		}
+		for i := 0; i < len(records); i += transferBatch {
+			end := i + transferBatch
+			if end > len(records) {
+				end = len(records)
+			}
+			ch <- records[i:end]
+		}
+		ch <- []dns.RR{soa}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// servesZone returns true if zone is one of the zones found in redis
+func (redis *Redis) servesZone(zone string) bool {
+	for _, z := range redis.zones() {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// getAll returns all the records of a zone, by location
+func (redis *Redis) getAll(zone string) (map[string]*Record, error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	vals, err := redisCon.StringMap(conn.Do("HGETALL", redis.keyPrefix+zone+redis.keySuffix))
+	if err != nil {
+		return nil, fmt.Errorf("HGETALL failed: %v", err)
+	}
+	entries := make(map[string]*Record, len(vals))
+	for location, val := range vals {
+		if isMeta(location) {
+			continue
+		}
+		r := new(Record)
+		if err := json.Unmarshal([]byte(val), r); err != nil {
+			log.Printf("[ERROR] redis skipped malformed records of %s in %s: %v", location, zone, err)
+			continue
+		}
+		entries[location] = r
+	}
+	return entries, nil
+}
+
+// transferRecords returns the records of a zone in transfer order: the SOA
+// first, followed by every other record. It returns nothing if the zone has
+// no SOA.
+func (redis *Redis) transferRecords(zone string, entries map[string]*Record) []dns.RR {
+	apex, ok := entries["@"]
+	if !ok || apex.SOA.Ns == "" {
+		return nil
+	}
+	// The zone is given no location, so that no glue is looked up: the
+	// addresses of the hosts in the zone are transferred anyway.
+	z := &Zone{Name: zone}
+
+	records, _ := redis.SOA(zone, z, apex)
+
+	// Sort the locations, so that transfers are reproducible
+	locations := make([]string, 0, len(entries))
+	for location := range entries {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	for _, location := range locations {
+		record := entries[location]
+		name := zone
+		if location != "@" {
+			name = dns.Fqdn(location) + zone
+		}
+		for _, rrs := range [][]dns.RR{
+			first(redis.NS(name, z, record)),
+			first(redis.A(name, z, record)),
+			first(redis.AAAA(name, z, record)),
+			first(redis.CNAME(name, z, record)),
+			first(redis.MX(name, z, record)),
+			first(redis.SRV(name, z, record)),
+			first(redis.TXT(name, z, record)),
+			first(redis.CAA(name, z, record)),
+			first(redis.PTR(name, z, record)),
+			first(redis.RR(name, z, record)),
+		} {
+			records = append(records, rrs...)
+		}
+	}
+	return records
+}
+
+// first drops the extras of a lookup
+func first(answers, _ []dns.RR) []dns.RR { return answers }
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTransferRecords(t *testing.T) {
+	r := &Redis{Ttl: 300}
+	entries := make(map[string]*Record)
+	for _, cmd := range lookupEntries[1] {
+		rec := new(Record)
+		if err := json.Unmarshal([]byte(cmd[1]), rec); err != nil {
+			t.Fatalf("invalid entry %s: %v", cmd[0], err)
+		}
+		entries[cmd[0]] = rec
+	}
+	entries["@"].SOA.Serial = 2024010101
+
+	records := r.transferRecords("example.net.", entries)
+	if len(records) != 11 {
+		t.Fatalf("expected 11 records, got %d: %v", len(records), records)
+	}
+	soa, ok := records[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("expected the SOA first, got %v", records[0])
+	}
+	if soa.Serial != 2024010101 {
+		t.Errorf("expected the serial of the SOA record, got %d", soa.Serial)
+	}
+	for _, rr := range records[1:] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			t.Errorf("unexpected SOA in the zone body: %v", rr)
+		}
+		if !dns.IsSubDomain("example.net.", rr.Header().Name) {
+			t.Errorf("record out of the zone: %v", rr)
+		}
+	}
+
+	delete(entries, "@")
+	if records := r.transferRecords("example.net.", entries); records != nil {
+		t.Errorf("expected no records for a zone without SOA, got %v", records)
+	}
+}